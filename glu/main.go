@@ -29,11 +29,13 @@ func dothings() error {
 	now := time.Now()
 	var loglevel string = "info"
 	var quiet bool
+	var fontpath string
 	op := optionparser.NewOptionParser()
 	op.Banner = "glu - Lua typesetting with boxes and glue"
 	op.Coda = "\nUsage: glu [options] <filename.lua>"
 	op.On("--loglevel LVL", "Set the log level (debug, info, warn, error)", &loglevel)
 	op.On("-q", "--quiet", "Suppress output on console", &quiet)
+	op.On("--fontpath DIRS", "Additional font directories (separated by "+string(os.PathListSeparator)+")", &fontpath)
 	op.Command("help", "Show the help message")
 	op.Command("version", "Print version and exit")
 	if err := op.Parse(); err != nil {
@@ -100,6 +102,10 @@ func dothings() error {
 
 	logger.Info("Start processing", "file", mainfile, "glu version", Version, "date", time.Now().Format(time.RFC3339))
 
+	if fontpath != "" {
+		luafrontend.AddFontDirs(filepath.SplitList(fontpath)...)
+	}
+
 	// Create Lua state
 	l := lua.NewState()
 	lua.OpenLibraries(l)
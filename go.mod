@@ -3,12 +3,14 @@ module github.com/speedata/glu
 go 1.24.0
 
 require (
+	github.com/andybalholm/brotli v1.1.1
 	github.com/boxesandglue/baseline-pdf v1.1.4
 	github.com/boxesandglue/boxesandglue v0.2.4
 	github.com/boxesandglue/textshape v0.0.7
 	github.com/speedata/cxpath v0.0.5
 	github.com/speedata/go-lua v0.1.2
 	github.com/speedata/optionparser v1.1.1
+	software.sslmate.com/src/go-pkcs12 v0.7.1
 )
 
 require (
@@ -18,5 +20,6 @@ require (
 	github.com/speedata/goxml v1.0.5 // indirect
 	github.com/speedata/goxpath v1.0.4 // indirect
 	github.com/speedata/hyphenation v1.0.1 // indirect
+	golang.org/x/crypto v0.46.0 // indirect
 	golang.org/x/net v0.48.0 // indirect
 )
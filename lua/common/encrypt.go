@@ -0,0 +1,354 @@
+package common
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"hash"
+
+	"github.com/speedata/go-lua"
+)
+
+// Encryption are the options of the standard security handler. glu writes
+// AES-256 (revision 6), AES-128 (revision 4) and RC4-128 (revision 3).
+type Encryption struct {
+	UserPassword  string
+	OwnerPassword string
+	// Algorithm is AES-256, AES-128 or RC4-128
+	Algorithm string
+	// Permissions is the P value of the encryption dictionary
+	Permissions int32
+}
+
+// permissionBits are the bits of the P value by permission name.
+var permissionBits = map[string]uint{
+	"print":              3,
+	"modify":             4,
+	"copy":               5,
+	"annotate":           6,
+	"fill_forms":         9,
+	"accessibility":      10,
+	"assemble":           11,
+	"print_high_quality": 12,
+}
+
+// Allows reports whether the permission is granted.
+func (e *Encryption) Allows(permission string) bool {
+	return e.Permissions&(1<<(permissionBits[permission]-1)) != 0
+}
+
+// CheckEncryption reads the encryption options from the table at index:
+// { user_password = "", owner_password = "", algorithm = "AES-256",
+// permissions = { print = true, copy = false, ... } }. Permissions that are
+// not in the table are granted, print_high_quality follows print.
+func CheckEncryption(l *lua.State, index int) *Encryption {
+	lua.CheckType(l, index, lua.TypeTable)
+	e := &Encryption{Algorithm: "AES-256"}
+	for _, opt := range []struct {
+		key string
+		val *string
+	}{{"user_password", &e.UserPassword}, {"owner_password", &e.OwnerPassword}, {"algorithm", &e.Algorithm}} {
+		l.Field(index, opt.key)
+		if !l.IsNil(-1) {
+			*opt.val = lua.CheckString(l, -1)
+		}
+		l.Pop(1)
+	}
+	switch e.Algorithm {
+	case "AES-256", "AES-128", "RC4-128":
+	default:
+		lua.Errorf(l, "encrypt: unknown algorithm %s (use AES-256, AES-128 or RC4-128)", e.Algorithm)
+		return nil
+	}
+
+	// bits 7, 8 and 13-32 are set, bits 1 and 2 are 0
+	p := uint32(0xFFFFF0C0)
+	granted := map[string]bool{}
+	for name := range permissionBits {
+		granted[name] = true
+	}
+	l.Field(index, "permissions")
+	if !l.IsNil(-1) {
+		lua.CheckType(l, -1, lua.TypeTable)
+		l.PushNil()
+		for l.Next(-2) {
+			name := "?"
+			if l.TypeOf(-2) == lua.TypeString {
+				name, _ = l.ToString(-2)
+			}
+			if _, ok := permissionBits[name]; !ok {
+				lua.Errorf(l, "encrypt: unknown permission %s", name)
+				return nil
+			}
+			granted[name] = l.ToBoolean(-1)
+			l.Pop(1)
+		}
+		l.Field(-1, "print_high_quality")
+		if l.IsNil(-1) {
+			granted["print_high_quality"] = granted["print"]
+		}
+		l.Pop(1)
+	}
+	l.Pop(1)
+	for name, bit := range permissionBits {
+		if granted[name] {
+			p |= 1 << (bit - 1)
+		}
+	}
+	e.Permissions = int32(p)
+	return e
+}
+
+var passwordPadding = []byte{
+	0x28, 0xBF, 0x4E, 0x5E, 0x4E, 0x75, 0x8A, 0x41, 0x64, 0x00, 0x4E, 0x56, 0xFF, 0xFA, 0x01, 0x08,
+	0x2E, 0x2E, 0x00, 0xB6, 0xD0, 0x68, 0x3E, 0x80, 0x2F, 0x0C, 0xA9, 0xFE, 0x64, 0x53, 0x69, 0x7A,
+}
+
+// securityHandler encrypts the strings and streams of a PDF file.
+type securityHandler struct {
+	revision int
+	aes      bool
+	key      []byte
+	dict     PDFDict
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return b
+}
+
+func padPassword(pw string) []byte {
+	return append([]byte(pw), passwordPadding...)[:32]
+}
+
+func rc4Crypt(key, data []byte) []byte {
+	c, _ := rc4.NewCipher(key)
+	out := make([]byte, len(data))
+	c.XORKeyStream(out, data)
+	return out
+}
+
+// rc4Rounds encrypts data with key and 19 more times with key XOR round
+// (algorithms 3 and 5 of ISO 32000).
+func rc4Rounds(key, data []byte) []byte {
+	data = rc4Crypt(key, data)
+	k := make([]byte, len(key))
+	for i := 1; i <= 19; i++ {
+		for j := range key {
+			k[j] = key[j] ^ byte(i)
+		}
+		data = rc4Crypt(k, data)
+	}
+	return data
+}
+
+// aesCBC encrypts data without padding.
+func aesCBC(key, iv, data []byte) []byte {
+	block, _ := aes.NewCipher(key)
+	out := make([]byte, len(data))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(out, data)
+	return out
+}
+
+// hash2B is the password hash of revision 6 (algorithm 2.B of ISO 32000-2).
+func hash2B(password, salt, udata []byte) []byte {
+	h := sha256.Sum256(append(append(append([]byte{}, password...), salt...), udata...))
+	k := h[:]
+	var e []byte
+	for i := 0; i < 64 || int(e[len(e)-1]) > i-32; i++ {
+		seq := append(append(append([]byte{}, password...), k...), udata...)
+		k1 := bytes.Repeat(seq, 64)
+		e = aesCBC(k[:16], k[16:32], k1)
+		sum := 0
+		for _, c := range e[:16] {
+			sum += int(c)
+		}
+		var hf hash.Hash
+		switch sum % 3 {
+		case 0:
+			hf = sha256.New()
+		case 1:
+			hf = sha512.New384()
+		default:
+			hf = sha512.New()
+		}
+		hf.Write(e)
+		k = hf.Sum(nil)
+	}
+	return k[:32]
+}
+
+// newSecurityHandler computes the file key and the encryption dictionary.
+// id is the first element of the file identifier.
+func newSecurityHandler(e *Encryption, id []byte) *securityHandler {
+	sh := &securityHandler{}
+	p := make([]byte, 4)
+	binary.LittleEndian.PutUint32(p, uint32(e.Permissions))
+	owner := e.OwnerPassword
+	if owner == "" {
+		// nobody can change the permissions
+		owner = hex.EncodeToString(randomBytes(16))
+	}
+
+	if e.Algorithm == "AES-256" {
+		sh.revision, sh.aes = 6, true
+		user, ownerPW := []byte(e.UserPassword), []byte(owner)
+		if len(user) > 127 {
+			user = user[:127]
+		}
+		if len(ownerPW) > 127 {
+			ownerPW = ownerPW[:127]
+		}
+		sh.key = randomBytes(32)
+		iv := make([]byte, 16)
+		salts := randomBytes(32)
+		u := append(hash2B(user, salts[0:8], nil), salts[0:16]...)
+		ue := aesCBC(hash2B(user, salts[8:16], nil), iv, sh.key)
+		o := append(hash2B(ownerPW, salts[16:24], u), salts[16:32]...)
+		oe := aesCBC(hash2B(ownerPW, salts[24:32], u), iv, sh.key)
+		perms := append(append(p, 0xFF, 0xFF, 0xFF, 0xFF, 'T', 'a', 'd', 'b'), randomBytes(4)...)
+		block, _ := aes.NewCipher(sh.key)
+		block.Encrypt(perms, perms)
+		sh.dict = PDFDict{
+			"Filter": PDFName("Standard"),
+			"V":      5,
+			"R":      6,
+			"Length": 256,
+			"CF": PDFDict{"StdCF": PDFDict{
+				"AuthEvent": PDFName("DocOpen"),
+				"CFM":       PDFName("AESV3"),
+				"Length":    32,
+			}},
+			"StmF":            PDFName("StdCF"),
+			"StrF":            PDFName("StdCF"),
+			"O":               PDFString(o),
+			"U":               PDFString(u),
+			"OE":              PDFString(oe),
+			"UE":              PDFString(ue),
+			"P":               int(e.Permissions),
+			"Perms":           PDFString(perms),
+			"EncryptMetadata": true,
+		}
+		return sh
+	}
+
+	// revision 3 (RC4) and 4 (AES) with a 128 bit key
+	const n = 16
+	sh.revision, sh.aes = 3, e.Algorithm == "AES-128"
+	if sh.aes {
+		sh.revision = 4
+	}
+	h := md5.Sum(padPassword(owner))
+	for i := 0; i < 50; i++ {
+		h = md5.Sum(h[:n])
+	}
+	o := rc4Rounds(h[:n], padPassword(e.UserPassword))
+
+	h = md5.Sum(bytes.Join([][]byte{padPassword(e.UserPassword), o, p, id}, nil))
+	for i := 0; i < 50; i++ {
+		h = md5.Sum(h[:n])
+	}
+	sh.key = append([]byte{}, h[:n]...)
+	uh := md5.Sum(append(append([]byte{}, passwordPadding...), id...))
+	u := append(rc4Rounds(sh.key, uh[:]), make([]byte, 16)...)
+
+	sh.dict = PDFDict{
+		"Filter": PDFName("Standard"),
+		"V":      2,
+		"R":      sh.revision,
+		"Length": 128,
+		"O":      PDFString(o),
+		"U":      PDFString(u),
+		"P":      int(e.Permissions),
+	}
+	if sh.aes {
+		sh.dict["V"] = 4
+		sh.dict["CF"] = PDFDict{"StdCF": PDFDict{
+			"AuthEvent": PDFName("DocOpen"),
+			"CFM":       PDFName("AESV2"),
+			"Length":    16,
+		}}
+		sh.dict["StmF"] = PDFName("StdCF")
+		sh.dict["StrF"] = PDFName("StdCF")
+		sh.dict["EncryptMetadata"] = true
+	}
+	return sh
+}
+
+// encrypt encrypts the string or stream data of object num.
+func (sh *securityHandler) encrypt(num int, data []byte) []byte {
+	key := sh.key
+	if sh.revision < 6 {
+		k := append(append([]byte{}, sh.key...), byte(num), byte(num>>8), byte(num>>16), 0, 0)
+		if sh.aes {
+			k = append(k, "sAlT"...)
+		}
+		h := md5.Sum(k)
+		key = h[:min(len(sh.key)+5, 16)]
+	}
+	if !sh.aes {
+		return rc4Crypt(key, data)
+	}
+	pad := aes.BlockSize - len(data)%aes.BlockSize
+	plain := append(append([]byte{}, data...), bytes.Repeat([]byte{byte(pad)}, pad)...)
+	iv := randomBytes(aes.BlockSize)
+	return append(iv, aesCBC(key, iv, plain)...)
+}
+
+// value encrypts the strings in v.
+func (sh *securityHandler) value(num int, v any) any {
+	switch t := v.(type) {
+	case PDFString:
+		return PDFString(sh.encrypt(num, []byte(t)))
+	case PDFArray:
+		for i, elt := range t {
+			t[i] = sh.value(num, elt)
+		}
+	case PDFDict:
+		for k, elt := range t {
+			t[k] = sh.value(num, elt)
+		}
+	}
+	return v
+}
+
+// Encrypt encrypts all strings and streams of f and adds the encryption
+// dictionary.
+func (f *PDFFile) Encrypt(e *Encryption) {
+	ids, _ := f.Resolve(f.Trailer["ID"]).(PDFArray)
+	var id PDFString
+	if len(ids) == 2 {
+		id, _ = ids[0].(PDFString)
+	}
+	if id == "" {
+		id = PDFString(randomBytes(16))
+		f.Trailer["ID"] = PDFArray{id, id}
+	}
+	sh := newSecurityHandler(e, []byte(id))
+	for num, obj := range f.Objects {
+		obj.Value = sh.value(num, obj.Value)
+		if obj.Stream != nil {
+			obj.Stream = sh.encrypt(num, obj.Stream)
+		}
+	}
+	f.Trailer["Encrypt"] = f.Add(sh.dict)
+}
+
+// EncryptPDF encrypts a PDF file with a classic cross reference table such
+// as the ones that the PDF writer of boxesandglue writes.
+func EncryptPDF(data []byte, e *Encryption) ([]byte, error) {
+	f, err := ReadPDF(data)
+	if err != nil {
+		return nil, err
+	}
+	f.Encrypt(e)
+	return f.Bytes(), nil
+}
@@ -0,0 +1,874 @@
+package common
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// The PDF writer of boxesandglue has no way to add resources to a page or to
+// change objects it has written. glu reads the finished PDF back into a
+// PDFFile, changes the objects and writes a new file.
+
+// PDFName is a PDF name without the leading slash.
+type PDFName string
+
+// PDFString is a PDF string. Hex strings are decoded.
+type PDFString string
+
+// PDFTextString returns s as a PDF text string, strings with non ASCII
+// characters are encoded as UTF-16BE.
+func PDFTextString(s string) PDFString {
+	for _, r := range s {
+		if r >= 0x80 {
+			var b strings.Builder
+			b.WriteString("\xfe\xff")
+			for _, u := range utf16.Encode([]rune(s)) {
+				b.WriteByte(byte(u >> 8))
+				b.WriteByte(byte(u))
+			}
+			return PDFString(b.String())
+		}
+	}
+	return PDFString(s)
+}
+
+// PDFRef is a reference to an indirect object (the generation is always 0).
+type PDFRef int
+
+// PDFRaw is a number, a boolean, null or an operator that is copied verbatim.
+type PDFRaw string
+
+// PDFArray is a PDF array.
+type PDFArray []any
+
+// PDFDict is a PDF dictionary, the keys are names without the slash.
+type PDFDict map[string]any
+
+// PDFObject is an indirect object. Stream is nil for objects without a
+// stream, the stream data is not decoded.
+type PDFObject struct {
+	Value  any
+	Stream []byte
+}
+
+// PDFFile is a PDF file in memory.
+type PDFFile struct {
+	Version string
+	Objects map[int]*PDFObject
+	Trailer PDFDict
+}
+
+func isPDFSpace(c byte) bool {
+	return c == 0 || c == '\t' || c == '\n' || c == '\f' || c == '\r' || c == ' '
+}
+
+func isPDFDelimiter(c byte) bool {
+	return strings.IndexByte("()<>[]{}/%", c) >= 0
+}
+
+// PDFLexer reads PDF values from data.
+type PDFLexer struct {
+	Data []byte
+	Pos  int
+	// NoRefs turns off the detection of "n g R" references, content streams
+	// have no references.
+	NoRefs bool
+}
+
+// EOF reports whether all data has been read.
+func (lx *PDFLexer) EOF() bool {
+	return lx.Pos >= len(lx.Data)
+}
+
+// SkipSpace skips white space and comments.
+func (lx *PDFLexer) SkipSpace() {
+	for lx.Pos < len(lx.Data) {
+		c := lx.Data[lx.Pos]
+		if c == '%' {
+			for lx.Pos < len(lx.Data) && lx.Data[lx.Pos] != '\n' && lx.Data[lx.Pos] != '\r' {
+				lx.Pos++
+			}
+			continue
+		}
+		if !isPDFSpace(c) {
+			return
+		}
+		lx.Pos++
+	}
+}
+
+// word reads a regular token such as a number or an operator.
+func (lx *PDFLexer) word() string {
+	start := lx.Pos
+	for lx.Pos < len(lx.Data) && !isPDFSpace(lx.Data[lx.Pos]) && !isPDFDelimiter(lx.Data[lx.Pos]) {
+		lx.Pos++
+	}
+	return string(lx.Data[start:lx.Pos])
+}
+
+// Value reads the next value. Regular tokens are returned as PDFRaw.
+func (lx *PDFLexer) Value() (any, error) {
+	lx.SkipSpace()
+	if lx.EOF() {
+		return nil, io.ErrUnexpectedEOF
+	}
+	switch c := lx.Data[lx.Pos]; c {
+	case '/':
+		lx.Pos++
+		return lx.name(), nil
+	case '(':
+		return lx.literalString()
+	case '<':
+		if lx.Pos+1 < len(lx.Data) && lx.Data[lx.Pos+1] == '<' {
+			return lx.dict()
+		}
+		return lx.hexString()
+	case '[':
+		return lx.array()
+	case ']', '>', ')', '{', '}':
+		return nil, fmt.Errorf("unexpected %q at offset %d", c, lx.Pos)
+	}
+	w := lx.word()
+	if w == "" {
+		return nil, fmt.Errorf("unexpected %q at offset %d", lx.Data[lx.Pos], lx.Pos)
+	}
+	if !lx.NoRefs {
+		if num, err := strconv.Atoi(w); err == nil {
+			// look ahead for "g R"
+			save := lx.Pos
+			lx.SkipSpace()
+			if _, err := strconv.Atoi(lx.word()); err == nil {
+				lx.SkipSpace()
+				if lx.word() == "R" {
+					return PDFRef(num), nil
+				}
+			}
+			lx.Pos = save
+		}
+	}
+	return PDFRaw(w), nil
+}
+
+func (lx *PDFLexer) name() PDFName {
+	w := lx.word()
+	if !strings.Contains(w, "#") {
+		return PDFName(w)
+	}
+	var b strings.Builder
+	for i := 0; i < len(w); i++ {
+		if w[i] == '#' && i+2 < len(w) {
+			if n, err := strconv.ParseUint(w[i+1:i+3], 16, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 2
+				continue
+			}
+		}
+		b.WriteByte(w[i])
+	}
+	return PDFName(b.String())
+}
+
+func (lx *PDFLexer) literalString() (PDFString, error) {
+	lx.Pos++
+	var b strings.Builder
+	depth := 1
+	for lx.Pos < len(lx.Data) {
+		c := lx.Data[lx.Pos]
+		lx.Pos++
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return PDFString(b.String()), nil
+			}
+		case '\\':
+			if lx.EOF() {
+				continue
+			}
+			c = lx.Data[lx.Pos]
+			lx.Pos++
+			switch c {
+			case 'n':
+				c = '\n'
+			case 'r':
+				c = '\r'
+			case 't':
+				c = '\t'
+			case 'b':
+				c = '\b'
+			case 'f':
+				c = '\f'
+			case '\r':
+				// line continuation
+				if !lx.EOF() && lx.Data[lx.Pos] == '\n' {
+					lx.Pos++
+				}
+				continue
+			case '\n':
+				continue
+			default:
+				if c >= '0' && c <= '7' {
+					n := int(c - '0')
+					for i := 0; i < 2 && !lx.EOF() && lx.Data[lx.Pos] >= '0' && lx.Data[lx.Pos] <= '7'; i++ {
+						n = n*8 + int(lx.Data[lx.Pos]-'0')
+						lx.Pos++
+					}
+					c = byte(n)
+				}
+			}
+		}
+		b.WriteByte(c)
+	}
+	return "", io.ErrUnexpectedEOF
+}
+
+func (lx *PDFLexer) hexString() (PDFString, error) {
+	lx.Pos++
+	var digits []byte
+	for lx.Pos < len(lx.Data) {
+		c := lx.Data[lx.Pos]
+		lx.Pos++
+		if c == '>' {
+			if len(digits)%2 == 1 {
+				digits = append(digits, '0')
+			}
+			var b strings.Builder
+			for i := 0; i < len(digits); i += 2 {
+				n, err := strconv.ParseUint(string(digits[i:i+2]), 16, 8)
+				if err != nil {
+					return "", fmt.Errorf("invalid hex string at offset %d", lx.Pos)
+				}
+				b.WriteByte(byte(n))
+			}
+			return PDFString(b.String()), nil
+		}
+		if !isPDFSpace(c) {
+			digits = append(digits, c)
+		}
+	}
+	return "", io.ErrUnexpectedEOF
+}
+
+func (lx *PDFLexer) array() (PDFArray, error) {
+	lx.Pos++
+	ary := PDFArray{}
+	for {
+		lx.SkipSpace()
+		if lx.EOF() {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if lx.Data[lx.Pos] == ']' {
+			lx.Pos++
+			return ary, nil
+		}
+		v, err := lx.Value()
+		if err != nil {
+			return nil, err
+		}
+		ary = append(ary, v)
+	}
+}
+
+func (lx *PDFLexer) dict() (PDFDict, error) {
+	lx.Pos += 2
+	d := PDFDict{}
+	for {
+		lx.SkipSpace()
+		if lx.EOF() {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if lx.Data[lx.Pos] == '>' {
+			if lx.Pos+1 < len(lx.Data) && lx.Data[lx.Pos+1] == '>' {
+				lx.Pos += 2
+				return d, nil
+			}
+			return nil, fmt.Errorf("unexpected '>' at offset %d", lx.Pos)
+		}
+		if lx.Data[lx.Pos] != '/' {
+			return nil, fmt.Errorf("dictionary key expected at offset %d", lx.Pos)
+		}
+		lx.Pos++
+		key := lx.name()
+		v, err := lx.Value()
+		if err != nil {
+			return nil, err
+		}
+		d[string(key)] = v
+	}
+}
+
+// PDFNumber formats f with up to six decimal places. Scale factors need more
+// precision than pdf.FloatToPoint provides.
+func PDFNumber(f float64) string {
+	s := strings.TrimRight(strings.TrimRight(strconv.FormatFloat(f, 'f', 6, 64), "0"), ".")
+	if s == "-0" {
+		return "0"
+	}
+	return s
+}
+
+// ReadPDF parses a PDF file with a classic cross reference table such as the
+// ones that boxesandglue writes.
+func ReadPDF(data []byte) (*PDFFile, error) {
+	f := &PDFFile{Objects: make(map[int]*PDFObject), Version: "1.7"}
+	if bytes.HasPrefix(data, []byte("%PDF-")) {
+		lx := PDFLexer{Data: data, Pos: 5}
+		f.Version = lx.word()
+	}
+	idx := bytes.LastIndex(data, []byte("startxref"))
+	if idx < 0 {
+		return nil, fmt.Errorf("startxref not found")
+	}
+	lx := &PDFLexer{Data: data, Pos: idx + len("startxref")}
+	lx.SkipSpace()
+	xref, err := strconv.Atoi(lx.word())
+	if err != nil || xref >= len(data) {
+		return nil, fmt.Errorf("invalid startxref")
+	}
+	lx.Pos = xref
+	lx.SkipSpace()
+	if lx.word() != "xref" {
+		return nil, fmt.Errorf("cross reference table not found")
+	}
+	offsets := make(map[int]int)
+	for {
+		lx.SkipSpace()
+		w := lx.word()
+		if w == "trailer" {
+			break
+		}
+		first, err := strconv.Atoi(w)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cross reference table")
+		}
+		lx.SkipSpace()
+		count, err := strconv.Atoi(lx.word())
+		if err != nil {
+			return nil, fmt.Errorf("invalid cross reference table")
+		}
+		for i := 0; i < count; i++ {
+			lx.SkipSpace()
+			offset, _ := strconv.Atoi(lx.word())
+			lx.SkipSpace()
+			lx.word()
+			lx.SkipSpace()
+			if lx.word() == "n" {
+				offsets[first+i] = offset
+			}
+		}
+	}
+	trailer, err := lx.Value()
+	if err != nil {
+		return nil, err
+	}
+	var ok bool
+	if f.Trailer, ok = trailer.(PDFDict); !ok {
+		return nil, fmt.Errorf("invalid trailer")
+	}
+	for num, offset := range offsets {
+		obj, err := parseObject(data, offset, offsets)
+		if err != nil {
+			return nil, fmt.Errorf("object %d: %w", num, err)
+		}
+		f.Objects[num] = obj
+	}
+	return f, nil
+}
+
+// parseObject reads the indirect object at offset.
+func parseObject(data []byte, offset int, offsets map[int]int) (*PDFObject, error) {
+	lx := &PDFLexer{Data: data, Pos: offset}
+	for _, want := range []string{"", "", "obj"} {
+		lx.SkipSpace()
+		if w := lx.word(); w == "" || want != "" && w != want {
+			return nil, fmt.Errorf("invalid object header")
+		}
+	}
+	v, err := lx.Value()
+	if err != nil {
+		return nil, err
+	}
+	obj := &PDFObject{Value: v}
+	lx.SkipSpace()
+	if lx.word() != "stream" {
+		return obj, nil
+	}
+	if lx.Pos < len(data) && data[lx.Pos] == '\r' {
+		lx.Pos++
+	}
+	if lx.Pos < len(data) && data[lx.Pos] == '\n' {
+		lx.Pos++
+	}
+	dict, _ := v.(PDFDict)
+	length := dict["Length"]
+	if ref, ok := length.(PDFRef); ok {
+		lobj, err := parseObject(data, offsets[int(ref)], offsets)
+		if err != nil {
+			return nil, err
+		}
+		length = lobj.Value
+	}
+	n, ok := PDFInt(length)
+	if !ok || n < 0 || lx.Pos+n > len(data) {
+		return nil, fmt.Errorf("invalid stream length")
+	}
+	obj.Stream = data[lx.Pos : lx.Pos+n]
+	return obj, nil
+}
+
+// PDFInt returns the integer value of a number.
+func PDFInt(v any) (int, bool) {
+	switch t := v.(type) {
+	case int:
+		return t, true
+	case PDFRaw:
+		n, err := strconv.Atoi(string(t))
+		return n, err == nil
+	}
+	return 0, false
+}
+
+// PDFFloat returns the value of a number.
+func PDFFloat(v any) (float64, bool) {
+	switch t := v.(type) {
+	case int:
+		return float64(t), true
+	case float64:
+		return t, true
+	case PDFRaw:
+		f, err := strconv.ParseFloat(string(t), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// Resolve returns the value of the object that v refers to or v itself.
+func (f *PDFFile) Resolve(v any) any {
+	if ref, ok := v.(PDFRef); ok {
+		if obj := f.Objects[int(ref)]; obj != nil {
+			return obj.Value
+		}
+		return nil
+	}
+	return v
+}
+
+// Dict returns the dictionary v or the dictionary that v refers to.
+func (f *PDFFile) Dict(v any) PDFDict {
+	d, _ := f.Resolve(v).(PDFDict)
+	return d
+}
+
+// SubDict returns the dictionary at key in d and creates it if necessary.
+func (f *PDFFile) SubDict(d PDFDict, key string) PDFDict {
+	if sub := f.Dict(d[key]); sub != nil {
+		return sub
+	}
+	sub := PDFDict{}
+	d[key] = sub
+	return sub
+}
+
+// Add adds a new object and returns the reference.
+func (f *PDFFile) Add(v any) PDFRef {
+	return f.AddObject(&PDFObject{Value: v})
+}
+
+// AddStream adds a compressed stream with the dictionary d.
+func (f *PDFFile) AddStream(d PDFDict, data []byte) PDFRef {
+	obj := &PDFObject{Value: d}
+	f.SetStream(obj, data)
+	return f.AddObject(obj)
+}
+
+// AddObject adds obj as a new object and returns the reference.
+func (f *PDFFile) AddObject(obj *PDFObject) PDFRef {
+	num := 1
+	for n := range f.Objects {
+		num = max(num, n+1)
+	}
+	f.Objects[num] = obj
+	return PDFRef(num)
+}
+
+// Catalog returns the document catalog.
+func (f *PDFFile) Catalog() PDFDict {
+	return f.Dict(f.Trailer["Root"])
+}
+
+// OutputProfile returns the ICC profile of the first output intent.
+func (f *PDFFile) OutputProfile() (PDFRef, bool) {
+	if intents, ok := f.Resolve(f.Catalog()["OutputIntents"]).(PDFArray); ok && len(intents) > 0 {
+		ref, ok := f.Dict(intents[0])["DestOutputProfile"].(PDFRef)
+		return ref, ok
+	}
+	return 0, false
+}
+
+// Pages returns the page dictionaries in document order.
+func (f *PDFFile) Pages() []PDFDict {
+	var pages []PDFDict
+	var walk func(node PDFDict, depth int)
+	walk = func(node PDFDict, depth int) {
+		if node == nil || depth > 64 {
+			return
+		}
+		if t, _ := node["Type"].(PDFName); t == "Page" {
+			pages = append(pages, node)
+			return
+		}
+		kids, _ := f.Resolve(node["Kids"]).(PDFArray)
+		for _, kid := range kids {
+			walk(f.Dict(kid), depth+1)
+		}
+	}
+	walk(f.Dict(f.Catalog()["Pages"]), 0)
+	return pages
+}
+
+// PageRefs returns the references of the page objects in document order.
+func (f *PDFFile) PageRefs() []PDFRef {
+	var refs []PDFRef
+	var walk func(node PDFDict, depth int)
+	walk = func(node PDFDict, depth int) {
+		kids, _ := f.Resolve(node["Kids"]).(PDFArray)
+		for _, kid := range kids {
+			k := f.Dict(kid)
+			if t, _ := k["Type"].(PDFName); t == "Page" {
+				ref, _ := kid.(PDFRef)
+				refs = append(refs, ref)
+			} else if k != nil && depth < 64 {
+				walk(k, depth+1)
+			}
+		}
+	}
+	walk(f.Dict(f.Catalog()["Pages"]), 0)
+	return refs
+}
+
+// TruncatePages keeps the first n pages in the page tree. The objects of the
+// other pages and their content streams are removed.
+func (f *PDFFile) TruncatePages(n int) {
+	var walk func(node PDFDict, depth int) int
+	walk = func(node PDFDict, depth int) int {
+		kids, _ := f.Resolve(node["Kids"]).(PDFArray)
+		keep := PDFArray{}
+		count := 0
+		for _, kid := range kids {
+			k := f.Dict(kid)
+			if t, _ := k["Type"].(PDFName); t == "Page" {
+				if n > 0 {
+					keep = append(keep, kid)
+					n--
+					count++
+					continue
+				}
+				refs := PDFArray{kid, k["Contents"]}
+				if contents, ok := k["Contents"].(PDFArray); ok {
+					refs = append(PDFArray{kid}, contents...)
+				}
+				for _, r := range refs {
+					if ref, ok := r.(PDFRef); ok {
+						delete(f.Objects, int(ref))
+					}
+				}
+				continue
+			}
+			if depth < 64 {
+				if c := walk(k, depth+1); c > 0 {
+					keep = append(keep, kid)
+					count += c
+				}
+			}
+		}
+		node["Kids"] = keep
+		node["Count"] = count
+		return count
+	}
+	walk(f.Dict(f.Catalog()["Pages"]), 0)
+}
+
+// Contents returns the content stream objects of a page.
+func (f *PDFFile) Contents(page PDFDict) []*PDFObject {
+	var refs []any
+	switch t := page["Contents"].(type) {
+	case PDFRef:
+		refs = []any{t}
+	case PDFArray:
+		refs = t
+	}
+	var ret []*PDFObject
+	for _, r := range refs {
+		if ref, ok := r.(PDFRef); ok && f.Objects[int(ref)] != nil && f.Objects[int(ref)].Stream != nil {
+			ret = append(ret, f.Objects[int(ref)])
+		}
+	}
+	return ret
+}
+
+// StreamData returns the decoded data of a stream. Only streams without a
+// filter or with the FlateDecode filter (and PNG predictors) can be decoded.
+func (f *PDFFile) StreamData(obj *PDFObject) ([]byte, bool) {
+	d, _ := obj.Value.(PDFDict)
+	switch filter := f.Resolve(d["Filter"]).(type) {
+	case nil:
+		return obj.Stream, true
+	case PDFName:
+		if filter != "FlateDecode" {
+			return nil, false
+		}
+	default:
+		return nil, false
+	}
+	r, err := zlib.NewReader(bytes.NewReader(obj.Stream))
+	if err != nil {
+		return nil, false
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, false
+	}
+	if parms := f.Dict(d["DecodeParms"]); parms != nil {
+		return decodePredictor(data, parms)
+	}
+	return data, true
+}
+
+// decodePredictor reverses the PNG predictors of the data.
+func decodePredictor(data []byte, parms PDFDict) ([]byte, bool) {
+	predictor, _ := PDFInt(parms["Predictor"])
+	if predictor <= 1 {
+		return data, true
+	}
+	if predictor < 10 {
+		return nil, false
+	}
+	param := func(key string, def int) int {
+		if v, ok := PDFInt(parms[key]); ok {
+			return v
+		}
+		return def
+	}
+	colors, bpc, columns := param("Colors", 1), param("BitsPerComponent", 8), param("Columns", 1)
+	bpp := (colors*bpc + 7) / 8
+	rowLen := (colors*bpc*columns + 7) / 8
+	var out []byte
+	prev := make([]byte, rowLen)
+	for len(data) > rowLen {
+		filter, row := data[0], data[1:rowLen+1]
+		data = data[rowLen+1:]
+		cur := make([]byte, rowLen)
+		for i := range row {
+			var left, upleft byte
+			if i >= bpp {
+				left, upleft = cur[i-bpp], prev[i-bpp]
+			}
+			up := prev[i]
+			switch filter {
+			case 0:
+				cur[i] = row[i]
+			case 1:
+				cur[i] = row[i] + left
+			case 2:
+				cur[i] = row[i] + up
+			case 3:
+				cur[i] = row[i] + byte((int(left)+int(up))/2)
+			case 4:
+				cur[i] = row[i] + paeth(left, up, upleft)
+			default:
+				return nil, false
+			}
+		}
+		out = append(out, cur...)
+		prev = cur
+	}
+	return out, true
+}
+
+func paeth(a, b, c byte) byte {
+	abs := func(x int) int {
+		if x < 0 {
+			return -x
+		}
+		return x
+	}
+	p := int(a) + int(b) - int(c)
+	pa, pb, pc := abs(p-int(a)), abs(p-int(b)), abs(p-int(c))
+	if pa <= pb && pa <= pc {
+		return a
+	}
+	if pb <= pc {
+		return b
+	}
+	return c
+}
+
+// SetStream replaces the stream data of obj with the compressed data.
+func (f *PDFFile) SetStream(obj *PDFObject, data []byte) {
+	var b bytes.Buffer
+	zw := zlib.NewWriter(&b)
+	zw.Write(data)
+	zw.Close()
+	d, _ := obj.Value.(PDFDict)
+	if d == nil {
+		d = PDFDict{}
+		obj.Value = d
+	}
+	d["Filter"] = PDFName("FlateDecode")
+	delete(d, "DecodeParms")
+	delete(d, "Length1")
+	obj.Stream = b.Bytes()
+}
+
+// Bytes returns the PDF file.
+func (f *PDFFile) Bytes() []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%%PDF-%s\n%%\xe2\xe3\xcf\xd3\n", f.Version)
+	nums := make([]int, 0, len(f.Objects))
+	for n := range f.Objects {
+		nums = append(nums, n)
+	}
+	sort.Ints(nums)
+	size := 1
+	if len(nums) > 0 {
+		size = nums[len(nums)-1] + 1
+	}
+	offsets := make([]int, size)
+	for _, n := range nums {
+		obj := f.Objects[n]
+		offsets[n] = b.Len()
+		fmt.Fprintf(&b, "%d 0 obj\n", n)
+		if obj.Stream != nil {
+			d, _ := obj.Value.(PDFDict)
+			if d == nil {
+				d = PDFDict{}
+				obj.Value = d
+			}
+			d["Length"] = len(obj.Stream)
+		}
+		WritePDFValue(&b, obj.Value, 0)
+		if obj.Stream != nil {
+			b.WriteString("\nstream\n")
+			b.Write(obj.Stream)
+			b.WriteString("\nendstream")
+		}
+		b.WriteString("\nendobj\n")
+	}
+	xref := b.Len()
+	fmt.Fprintf(&b, "xref\n0 %d\n", size)
+	for n, offset := range offsets {
+		if n == 0 || f.Objects[n] == nil {
+			b.WriteString("0000000000 65535 f \n")
+		} else {
+			fmt.Fprintf(&b, "%010d 00000 n \n", offset)
+		}
+	}
+	trailer := PDFDict{}
+	for k, v := range f.Trailer {
+		trailer[k] = v
+	}
+	delete(trailer, "Prev")
+	trailer["Size"] = size
+	b.WriteString("trailer\n")
+	WritePDFValue(&b, trailer, 0)
+	fmt.Fprintf(&b, "\nstartxref\n%d\n%%%%EOF\n", xref)
+	return b.Bytes()
+}
+
+// WritePDFValue writes the PDF representation of v. level is the nesting
+// depth of dictionaries for the indentation.
+func WritePDFValue(b *bytes.Buffer, v any, level int) {
+	switch t := v.(type) {
+	case nil:
+		b.WriteString("null")
+	case bool:
+		b.WriteString(strconv.FormatBool(t))
+	case int:
+		b.WriteString(strconv.Itoa(t))
+	case float64:
+		b.WriteString(PDFNumber(t))
+	case PDFRaw:
+		b.WriteString(string(t))
+	case PDFRef:
+		fmt.Fprintf(b, "%d 0 R", t)
+	case PDFName:
+		b.WriteString(pdfNameString(string(t)))
+	case PDFString:
+		writePDFString(b, string(t))
+	case PDFArray:
+		b.WriteByte('[')
+		for i, elt := range t {
+			if i > 0 {
+				b.WriteByte(' ')
+			}
+			WritePDFValue(b, elt, level)
+		}
+		b.WriteByte(']')
+	case PDFDict:
+		keys := make([]string, 0, len(t))
+		for k := range t {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			if keys[i] == "Type" || keys[j] == "Type" {
+				return keys[i] == "Type"
+			}
+			return keys[i] < keys[j]
+		})
+		b.WriteString("<<\n")
+		for _, k := range keys {
+			b.WriteString(strings.Repeat(" ", level+1))
+			b.WriteString(pdfNameString(k))
+			b.WriteByte(' ')
+			WritePDFValue(b, t[k], level+1)
+			b.WriteByte('\n')
+		}
+		b.WriteString(strings.Repeat(" ", level))
+		b.WriteString(">>")
+	default:
+		fmt.Fprint(b, t)
+	}
+}
+
+// pdfNameString returns the name with the slash, characters that are not
+// allowed in a name are written as #xx.
+func pdfNameString(name string) string {
+	var b strings.Builder
+	b.WriteByte('/')
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c <= ' ' || c >= 0x7f || c == '#' || isPDFDelimiter(c) {
+			fmt.Fprintf(&b, "#%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// writePDFString writes s as a literal string or as a hex string if s
+// contains non printable characters.
+func writePDFString(b *bytes.Buffer, s string) {
+	for i := 0; i < len(s); i++ {
+		if s[i] < ' ' || s[i] >= 0x7f {
+			fmt.Fprintf(b, "<%X>", s)
+			return
+		}
+	}
+	b.WriteByte('(')
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c == '(' || c == ')' || c == '\\' {
+			b.WriteByte('\\')
+		}
+		b.WriteByte(s[i])
+	}
+	b.WriteByte(')')
+}
@@ -0,0 +1,219 @@
+package common
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+const (
+	woffSignature  = "wOFF"
+	woff2Signature = "wOF2"
+	// maxFontSize limits the size of a decoded font to protect against
+	// broken or malicious files.
+	maxFontSize = 1 << 30
+)
+
+// IsWebFont returns true if the file starts with the WOFF or WOFF2 signature.
+// Files that cannot be read are no web fonts.
+func IsWebFont(filename string) bool {
+	f, err := os.Open(filename)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	var signature [4]byte
+	if _, err := io.ReadFull(f, signature[:]); err != nil {
+		return false
+	}
+	return HasWebFontSignature(signature[:])
+}
+
+// HasWebFontSignature returns true if data starts with the WOFF or WOFF2
+// signature.
+func HasWebFontSignature(data []byte) bool {
+	if len(data) < 4 {
+		return false
+	}
+	switch string(data[:4]) {
+	case woffSignature, woff2Signature:
+		return true
+	}
+	return false
+}
+
+// ReadFontFile reads a font file. WOFF and WOFF2 files are converted to
+// TrueType/OpenType data.
+func ReadFontFile(filename string) ([]byte, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return DecodeWebFont(data)
+}
+
+// DecodeWebFont converts WOFF and WOFF2 data to TrueType/OpenType data. Other
+// data is returned unchanged.
+func DecodeWebFont(data []byte) ([]byte, error) {
+	if len(data) < 4 {
+		return data, nil
+	}
+	switch string(data[:4]) {
+	case woffSignature:
+		return decodeWOFF(data)
+	case woff2Signature:
+		return decodeWOFF2(data)
+	}
+	return data, nil
+}
+
+// decodeWOFF decodes a WOFF 1.0 file. Each table is compressed with zlib on
+// its own.
+func decodeWOFF(data []byte) ([]byte, error) {
+	if len(data) < 44 {
+		return nil, fmt.Errorf("woff: file too short")
+	}
+	flavor := binary.BigEndian.Uint32(data[4:])
+	numTables := int(binary.BigEndian.Uint16(data[12:]))
+	totalSfntSize := binary.BigEndian.Uint32(data[16:])
+	if numTables == 0 || 44+numTables*20 > len(data) {
+		return nil, fmt.Errorf("woff: invalid table directory")
+	}
+	if totalSfntSize > maxFontSize {
+		return nil, fmt.Errorf("woff: font too large")
+	}
+	tables := make([]sfntTable, numTables)
+	for i := range tables {
+		entry := data[44+i*20:]
+		offset := binary.BigEndian.Uint32(entry[4:])
+		compLength := binary.BigEndian.Uint32(entry[8:])
+		origLength := binary.BigEndian.Uint32(entry[12:])
+		if uint64(offset)+uint64(compLength) > uint64(len(data)) || origLength > totalSfntSize {
+			return nil, fmt.Errorf("woff: table %q out of bounds", entry[0:4])
+		}
+		raw := data[offset : offset+compLength]
+		var tbl []byte
+		switch {
+		case compLength == origLength:
+			tbl = raw
+		case compLength < origLength:
+			zr, err := zlib.NewReader(bytes.NewReader(raw))
+			if err != nil {
+				return nil, fmt.Errorf("woff: table %q: %w", entry[0:4], err)
+			}
+			tbl = make([]byte, origLength)
+			if _, err = io.ReadFull(zr, tbl); err != nil {
+				return nil, fmt.Errorf("woff: table %q: %w", entry[0:4], err)
+			}
+		default:
+			return nil, fmt.Errorf("woff: table %q: invalid length", entry[0:4])
+		}
+		tables[i] = sfntTable{tag: string(entry[0:4]), data: tbl}
+	}
+	fnt := sfntFont{flavor: flavor}
+	for i := range tables {
+		fnt.tables = append(fnt.tables, i)
+	}
+	return writeSfnt(false, []sfntFont{fnt}, tables), nil
+}
+
+// sfntTable is a table of a TrueType/OpenType font.
+type sfntTable struct {
+	tag  string
+	data []byte
+}
+
+// sfntFont is a font in a collection. The tables are indexes into the list
+// of tables, so fonts can share tables.
+type sfntFont struct {
+	flavor uint32
+	tables []int
+}
+
+func pad4(n int) int {
+	return (n + 3) &^ 3
+}
+
+func sfntChecksum(data []byte) uint32 {
+	var sum uint32
+	for i := 0; i+4 <= len(data); i += 4 {
+		sum += binary.BigEndian.Uint32(data[i:])
+	}
+	return sum
+}
+
+// writeSfnt creates a font file (or a font collection) from the tables. The
+// table checksums and the checksum adjustment in the head table are
+// recalculated.
+func writeSfnt(collection bool, fonts []sfntFont, tables []sfntTable) []byte {
+	size := 0
+	if collection {
+		size = 12 + 4*len(fonts)
+	}
+	fontOffsets := make([]int, len(fonts))
+	for i, f := range fonts {
+		fontOffsets[i] = size
+		size += 12 + 16*len(f.tables)
+	}
+	tableOffsets := make([]int, len(tables))
+	for i, t := range tables {
+		size = pad4(size)
+		tableOffsets[i] = size
+		size += len(t.data)
+	}
+	out := make([]byte, pad4(size))
+	checksums := make([]uint32, len(tables))
+	headOffset := -1
+	for i, t := range tables {
+		o := tableOffsets[i]
+		copy(out[o:], t.data)
+		if t.tag == "head" && len(t.data) >= 12 {
+			// the checksum adjustment is calculated when the file is complete
+			binary.BigEndian.PutUint32(out[o+8:], 0)
+			headOffset = o
+		}
+		checksums[i] = sfntChecksum(out[o:pad4(o+len(t.data))])
+	}
+	if collection {
+		copy(out, "ttcf")
+		binary.BigEndian.PutUint32(out[4:], 0x00010000)
+		binary.BigEndian.PutUint32(out[8:], uint32(len(fonts)))
+		for i, o := range fontOffsets {
+			binary.BigEndian.PutUint32(out[12+4*i:], uint32(o))
+		}
+	}
+	for i, f := range fonts {
+		o := fontOffsets[i]
+		// the table directory must be sorted by tag
+		sorted := append([]int{}, f.tables...)
+		sort.Slice(sorted, func(a, b int) bool { return tables[sorted[a]].tag < tables[sorted[b]].tag })
+		n := len(sorted)
+		entrySelector := 0
+		for 1<<(entrySelector+1) <= n {
+			entrySelector++
+		}
+		searchRange := (1 << entrySelector) * 16
+		binary.BigEndian.PutUint32(out[o:], f.flavor)
+		binary.BigEndian.PutUint16(out[o+4:], uint16(n))
+		binary.BigEndian.PutUint16(out[o+6:], uint16(searchRange))
+		binary.BigEndian.PutUint16(out[o+8:], uint16(entrySelector))
+		binary.BigEndian.PutUint16(out[o+10:], uint16(n*16-searchRange))
+		for j, ti := range sorted {
+			entry := out[o+12+16*j:]
+			copy(entry[0:4], tables[ti].tag)
+			binary.BigEndian.PutUint32(entry[4:], checksums[ti])
+			binary.BigEndian.PutUint32(entry[8:], uint32(tableOffsets[ti]))
+			binary.BigEndian.PutUint32(entry[12:], uint32(len(tables[ti].data)))
+		}
+	}
+	// In a collection the head tables are not adjusted, the checksum would
+	// cover all fonts.
+	if !collection && headOffset >= 0 {
+		binary.BigEndian.PutUint32(out[headOffset+8:], 0xB1B0AFBA-sfntChecksum(out))
+	}
+	return out
+}
@@ -0,0 +1,582 @@
+package common
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/andybalholm/brotli"
+)
+
+// woff2KnownTags are the tags that are encoded as an index in the WOFF2
+// table directory.
+var woff2KnownTags = [63]string{
+	"cmap", "head", "hhea", "hmtx", "maxp", "name", "OS/2", "post",
+	"cvt ", "fpgm", "glyf", "loca", "prep", "CFF ", "VORG", "EBDT",
+	"EBLC", "gasp", "hdmx", "kern", "LTSH", "PCLT", "VDMX", "vhea",
+	"vmtx", "BASE", "GDEF", "GPOS", "GSUB", "EBSC", "JSTF", "MATH",
+	"CBDT", "CBLC", "COLR", "CPAL", "SVG ", "sbix", "acnt", "avar",
+	"bdat", "bloc", "bsln", "cvar", "fdsc", "feat", "fmtx", "fvar",
+	"gvar", "hsty", "just", "lcar", "mort", "morx", "opbd", "prop",
+	"trak", "Zapf", "Silf", "Glat", "Gloc", "Feat", "Sill",
+}
+
+const ttcfFlavor = 0x74746366
+
+// woffReader reads big endian values. The first error is kept and all
+// further reads return zero values.
+type woffReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *woffReader) bytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || r.pos+n > len(r.data) {
+		r.err = fmt.Errorf("unexpected end of data")
+		return nil
+	}
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b
+}
+
+func (r *woffReader) u8() uint8 {
+	if b := r.bytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *woffReader) u16() uint16 {
+	if b := r.bytes(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *woffReader) i16() int16 {
+	return int16(r.u16())
+}
+
+func (r *woffReader) u32() uint32 {
+	if b := r.bytes(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+// u255 reads a 255UInt16 value.
+func (r *woffReader) u255() int {
+	switch code := r.u8(); code {
+	case 253:
+		return int(r.u16())
+	case 254:
+		return int(r.u8()) + 506
+	case 255:
+		return int(r.u8()) + 253
+	default:
+		return int(code)
+	}
+}
+
+// base128 reads a UIntBase128 value.
+func (r *woffReader) base128() uint32 {
+	var acc uint32
+	for i := 0; i < 5; i++ {
+		b := r.u8()
+		if r.err != nil {
+			return 0
+		}
+		if (i == 0 && b == 0x80) || acc&0xFE000000 != 0 {
+			r.err = fmt.Errorf("invalid UIntBase128 value")
+			return 0
+		}
+		acc = acc<<7 | uint32(b&0x7f)
+		if b&0x80 == 0 {
+			return acc
+		}
+	}
+	r.err = fmt.Errorf("UIntBase128 value too long")
+	return 0
+}
+
+type woff2Table struct {
+	tag        string
+	transform  uint8
+	origLength uint32
+	// length is the length of the (possibly transformed) table in the
+	// decompressed data.
+	length uint32
+	data   []byte
+	done   bool
+	// xMins are the glyph bounding box minima of a reconstructed glyf
+	// table. They are the left side bearings in a transformed hmtx table.
+	xMins []int16
+}
+
+// transformed returns true if the table data must be reconstructed. For glyf
+// and loca the transformation version 0 is the transformation, for all
+// other tables version 0 is the null transformation.
+func (t *woff2Table) transformed() bool {
+	if t.tag == "glyf" || t.tag == "loca" {
+		return t.transform == 0
+	}
+	return t.transform != 0
+}
+
+// decodeWOFF2 decodes a WOFF 2.0 file. All tables are compressed together
+// with Brotli, the glyf, loca and hmtx tables may be transformed.
+func decodeWOFF2(data []byte) ([]byte, error) {
+	if len(data) < 48 {
+		return nil, fmt.Errorf("woff2: file too short")
+	}
+	flavor := binary.BigEndian.Uint32(data[4:])
+	numTables := int(binary.BigEndian.Uint16(data[12:]))
+	totalSfntSize := binary.BigEndian.Uint32(data[16:])
+	totalCompressedSize := binary.BigEndian.Uint32(data[20:])
+	if numTables == 0 {
+		return nil, fmt.Errorf("woff2: no tables")
+	}
+	r := &woffReader{data: data, pos: 48}
+	tables := make([]*woff2Table, numTables)
+	var streamSize uint64
+	for i := range tables {
+		flags := r.u8()
+		t := &woff2Table{transform: flags >> 6}
+		if flags&0x3f == 0x3f {
+			t.tag = string(r.bytes(4))
+		} else {
+			t.tag = woff2KnownTags[flags&0x3f]
+		}
+		t.origLength = r.base128()
+		t.length = t.origLength
+		if t.transformed() {
+			t.length = r.base128()
+			if t.tag == "loca" && t.length != 0 {
+				return nil, fmt.Errorf("woff2: transformed loca table must be empty")
+			}
+		}
+		streamSize += uint64(t.length)
+		tables[i] = t
+	}
+
+	var fonts []sfntFont
+	collection := flavor == ttcfFlavor
+	if collection {
+		r.u32() // version
+		numFonts := r.u255()
+		for i := 0; i < numFonts && r.err == nil; i++ {
+			fnt := sfntFont{}
+			n := r.u255()
+			fnt.flavor = r.u32()
+			for j := 0; j < n && r.err == nil; j++ {
+				idx := r.u255()
+				if idx >= numTables {
+					return nil, fmt.Errorf("woff2: invalid table index in collection")
+				}
+				fnt.tables = append(fnt.tables, idx)
+			}
+			fonts = append(fonts, fnt)
+		}
+	} else {
+		fnt := sfntFont{flavor: flavor}
+		for i := range tables {
+			fnt.tables = append(fnt.tables, i)
+		}
+		fonts = append(fonts, fnt)
+	}
+	compressed := r.bytes(int(totalCompressedSize))
+	if r.err != nil {
+		return nil, fmt.Errorf("woff2: %w", r.err)
+	}
+	if streamSize > maxFontSize || totalSfntSize > maxFontSize {
+		return nil, fmt.Errorf("woff2: font too large")
+	}
+	stream, err := io.ReadAll(io.LimitReader(brotli.NewReader(bytes.NewReader(compressed)), int64(streamSize)))
+	if err != nil {
+		return nil, fmt.Errorf("woff2: %w", err)
+	}
+	if uint64(len(stream)) != streamSize {
+		return nil, fmt.Errorf("woff2: decompressed data has the wrong size")
+	}
+	pos := uint32(0)
+	for _, t := range tables {
+		t.data = stream[pos : pos+t.length]
+		pos += t.length
+	}
+
+	for _, fnt := range fonts {
+		byTag := make(map[string]*woff2Table, len(fnt.tables))
+		for _, idx := range fnt.tables {
+			byTag[tables[idx].tag] = tables[idx]
+		}
+		if err := reconstructWOFF2Font(byTag); err != nil {
+			return nil, err
+		}
+	}
+
+	sfntTables := make([]sfntTable, numTables)
+	for i, t := range tables {
+		if t.transformed() && !t.done {
+			return nil, fmt.Errorf("woff2: cannot reconstruct table %q", t.tag)
+		}
+		sfntTables[i] = sfntTable{tag: t.tag, data: t.data}
+	}
+	return writeSfnt(collection, fonts, sfntTables), nil
+}
+
+// reconstructWOFF2Font undoes the glyf/loca and hmtx transformations of the
+// tables of one font. Tables shared in a collection are reconstructed once.
+func reconstructWOFF2Font(byTag map[string]*woff2Table) error {
+	glyf, loca := byTag["glyf"], byTag["loca"]
+	if glyf != nil && glyf.transformed() && !glyf.done {
+		if loca == nil {
+			return fmt.Errorf("woff2: transformed glyf table without loca table")
+		}
+		glyfData, locaData, xMins, err := reconstructGlyf(glyf.data)
+		if err != nil {
+			return fmt.Errorf("woff2: glyf: %w", err)
+		}
+		glyf.data, glyf.done = glyfData, true
+		loca.data, loca.done = locaData, true
+		glyf.xMins = xMins
+	}
+	hmtx := byTag["hmtx"]
+	if hmtx != nil && hmtx.transformed() && !hmtx.done {
+		hhea := byTag["hhea"]
+		if hhea == nil || len(hhea.data) < 36 || glyf == nil || glyf.xMins == nil {
+			return fmt.Errorf("woff2: transformed hmtx table needs hhea and a transformed glyf table")
+		}
+		numHMetrics := int(binary.BigEndian.Uint16(hhea.data[34:]))
+		hmtxData, err := reconstructHmtx(hmtx.data, numHMetrics, glyf.xMins)
+		if err != nil {
+			return fmt.Errorf("woff2: hmtx: %w", err)
+		}
+		hmtx.data, hmtx.done = hmtxData, true
+	}
+	return nil
+}
+
+// reconstructGlyf rebuilds the glyf and loca tables from a transformed glyf
+// table. It also returns the xMin values of all glyphs.
+func reconstructGlyf(data []byte) ([]byte, []byte, []int16, error) {
+	hdr := &woffReader{data: data}
+	hdr.u16() // reserved
+	optionFlags := hdr.u16()
+	numGlyphs := int(hdr.u16())
+	indexFormat := hdr.u16()
+	var sizes [7]uint32
+	for i := range sizes {
+		sizes[i] = hdr.u32()
+	}
+	// the streams follow the header in the same order as their sizes
+	streams := make([]*woffReader, len(sizes))
+	for i, size := range sizes {
+		streams[i] = &woffReader{data: hdr.bytes(int(size))}
+	}
+	var overlap []byte
+	if optionFlags&1 != 0 {
+		overlap = hdr.bytes((numGlyphs + 7) / 8)
+	}
+	if hdr.err != nil {
+		return nil, nil, nil, hdr.err
+	}
+	nContours, nPoints, flags, glyphs, composites, bboxes, instructions := streams[0], streams[1], streams[2], streams[3], streams[4], streams[5], streams[6]
+	bboxBitmap := bboxes.bytes(((numGlyphs + 31) / 32) * 4)
+
+	var out []byte
+	offsets := make([]int, numGlyphs+1)
+	xMins := make([]int16, numGlyphs)
+	for i := 0; i < numGlyphs; i++ {
+		offsets[i] = len(out)
+		nc := nContours.i16()
+		hasBBox := bboxBitmap != nil && bboxBitmap[i>>3]&(0x80>>(i&7)) != 0
+		switch {
+		case nc == 0:
+			if hasBBox {
+				return nil, nil, nil, fmt.Errorf("empty glyph %d has a bounding box", i)
+			}
+		case nc < 0:
+			if !hasBBox {
+				return nil, nil, nil, fmt.Errorf("composite glyph %d has no bounding box", i)
+			}
+			bbox := bboxes.bytes(8)
+			component, haveInstructions := readCompositeGlyph(composites)
+			out = binary.BigEndian.AppendUint16(out, uint16(nc))
+			out = append(out, bbox...)
+			out = append(out, component...)
+			if haveInstructions {
+				n := glyphs.u255()
+				out = binary.BigEndian.AppendUint16(out, uint16(n))
+				out = append(out, instructions.bytes(n)...)
+			}
+			if bbox != nil {
+				xMins[i] = int16(binary.BigEndian.Uint16(bbox))
+			}
+		default:
+			endPoints := make([]int, nc)
+			total := 0
+			for c := range endPoints {
+				total += nPoints.u255()
+				endPoints[c] = total - 1
+			}
+			if total > 0xffff {
+				return nil, nil, nil, fmt.Errorf("glyph %d has too many points", i)
+			}
+			dx := make([]int, total)
+			dy := make([]int, total)
+			onCurve := make([]bool, total)
+			var x, y, xMin, yMin, xMax, yMax int
+			for p := 0; p < total; p++ {
+				flag := flags.u8()
+				onCurve[p] = flag&0x80 == 0
+				flag &= 0x7f
+				n := 4
+				switch {
+				case flag < 84:
+					n = 1
+				case flag < 120:
+					n = 2
+				case flag < 124:
+					n = 3
+				}
+				dx[p], dy[p] = decodeTriplet(flag, glyphs.bytes(n))
+				x += dx[p]
+				y += dy[p]
+				if p == 0 || x < xMin {
+					xMin = x
+				}
+				if p == 0 || x > xMax {
+					xMax = x
+				}
+				if p == 0 || y < yMin {
+					yMin = y
+				}
+				if p == 0 || y > yMax {
+					yMax = y
+				}
+			}
+			n := glyphs.u255()
+			inst := instructions.bytes(n)
+			if hasBBox {
+				xMin, yMin = int(bboxes.i16()), int(bboxes.i16())
+				xMax, yMax = int(bboxes.i16()), int(bboxes.i16())
+			}
+			out = binary.BigEndian.AppendUint16(out, uint16(nc))
+			for _, v := range []int{xMin, yMin, xMax, yMax} {
+				out = binary.BigEndian.AppendUint16(out, uint16(int16(v)))
+			}
+			for _, e := range endPoints {
+				out = binary.BigEndian.AppendUint16(out, uint16(e))
+			}
+			out = binary.BigEndian.AppendUint16(out, uint16(n))
+			out = append(out, inst...)
+			hasOverlap := overlap != nil && overlap[i>>3]&(0x80>>(i&7)) != 0
+			out = appendGlyphPoints(out, dx, dy, onCurve, hasOverlap)
+			xMins[i] = int16(xMin)
+		}
+		for _, s := range streams {
+			if s.err != nil {
+				return nil, nil, nil, fmt.Errorf("glyph %d: %w", i, s.err)
+			}
+		}
+		for len(out)%4 != 0 {
+			out = append(out, 0)
+		}
+	}
+	offsets[numGlyphs] = len(out)
+
+	var loca []byte
+	for _, o := range offsets {
+		if indexFormat == 0 {
+			if o/2 > 0xffff {
+				return nil, nil, nil, fmt.Errorf("glyf table too large for short loca format")
+			}
+			loca = binary.BigEndian.AppendUint16(loca, uint16(o/2))
+		} else {
+			loca = binary.BigEndian.AppendUint32(loca, uint32(o))
+		}
+	}
+	return out, loca, xMins, nil
+}
+
+// decodeTriplet decodes a point of a simple glyph, see section 5.2 of the
+// WOFF2 specification.
+func decodeTriplet(flag uint8, in []byte) (int, int) {
+	if in == nil {
+		return 0, 0
+	}
+	withSign := func(flag uint8, v int) int {
+		if flag&1 != 0 {
+			return v
+		}
+		return -v
+	}
+	f := int(flag)
+	switch {
+	case flag < 10:
+		return 0, withSign(flag, (f&14)<<7+int(in[0]))
+	case flag < 20:
+		return withSign(flag, ((f-10)&14)<<7+int(in[0])), 0
+	case flag < 84:
+		b0, b1 := f-20, int(in[0])
+		return withSign(flag, 1+(b0&0x30)+(b1>>4)), withSign(flag>>1, 1+((b0&0x0c)<<2)+(b1&0x0f))
+	case flag < 120:
+		b0 := f - 84
+		return withSign(flag, 1+((b0/12)<<8)+int(in[0])), withSign(flag>>1, 1+(((b0%12)>>2)<<8)+int(in[1]))
+	case flag < 124:
+		b2 := int(in[1])
+		return withSign(flag, int(in[0])<<4+b2>>4), withSign(flag>>1, (b2&0x0f)<<8+int(in[2]))
+	default:
+		return withSign(flag, int(in[0])<<8+int(in[1])), withSign(flag>>1, int(in[2])<<8+int(in[3]))
+	}
+}
+
+// readCompositeGlyph returns the component records of a composite glyph and
+// whether the glyph has instructions.
+func readCompositeGlyph(r *woffReader) ([]byte, bool) {
+	const (
+		argsAreWords     = 0x0001
+		haveScale        = 0x0008
+		moreComponents   = 0x0020
+		haveXYScale      = 0x0040
+		haveTwoByTwo     = 0x0080
+		haveInstructions = 0x0100
+	)
+	start := r.pos
+	instructions := false
+	for r.err == nil {
+		flags := r.u16()
+		instructions = instructions || flags&haveInstructions != 0
+		size := 4 // glyph index and two byte arguments
+		if flags&argsAreWords != 0 {
+			size = 6
+		}
+		switch {
+		case flags&haveScale != 0:
+			size += 2
+		case flags&haveXYScale != 0:
+			size += 4
+		case flags&haveTwoByTwo != 0:
+			size += 8
+		}
+		r.bytes(size)
+		if flags&moreComponents == 0 {
+			break
+		}
+	}
+	if r.err != nil {
+		return nil, false
+	}
+	return r.data[start:r.pos], instructions
+}
+
+// appendGlyphPoints appends the flags and the coordinates of a simple glyph
+// in the glyf table format.
+func appendGlyphPoints(out []byte, dx, dy []int, onCurve []bool, overlap bool) []byte {
+	const (
+		onCurvePoint = 0x01
+		xShort       = 0x02
+		yShort       = 0x04
+		repeat       = 0x08
+		xSame        = 0x10
+		ySame        = 0x20
+		overlapFlag  = 0x40
+	)
+	var flags, xs, ys []byte
+	var last byte
+	repeats := 0
+	for i := range dx {
+		var f byte
+		if onCurve[i] {
+			f |= onCurvePoint
+		}
+		if i == 0 && overlap {
+			f |= overlapFlag
+		}
+		switch x := dx[i]; {
+		case x == 0:
+			f |= xSame
+		case x > -256 && x < 256:
+			f |= xShort
+			if x > 0 {
+				f |= xSame
+			} else {
+				x = -x
+			}
+			xs = append(xs, byte(x))
+		default:
+			xs = binary.BigEndian.AppendUint16(xs, uint16(int16(x)))
+		}
+		switch y := dy[i]; {
+		case y == 0:
+			f |= ySame
+		case y > -256 && y < 256:
+			f |= yShort
+			if y > 0 {
+				f |= ySame
+			} else {
+				y = -y
+			}
+			ys = append(ys, byte(y))
+		default:
+			ys = binary.BigEndian.AppendUint16(ys, uint16(int16(y)))
+		}
+		if n := len(flags); i > 0 && f == last && repeats < 255 {
+			if repeats == 0 {
+				flags[n-1] |= repeat
+				flags = append(flags, 1)
+			} else {
+				flags[n-1]++
+			}
+			repeats++
+		} else {
+			flags = append(flags, f)
+			last = f
+			repeats = 0
+		}
+	}
+	out = append(out, flags...)
+	out = append(out, xs...)
+	return append(out, ys...)
+}
+
+// reconstructHmtx rebuilds the hmtx table. The left side bearings may be
+// omitted in the transformed table, they are the xMin values of the glyphs
+// then.
+func reconstructHmtx(data []byte, numHMetrics int, xMins []int16) ([]byte, error) {
+	numGlyphs := len(xMins)
+	if numHMetrics > numGlyphs || numHMetrics == 0 {
+		return nil, fmt.Errorf("invalid number of horizontal metrics")
+	}
+	r := &woffReader{data: data}
+	flags := r.u8()
+	advances := make([]uint16, numHMetrics)
+	for i := range advances {
+		advances[i] = r.u16()
+	}
+	lsbs := make([]int16, numGlyphs)
+	for i := range lsbs {
+		if (i < numHMetrics && flags&1 == 0) || (i >= numHMetrics && flags&2 == 0) {
+			lsbs[i] = r.i16()
+		} else {
+			lsbs[i] = xMins[i]
+		}
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	out := make([]byte, 0, 4*numHMetrics+2*(numGlyphs-numHMetrics))
+	for i, lsb := range lsbs {
+		if i < numHMetrics {
+			out = binary.BigEndian.AppendUint16(out, advances[i])
+		}
+		out = binary.BigEndian.AppendUint16(out, uint16(lsb))
+	}
+	return out, nil
+}
@@ -0,0 +1,337 @@
+package frontend
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/boxesandglue/boxesandglue/backend/bag"
+	"github.com/boxesandglue/boxesandglue/backend/document"
+	"github.com/speedata/glu/lua/common"
+	"github.com/speedata/go-lua"
+)
+
+// attachmentRelationships are the AFRelationship values of PDF 2.0 and
+// PDF/A-3.
+var attachmentRelationships = map[string]bool{
+	"Source":      true,
+	"Data":        true,
+	"Alternative": true,
+	"Supplement":  true,
+	"Unspecified": true,
+}
+
+// attachmentIcons are the icons of file attachment annotations.
+var attachmentIcons = map[string]string{
+	"graph":     "Graph",
+	"paperclip": "Paperclip",
+	"pushpin":   "PushPin",
+	"tag":       "Tag",
+}
+
+// attachment has the properties of an attached file that the library does
+// not write.
+type attachment struct {
+	// relationship is the AFRelationship, the library writes Alternative
+	// if it is empty
+	relationship string
+	creationDate time.Time
+}
+
+// fileAnnotation is a file attachment annotation on a page.
+type fileAnnotation struct {
+	// name is the name of the attached file
+	name        string
+	description string
+	icon        string
+	// x and y are the top left corner on the page
+	x, y          bag.ScaledPoint
+	width, height bag.ScaledPoint
+}
+
+// parseDate parses an RFC 3339 date ("2024-05-17T10:30:00+02:00"), a date
+// and time without zone or a date ("2024-05-17") in local time.
+func parseDate(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid date %q (use 2006-01-02 or 2006-01-02T15:04:05Z07:00)", s)
+}
+
+// pdfDate returns t as a PDF date string.
+func pdfDate(t time.Time) pdfString {
+	_, offset := t.Zone()
+	sign := byte('+')
+	if offset < 0 {
+		sign = '-'
+		offset = -offset
+	}
+	return pdfString(fmt.Sprintf("D:%s%c%02d'%02d'", t.Format("20060102150405"), sign, offset/3600, offset%3600/60))
+}
+
+// optionalDate reads the date at key of the table at index.
+func optionalDate(l *lua.State, index int, key string) (time.Time, error) {
+	l.Field(index, key)
+	defer l.Pop(1)
+	if l.IsNil(-1) {
+		return time.Time{}, nil
+	}
+	return parseDate(lua.CheckString(l, -1))
+}
+
+// checkAttachment reads the options of an attached file from the table at
+// index: filename or data, name, description, mimetype, relationship,
+// creation_date and mod_date.
+func checkAttachment(l *lua.State, index int, fn string) (document.Attachment, *attachment) {
+	var att document.Attachment
+	a := &attachment{}
+
+	l.Field(index, "filename")
+	filename := ""
+	if !l.IsNil(-1) {
+		filename = lua.CheckString(l, -1)
+	}
+	l.Pop(1)
+	l.Field(index, "data")
+	hasData := !l.IsNil(-1)
+	if hasData {
+		att.Data = []byte(lua.CheckString(l, -1))
+	}
+	l.Pop(1)
+
+	switch {
+	case filename != "" && hasData:
+		lua.Errorf(l, "%s: use either filename or data", fn)
+	case filename != "":
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			lua.Errorf(l, "%s: failed to read file: %s", fn, err.Error())
+		}
+		att.Data = data
+		att.Name = filepath.Base(filename)
+		if fi, err := os.Stat(filename); err == nil {
+			att.ModDate = fi.ModTime()
+		}
+	case hasData:
+		// the file is created with the document
+	default:
+		lua.Errorf(l, "%s: filename or data is required", fn)
+	}
+
+	l.Field(index, "name")
+	if !l.IsNil(-1) {
+		att.Name = lua.CheckString(l, -1)
+	}
+	l.Pop(1)
+	if att.Name == "" {
+		lua.Errorf(l, "%s: name is required for data", fn)
+	}
+
+	l.Field(index, "description")
+	if !l.IsNil(-1) {
+		att.Description = lua.CheckString(l, -1)
+	}
+	l.Pop(1)
+
+	att.MimeType = "application/octet-stream"
+	l.Field(index, "mimetype")
+	if !l.IsNil(-1) {
+		att.MimeType = lua.CheckString(l, -1)
+	}
+	l.Pop(1)
+
+	l.Field(index, "relationship")
+	if !l.IsNil(-1) {
+		a.relationship = lua.CheckString(l, -1)
+		if !attachmentRelationships[a.relationship] {
+			lua.Errorf(l, "%s: unknown relationship %s (use Source, Data, Alternative, Supplement or Unspecified)", fn, a.relationship)
+		}
+	}
+	l.Pop(1)
+
+	var err error
+	if a.creationDate, err = optionalDate(l, index, "creation_date"); err != nil {
+		lua.Errorf(l, "%s: creation_date: %s", fn, err.Error())
+	}
+	modDate, err := optionalDate(l, index, "mod_date")
+	if err != nil {
+		lua.Errorf(l, "%s: mod_date: %s", fn, err.Error())
+	}
+	if !modDate.IsZero() {
+		att.ModDate = modDate
+	}
+	return att, a
+}
+
+// attachFile adds the file to the document.
+func (d *Document) attachFile(att document.Attachment, a *attachment) error {
+	if _, ok := d.attachments[att.Name]; ok {
+		return fmt.Errorf("the document already has an attachment named %s", att.Name)
+	}
+	if att.ModDate.IsZero() {
+		// the file is created with the document
+		att.ModDate = d.Value.Doc.CreationDate
+	}
+	d.Value.Doc.AttachFile(att)
+	d.attachments[att.Name] = a
+	return nil
+}
+
+// documentAttachFile attaches a file to the document: doc:attach_file(options)
+// options: { filename = "path/to/file", name = "visible name", description = "desc", mimetype = "text/xml" }
+// or data = "file contents" instead of filename, relationship = "Source",
+// creation_date and mod_date
+func documentAttachFile(l *lua.State) int {
+	d := checkDocument(l, 1)
+	lua.CheckType(l, 2, lua.TypeTable)
+
+	att, a := checkAttachment(l, 2, "attach_file")
+	if err := d.attachFile(att, a); err != nil {
+		lua.Errorf(l, "attach_file: %s", err.Error())
+	}
+	return 0
+}
+
+// pageAttachFile attaches a file to the document and shows it as an icon on
+// the page: page:attach_file(options)
+// options are the options of doc:attach_file and x, y, width, height and
+// icon ("PushPin", "Paperclip", "Graph" or "Tag")
+func pageAttachFile(l *lua.State) int {
+	p := checkPage(l, 1)
+	lua.CheckType(l, 2, lua.TypeTable)
+
+	att, a := checkAttachment(l, 2, "attach_file")
+	fa := fileAnnotation{
+		name:        att.Name,
+		description: att.Description,
+		icon:        "PushPin",
+		width:       12 * bag.Factor,
+		height:      16 * bag.Factor,
+	}
+	l.Field(2, "x")
+	fa.x = checkDimension(l, -1)
+	l.Pop(1)
+	l.Field(2, "y")
+	fa.y = checkDimension(l, -1)
+	l.Pop(1)
+	l.Field(2, "width")
+	if !l.IsNil(-1) {
+		fa.width = checkDimension(l, -1)
+	}
+	l.Pop(1)
+	l.Field(2, "height")
+	if !l.IsNil(-1) {
+		fa.height = checkDimension(l, -1)
+	}
+	l.Pop(1)
+	l.Field(2, "icon")
+	if !l.IsNil(-1) {
+		icon := lua.CheckString(l, -1)
+		var ok bool
+		if fa.icon, ok = attachmentIcons[strings.ToLower(icon)]; !ok {
+			lua.Errorf(l, "attach_file: unknown icon %s (use PushPin, Paperclip, Graph or Tag)", icon)
+		}
+	}
+	l.Pop(1)
+	if fa.description == "" {
+		fa.description = att.Name
+	}
+
+	if err := p.doc.attachFile(att, a); err != nil {
+		lua.Errorf(l, "attach_file: %s", err.Error())
+	}
+	p.annotations = append(p.annotations, fa)
+	l.PushValue(1)
+	return 1
+}
+
+// attachmentAppearance returns the appearance stream of a file attachment
+// annotation, PDF/A and PDF/X require appearances for all annotations.
+func attachmentAppearance(f *pdfFile, wd, ht float64) pdfRef {
+	n := common.PDFNumber
+	var b strings.Builder
+	fold := min(wd, ht) / 3
+	fmt.Fprintf(&b, "0 G 1 g 0.5 w 0.25 0.25 m %s 0.25 l %s %s l %s %s l 0.25 %s l h B\n",
+		n(wd-0.25), n(wd-0.25), n(ht-fold), n(wd-fold), n(ht-0.25), n(ht-0.25))
+	fmt.Fprintf(&b, "%s %s m %s %s l %s %s l S\n", n(wd-fold), n(ht-0.25), n(wd-fold), n(ht-fold), n(wd-0.25), n(ht-fold))
+	for y := ht - fold - 3; y > 3; y -= 3 {
+		fmt.Fprintf(&b, "2 %s m %s %s l S\n", n(y), n(wd-2), n(y))
+	}
+	return f.AddStream(pdfDict{
+		"Type":    pdfName("XObject"),
+		"Subtype": pdfName("Form"),
+		"BBox":    pdfArray{0.0, 0.0, wd, ht},
+	}, []byte(b.String()))
+}
+
+// writeAttachments sets the relationship and creation date of the attached
+// files and adds the file attachment annotations to the pages. The library
+// writes all files as alternative representations.
+func (d *Document) writeAttachments(f *pdfFile) error {
+	filespecs := make(map[string]pdfRef)
+	af, _ := f.Resolve(f.Catalog()["AF"]).(pdfArray)
+	for _, ref := range af {
+		fs := f.Dict(ref)
+		name, _ := f.Resolve(fs["UF"]).(pdfString)
+		a, ok := d.attachments[string(name)]
+		if !ok {
+			continue
+		}
+		if r, ok := ref.(pdfRef); ok {
+			filespecs[string(name)] = r
+		}
+		if a.relationship != "" {
+			fs["AFRelationship"] = pdfName(a.relationship)
+		}
+		if !a.creationDate.IsZero() {
+			if ef := f.Dict(f.Dict(fs["EF"])["F"]); ef != nil {
+				f.SubDict(ef, "Params")["CreationDate"] = pdfDate(a.creationDate)
+			}
+		}
+	}
+
+	appearance := d.Value.Doc.Format != document.FormatPDF && d.Value.Doc.Format != document.FormatPDFUA
+	refs := f.PageRefs()
+	if len(refs) != len(d.shipped) {
+		return fmt.Errorf("attachments: %d pages in the PDF, %d pages shipped out", len(refs), len(d.shipped))
+	}
+	for i, sp := range d.shipped {
+		if len(sp.annotations) == 0 {
+			continue
+		}
+		page := f.Dict(refs[i])
+		annots, _ := f.Resolve(page["Annots"]).(pdfArray)
+		m := sp.margin.ToPT()
+		for _, fa := range sp.annotations {
+			fs, ok := filespecs[fa.name]
+			if !ok {
+				return fmt.Errorf("attachments: file %s not found", fa.name)
+			}
+			x, y := m+fa.x.ToPT(), m+fa.y.ToPT()
+			wd, ht := fa.width.ToPT(), fa.height.ToPT()
+			annot := pdfDict{
+				"Type":     pdfName("Annot"),
+				"Subtype":  pdfName("FileAttachment"),
+				"Rect":     pdfBox([4]float64{x, y - ht, x + wd, y}),
+				"FS":       fs,
+				"Name":     pdfName(fa.icon),
+				"Contents": common.PDFTextString(fa.description),
+				"P":        refs[i],
+			}
+			if appearance {
+				annot["F"] = 4
+				annot["AP"] = pdfDict{"N": attachmentAppearance(f, wd, ht)}
+			}
+			annots = append(annots, f.Add(annot))
+		}
+		page["Annots"] = annots
+	}
+	return nil
+}
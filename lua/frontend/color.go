@@ -1,6 +1,8 @@
 package frontend
 
 import (
+	"fmt"
+
 	"github.com/boxesandglue/boxesandglue/backend/color"
 	"github.com/speedata/go-lua"
 )
@@ -10,6 +12,9 @@ const colorMetaTable = "Color"
 // Color wraps the boxesandglue color.Color type
 type Color struct {
 	Value *color.Color
+	// spec describes glu colors (spot colors, overprint and transparency),
+	// a document uses a color of its own for these
+	spec *colorSpec
 }
 
 // checkColor retrieves a Color userdata from the stack
@@ -22,9 +27,20 @@ func checkColor(l *lua.State, index int) *Color {
 	return nil
 }
 
-// colorNew creates a color from RGB values: color.new(r, g, b, [a])
+// colorNew creates a color: color.new(r, g, b, [a]) or color.new(options)
 // Values can be 0-1 scale or 0-255 scale (auto-detected)
 func colorNew(l *lua.State) int {
+	if l.IsTable(1) {
+		c, err := colorFromTable(l, 1)
+		if err != nil {
+			lua.Errorf(l, "color: %s", err.Error())
+			return 0
+		}
+		l.PushUserData(c)
+		lua.SetMetaTableNamed(l, colorMetaTable)
+		return 1
+	}
+
 	col := &color.Color{Space: color.ColorRGB}
 
 	if l.IsNumber(1) {
@@ -48,57 +64,204 @@ func colorNew(l *lua.State) int {
 			col.A = a
 		}
 	} else {
-		lua.Errorf(l, "color.new requires numeric arguments (r, g, b, [a])")
+		lua.Errorf(l, "color.new requires numeric arguments (r, g, b, [a]) or a table")
 		return 0
 	}
+	c := &Color{Value: col}
+	if col.A < 1 {
+		c = newSpecColor(&colorSpec{process: col, alpha: col.A})
+	}
 
-	l.PushUserData(&Color{Value: col})
+	l.PushUserData(c)
 	lua.SetMetaTableNamed(l, colorMetaTable)
 	return 1
 }
 
+// colorOptions are the fields of a color definition in a table or a palette
+// file. Numbers are float64 values.
+type colorOptions map[string]any
+
+// colorOptionKeys are the keys read from a color table.
+var colorOptionKeys = []string{"model", "name", "r", "g", "b", "a", "c", "m", "y", "k", "cmyk", "tint", "overprint"}
+
+// colorFromTable creates a color from a table:
+// { model = "rgb", r = 1, g = 0, b = 0, [a = 1] }
+// { model = "cmyk", c = 0, m = 0, y = 0, k = 1 }
+// { model = "gray", g = 0.5 }
+// { model = "spot", name = "PANTONE 286 C", cmyk = { 1, 0.66, 0, 0.02 }, [tint = 1] }
+// All models accept overprint = true.
+func colorFromTable(l *lua.State, index int) (*Color, error) {
+	opts := colorOptions{}
+	for _, key := range colorOptionKeys {
+		l.Field(index, key)
+		switch l.TypeOf(-1) {
+		case lua.TypeNumber:
+			opts[key], _ = l.ToNumber(-1)
+		case lua.TypeString:
+			opts[key], _ = l.ToString(-1)
+		case lua.TypeBoolean:
+			opts[key] = l.ToBoolean(-1)
+		case lua.TypeTable:
+			var values []float64
+			for i := 1; i <= l.RawLength(-1); i++ {
+				l.RawGetInt(-1, i)
+				v, _ := l.ToNumber(-1)
+				values = append(values, v)
+				l.Pop(1)
+			}
+			opts[key] = values
+		}
+		l.Pop(1)
+	}
+	return opts.color()
+}
+
+func (opts colorOptions) number(key string, def float64) float64 {
+	if n, ok := opts[key].(float64); ok {
+		return n
+	}
+	return def
+}
+
+// numbers returns a list of numbers ([]float64 or []any from JSON).
+func (opts colorOptions) numbers(key string) []float64 {
+	switch t := opts[key].(type) {
+	case []float64:
+		return t
+	case []any:
+		var ret []float64
+		for _, v := range t {
+			n, _ := v.(float64)
+			ret = append(ret, n)
+		}
+		return ret
+	}
+	return nil
+}
+
+// color creates the color of the options.
+func (opts colorOptions) color() (*Color, error) {
+	model, ok := opts["model"].(string)
+	if !ok {
+		model = "rgb"
+	}
+	overprint, _ := opts["overprint"].(bool)
+
+	col := &color.Color{A: opts.number("a", 1)}
+	switch model {
+	case "rgb":
+		col.Space = color.ColorRGB
+		col.R, col.G, col.B = opts.number("r", 0), opts.number("g", 0), opts.number("b", 0)
+		if col.R > 1 || col.G > 1 || col.B > 1 {
+			col.R, col.G, col.B = col.R/255, col.G/255, col.B/255
+		}
+	case "cmyk":
+		col.Space = color.ColorCMYK
+		col.C, col.M, col.Y, col.K = opts.number("c", 0), opts.number("m", 0), opts.number("y", 0), opts.number("k", 0)
+	case "gray":
+		col.Space = color.ColorGray
+		col.G = opts.number("g", 0)
+	case "spot":
+		spec := &colorSpec{tint: opts.number("tint", 1), overprint: overprint, alpha: col.A}
+		spec.name, _ = opts["name"].(string)
+		if spec.name == "" {
+			return nil, fmt.Errorf("spot color needs a name")
+		}
+		cmyk := opts.numbers("cmyk")
+		if len(cmyk) != 4 {
+			return nil, fmt.Errorf("spot color %q needs the cmyk values {c, m, y, k}", spec.name)
+		}
+		copy(spec.cmyk[:], cmyk)
+		if spec.tint < 0 || spec.tint > 1 {
+			return nil, fmt.Errorf("tint must be between 0 and 1")
+		}
+		return newSpecColor(spec), nil
+	default:
+		return nil, fmt.Errorf("unknown color model %q (use rgb, cmyk, gray or spot)", model)
+	}
+	if overprint || col.A < 1 {
+		return newSpecColor(&colorSpec{process: col, overprint: overprint, alpha: col.A}), nil
+	}
+	return &Color{Value: col}, nil
+}
+
 // colorIndex handles attribute access (__index metamethod)
 func colorIndex(l *lua.State) int {
 	c := checkColor(l, 1)
 	key := lua.CheckString(l, 2)
 
+	col, spec := c.Value, c.spec
+	if spec != nil && spec.process != nil {
+		col = spec.process
+	}
 	switch key {
+	case "model":
+		l.PushString(map[color.Space]string{
+			color.ColorRGB:       "rgb",
+			color.ColorCMYK:      "cmyk",
+			color.ColorGray:      "gray",
+			color.ColorSpotcolor: "spot",
+		}[col.Space])
+		return 1
+	case "name":
+		if col.Space == color.ColorSpotcolor {
+			l.PushString(col.Basecolor)
+			return 1
+		}
+	case "tint":
+		if col.Space == color.ColorSpotcolor {
+			tint := 1.0
+			if spec != nil {
+				tint = spec.tint
+			}
+			l.PushNumber(tint)
+			return 1
+		}
+	case "overprint":
+		l.PushBoolean(spec != nil && spec.overprint)
+		return 1
+	case "to_cmyk":
+		l.PushGoFunction(colorToCMYK)
+		return 1
+	case "to_rgb":
+		l.PushGoFunction(colorToRGB)
+		return 1
 	case "r", "red":
-		if c.Value.Space == color.ColorRGB || c.Value.Space == color.ColorNone {
-			l.PushNumber(c.Value.R)
+		if col.Space == color.ColorRGB || col.Space == color.ColorNone {
+			l.PushNumber(col.R)
 			return 1
 		}
 	case "g", "green":
-		if c.Value.Space == color.ColorRGB || c.Value.Space == color.ColorNone {
-			l.PushNumber(c.Value.G)
+		if col.Space == color.ColorRGB || col.Space == color.ColorNone {
+			l.PushNumber(col.G)
 			return 1
 		}
 	case "b", "blue":
-		if c.Value.Space == color.ColorRGB || c.Value.Space == color.ColorNone {
-			l.PushNumber(c.Value.B)
+		if col.Space == color.ColorRGB || col.Space == color.ColorNone {
+			l.PushNumber(col.B)
 			return 1
 		}
 	case "a", "alpha":
-		l.PushNumber(c.Value.A)
+		l.PushNumber(col.A)
 		return 1
 	case "c", "cyan":
-		if c.Value.Space == color.ColorCMYK {
-			l.PushNumber(c.Value.C)
+		if col.Space == color.ColorCMYK || col.Space == color.ColorSpotcolor {
+			l.PushNumber(cmykOf(col, spec)[0])
 			return 1
 		}
 	case "m", "magenta":
-		if c.Value.Space == color.ColorCMYK {
-			l.PushNumber(c.Value.M)
+		if col.Space == color.ColorCMYK || col.Space == color.ColorSpotcolor {
+			l.PushNumber(cmykOf(col, spec)[1])
 			return 1
 		}
 	case "y", "yellow":
-		if c.Value.Space == color.ColorCMYK {
-			l.PushNumber(c.Value.Y)
+		if col.Space == color.ColorCMYK || col.Space == color.ColorSpotcolor {
+			l.PushNumber(cmykOf(col, spec)[2])
 			return 1
 		}
 	case "k", "black":
-		if c.Value.Space == color.ColorCMYK {
-			l.PushNumber(c.Value.K)
+		if col.Space == color.ColorCMYK || col.Space == color.ColorSpotcolor {
+			l.PushNumber(cmykOf(col, spec)[3])
 			return 1
 		}
 	}
@@ -106,6 +269,15 @@ func colorIndex(l *lua.State) int {
 	return 0
 }
 
+// cmykOf returns the CMYK values of a color. For spot colors these are the
+// values of the alternate color at full strength.
+func cmykOf(col *color.Color, spec *colorSpec) [4]float64 {
+	if spec != nil && spec.process == nil {
+		return spec.cmyk
+	}
+	return [4]float64{col.C, col.M, col.Y, col.K}
+}
+
 // registerColorMetaTable creates the Color metatable
 func registerColorMetaTable(l *lua.State) {
 	lua.NewMetaTable(l, colorMetaTable)
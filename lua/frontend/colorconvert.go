@@ -0,0 +1,362 @@
+package frontend
+
+import (
+	"bytes"
+	"fmt"
+	"image/jpeg"
+	"log/slog"
+
+	"github.com/boxesandglue/boxesandglue/backend/color"
+	"github.com/speedata/glu/lua/common"
+	"github.com/speedata/go-lua"
+)
+
+// RGB colors are sRGB colors for the conversions, gray is converted to
+// black (K) and from RGB with equal components.
+
+// rgbToCMYK converts an sRGB color into the CMYK space of profile. Neutral
+// colors (black text for example) are converted to black only instead of a
+// mix of all four inks.
+func rgbToCMYK(profile *iccProfile, rgb [3]float64) []float64 {
+	if rgb[0] == rgb[1] && rgb[1] == rgb[2] {
+		return []float64{0, 0, 0, 1 - clamp01(rgb[0])}
+	}
+	return iccConvert(srgbProfile, profile, rgb[:])
+}
+
+// profile returns the parsed ICC profile.
+func (cp *ColorProfile) profile() (*iccProfile, error) {
+	if cp.icc == nil {
+		icc, err := parseICC(cp.data)
+		if err != nil {
+			return nil, err
+		}
+		cp.icc = icc
+	}
+	return cp.icc, nil
+}
+
+// pushConverted pushes col as a new color, overprint and opacity of the
+// original color are kept.
+func pushConverted(l *lua.State, col *color.Color, spec *colorSpec) int {
+	col.A = 1
+	c := &Color{Value: col}
+	if spec != nil && (spec.overprint || spec.alpha < 1) {
+		col.A = spec.alpha
+		c = newSpecColor(&colorSpec{process: col, overprint: spec.overprint, alpha: spec.alpha})
+	}
+	l.PushUserData(c)
+	lua.SetMetaTableNamed(l, colorMetaTable)
+	return 1
+}
+
+// colorToCMYK converts a color to CMYK: color:to_cmyk(profile)
+func colorToCMYK(l *lua.State) int {
+	c := checkColor(l, 1)
+	icc, err := checkColorProfile(l, 2).profile()
+	if err != nil {
+		lua.Errorf(l, "failed to convert color: %s", err.Error())
+		return 0
+	}
+	if icc.space != "CMYK" {
+		lua.Errorf(l, "to_cmyk needs a CMYK profile, the profile is %s", icc.space)
+		return 0
+	}
+	col, spec := c.Value, c.spec
+	if spec != nil && spec.process != nil {
+		col = spec.process
+	}
+	ret := &color.Color{Space: color.ColorCMYK, A: col.A}
+	switch col.Space {
+	case color.ColorRGB, color.ColorNone:
+		v := rgbToCMYK(icc, [3]float64{col.R, col.G, col.B})
+		ret.C, ret.M, ret.Y, ret.K = v[0], v[1], v[2], v[3]
+	case color.ColorGray:
+		ret.K = 1 - col.G
+	default:
+		// spot colors are converted to the tinted alternate color
+		ret.C, ret.M, ret.Y, ret.K = col.C, col.M, col.Y, col.K
+	}
+	return pushConverted(l, ret, spec)
+}
+
+// colorToRGB converts a color to RGB: color:to_rgb([profile]). The profile
+// is the CMYK profile of CMYK and spot colors.
+func colorToRGB(l *lua.State) int {
+	c := checkColor(l, 1)
+	col, spec := c.Value, c.spec
+	if spec != nil && spec.process != nil {
+		col = spec.process
+	}
+	ret := &color.Color{Space: color.ColorRGB, A: col.A}
+	switch col.Space {
+	case color.ColorRGB, color.ColorNone:
+		ret.R, ret.G, ret.B = col.R, col.G, col.B
+	case color.ColorGray:
+		ret.R, ret.G, ret.B = col.G, col.G, col.G
+	default:
+		if l.IsNoneOrNil(2) {
+			lua.Errorf(l, "to_rgb needs the CMYK profile to convert a %s color", map[color.Space]string{color.ColorCMYK: "CMYK", color.ColorSpotcolor: "spot"}[col.Space])
+			return 0
+		}
+		icc, err := checkColorProfile(l, 2).profile()
+		if err != nil {
+			lua.Errorf(l, "failed to convert color: %s", err.Error())
+			return 0
+		}
+		if icc.space != "CMYK" {
+			lua.Errorf(l, "to_rgb needs a CMYK profile, the profile is %s", icc.space)
+			return 0
+		}
+		v := iccConvert(icc, srgbProfile, []float64{col.C, col.M, col.Y, col.K})
+		ret.R, ret.G, ret.B = v[0], v[1], v[2]
+	}
+	return pushConverted(l, ret, spec)
+}
+
+// rgbConverter converts the RGB colors of a PDF file into the CMYK space of
+// the output intent.
+type rgbConverter struct {
+	f       *pdfFile
+	profile *iccProfile
+	colors  map[[3]float64][]float64
+	// pixels is the lookup table for images, created on first use
+	pixels *clut
+	done   map[pdfRef]bool
+}
+
+// convertRGBToCMYK converts the RGB colors in the page contents, in form
+// XObjects and the RGB images.
+func convertRGBToCMYK(f *pdfFile) error {
+	ref, ok := f.OutputProfile()
+	if !ok {
+		return fmt.Errorf("converting RGB colors needs an output intent (format PDF/X-3, PDF/X-4 or PDF/A-3b)")
+	}
+	data, ok := f.StreamData(f.Objects[int(ref)])
+	if !ok {
+		return fmt.Errorf("cannot read the output intent profile")
+	}
+	icc, err := parseICC(data)
+	if err != nil {
+		return err
+	}
+	if icc.space != "CMYK" {
+		return fmt.Errorf("the output intent profile is not a CMYK profile")
+	}
+	cv := &rgbConverter{
+		f:       f,
+		profile: icc,
+		colors:  make(map[[3]float64][]float64),
+		done:    make(map[pdfRef]bool),
+	}
+	for _, page := range f.Pages() {
+		cv.group(page)
+		for _, obj := range f.Contents(page) {
+			cv.stream(obj)
+		}
+		cv.resources(f.Dict(page["Resources"]))
+	}
+	return nil
+}
+
+func (cv *rgbConverter) convert(rgb [3]float64) []float64 {
+	if cmyk, ok := cv.colors[rgb]; ok {
+		return cmyk
+	}
+	cmyk := rgbToCMYK(cv.profile, rgb)
+	cv.colors[rgb] = cmyk
+	return cmyk
+}
+
+// group changes the color space of a transparency group.
+func (cv *rgbConverter) group(d pdfDict) {
+	if g := cv.f.Dict(d["Group"]); g != nil && g["CS"] == pdfName("DeviceRGB") {
+		g["CS"] = pdfName("DeviceCMYK")
+	}
+}
+
+func (cv *rgbConverter) resources(res pdfDict) {
+	for name, v := range cv.f.Dict(res["XObject"]) {
+		ref, ok := v.(pdfRef)
+		if !ok || cv.done[ref] || cv.f.Objects[int(ref)] == nil {
+			continue
+		}
+		cv.done[ref] = true
+		obj := cv.f.Objects[int(ref)]
+		d, _ := obj.Value.(pdfDict)
+		switch d["Subtype"] {
+		case pdfName("Form"):
+			cv.group(d)
+			cv.stream(obj)
+			cv.resources(cv.f.Dict(d["Resources"]))
+		case pdfName("Image"):
+			if err := cv.image(obj, d); err != nil {
+				slog.Warn("Image is not converted to CMYK", "name", name, "error", err.Error())
+			}
+		}
+	}
+}
+
+// stream replaces the rg and RG operators in a content stream.
+func (cv *rgbConverter) stream(obj *pdfObject) {
+	data, ok := cv.f.StreamData(obj)
+	if !ok || !bytes.Contains(data, []byte("rg")) && !bytes.Contains(data, []byte("RG")) {
+		return
+	}
+	lx := &pdfLexer{Data: data, NoRefs: true}
+	var out bytes.Buffer
+	copied, start := 0, -1
+	var operands []any
+	changed := false
+	for {
+		lx.SkipSpace()
+		if lx.EOF() {
+			break
+		}
+		pos := lx.Pos
+		v, err := lx.Value()
+		if err != nil {
+			return
+		}
+		if start < 0 {
+			start = pos
+		}
+		tok, ok := v.(pdfRaw)
+		if !ok || isPDFOperand(tok) {
+			operands = append(operands, v)
+			continue
+		}
+		switch tok {
+		case "ID":
+			// skip the inline image data
+			if end := bytes.Index(data[lx.Pos:], []byte("EI")); end >= 0 {
+				lx.Pos += end + 2
+			}
+		case "rg", "RG":
+			var rgb [3]float64
+			ok := len(operands) == 3
+			for i := 0; ok && i < 3; i++ {
+				rgb[i], ok = common.PDFFloat(operands[i])
+			}
+			if !ok {
+				break
+			}
+			cmyk := cv.convert(rgb)
+			op := "k"
+			if tok == "RG" {
+				op = "K"
+			}
+			out.Write(data[copied:start])
+			fmt.Fprintf(&out, "%s %s %s %s %s", common.PDFNumber(cmyk[0]), common.PDFNumber(cmyk[1]), common.PDFNumber(cmyk[2]), common.PDFNumber(cmyk[3]), op)
+			copied = lx.Pos
+			changed = true
+		}
+		operands = operands[:0]
+		start = -1
+	}
+	if changed {
+		out.Write(data[copied:])
+		cv.f.SetStream(obj, out.Bytes())
+	}
+}
+
+// pixel converts an RGB pixel with the lookup table of the images. Neutral
+// pixels are not converted to black only as in rgbToCMYK, that would change
+// the tones of a photo between gray and almost gray areas.
+func (cv *rgbConverter) pixel(r, g, b byte) []float64 {
+	if cv.pixels == nil {
+		const n = 33
+		cv.pixels = &clut{grid: []int{n, n, n}, out: 4, data: make([]float64, 0, n*n*n*4)}
+		for i := 0; i < n; i++ {
+			for j := 0; j < n; j++ {
+				for k := 0; k < n; k++ {
+					rgb := [3]float64{float64(i) / (n - 1), float64(j) / (n - 1), float64(k) / (n - 1)}
+					cv.pixels.data = append(cv.pixels.data, iccConvert(srgbProfile, cv.profile, rgb[:])...)
+				}
+			}
+		}
+	}
+	return cv.pixels.eval([]float64{float64(r) / 255, float64(g) / 255, float64(b) / 255})
+}
+
+// image converts an RGB image or an indexed image with an RGB palette.
+func (cv *rgbConverter) image(obj *pdfObject, d pdfDict) error {
+	switch cs := cv.f.Resolve(d["ColorSpace"]).(type) {
+	case pdfName:
+		if cs != "DeviceRGB" {
+			return nil
+		}
+	case pdfArray:
+		if len(cs) == 4 && cs[0] == pdfName("Indexed") && cs[1] == pdfName("DeviceRGB") {
+			return cv.palette(d, cs)
+		}
+		return nil
+	default:
+		return nil
+	}
+	if bpc, _ := common.PDFInt(d["BitsPerComponent"]); bpc != 8 {
+		return fmt.Errorf("%d bits per component are not supported", bpc)
+	}
+	var pixels []byte
+	if d["Filter"] == pdfName("DCTDecode") {
+		img, err := jpeg.Decode(bytes.NewReader(obj.Stream))
+		if err != nil {
+			return err
+		}
+		bounds := img.Bounds()
+		pixels = make([]byte, 0, bounds.Dx()*bounds.Dy()*3)
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				r, g, b, _ := img.At(x, y).RGBA()
+				pixels = append(pixels, byte(r>>8), byte(g>>8), byte(b>>8))
+			}
+		}
+	} else {
+		var ok bool
+		if pixels, ok = cv.f.StreamData(obj); !ok {
+			return fmt.Errorf("the image data cannot be decoded")
+		}
+	}
+	cache := make(map[[3]byte][4]byte)
+	cmyk := make([]byte, 0, len(pixels)/3*4)
+	for i := 0; i+2 < len(pixels); i += 3 {
+		key := [3]byte{pixels[i], pixels[i+1], pixels[i+2]}
+		px, ok := cache[key]
+		if !ok {
+			for j, v := range cv.pixel(key[0], key[1], key[2]) {
+				px[j] = byte(clamp01(v)*255 + 0.5)
+			}
+			cache[key] = px
+		}
+		cmyk = append(cmyk, px[:]...)
+	}
+	d["ColorSpace"] = pdfName("DeviceCMYK")
+	cv.f.SetStream(obj, cmyk)
+	return nil
+}
+
+// palette converts the RGB palette of an indexed image.
+func (cv *rgbConverter) palette(d pdfDict, cs pdfArray) error {
+	var lookup []byte
+	switch t := cs[3].(type) {
+	case pdfString:
+		lookup = []byte(t)
+	case pdfRef:
+		obj := cv.f.Objects[int(t)]
+		if obj == nil {
+			return fmt.Errorf("missing palette")
+		}
+		var ok bool
+		if lookup, ok = cv.f.StreamData(obj); !ok {
+			return fmt.Errorf("the palette cannot be decoded")
+		}
+	}
+	cmyk := make([]byte, 0, len(lookup)/3*4)
+	for i := 0; i+2 < len(lookup); i += 3 {
+		for _, v := range cv.pixel(lookup[i], lookup[i+1], lookup[i+2]) {
+			cmyk = append(cmyk, byte(clamp01(v)*255+0.5))
+		}
+	}
+	d["ColorSpace"] = pdfArray{pdfName("Indexed"), pdfName("DeviceCMYK"), cs[2], cv.f.AddStream(pdfDict{}, cmyk)}
+	return nil
+}
@@ -0,0 +1,1044 @@
+package frontend
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	pdf "github.com/boxesandglue/baseline-pdf"
+	"github.com/boxesandglue/boxesandglue/backend/color"
+	"github.com/boxesandglue/boxesandglue/backend/node"
+	"github.com/boxesandglue/textshape/ot"
+	"github.com/speedata/glu/lua/common"
+)
+
+// Color fonts (COLR/CPAL and SVG glyphs) are drawn with PDF path operators in
+// front of the glyph, which is then output with the invisible text rendering
+// mode. This keeps the text searchable and needs no page resources. Gradients
+// are drawn as narrow bands of solid color. Transparency is not supported:
+// colors that are less than half opaque are left out, the others are drawn
+// opaque.
+
+var (
+	tagCOLR = ot.MakeTag('C', 'O', 'L', 'R')
+	tagCPAL = ot.MakeTag('C', 'P', 'A', 'L')
+	tagSVG  = ot.MakeTag('S', 'V', 'G', ' ')
+)
+
+const (
+	// foregroundIndex is the palette index that stands for the text color.
+	foregroundIndex = 0xFFFF
+	// maxPaintDepth limits the nesting of paint tables and SVG elements.
+	maxPaintDepth = 64
+	// gradientSteps is the number of color bands between the first and the
+	// last color stop of a gradient.
+	gradientSteps = 64
+	// maxGradientBands limits the number of bands of a gradient.
+	maxGradientBands = 1024
+	// minAlpha is the opacity from which colors are drawn.
+	minAlpha = 0.5
+)
+
+const (
+	extendPad = iota
+	extendRepeat
+	extendReflect
+)
+
+// composite modes of COLRv1
+const (
+	compositeClear    = 0
+	compositeSrc      = 1
+	compositeSrcOver  = 3
+	compositeDestOver = 4
+)
+
+// fontData is a font table with big endian readers. Reading outside of the
+// table returns 0, so broken tables cannot cause a panic.
+type fontData []byte
+
+func (d fontData) u8(off int) int {
+	if off < 0 || off >= len(d) {
+		return 0
+	}
+	return int(d[off])
+}
+
+func (d fontData) u16(off int) int {
+	if off < 0 || off+2 > len(d) {
+		return 0
+	}
+	return int(binary.BigEndian.Uint16(d[off:]))
+}
+
+func (d fontData) i16(off int) int {
+	return int(int16(d.u16(off)))
+}
+
+func (d fontData) u24(off int) int {
+	return d.u8(off)<<16 | d.u16(off+1)
+}
+
+func (d fontData) u32(off int) int {
+	if off < 0 || off+4 > len(d) {
+		return 0
+	}
+	return int(binary.BigEndian.Uint32(d[off:]))
+}
+
+func (d fontData) f2dot14(off int) float64 {
+	return float64(d.i16(off)) / 16384
+}
+
+func (d fontData) fixed(off int) float64 {
+	return float64(int32(d.u32(off))) / 65536
+}
+
+// rgba is a color with components from 0 to 1.
+type rgba struct {
+	r, g, b, a float64
+}
+
+func (c rgba) mix(other rgba, f float64) rgba {
+	return rgba{
+		r: c.r + (other.r-c.r)*f,
+		g: c.g + (other.g-c.g)*f,
+		b: c.b + (other.b-c.b)*f,
+		a: c.a + (other.a-c.a)*f,
+	}
+}
+
+// pdfFill returns the PDF instruction for the fill color.
+func (c rgba) pdfFill() string {
+	return fmt.Sprintf("%s %s %s rg", pdf.FloatToPoint(c.r), pdf.FloatToPoint(c.g), pdf.FloatToPoint(c.b))
+}
+
+// pdfStroke returns the PDF instruction for the stroke color.
+func (c rgba) pdfStroke() string {
+	return fmt.Sprintf("%s %s %s RG", pdf.FloatToPoint(c.r), pdf.FloatToPoint(c.g), pdf.FloatToPoint(c.b))
+}
+
+// colorToRGBA converts a document color to RGB. It is used for gradients that
+// contain the text color.
+func colorToRGBA(col *color.Color) rgba {
+	if col == nil {
+		return rgba{a: 1}
+	}
+	switch col.Space {
+	case color.ColorRGB:
+		return rgba{r: col.R, g: col.G, b: col.B, a: 1}
+	case color.ColorGray:
+		return rgba{r: col.G, g: col.G, b: col.G, a: 1}
+	case color.ColorCMYK, color.ColorSpotcolor:
+		return rgba{r: (1 - col.C) * (1 - col.K), g: (1 - col.M) * (1 - col.K), b: (1 - col.Y) * (1 - col.K), a: 1}
+	}
+	return rgba{a: 1}
+}
+
+// matrix is a transformation matrix in PDF order (a b c d e f).
+type matrix [6]float64
+
+var identity = matrix{1, 0, 0, 1, 0, 0}
+
+// mul returns the transformation that applies m first and then n.
+func (m matrix) mul(n matrix) matrix {
+	return matrix{
+		m[0]*n[0] + m[1]*n[2], m[0]*n[1] + m[1]*n[3],
+		m[2]*n[0] + m[3]*n[2], m[2]*n[1] + m[3]*n[3],
+		m[4]*n[0] + m[5]*n[2] + n[4], m[4]*n[1] + m[5]*n[3] + n[5],
+	}
+}
+
+func (m matrix) apply(x, y float64) (float64, float64) {
+	return x*m[0] + y*m[2] + m[4], x*m[1] + y*m[3] + m[5]
+}
+
+func (m matrix) invert() (matrix, bool) {
+	det := m[0]*m[3] - m[1]*m[2]
+	if det == 0 || math.IsNaN(det) {
+		return identity, false
+	}
+	return matrix{
+		m[3] / det, -m[1] / det,
+		-m[2] / det, m[0] / det,
+		(m[2]*m[5] - m[3]*m[4]) / det, (m[1]*m[4] - m[0]*m[5]) / det,
+	}, true
+}
+
+func (m matrix) String() string {
+	s := make([]string, 6)
+	for i, v := range m {
+		s[i] = common.PDFNumber(v)
+	}
+	return strings.Join(s, " ") + " cm"
+}
+
+func translation(x, y float64) matrix {
+	return matrix{1, 0, 0, 1, x, y}
+}
+
+// around returns m applied with (x, y) as the origin.
+func around(m matrix, x, y float64) matrix {
+	return translation(-x, -y).mul(m).mul(translation(x, y))
+}
+
+// bbox is a rectangle, empty if min > max.
+type bbox struct {
+	minX, minY, maxX, maxY float64
+}
+
+var emptyBBox = bbox{math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)}
+
+func (b bbox) empty() bool {
+	return b.minX > b.maxX || b.minY > b.maxY
+}
+
+func (b *bbox) add(x, y float64) {
+	b.minX, b.maxX = min(b.minX, x), max(b.maxX, x)
+	b.minY, b.maxY = min(b.minY, y), max(b.maxY, y)
+}
+
+func (b bbox) intersect(other bbox) bbox {
+	return bbox{max(b.minX, other.minX), max(b.minY, other.minY), min(b.maxX, other.maxX), min(b.maxY, other.maxY)}
+}
+
+func (b bbox) corners() [4][2]float64 {
+	return [4][2]float64{{b.minX, b.minY}, {b.maxX, b.minY}, {b.maxX, b.maxY}, {b.minX, b.maxY}}
+}
+
+func (b bbox) transform(m matrix) bbox {
+	ret := emptyBBox
+	for _, c := range b.corners() {
+		ret.add(m.apply(c[0], c[1]))
+	}
+	return ret
+}
+
+// glyphPath is the outline of a glyph as PDF path instructions in font units.
+type glyphPath struct {
+	ops string
+	box bbox
+}
+
+// colrClip is a clip box for a range of COLRv1 base glyphs.
+type colrClip struct {
+	first, last int
+	box         bbox
+}
+
+// colorFont holds the color glyph tables of a face.
+type colorFont struct {
+	face     *pdf.Face
+	palettes [][]rgba
+	colr     fontData
+	// baseGlyphs maps a COLRv0 base glyph to its first layer record and the
+	// number of layers.
+	baseGlyphs   map[int][2]int
+	layerRecords int
+	// paints maps a COLRv1 base glyph to the offset of its paint table.
+	paints    map[int]int
+	layerList []int
+	clips     []colrClip
+	svg       *svgGlyphs
+	paths     map[int]*glyphPath
+	drawings  map[colorGlyphKey]string
+}
+
+type colorGlyphKey struct {
+	gid     int
+	palette int
+	fg      rgba
+}
+
+// newColorFont reads the color tables of face. getColor resolves the color
+// names in SVG glyphs. It returns nil if the face has no color glyphs.
+func newColorFont(face *pdf.Face, getColor func(string) *color.Color) *colorFont {
+	fnt := face.Shaper.Font()
+	cf := &colorFont{
+		face:       face,
+		baseGlyphs: make(map[int][2]int),
+		paints:     make(map[int]int),
+		paths:      make(map[int]*glyphPath),
+		drawings:   make(map[colorGlyphKey]string),
+	}
+	if data, err := fnt.TableData(tagCPAL); err == nil {
+		cf.palettes = parseCPAL(fontData(data))
+	}
+	if data, err := fnt.TableData(tagCOLR); err == nil && len(data) >= 14 {
+		cf.parseCOLR(fontData(data))
+	}
+	if data, err := fnt.TableData(tagSVG); err == nil {
+		cf.svg = parseSVGTable(fontData(data), getColor)
+	}
+	if len(cf.baseGlyphs) == 0 && len(cf.paints) == 0 && cf.svg == nil {
+		return nil
+	}
+	return cf
+}
+
+// parseCPAL returns the color palettes of the CPAL table or nil if the table
+// is too short for its palettes.
+func parseCPAL(d fontData) [][]rgba {
+	if len(d) < 12 {
+		return nil
+	}
+	numEntries := d.u16(2)
+	numPalettes := d.u16(4)
+	records := d.u32(8)
+	if 12+2*numPalettes > len(d) {
+		return nil
+	}
+	palettes := make([][]rgba, 0, numPalettes)
+	for i := range numPalettes {
+		first := d.u16(12 + 2*i)
+		if records+4*(first+numEntries) > len(d) {
+			return nil
+		}
+		pal := make([]rgba, numEntries)
+		for j := range pal {
+			o := records + 4*(first+j)
+			pal[j] = rgba{
+				r: float64(d.u8(o+2)) / 255,
+				g: float64(d.u8(o+1)) / 255,
+				b: float64(d.u8(o)) / 255,
+				a: float64(d.u8(o+3)) / 255,
+			}
+		}
+		palettes = append(palettes, pal)
+	}
+	return palettes
+}
+
+func (cf *colorFont) parseCOLR(d fontData) {
+	cf.colr = d
+	numBaseGlyphs := d.u16(2)
+	baseRecords := d.u32(4)
+	cf.layerRecords = d.u32(8)
+	for i := range numBaseGlyphs {
+		o := baseRecords + 6*i
+		if d.u16(o+4) > 0 {
+			cf.baseGlyphs[d.u16(o)] = [2]int{d.u16(o + 2), d.u16(o + 4)}
+		}
+	}
+	if d.u16(0) < 1 || len(d) < 34 {
+		return
+	}
+	if baseGlyphList := d.u32(14); baseGlyphList > 0 {
+		n := d.u32(baseGlyphList)
+		for i := 0; i < n && baseGlyphList+4+6*i < len(d); i++ {
+			o := baseGlyphList + 4 + 6*i
+			cf.paints[d.u16(o)] = baseGlyphList + d.u32(o+2)
+		}
+	}
+	if layerList := d.u32(18); layerList > 0 {
+		n := d.u32(layerList)
+		for i := 0; i < n && layerList+4+4*i < len(d); i++ {
+			cf.layerList = append(cf.layerList, layerList+d.u32(layerList+4+4*i))
+		}
+	}
+	if clipList := d.u32(22); clipList > 0 {
+		n := d.u32(clipList + 1)
+		for i := 0; i < n && clipList+5+7*i < len(d); i++ {
+			o := clipList + 5 + 7*i
+			box := clipList + d.u24(o+4)
+			cf.clips = append(cf.clips, colrClip{
+				first: d.u16(o),
+				last:  d.u16(o + 2),
+				box:   bbox{float64(d.i16(box + 1)), float64(d.i16(box + 3)), float64(d.i16(box + 5)), float64(d.i16(box + 7))},
+			})
+		}
+	}
+}
+
+// hasColorGlyph returns true if the glyph has a color representation.
+func (cf *colorFont) hasColorGlyph(gid int) bool {
+	if _, ok := cf.paints[gid]; ok {
+		return true
+	}
+	if _, ok := cf.baseGlyphs[gid]; ok {
+		return true
+	}
+	return cf.svg != nil && cf.svg.has(gid)
+}
+
+// draw returns the PDF instructions for the color glyph in font units with
+// the origin on the base line. Palette index 0xFFFF uses the current fill
+// color, gradients use fg for it. It returns the empty string if gid has no
+// color glyph.
+func (cf *colorFont) draw(gid int, palette int, fg rgba) string {
+	key := colorGlyphKey{gid: gid, palette: palette, fg: fg}
+	if s, ok := cf.drawings[key]; ok {
+		return s
+	}
+	p := &colorPainter{cf: cf, fg: fg, ctm: identity, active: make(map[int]bool)}
+	if palette >= 0 && palette < len(cf.palettes) {
+		p.palette = cf.palettes[palette]
+	} else if len(cf.palettes) > 0 {
+		p.palette = cf.palettes[0]
+	}
+	xMin, yMin, xMax, yMax := cf.face.OTFace().BBox()
+	p.clip = bbox{float64(xMin), float64(yMin), float64(xMax), float64(yMax)}
+	if paint, ok := cf.paints[gid]; ok {
+		for _, c := range cf.clips {
+			if gid >= c.first && gid <= c.last {
+				p.clip = c.box
+				fmt.Fprintf(&p.out, "%s %s %s %s re W n\n", pdf.FloatToPoint(c.box.minX), pdf.FloatToPoint(c.box.minY), pdf.FloatToPoint(c.box.maxX-c.box.minX), pdf.FloatToPoint(c.box.maxY-c.box.minY))
+				break
+			}
+		}
+		p.active[gid] = true
+		p.paint(paint)
+	} else if layers, ok := cf.baseGlyphs[gid]; ok {
+		for i := range layers[1] {
+			o := cf.layerRecords + 4*(layers[0]+i)
+			if path := cf.path(cf.colr.u16(o)); path != nil {
+				p.fillPath(path.ops, cf.colr.u16(o+2), 1)
+			}
+		}
+	} else if cf.svg != nil {
+		cf.svg.draw(p, gid)
+	}
+	cf.drawings[key] = p.out.String()
+	return cf.drawings[key]
+}
+
+// path returns the outline of the glyph or nil if the glyph is empty.
+func (cf *colorFont) path(gid int) *glyphPath {
+	if gp, ok := cf.paths[gid]; ok {
+		return gp
+	}
+	var gp *glyphPath
+	if outline, ok := cf.face.OTFace().GlyphOutline(ot.GlyphID(gid)); ok && len(outline.Segments) > 0 {
+		gp = &glyphPath{box: emptyBBox}
+		var b strings.Builder
+		var curX, curY float64
+		pt := func(p ot.OutlinePoint) (float64, float64) {
+			gp.box.add(float64(p.X), float64(p.Y))
+			return float64(p.X), float64(p.Y)
+		}
+		for _, seg := range outline.Segments {
+			switch seg.Op {
+			case ot.SegmentMoveTo:
+				curX, curY = pt(seg.Args[0])
+				writePoints(&b, "m", curX, curY)
+			case ot.SegmentLineTo:
+				curX, curY = pt(seg.Args[0])
+				writePoints(&b, "l", curX, curY)
+			case ot.SegmentQuadTo:
+				cx, cy := pt(seg.Args[0])
+				x, y := pt(seg.Args[1])
+				writePoints(&b, "c", curX+2*(cx-curX)/3, curY+2*(cy-curY)/3, x+2*(cx-x)/3, y+2*(cy-y)/3, x, y)
+				curX, curY = x, y
+			case ot.SegmentCubeTo:
+				x1, y1 := pt(seg.Args[0])
+				x2, y2 := pt(seg.Args[1])
+				curX, curY = pt(seg.Args[2])
+				writePoints(&b, "c", x1, y1, x2, y2, curX, curY)
+			}
+		}
+		gp.ops = b.String()
+	}
+	cf.paths[gid] = gp
+	return gp
+}
+
+// writePoints writes the coordinates followed by the path operator.
+func writePoints(b *strings.Builder, op string, coords ...float64) {
+	for _, c := range coords {
+		b.WriteString(pdf.FloatToPoint(c))
+		b.WriteByte(' ')
+	}
+	b.WriteString(op)
+	b.WriteByte('\n')
+}
+
+// polygon returns the PDF path for the closed polygon.
+func polygon(points ...[2]float64) string {
+	var b strings.Builder
+	for i, pt := range points {
+		op := "l"
+		if i == 0 {
+			op = "m"
+		}
+		writePoints(&b, op, pt[0], pt[1])
+	}
+	b.WriteString("h\n")
+	return b.String()
+}
+
+// ellipsePath returns the PDF path for an ellipse drawn with four Bézier
+// curves.
+func ellipsePath(cx, cy, rx, ry float64) string {
+	const k = 0.5522847498
+	var b strings.Builder
+	writePoints(&b, "m", cx+rx, cy)
+	writePoints(&b, "c", cx+rx, cy+k*ry, cx+k*rx, cy+ry, cx, cy+ry)
+	writePoints(&b, "c", cx-k*rx, cy+ry, cx-rx, cy+k*ry, cx-rx, cy)
+	writePoints(&b, "c", cx-rx, cy-k*ry, cx-k*rx, cy-ry, cx, cy-ry)
+	writePoints(&b, "c", cx+k*rx, cy-ry, cx+rx, cy-k*ry, cx+rx, cy)
+	b.WriteString("h\n")
+	return b.String()
+}
+
+// colorPainter creates the PDF instructions for a color glyph.
+type colorPainter struct {
+	cf      *colorFont
+	palette []rgba
+	fg      rgba
+	out     strings.Builder
+	// ctm transforms the current paint coordinates to glyph coordinates.
+	ctm matrix
+	// clip is the current clip region in glyph coordinates.
+	clip   bbox
+	depth  int
+	active map[int]bool
+}
+
+// color returns the palette color with the alpha value applied. ok is false
+// for the text color.
+func (p *colorPainter) color(idx int, alpha float64) (c rgba, ok bool) {
+	if idx == foregroundIndex || idx >= len(p.palette) {
+		c = p.fg
+	} else {
+		c, ok = p.palette[idx], true
+	}
+	c.a *= alpha
+	return c, ok
+}
+
+// fillPath fills the path with a palette color.
+func (p *colorPainter) fillPath(ops string, idx int, alpha float64) {
+	c, ok := p.color(idx, alpha)
+	if c.a < minAlpha {
+		return
+	}
+	if ok {
+		fmt.Fprintf(&p.out, "q %s\n%sf Q\n", c.pdfFill(), ops)
+	} else {
+		// keep the text color from the graphics state
+		fmt.Fprintf(&p.out, "%sf\n", ops)
+	}
+}
+
+// region returns the corners of the clip region in paint coordinates.
+func (p *colorPainter) region() ([4][2]float64, bool) {
+	var ret [4][2]float64
+	inv, ok := p.ctm.invert()
+	if !ok || p.clip.empty() {
+		return ret, false
+	}
+	for i, c := range p.clip.corners() {
+		ret[i][0], ret[i][1] = inv.apply(c[0], c[1])
+	}
+	return ret, true
+}
+
+// transformed calls fn with the transformation applied.
+func (p *colorPainter) transformed(m matrix, fn func()) {
+	saved := p.ctm
+	p.ctm = m.mul(p.ctm)
+	fmt.Fprintf(&p.out, "q %s\n", m)
+	fn()
+	p.out.WriteString("Q\n")
+	p.ctm = saved
+}
+
+// transform paints the child table with the transformation.
+func (p *colorPainter) transform(m matrix, child int) {
+	p.transformed(m, func() { p.paint(child) })
+}
+
+// paint draws the COLRv1 paint table at offset off of the COLR table. The
+// variable paint formats are drawn with their default values.
+func (p *colorPainter) paint(off int) {
+	if p.depth >= maxPaintDepth {
+		return
+	}
+	p.depth++
+	defer func() { p.depth-- }()
+	d := p.cf.colr
+	format := d.u8(off)
+	switch format {
+	case 1: // PaintColrLayers
+		n, first := d.u8(off+1), d.u32(off+2)
+		for i := first; i < first+n && i < len(p.cf.layerList); i++ {
+			p.paint(p.cf.layerList[i])
+		}
+	case 2, 3: // PaintSolid
+		if r, ok := p.region(); ok {
+			p.fillPath(polygon(r[:]...), d.u16(off+1), d.f2dot14(off+3))
+		}
+	case 4, 5: // PaintLinearGradient
+		cl := p.colorLine(off+d.u24(off+1), format == 5)
+		p.linearGradient(cl, float64(d.i16(off+4)), float64(d.i16(off+6)), float64(d.i16(off+8)), float64(d.i16(off+10)), float64(d.i16(off+12)), float64(d.i16(off+14)))
+	case 6, 7: // PaintRadialGradient
+		cl := p.colorLine(off+d.u24(off+1), format == 7)
+		p.radialGradient(cl, float64(d.i16(off+4)), float64(d.i16(off+6)), float64(d.u16(off+8)), float64(d.i16(off+10)), float64(d.i16(off+12)), float64(d.u16(off+14)))
+	case 8, 9: // PaintSweepGradient
+		cl := p.colorLine(off+d.u24(off+1), format == 9)
+		p.sweepGradient(cl, float64(d.i16(off+4)), float64(d.i16(off+6)), d.f2dot14(off+8)*180, d.f2dot14(off+10)*180)
+	case 10: // PaintGlyph
+		path := p.cf.path(d.u16(off + 4))
+		if path == nil {
+			return
+		}
+		saved := p.clip
+		p.clip = p.clip.intersect(path.box.transform(p.ctm))
+		fmt.Fprintf(&p.out, "q\n%sW n\n", path.ops)
+		p.paint(off + d.u24(off+1))
+		p.out.WriteString("Q\n")
+		p.clip = saved
+	case 11: // PaintColrGlyph
+		gid := d.u16(off + 1)
+		if paint, ok := p.cf.paints[gid]; ok && !p.active[gid] {
+			p.active[gid] = true
+			p.paint(paint)
+			delete(p.active, gid)
+		}
+	case 12, 13: // PaintTransform
+		t := off + d.u24(off+4)
+		m := matrix{d.fixed(t), d.fixed(t + 4), d.fixed(t + 8), d.fixed(t + 12), d.fixed(t + 16), d.fixed(t + 20)}
+		p.transform(m, off+d.u24(off+1))
+	case 14, 15: // PaintTranslate
+		p.transform(translation(float64(d.i16(off+4)), float64(d.i16(off+6))), off+d.u24(off+1))
+	case 16, 17: // PaintScale
+		p.transform(matrix{d.f2dot14(off + 4), 0, 0, d.f2dot14(off + 6), 0, 0}, off+d.u24(off+1))
+	case 18, 19: // PaintScaleAroundCenter
+		m := matrix{d.f2dot14(off + 4), 0, 0, d.f2dot14(off + 6), 0, 0}
+		p.transform(around(m, float64(d.i16(off+8)), float64(d.i16(off+10))), off+d.u24(off+1))
+	case 20, 21: // PaintScaleUniform
+		s := d.f2dot14(off + 4)
+		p.transform(matrix{s, 0, 0, s, 0, 0}, off+d.u24(off+1))
+	case 22, 23: // PaintScaleUniformAroundCenter
+		s := d.f2dot14(off + 4)
+		p.transform(around(matrix{s, 0, 0, s, 0, 0}, float64(d.i16(off+6)), float64(d.i16(off+8))), off+d.u24(off+1))
+	case 24, 25: // PaintRotate
+		p.transform(rotation(d.f2dot14(off+4)), off+d.u24(off+1))
+	case 26, 27: // PaintRotateAroundCenter
+		p.transform(around(rotation(d.f2dot14(off+4)), float64(d.i16(off+6)), float64(d.i16(off+8))), off+d.u24(off+1))
+	case 28, 29: // PaintSkew
+		p.transform(skew(d.f2dot14(off+4), d.f2dot14(off+6)), off+d.u24(off+1))
+	case 30, 31: // PaintSkewAroundCenter
+		p.transform(around(skew(d.f2dot14(off+4), d.f2dot14(off+6)), float64(d.i16(off+8)), float64(d.i16(off+10))), off+d.u24(off+1))
+	case 32: // PaintComposite
+		src, backdrop := off+d.u24(off+1), off+d.u24(off+5)
+		switch d.u8(off + 4) {
+		case compositeClear:
+		case compositeSrc:
+			p.paint(src)
+		case compositeSrcOver:
+			p.paint(backdrop)
+			p.paint(src)
+		case compositeDestOver:
+			p.paint(src)
+			p.paint(backdrop)
+		default:
+			// The other modes need transparency or blending. The source is
+			// usually a shading effect, so the backdrop alone comes closest.
+			p.paint(backdrop)
+		}
+	}
+}
+
+// rotation returns a rotation matrix, angle is in multiples of 180°.
+func rotation(angle float64) matrix {
+	s, c := math.Sincos(angle * math.Pi)
+	return matrix{c, s, -s, c, 0, 0}
+}
+
+// skew returns a skew matrix, the angles are in multiples of 180°.
+func skew(x, y float64) matrix {
+	return matrix{1, math.Tan(y * math.Pi), -math.Tan(x * math.Pi), 1, 0, 0}
+}
+
+type colorStop struct {
+	offset float64
+	color  rgba
+}
+
+// colorLine holds the color stops of a gradient.
+type colorLine struct {
+	extend int
+	stops  []colorStop
+}
+
+// colorLine reads a (variable) color line table.
+func (p *colorPainter) colorLine(off int, variable bool) colorLine {
+	d := p.cf.colr
+	cl := colorLine{extend: d.u8(off)}
+	size := 6
+	if variable {
+		size = 10
+	}
+	for i := range d.u16(off + 1) {
+		o := off + 3 + i*size
+		c, _ := p.color(d.u16(o+2), d.f2dot14(o+4))
+		cl.stops = append(cl.stops, colorStop{offset: d.f2dot14(o), color: c})
+	}
+	sort.SliceStable(cl.stops, func(a, b int) bool { return cl.stops[a].offset < cl.stops[b].offset })
+	return cl
+}
+
+// at returns the color at position t of the color line.
+func (cl colorLine) at(t float64) rgba {
+	first, last := cl.stops[0], cl.stops[len(cl.stops)-1]
+	if span := last.offset - first.offset; span > 0 {
+		switch cl.extend {
+		case extendRepeat:
+			t = first.offset + floorMod(t-first.offset, span)
+		case extendReflect:
+			u := floorMod(t-first.offset, 2*span)
+			if u > span {
+				u = 2*span - u
+			}
+			t = first.offset + u
+		}
+	}
+	if t <= first.offset {
+		return first.color
+	}
+	for i := 1; i < len(cl.stops); i++ {
+		a, b := cl.stops[i-1], cl.stops[i]
+		if t <= b.offset {
+			if b.offset == a.offset {
+				return b.color
+			}
+			return a.color.mix(b.color, (t-a.offset)/(b.offset-a.offset))
+		}
+	}
+	return last.color
+}
+
+func floorMod(a, b float64) float64 {
+	return a - b*math.Floor(a/b)
+}
+
+// colorBand is a range of the color line drawn with one color.
+type colorBand struct {
+	t0, t1 float64
+	color  rgba
+}
+
+// bands splits the range from tmin to tmax into bands of solid color.
+// Adjacent bands with the same color are merged.
+func (cl colorLine) bands(tmin, tmax float64) []colorBand {
+	if len(cl.stops) == 0 || !(tmax > tmin) {
+		return nil
+	}
+	first, last := cl.stops[0].offset, cl.stops[len(cl.stops)-1].offset
+	step := (last - first) / gradientSteps
+	if step <= 0 {
+		step = (tmax - tmin) / gradientSteps
+	}
+	step = max(step, (tmax-tmin)/maxGradientBands)
+	var ret []colorBand
+	var prev string
+	for t := first + math.Floor((tmin-first)/step)*step; t < tmax; t += step {
+		t0, t1 := max(t, tmin), min(t+step, tmax)
+		c := cl.at((t0 + t1) / 2)
+		if pdfColor := c.pdfFill(); len(ret) > 0 && pdfColor == prev {
+			ret[len(ret)-1].t1 = t1
+		} else {
+			ret = append(ret, colorBand{t0: t0, t1: t1, color: c})
+			prev = pdfColor
+		}
+	}
+	return ret
+}
+
+// fillBand fills the path with the color of the band.
+func (p *colorPainter) fillBand(ops string, c rgba) {
+	if c.a < minAlpha {
+		return
+	}
+	fmt.Fprintf(&p.out, "%s\n%sf\n", c.pdfFill(), ops)
+}
+
+// linearGradient draws a linear gradient from p0 to p1, p2 sets the rotation
+// of the color bands.
+func (p *colorPainter) linearGradient(cl colorLine, x0, y0, x1, y1, x2, y2 float64) {
+	r, ok := p.region()
+	if !ok || len(cl.stops) == 0 {
+		return
+	}
+	// project p1 onto the line through p0 perpendicular to p0p2
+	dx, dy := x1-x0, y1-y0
+	if nx, ny := x2-x0, y2-y0; nx != 0 || ny != 0 {
+		k := (dx*ny - dy*nx) / (nx*nx + ny*ny)
+		dx, dy = k*ny, -k*nx
+	}
+	l2 := dx*dx + dy*dy
+	if l2 == 0 {
+		return
+	}
+	tmin, tmax, smin, smax := math.Inf(1), math.Inf(-1), math.Inf(1), math.Inf(-1)
+	for _, c := range r {
+		t := ((c[0]-x0)*dx + (c[1]-y0)*dy) / l2
+		s := (-(c[0]-x0)*dy + (c[1]-y0)*dx) / l2
+		tmin, tmax = min(tmin, t), max(tmax, t)
+		smin, smax = min(smin, s), max(smax, s)
+	}
+	at := func(t, s float64) [2]float64 {
+		return [2]float64{x0 + t*dx - s*dy, y0 + t*dy + s*dx}
+	}
+	p.out.WriteString("q\n")
+	bands := cl.bands(tmin, tmax)
+	overlap := (tmax - tmin) / 1000
+	for i, b := range bands {
+		t1 := b.t1
+		if i < len(bands)-1 {
+			// avoid hairline gaps between the bands
+			t1 += overlap
+		}
+		p.fillBand(polygon(at(b.t0, smin), at(t1, smin), at(t1, smax), at(b.t0, smax)), b.color)
+	}
+	p.out.WriteString("Q\n")
+}
+
+// radialGradient draws a gradient between two circles. The circles are drawn
+// from the largest to the smallest.
+func (p *colorPainter) radialGradient(cl colorLine, x0, y0, r0, x1, y1, r1 float64) {
+	r, ok := p.region()
+	if !ok || len(cl.stops) == 0 {
+		return
+	}
+	dr := r1 - r0
+	circle := func(t float64) (float64, float64, float64) {
+		return x0 + t*(x1-x0), y0 + t*(y1-y0), r0 + t*dr
+	}
+	// covers reports whether the circle at t contains the corners of the
+	// region which get inside the circles at all when t grows in direction
+	// dir. Corners outside of the cone of the circles are never covered.
+	covers := func(t, dir float64) bool {
+		cx, cy, cr := circle(t)
+		for _, c := range r {
+			dx, dy := c[0]-x0, c[1]-y0
+			a := (x1-x0)*(x1-x0) + (y1-y0)*(y1-y0) - dr*dr
+			b := -2 * (dx*(x1-x0) + dy*(y1-y0) + r0*dr)
+			if a > 0 || a == 0 && b*dir >= 0 {
+				continue
+			}
+			if math.Hypot(c[0]-cx, c[1]-cy) > cr {
+				return false
+			}
+		}
+		return true
+	}
+	first, last := cl.stops[0].offset, cl.stops[len(cl.stops)-1].offset
+	span := max(last-first, 1)
+	tmin, tmax := first, last
+	switch {
+	case dr > 0:
+		tmin = -r0 / dr
+		if cl.extend == extendPad {
+			tmin = max(tmin, min(first, 0))
+		}
+		for i := 0; i < 40 && !covers(tmax, 1); i++ {
+			tmax += span
+			span *= 2
+		}
+	case dr < 0:
+		tmax = -r0 / dr
+		if cl.extend == extendPad {
+			tmax = min(tmax, max(last, 1))
+		}
+		for i := 0; i < 40 && !covers(tmin, -1); i++ {
+			tmin -= span
+			span *= 2
+		}
+	}
+	bands := cl.bands(tmin, tmax)
+	p.out.WriteString("q\n")
+	for i := range bands {
+		b := bands[i]
+		t := (b.t0 + b.t1) / 2
+		switch {
+		case dr > 0:
+			b = bands[len(bands)-1-i]
+			t = b.t1
+		case dr < 0:
+			t = b.t0
+		}
+		if cx, cy, cr := circle(t); cr > 0 {
+			p.fillBand(ellipsePath(cx, cy, cr, cr), b.color)
+		}
+	}
+	p.out.WriteString("Q\n")
+}
+
+// sweepGradient draws a gradient around the center, the angles are in degrees
+// counter-clockwise.
+func (p *colorPainter) sweepGradient(cl colorLine, cx, cy, start, end float64) {
+	r, ok := p.region()
+	if !ok || len(cl.stops) == 0 || start == end {
+		return
+	}
+	radius := 1.0
+	for _, c := range r {
+		radius = max(radius, 1.1*math.Hypot(c[0]-cx, c[1]-cy))
+	}
+	const step = 1.0
+	type wedge struct {
+		a0, a1 float64
+		color  rgba
+	}
+	var wedges []wedge
+	var prev string
+	for a := 0.0; a < 360; a += step {
+		c := cl.at((a + step/2 - start) / (end - start))
+		if pdfColor := c.pdfFill(); len(wedges) > 0 && pdfColor == prev {
+			wedges[len(wedges)-1].a1 = a + step
+		} else {
+			wedges = append(wedges, wedge{a0: a, a1: a + step, color: c})
+			prev = pdfColor
+		}
+	}
+	p.out.WriteString("q\n")
+	for i, w := range wedges {
+		a1 := w.a1
+		if i < len(wedges)-1 {
+			a1 += step / 4
+		}
+		points := [][2]float64{{cx, cy}}
+		n := int(math.Ceil((a1 - w.a0) / 10))
+		for j := 0; j <= n; j++ {
+			s, c := math.Sincos((w.a0 + (a1-w.a0)*float64(j)/float64(n)) * math.Pi / 180)
+			points = append(points, [2]float64{cx + radius*c, cy + radius*s})
+		}
+		p.fillBand(polygon(points...), w.color)
+	}
+	p.out.WriteString("Q\n")
+}
+
+// attrColorGlyphs marks the nodes that start and end a run of text in a color
+// font with a palette or a text color.
+const attrColorGlyphs = "glu-colorglyphs"
+
+// colorGlyphMarker is stored in the attributes of the invisible rules around a
+// run of text in a color font.
+type colorGlyphMarker struct {
+	start   bool
+	palette int
+	fg      rgba
+}
+
+// colorGlyphNodes returns the invisible rules that start and end a run with
+// the palette and text color.
+func colorGlyphNodes(palette int, fg rgba) (node.Node, node.Node) {
+	start := node.NewRule()
+	start.Hide = true
+	start.Attributes = node.H{attrColorGlyphs: &colorGlyphMarker{start: true, palette: palette, fg: fg}}
+	stop := node.NewRule()
+	stop.Hide = true
+	stop.Attributes = node.H{attrColorGlyphs: &colorGlyphMarker{palette: palette, fg: fg}}
+	return start, stop
+}
+
+func colorGlyphMarkerOf(n node.Node) (*colorGlyphMarker, bool) {
+	if val, ok := node.GetAttribute(n, attrColorGlyphs); ok {
+		m, ok := val.(*colorGlyphMarker)
+		return m, ok
+	}
+	return nil, false
+}
+
+// colorFont returns the color glyph tables of face or nil if the face has no
+// color glyphs.
+func (d *Document) colorFont(face *pdf.Face) *colorFont {
+	if cf, ok := d.colorFonts[face]; ok {
+		return cf
+	}
+	cf := newColorFont(face, func(s string) *color.Color { return d.processColor(d.color(s)) })
+	d.colorFonts[face] = cf
+	return cf
+}
+
+// colorGlyphState is the state of the post line break callback for color
+// glyphs.
+type colorGlyphState struct {
+	runs []*colorGlyphMarker
+	// bold is the number of open synthetic bold styles, which use a different
+	// text rendering mode.
+	bold int
+	// invisible is true if the text rendering mode is set to invisible.
+	invisible bool
+}
+
+// restore returns the invisible rule that switches back to the visible text
+// rendering mode.
+func (st *colorGlyphState) restore() node.Node {
+	r := node.NewRule()
+	r.Hide = true
+	r.Pre = "0 Tr"
+	if st.bold > 0 {
+		r.Pre = "2 Tr"
+	}
+	st.invisible = false
+	return r
+}
+
+// postLinebreakColor inserts the drawings of the color glyphs before the
+// glyphs.
+func (d *Document) postLinebreakColor(vl *node.VList) *node.VList {
+	vl.List = d.colorGlyphs(vl.List, &colorGlyphState{})
+	return vl
+}
+
+func (d *Document) colorGlyphs(head node.Node, st *colorGlyphState) node.Node {
+	var tail node.Node
+	for n := head; n != nil; n = n.Next() {
+		tail = n
+		switch t := n.(type) {
+		case *node.HList:
+			t.List = d.colorGlyphs(t.List, st)
+		case *node.VList:
+			t.List = d.colorGlyphs(t.List, st)
+		case *node.Rule, *node.StartStop:
+			if m, ok := colorGlyphMarkerOf(n); ok {
+				if m.start {
+					st.runs = append(st.runs, m)
+				} else if len(st.runs) > 0 {
+					st.runs = st.runs[:len(st.runs)-1]
+				}
+			} else if m, ok := syntheticMarkerOf(n); ok && m.bold {
+				// the marker sets the text rendering mode
+				if m.start {
+					st.bold++
+				} else {
+					st.bold--
+				}
+				st.invisible = false
+			}
+		case *node.Glyph:
+			var drawing string
+			if t.Font != nil && t.Font.Face != nil {
+				if cf := d.colorFont(t.Font.Face); cf != nil && cf.hasColorGlyph(t.Codepoint) {
+					palette, fg := 0, rgba{a: 1}
+					if len(st.runs) > 0 {
+						palette, fg = st.runs[len(st.runs)-1].palette, st.runs[len(st.runs)-1].fg
+					}
+					drawing = cf.draw(t.Codepoint, palette, fg)
+				}
+			}
+			if drawing == "" {
+				if st.invisible {
+					head = node.InsertBefore(head, n, st.restore())
+				}
+				continue
+			}
+			face := t.Font.Face
+			scale := common.PDFNumber(t.Font.Size.ToPT() * face.Scale / float64(face.UnitsPerEM))
+			r := node.NewRule()
+			r.Hide = true
+			r.Pre = fmt.Sprintf("q %s 0 0 %s %s %s cm\n%sQ 3 Tr", scale, scale, pdf.FloatToPoint(t.XOffset.ToPT()), pdf.FloatToPoint(t.YOffset.ToPT()), drawing)
+			head = node.InsertBefore(head, n, r)
+			st.invisible = true
+		}
+	}
+	if st.invisible && tail != nil {
+		node.InsertAfter(head, tail, st.restore())
+	}
+	return head
+}
@@ -10,6 +10,9 @@ const colorProfileMetaTable = "ColorProfile"
 // ColorProfile wraps the document.ColorProfile type
 type ColorProfile struct {
 	Value *document.ColorProfile
+	// data is the ICC profile, icc the parsed profile for color conversions
+	data []byte
+	icc  *iccProfile
 }
 
 // checkColorProfile retrieves a ColorProfile userdata from the stack
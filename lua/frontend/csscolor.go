@@ -0,0 +1,294 @@
+package frontend
+
+import (
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/boxesandglue/boxesandglue/backend/color"
+)
+
+// parseCSSColor parses the CSS Color 4 syntax: hex colors (#rgb, #rgba,
+// #rrggbb, #rrggbbaa), the functions rgb(), rgba(), hsl(), hsla(), hwb(),
+// lab(), lch(), oklab(), oklch() and color(), the keyword transparent and
+// device-cmyk() from CSS Color 5. Named colors are not handled here. The
+// colors are sRGB colors (CMYK for device-cmyk()) with the alpha value in A,
+// colors outside of sRGB are clipped.
+func parseCSSColor(s string) (*color.Color, bool) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "transparent" {
+		return &color.Color{Space: color.ColorRGB}, true
+	}
+	if strings.HasPrefix(s, "#") {
+		return parseHexColor(s[1:])
+	}
+	open := strings.IndexByte(s, '(')
+	if open < 0 || !strings.HasSuffix(s, ")") {
+		return nil, false
+	}
+	args, alpha, ok := cssColorArguments(s[open+1 : len(s)-1])
+	if !ok {
+		return nil, false
+	}
+	col := &color.Color{Space: color.ColorRGB, A: alpha}
+	var rgb [3]float64
+	switch fn := s[:open]; fn {
+	case "rgb", "rgba":
+		if len(args) != 3 {
+			return nil, false
+		}
+		for i, a := range args {
+			if rgb[i], ok = cssNumber(a, 255); !ok {
+				return nil, false
+			}
+			rgb[i] /= 255
+		}
+	case "hsl", "hsla", "hwb":
+		if len(args) != 3 {
+			return nil, false
+		}
+		h, ok1 := cssHue(args[0])
+		a, ok2 := cssNumber(args[1], 100)
+		b, ok3 := cssNumber(args[2], 100)
+		if !ok1 || !ok2 || !ok3 {
+			return nil, false
+		}
+		if fn == "hwb" {
+			rgb = hwbToRGB(h, a/100, b/100)
+		} else {
+			rgb = hslToRGB(h, a/100, b/100)
+		}
+	case "lab", "oklab", "lch", "oklch":
+		if len(args) != 3 {
+			return nil, false
+		}
+		// the reference values for percentages
+		lightness, chroma := 100.0, 125.0
+		if fn == "lch" {
+			chroma = 150
+		} else if strings.HasPrefix(fn, "ok") {
+			lightness, chroma = 1, 0.4
+		}
+		l, ok1 := cssNumber(args[0], lightness)
+		a, ok2 := cssNumber(args[1], chroma)
+		var b float64
+		var ok3 bool
+		if strings.HasSuffix(fn, "lch") {
+			// a is the chroma
+			var h float64
+			h, ok3 = cssHue(args[2])
+			a, b = a*math.Cos(h*math.Pi/180), a*math.Sin(h*math.Pi/180)
+		} else {
+			b, ok3 = cssNumber(args[2], chroma)
+		}
+		if !ok1 || !ok2 || !ok3 {
+			return nil, false
+		}
+		if strings.HasPrefix(fn, "ok") {
+			rgb = oklabToRGB(l, a, b)
+		} else {
+			v := srgbProfile.fromLab([3]float64{l, a, b})
+			copy(rgb[:], v)
+		}
+	case "color":
+		if len(args) != 4 {
+			return nil, false
+		}
+		var v [3]float64
+		for i, a := range args[1:] {
+			if v[i], ok = cssNumber(a, 1); !ok {
+				return nil, false
+			}
+		}
+		if rgb, ok = predefinedSpaceToRGB(args[0], v); !ok {
+			return nil, false
+		}
+	case "device-cmyk":
+		if len(args) != 4 {
+			return nil, false
+		}
+		col.Space = color.ColorCMYK
+		var cmyk [4]float64
+		for i, a := range args {
+			if cmyk[i], ok = cssNumber(a, 1); !ok {
+				return nil, false
+			}
+			cmyk[i] = clamp01(cmyk[i])
+		}
+		col.C, col.M, col.Y, col.K = cmyk[0], cmyk[1], cmyk[2], cmyk[3]
+		return col, true
+	default:
+		return nil, false
+	}
+	col.R, col.G, col.B = clamp01(rgb[0]), clamp01(rgb[1]), clamp01(rgb[2])
+	return col, true
+}
+
+func parseHexColor(hex string) (*color.Color, bool) {
+	if len(hex) == 3 || len(hex) == 4 {
+		var b strings.Builder
+		for _, c := range hex {
+			b.WriteRune(c)
+			b.WriteRune(c)
+		}
+		hex = b.String()
+	}
+	if len(hex) != 6 && len(hex) != 8 {
+		return nil, false
+	}
+	v := make([]float64, 4)
+	v[3] = 255
+	for i := 0; i < len(hex)/2; i++ {
+		n, err := strconv.ParseUint(hex[2*i:2*i+2], 16, 8)
+		if err != nil {
+			return nil, false
+		}
+		v[i] = float64(n)
+	}
+	return &color.Color{Space: color.ColorRGB, R: v[0] / 255, G: v[1] / 255, B: v[2] / 255, A: v[3] / 255}, true
+}
+
+// cssColorArguments splits the arguments of a color function. Commas (legacy
+// syntax) and spaces separate the arguments, the alpha value follows a slash
+// or is the fourth argument of the legacy syntax.
+func cssColorArguments(s string) ([]string, float64, bool) {
+	alpha := 1.0
+	var alphaArg string
+	if i := strings.IndexByte(s, '/'); i >= 0 {
+		s, alphaArg = s[:i], strings.TrimSpace(s[i+1:])
+	}
+	args := strings.Fields(strings.ReplaceAll(s, ",", " "))
+	if alphaArg == "" && strings.Contains(s, ",") && len(args) == 4 {
+		args, alphaArg = args[:3], args[3]
+	}
+	if alphaArg != "" {
+		a, ok := cssNumber(alphaArg, 1)
+		if !ok {
+			return nil, 0, false
+		}
+		alpha = clamp01(a)
+	}
+	return args, alpha, true
+}
+
+// cssNumber parses a number or a percentage of ref. The keyword none is 0.
+func cssNumber(s string, ref float64) (float64, bool) {
+	if s == "none" {
+		return 0, true
+	}
+	if strings.HasSuffix(s, "%") {
+		f, err := strconv.ParseFloat(s[:len(s)-1], 64)
+		return f / 100 * ref, err == nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	return f, err == nil
+}
+
+// cssHue parses an angle and returns degrees.
+func cssHue(s string) (float64, bool) {
+	factor := 1.0
+	for _, unit := range []struct {
+		suffix string
+		factor float64
+	}{{"grad", 0.9}, {"deg", 1}, {"rad", 180 / math.Pi}, {"turn", 360}} {
+		if strings.HasSuffix(s, unit.suffix) {
+			s, factor = strings.TrimSuffix(s, unit.suffix), unit.factor
+			break
+		}
+	}
+	f, ok := cssNumber(s, 1)
+	return f * factor, ok
+}
+
+func hslToRGB(h, s, l float64) [3]float64 {
+	h = math.Mod(math.Mod(h, 360)+360, 360)
+	s, l = clamp01(s), clamp01(l)
+	f := func(n float64) float64 {
+		k := math.Mod(n+h/30, 12)
+		a := s * math.Min(l, 1-l)
+		return l - a*math.Max(-1, math.Min(math.Min(k-3, 9-k), 1))
+	}
+	return [3]float64{f(0), f(8), f(4)}
+}
+
+func hwbToRGB(h, w, b float64) [3]float64 {
+	w, b = clamp01(w), clamp01(b)
+	if w+b >= 1 {
+		gray := w / (w + b)
+		return [3]float64{gray, gray, gray}
+	}
+	rgb := hslToRGB(h, 1, 0.5)
+	for i := range rgb {
+		rgb[i] = rgb[i]*(1-w-b) + w
+	}
+	return rgb
+}
+
+// srgbEncode applies the sRGB transfer function to a linear value.
+func srgbEncode(v float64) float64 {
+	v = clamp01(v)
+	if v <= 0.0031308 {
+		return 12.92 * v
+	}
+	return 1.055*math.Pow(v, 1/2.4) - 0.055
+}
+
+// srgbDecode returns the linear value of an sRGB value.
+func srgbDecode(v float64) float64 {
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func oklabToRGB(l, a, b float64) [3]float64 {
+	l1 := math.Pow(l+0.3963377774*a+0.2158037573*b, 3)
+	m1 := math.Pow(l-0.1055613458*a-0.0638541728*b, 3)
+	s1 := math.Pow(l-0.0894841775*a-1.2914855480*b, 3)
+	return [3]float64{
+		srgbEncode(4.0767416621*l1 - 3.3077115913*m1 + 0.2309699292*s1),
+		srgbEncode(-1.2684380046*l1 + 2.6097574011*m1 - 0.3413193965*s1),
+		srgbEncode(-0.0041960863*l1 - 0.7034186147*m1 + 1.7076147010*s1),
+	}
+}
+
+// linearToRGB converts linear values of another RGB space (or XYZ D65) with
+// the matrix m into sRGB.
+func linearToRGB(m [3][3]float64, v [3]float64) [3]float64 {
+	var rgb [3]float64
+	for i := range rgb {
+		rgb[i] = srgbEncode(m[i][0]*v[0] + m[i][1]*v[1] + m[i][2]*v[2])
+	}
+	return rgb
+}
+
+// predefinedSpaceToRGB converts a color of the color() function into sRGB.
+func predefinedSpaceToRGB(space string, v [3]float64) ([3]float64, bool) {
+	switch space {
+	case "srgb":
+		return v, true
+	case "srgb-linear":
+		return [3]float64{srgbEncode(v[0]), srgbEncode(v[1]), srgbEncode(v[2])}, true
+	case "display-p3":
+		var lin [3]float64
+		for i := range lin {
+			lin[i] = srgbDecode(v[i])
+		}
+		return linearToRGB([3][3]float64{
+			{1.2249401, -0.2249404, 0},
+			{-0.0420569, 1.0420571, 0},
+			{-0.0196376, -0.0786361, 1.0982735},
+		}, lin), true
+	case "xyz", "xyz-d65":
+		return linearToRGB([3][3]float64{
+			{3.2409699, -1.5373832, -0.4986108},
+			{-0.9692436, 1.8759675, 0.0415551},
+			{0.0556301, -0.2039770, 1.0569715},
+		}, v), true
+	case "xyz-d50":
+		var rgb [3]float64
+		copy(rgb[:], srgbProfile.fromLab(xyzToLab(v)))
+		return rgb, true
+	}
+	return v, false
+}
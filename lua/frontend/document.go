@@ -2,10 +2,14 @@ package frontend
 
 import (
 	"os"
-	"path/filepath"
+	"time"
 
+	pdf "github.com/boxesandglue/baseline-pdf"
+	"github.com/boxesandglue/boxesandglue/backend/bag"
+	"github.com/boxesandglue/boxesandglue/backend/color"
 	"github.com/boxesandglue/boxesandglue/backend/document"
 	"github.com/boxesandglue/boxesandglue/frontend"
+	"github.com/speedata/glu/lua/common"
 	"github.com/speedata/go-lua"
 )
 
@@ -14,6 +18,82 @@ const documentMetaTable = "Document"
 // Document wraps the boxesandglue frontend.Document type
 type Document struct {
 	Value *frontend.Document
+	// fallbacks are the document wide fallback font families
+	fallbacks []*frontend.FontFamily
+	// familyFallbacks are the fallback font families set with ff:set_fallbacks()
+	familyFallbacks map[*frontend.FontFamily][]*frontend.FontFamily
+	// sourceVariations are the variable font axis values of the font sources
+	sourceVariations map[*frontend.FontSource]map[string]float64
+	// weightRanges are the weight ranges of variable font sources
+	weightRanges map[*frontend.FontSource]weightRange
+	// synthesis are the settings for synthesized bold and italic per family
+	synthesis map[*frontend.FontFamily]synthesis
+	// synthesized are the synthesized styles that have been reported
+	synthesized map[synthesizedKey]bool
+	// colorFonts caches the color glyph tables per face (nil for faces
+	// without color glyphs)
+	colorFonts map[*pdf.Face]*colorFont
+	// filename is the name of the PDF file, the library writes to out and
+	// glu rewrites the file when the document is finished if needed
+	filename string
+	out      *os.File
+	// convertRGB converts the RGB colors to the CMYK space of the output
+	// intent when the document is finished
+	convertRGB bool
+	// namedColors are the colors defined by glu and the colors parsed from
+	// CSS values and predefined color names
+	namedColors map[string]*color.Color
+	// colorSpecs are the glu colors of the document by SpotcolorID and
+	// specColors the colors by description
+	colorSpecs map[int]*colorSpec
+	specColors map[*colorSpec]*color.Color
+	// pageLayout is the default page layout of new pages
+	pageLayout pageLayout
+	// shipped are the layouts of the shipped pages in page order
+	shipped []shippedPage
+	// pages is the number of pages created with doc:new_page()
+	pages int
+	// pageLabels are the page numbering ranges, sorted by start page
+	pageLabels []pageLabelRange
+	// xobjects are the Form XObjects, they are rendered when the document
+	// is finished
+	xobjects []*formXObject
+	// watermark is drawn on each page, nil for no watermark
+	watermark *watermark
+	// layers are the optional content groups
+	layers []*Layer
+	// tagged turns on the structure tree, PDF/UA documents are always
+	// tagged
+	tagged bool
+	// structElems are the structure elements by marker number
+	structElems []*structElem
+	// attachments are the attached files by name
+	attachments map[string]*attachment
+	// invoice is the embedded electronic invoice or nil
+	invoice *invoice
+	// xmpSchemas are the XMP properties of xmp_set and the invoice
+	xmpSchemas []*xmpSchema
+	// info are the custom entries of the document information dictionary
+	info map[string]string
+	// producer replaces the producer of the library if not empty
+	producer string
+	// modDate is the modification date, the library writes none
+	modDate time.Time
+	// lang is the language tag of the document
+	lang string
+	// strictConformance aborts the output if the preflight finds
+	// violations of the format
+	strictConformance bool
+	// encryption are the options of doc:encrypt or nil
+	encryption *common.Encryption
+	// signer signs the document at doc:finish() or nil
+	signer *signer
+	// hasSignatureField is true if a page has a signature field
+	hasSignatureField bool
+	// fields are the form fields of doc:new_field
+	fields []*formField
+	// flattenForms draws all fields into the pages
+	flattenForms bool
 }
 
 // checkDocument retrieves a Document userdata from the stack
@@ -30,13 +110,48 @@ func checkDocument(l *lua.State, index int) *Document {
 func documentNew(l *lua.State) int {
 	filename := lua.CheckString(l, 1)
 
-	doc, err := frontend.New(filename)
+	out, err := os.Create(filename)
 	if err != nil {
 		lua.Errorf(l, "failed to create document: %s", err.Error())
 		return 0
 	}
+	doc, err := frontend.NewForWriter(out)
+	if err != nil {
+		out.Close()
+		lua.Errorf(l, "failed to create document: %s", err.Error())
+		return 0
+	}
+	doc.Doc.Filename = filename
+	d := &Document{
+		Value:            doc,
+		filename:         filename,
+		out:              out,
+		familyFallbacks:  make(map[*frontend.FontFamily][]*frontend.FontFamily),
+		sourceVariations: make(map[*frontend.FontSource]map[string]float64),
+		weightRanges:     make(map[*frontend.FontSource]weightRange),
+		synthesis:        make(map[*frontend.FontFamily]synthesis),
+		synthesized:      make(map[synthesizedKey]bool),
+		colorFonts:       make(map[*pdf.Face]*colorFont),
+		namedColors:      make(map[string]*color.Color),
+		colorSpecs:       make(map[int]*colorSpec),
+		specColors:       make(map[*colorSpec]*color.Color),
+		pageLayout:       defaultPageLayout,
+
+		attachments: make(map[string]*attachment),
+		info:        make(map[string]string),
+	}
+	// postLinebreakSynthetic must run before postLinebreakColor: it restarts
+	// the synthetic styles on each line, and postLinebreakColor follows the
+	// synthetic bold markers to restore the fill and stroke rendering mode
+	// after a color glyph.
+	for _, fn := range []frontend.PostLinebreakCallbackFunc{postLinebreakSynthetic, d.postLinebreakColor} {
+		if err = doc.RegisterCallback(frontend.CallbackPostLinebreak, fn); err != nil {
+			lua.Errorf(l, "failed to create document: %s", err.Error())
+			return 0
+		}
+	}
 
-	l.PushUserData(&Document{Value: doc})
+	l.PushUserData(d)
 	lua.SetMetaTableNamed(l, documentMetaTable)
 	return 1
 }
@@ -44,13 +159,128 @@ func documentNew(l *lua.State) int {
 // documentFinish finalizes the document: doc:finish()
 func documentFinish(l *lua.State) int {
 	d := checkDocument(l, 1)
-	if err := d.Value.Finish(); err != nil {
+	if err := d.finish(); err != nil {
 		lua.Errorf(l, "failed to finish document: %s", err.Error())
 		return 0
 	}
 	return 0
 }
 
+// finish writes the PDF file. The PDF written by the library is read back and
+// changed afterwards where glu adds to the PDF output.
+func (d *Document) finish() error {
+	if err := d.checkEncryption(); err != nil {
+		return err
+	}
+	if d.invoice != nil {
+		if err := d.checkInvoiceFormat(); err != nil {
+			return err
+		}
+	}
+	d.Value.Doc.AdditionalXMLMetadata += d.xmpMetadata()
+	d.renderFormXObjects()
+	if err := d.Value.Finish(); err != nil {
+		d.out.Close()
+		return err
+	}
+	if err := d.out.Close(); err != nil {
+		return err
+	}
+	if !d.needsRewrite() {
+		return nil
+	}
+	data, err := os.ReadFile(d.filename)
+	if err != nil {
+		return err
+	}
+	if data, err = d.rewrite(data); err != nil {
+		return err
+	}
+	return os.WriteFile(d.filename, data, 0644)
+}
+
+// needsRewrite reports whether glu has to change the PDF written by the
+// library. The conditions are in the order of the steps in rewrite.
+func (d *Document) needsRewrite() bool {
+	return len(d.colorSpecs) > 0 ||
+		d.convertRGB ||
+		len(d.xobjects) > 0 ||
+		d.needsPageBoxes() ||
+		d.isTagged() || len(d.structElems) > 0 ||
+		len(d.pageLabels) > 0 ||
+		len(d.layers) > 0 ||
+		len(d.attachments) > 0 ||
+		d.needsMetadata() ||
+		len(d.fields) > 0 ||
+		d.signer != nil || d.hasSignatureField ||
+		d.Value.Doc.Format != document.FormatPDF ||
+		d.encryption != nil
+}
+
+// rewrite reads the PDF written by the library, adds what glu writes itself
+// and returns the new PDF.
+func (d *Document) rewrite(data []byte) ([]byte, error) {
+	f, err := common.ReadPDF(data)
+	if err != nil {
+		return nil, err
+	}
+	if err = d.writeColorSpecs(f); err != nil {
+		return nil, err
+	}
+	// after the color specs, these can be RGB colors with overprint
+	if d.convertRGB {
+		if err = convertRGBToCMYK(f); err != nil {
+			return nil, err
+		}
+	}
+	if err = d.writeFormXObjects(f); err != nil {
+		return nil, err
+	}
+	if err = d.writePageBoxes(f); err != nil {
+		return nil, err
+	}
+	// after the page boxes, the printer's marks are artifacts
+	if err = d.writeStructure(f); err != nil {
+		return nil, err
+	}
+	d.writePageLabels(f)
+	d.writeLayers(f)
+	if err = d.writeAttachments(f); err != nil {
+		return nil, err
+	}
+	if err = d.writeMetadata(f); err != nil {
+		return nil, err
+	}
+	if len(d.fields) > 0 {
+		if err = d.writeForms(f); err != nil {
+			return nil, err
+		}
+	}
+	if d.signer != nil || d.hasSignatureField {
+		if err = d.writeSignature(f); err != nil {
+			return nil, err
+		}
+	}
+	// after the forms, the attachments and the signature, their
+	// annotations are added to the structure tree
+	if d.isTagged() {
+		d.writeAnnotationStructure(f)
+	}
+	if d.Value.Doc.Format != document.FormatPDF {
+		if err = d.preflight(f); err != nil {
+			return nil, err
+		}
+	}
+	if d.encryption != nil {
+		f.Encrypt(d.encryption)
+	}
+	data = f.Bytes()
+	if d.signer != nil {
+		return d.signer.sign(data)
+	}
+	return data, nil
+}
+
 // documentNewFontFamily creates a new font family: doc:new_font_family(name)
 func documentNewFontFamily(l *lua.State) int {
 	d := checkDocument(l, 1)
@@ -58,7 +288,7 @@ func documentNewFontFamily(l *lua.State) int {
 
 	ff := d.Value.NewFontFamily(name)
 
-	l.PushUserData(&FontFamily{Value: ff, doc: d.Value})
+	l.PushUserData(&FontFamily{Value: ff, doc: d})
 	lua.SetMetaTableNamed(l, fontFamilyMetaTable)
 	return 1
 }
@@ -74,7 +304,7 @@ func documentFindFontFamily(l *lua.State) int {
 		return 1
 	}
 
-	l.PushUserData(&FontFamily{Value: ff, doc: d.Value})
+	l.PushUserData(&FontFamily{Value: ff, doc: d})
 	lua.SetMetaTableNamed(l, fontFamilyMetaTable)
 	return 1
 }
@@ -84,7 +314,7 @@ func documentLoadFace(l *lua.State) int {
 	d := checkDocument(l, 1)
 	fs := checkFontSource(l, 2)
 
-	face, err := d.Value.LoadFace(fs.Value)
+	face, err := d.Value.LoadFaceWithVariations(fs.Value, fs.variations)
 	if err != nil {
 		lua.Errorf(l, "failed to load face: %s", err.Error())
 		return 0
@@ -112,11 +342,15 @@ func documentFormatParagraph(l *lua.State) int {
 
 	// Collect options if provided
 	var opts []frontend.TypesettingOption
+	var family *frontend.FontFamily
+	var size bag.ScaledPoint
 	if l.Top() >= 4 && l.IsTable(4) {
 		opts = tableToTypesettingOptions(l, 4, d.Value)
+		family = optionsFontFamily(l, 4)
+		size = optionsFontSize(l, 4)
 	}
 
-	vlist, info, err := d.Value.FormatParagraph(te.Value, hsize, opts...)
+	vlist, info, err := d.Value.FormatParagraph(d.prepareText(te.Value, family, size), hsize, opts...)
 	if err != nil {
 		lua.Errorf(l, "format paragraph failed: %s", err.Error())
 		return 0
@@ -141,11 +375,14 @@ func documentBuildTable(l *lua.State) int {
 	d := checkDocument(l, 1)
 	tbl := checkTable(l, 2)
 
-	vlists, err := d.Value.BuildTable(tbl.Value)
+	vlists, err := d.Value.BuildTable(d.prepareTable(tbl.Value))
 	if err != nil {
 		lua.Errorf(l, "build table failed: %s", err.Error())
 		return 0
 	}
+	if d.isTagged() {
+		tagTable(tbl, vlists)
+	}
 
 	// Return array of vlists
 	l.NewTable()
@@ -164,7 +401,7 @@ func documentDefineColor(l *lua.State) int {
 	name := lua.CheckString(l, 2)
 	col := checkColor(l, 3)
 
-	d.Value.DefineColor(name, col.Value)
+	d.defineColor(name, d.colorValue(col))
 	return 0
 }
 
@@ -173,13 +410,13 @@ func documentGetColor(l *lua.State) int {
 	d := checkDocument(l, 1)
 	spec := lua.CheckString(l, 2)
 
-	col := d.Value.GetColor(spec)
+	col := d.color(spec)
 	if col == nil {
 		l.PushNil()
 		return 1
 	}
 
-	l.PushUserData(&Color{Value: col})
+	l.PushUserData(&Color{Value: col, spec: d.colorSpecOf(col)})
 	lua.SetMetaTableNamed(l, colorMetaTable)
 	return 1
 }
@@ -199,13 +436,21 @@ func documentGetLanguage(l *lua.State) int {
 	return 1
 }
 
+// documentSetFallbacks sets the document wide fallback font families: doc:set_fallbacks({ff1, ff2, ...})
+func documentSetFallbacks(l *lua.State) int {
+	d := checkDocument(l, 1)
+	d.fallbacks = checkFontFamilies(l, 2)
+	return 0
+}
+
 // documentNewPage creates a new page: doc:new_page()
 func documentNewPage(l *lua.State) int {
 	d := checkDocument(l, 1)
 
 	page := d.Value.Doc.NewPage()
+	d.pages++
 
-	l.PushUserData(&Page{Value: page})
+	l.PushUserData(&Page{Value: page, doc: d, layout: d.pageLayout, number: d.pages})
 	lua.SetMetaTableNamed(l, pageMetaTable)
 	return 1
 }
@@ -220,8 +465,13 @@ func documentLoadColorprofile(l *lua.State) int {
 		lua.Errorf(l, "failed to load color profile: %s", err.Error())
 		return 0
 	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		lua.Errorf(l, "failed to load color profile: %s", err.Error())
+		return 0
+	}
 
-	l.PushUserData(&ColorProfile{Value: cp})
+	l.PushUserData(&ColorProfile{Value: cp, data: data})
 	lua.SetMetaTableNamed(l, colorProfileMetaTable)
 	return 1
 }
@@ -258,63 +508,6 @@ func documentCreateImageNode(l *lua.State) int {
 	return 1
 }
 
-// documentAttachFile attaches a file to the document: doc:attach_file(options)
-// options: { filename = "path/to/file", name = "visible name", description = "desc", mimetype = "text/xml" }
-func documentAttachFile(l *lua.State) int {
-	d := checkDocument(l, 1)
-	lua.CheckType(l, 2, lua.TypeTable)
-
-	// Get filename (required)
-	l.Field(2, "filename")
-	if l.IsNil(-1) {
-		lua.Errorf(l, "attach_file: filename is required")
-		return 0
-	}
-	filename := lua.CheckString(l, -1)
-	l.Pop(1)
-
-	// Read file data
-	data, err := os.ReadFile(filename)
-	if err != nil {
-		lua.Errorf(l, "attach_file: failed to read file: %s", err.Error())
-		return 0
-	}
-
-	// Get name (optional, defaults to base filename)
-	l.Field(2, "name")
-	name := filepath.Base(filename)
-	if !l.IsNil(-1) {
-		name = lua.CheckString(l, -1)
-	}
-	l.Pop(1)
-
-	// Get description (optional)
-	l.Field(2, "description")
-	description := ""
-	if !l.IsNil(-1) {
-		description = lua.CheckString(l, -1)
-	}
-	l.Pop(1)
-
-	// Get mimetype (optional)
-	l.Field(2, "mimetype")
-	mimetype := "application/octet-stream"
-	if !l.IsNil(-1) {
-		mimetype = lua.CheckString(l, -1)
-	}
-	l.Pop(1)
-
-	attachment := document.Attachment{
-		Name:        name,
-		Description: description,
-		MimeType:    mimetype,
-		Data:        data,
-	}
-
-	d.Value.Doc.AttachFile(attachment)
-	return 0
-}
-
 // documentIndex handles attribute access (__index metamethod)
 func documentIndex(l *lua.State) int {
 	d := checkDocument(l, 1)
@@ -356,6 +549,43 @@ func documentIndex(l *lua.State) int {
 	case "additional_xml_metadata":
 		l.PushString(d.Value.Doc.AdditionalXMLMetadata)
 		return 1
+	case "producer":
+		l.PushString(d.producer)
+		return 1
+	case "strict_conformance":
+		l.PushBoolean(d.strictConformance)
+		return 1
+	case "flatten_forms":
+		l.PushBoolean(d.flattenForms)
+		return 1
+	case "creation_date":
+		l.PushString(d.Value.Doc.CreationDate.Format(time.RFC3339))
+		return 1
+	case "mod_date":
+		if d.modDate.IsZero() {
+			return 0
+		}
+		l.PushString(d.modDate.Format(time.RFC3339))
+		return 1
+	case "language":
+		l.PushString(d.lang)
+		return 1
+	case "convert_rgb_to_cmyk":
+		l.PushBoolean(d.convertRGB)
+		return 1
+	case "bleed", "trim", "art", "crop_marks", "registration_marks", "color_bars":
+		d.pageLayout.index(l, key)
+		return 1
+	case "watermark":
+		if d.watermark == nil {
+			l.PushNil()
+		} else {
+			l.PushString(d.watermark.text)
+		}
+		return 1
+	case "tagged":
+		l.PushBoolean(d.isTagged())
+		return 1
 	// Methods
 	case "finish":
 		l.PushGoFunction(documentFinish)
@@ -369,6 +599,9 @@ func documentIndex(l *lua.State) int {
 	case "load_face":
 		l.PushGoFunction(documentLoadFace)
 		return 1
+	case "find_system_font":
+		l.PushGoFunction(documentFindSystemFont)
+		return 1
 	case "create_text":
 		l.PushGoFunction(documentCreateText)
 		return 1
@@ -384,18 +617,54 @@ func documentIndex(l *lua.State) int {
 	case "get_color":
 		l.PushGoFunction(documentGetColor)
 		return 1
+	case "load_palette":
+		l.PushGoFunction(documentLoadPalette)
+		return 1
 	case "get_language":
 		l.PushGoFunction(documentGetLanguage)
 		return 1
+	case "set_fallbacks":
+		l.PushGoFunction(documentSetFallbacks)
+		return 1
 	case "new_page":
 		l.PushGoFunction(documentNewPage)
 		return 1
+	case "set_page_labels":
+		l.PushGoFunction(documentSetPageLabels)
+		return 1
+	case "page_label":
+		l.PushGoFunction(documentPageLabel)
+		return 1
 	case "attach_file":
 		l.PushGoFunction(documentAttachFile)
 		return 1
+	case "attach_invoice_xml":
+		l.PushGoFunction(documentAttachInvoiceXML)
+		return 1
+	case "encrypt":
+		l.PushGoFunction(documentEncrypt)
+		return 1
+	case "new_field":
+		l.PushGoFunction(documentNewField)
+		return 1
+	case "sign":
+		l.PushGoFunction(documentSign)
+		return 1
+	case "xmp_set":
+		l.PushGoFunction(documentXMPSet)
+		return 1
+	case "info_set":
+		l.PushGoFunction(documentInfoSet)
+		return 1
 	case "load_imagefile":
 		l.PushGoFunction(documentLoadImagefile)
 		return 1
+	case "new_layer":
+		l.PushGoFunction(documentNewLayer)
+		return 1
+	case "create_xobject":
+		l.PushGoFunction(documentCreateXObject)
+		return 1
 	case "create_image_node":
 		l.PushGoFunction(documentCreateImageNode)
 		return 1
@@ -442,8 +711,47 @@ func documentNewIndex(l *lua.State) int {
 	case "additional_xml_metadata":
 		d.Value.Doc.AdditionalXMLMetadata = lua.CheckString(l, 3)
 	case "language":
+		// a language tag sets the document language and the hyphenation
+		// language if glu has patterns for it
+		if l.IsString(3) {
+			d.lang = lua.CheckString(l, 3)
+			if lang, err := frontend.GetLanguage(d.lang); err == nil {
+				d.Value.Doc.DefaultLanguage = lang
+			}
+			return 0
+		}
 		lang := checkLanguage(l, 3)
 		d.Value.Doc.DefaultLanguage = lang.Value
+		d.lang = lang.Value.Name
+	case "producer":
+		d.producer = lua.CheckString(l, 3)
+	case "strict_conformance":
+		d.strictConformance = l.ToBoolean(3)
+	case "flatten_forms":
+		d.flattenForms = l.ToBoolean(3)
+	case "creation_date", "mod_date":
+		t, err := parseDate(lua.CheckString(l, 3))
+		if err != nil {
+			lua.Errorf(l, "%s: %s", key, err.Error())
+			return 0
+		}
+		if key == "creation_date" {
+			d.Value.Doc.CreationDate = t
+		} else {
+			d.modDate = t
+		}
+	case "convert_rgb_to_cmyk":
+		d.convertRGB = l.ToBoolean(3)
+	case "bleed", "trim", "art", "crop_marks", "registration_marks", "color_bars":
+		d.pageLayout.newIndex(l, key)
+	case "watermark":
+		if l.IsNil(3) {
+			d.watermark = nil
+		} else {
+			d.watermark = checkWatermark(l, 3)
+		}
+	case "tagged":
+		d.tagged = l.ToBoolean(3)
 	default:
 		lua.Errorf(l, "cannot set attribute %s on Document", key)
 	}
@@ -0,0 +1,38 @@
+package frontend
+
+import (
+	"fmt"
+
+	"github.com/speedata/glu/lua/common"
+	"github.com/speedata/go-lua"
+)
+
+// checkEncryption returns an error if the format does not allow the
+// encryption.
+func (d *Document) checkEncryption() error {
+	e := d.encryption
+	if e == nil {
+		return nil
+	}
+	switch name := formatNames[d.Value.Doc.Format]; name {
+	case "PDF/A-3b", "PDF/X-3", "PDF/X-4":
+		return fmt.Errorf("%s does not allow encryption", name)
+	case "PDF/UA":
+		if !e.Allows("accessibility") {
+			return fmt.Errorf("PDF/UA requires the accessibility permission")
+		}
+	}
+	return nil
+}
+
+// documentEncrypt encrypts the document with a password:
+// doc:encrypt{user_password = "", owner_password = "secret", permissions = {copy = false}}
+func documentEncrypt(l *lua.State) int {
+	d := checkDocument(l, 1)
+	d.encryption = common.CheckEncryption(l, 2)
+	if err := d.checkEncryption(); err != nil {
+		lua.Errorf(l, "encrypt: %s", err.Error())
+		return 0
+	}
+	return 0
+}
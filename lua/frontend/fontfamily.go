@@ -1,10 +1,14 @@
 package frontend
 
 import (
-	"fmt"
+	"encoding/binary"
+	"sort"
+	"unicode"
 
 	pdf "github.com/boxesandglue/baseline-pdf"
 	"github.com/boxesandglue/boxesandglue/frontend"
+	"github.com/boxesandglue/textshape/ot"
+	"github.com/speedata/glu/lua/common"
 	"github.com/speedata/go-lua"
 )
 
@@ -15,12 +19,20 @@ const faceMetaTable = "Face"
 // FontFamily wraps the boxesandglue frontend.FontFamily type
 type FontFamily struct {
 	Value *frontend.FontFamily
-	doc   *frontend.Document
+	doc   *Document
 }
 
 // FontSource wraps the boxesandglue frontend.FontSource type
 type FontSource struct {
 	Value *frontend.FontSource
+	// variations are the variable font axis values. They are not stored in
+	// Value.VariationSettings, because boxesandglue shares one face for all
+	// font sources with the same file. glu passes them as a text setting
+	// instead, so every instance gets its own face in the PDF.
+	variations map[string]float64
+	// location is the file name of a WOFF or WOFF2 font. These fonts are
+	// decoded into Value.Data.
+	location string
 }
 
 // Face wraps the baseline-pdf Face type
@@ -49,8 +61,11 @@ func checkFontSource(l *lua.State, index int) *FontSource {
 }
 
 // fontSourceNew creates a new FontSource: fontsource.new(options)
+// If options has a name but no location, the font is searched in the font
+// directories, optionally with weight and style.
 func fontSourceNew(l *lua.State) int {
 	fs := &frontend.FontSource{}
+	var variations map[string]float64
 
 	if l.IsTable(1) {
 		l.Field(1, "location")
@@ -78,6 +93,12 @@ func fontSourceNew(l *lua.State) int {
 		}
 		l.Pop(1)
 
+		l.Field(1, "variations")
+		if l.IsTable(-1) {
+			variations = tableToVariations(l, -1)
+		}
+		l.Pop(1)
+
 		// Parse features as array of strings
 		l.Field(1, "features")
 		if l.IsTable(-1) {
@@ -91,23 +112,56 @@ func fontSourceNew(l *lua.State) int {
 			}
 		}
 		l.Pop(1)
+
+		// Without a location the font is looked up by name in the font index
+		if fs.Location == "" && fs.Name != "" {
+			weight, style := readFontSelection(l, 1)
+			if err := findSystemFont(fs, weight, style); err != nil {
+				lua.Errorf(l, "fontsource: %s", err.Error())
+				return 0
+			}
+		}
 	} else if l.IsString(1) {
 		// Simple case: just a filename
 		fs.Location = lua.CheckString(l, 1)
 	}
 
-	l.PushUserData(&FontSource{Value: fs})
+	wrapper := &FontSource{Value: fs, variations: variations}
+	if err := wrapper.decodeWebFont(); err != nil {
+		lua.Errorf(l, "fontsource: %s", err.Error())
+		return 0
+	}
+	l.PushUserData(wrapper)
 	lua.SetMetaTableNamed(l, fontSourceMetaTable)
 	return 1
 }
 
+// decodeWebFont reads a WOFF or WOFF2 font into memory, because boxesandglue
+// loads only TrueType and OpenType files from disk. Web fonts are recognized
+// by their signature, not by the file extension.
+func (fs *FontSource) decodeWebFont() error {
+	if !common.IsWebFont(fs.Value.Location) {
+		return nil
+	}
+	data, err := common.ReadFontFile(fs.Value.Location)
+	if err != nil {
+		return err
+	}
+	fs.location = fs.Value.Location
+	fs.Value.Data = data
+	fs.Value.Location = ""
+	return nil
+}
+
 // fontFamilyAddMember adds a font member: ff:add_member(fontsource, weight, style)
 // or ff:add_member({source = fs, weight = 400, style = "normal"})
+// A weight range such as {100, 900} registers a variable font for all weights
+// in the range; the wght axis is set to the requested weight.
 func fontFamilyAddMember(l *lua.State) int {
 	ff := checkFontFamily(l, 1)
 
 	var fs *FontSource
-	var weightStr string = "400"
+	var weightIdx int
 	var styleStr string = "normal"
 
 	if l.IsTable(2) {
@@ -120,15 +174,6 @@ func fontFamilyAddMember(l *lua.State) int {
 		}
 		l.Pop(1)
 
-		l.Field(2, "weight")
-		if l.IsNumber(-1) {
-			n, _ := l.ToInteger(-1)
-			weightStr = fmt.Sprintf("%d", n)
-		} else if l.IsString(-1) {
-			weightStr, _ = l.ToString(-1)
-		}
-		l.Pop(1)
-
 		l.Field(2, "style")
 		if l.IsString(-1) {
 			styleStr, _ = l.ToString(-1)
@@ -139,19 +184,63 @@ func fontFamilyAddMember(l *lua.State) int {
 			lua.Errorf(l, "add_member: source is required")
 			return 0
 		}
+		l.Field(2, "weight")
 	} else {
 		// Positional call: ff:add_member(fontsource, weight, style)
 		fs = checkFontSource(l, 2)
-		weightStr = lua.OptString(l, 3, "400")
 		styleStr = lua.OptString(l, 4, "normal")
+		l.PushValue(3)
 	}
+	weightIdx = l.Top()
+
+	minWeight, maxWeight := frontend.FontWeight400, frontend.FontWeight400
+	switch {
+	case l.IsNumber(weightIdx):
+		n, _ := l.ToInteger(weightIdx)
+		minWeight, maxWeight = frontend.FontWeight(n), frontend.FontWeight(n)
+	case l.IsString(weightIdx):
+		s, _ := l.ToString(weightIdx)
+		minWeight = frontend.ResolveFontWeight(s, frontend.FontWeight400)
+		maxWeight = minWeight
+	case l.IsTable(weightIdx):
+		l.RawGetInt(weightIdx, 1)
+		l.RawGetInt(weightIdx, 2)
+		if !l.IsNumber(-2) || !l.IsNumber(-1) {
+			lua.Errorf(l, "add_member: weight range must be {min, max}")
+			return 0
+		}
+		lo, _ := l.ToInteger(-2)
+		hi, _ := l.ToInteger(-1)
+		if lo > hi {
+			lo, hi = hi, lo
+		}
+		minWeight, maxWeight = frontend.FontWeight(lo), frontend.FontWeight(hi)
+		l.Pop(2)
+	}
+	l.Pop(1)
 
-	weight := frontend.ResolveFontWeight(weightStr, frontend.FontWeight400)
 	style := frontend.ResolveFontStyle(styleStr)
 
-	if err := ff.Value.AddMember(fs.Value, weight, style); err != nil {
-		lua.Errorf(l, "failed to add member: %s", err.Error())
-		return 0
+	// A range is registered at its end points and at all multiples of 100 in
+	// between, so that the nearest member lookup finds the variable font.
+	weights := []frontend.FontWeight{minWeight}
+	for w := (minWeight/100 + 1) * 100; w < maxWeight; w += 100 {
+		weights = append(weights, w)
+	}
+	if maxWeight != minWeight {
+		weights = append(weights, maxWeight)
+	}
+	for _, weight := range weights {
+		if err := ff.Value.AddMember(fs.Value, weight, style); err != nil {
+			lua.Errorf(l, "failed to add member: %s", err.Error())
+			return 0
+		}
+	}
+	if len(fs.variations) > 0 {
+		ff.doc.sourceVariations[fs.Value] = fs.variations
+	}
+	if maxWeight != minWeight {
+		ff.doc.weightRanges[fs.Value] = weightRange{min: minWeight, max: maxWeight}
 	}
 
 	// Return self for chaining
@@ -159,6 +248,36 @@ func fontFamilyAddMember(l *lua.State) int {
 	return 1
 }
 
+// fontFamilySetFallbacks sets the fallback font families for glyphs missing in
+// this family: ff:set_fallbacks({ff1, ff2, ...})
+func fontFamilySetFallbacks(l *lua.State) int {
+	ff := checkFontFamily(l, 1)
+	ff.doc.familyFallbacks[ff.Value] = checkFontFamilies(l, 2)
+
+	// Return self for chaining
+	l.PushValue(1)
+	return 1
+}
+
+// checkFontFamilies reads an array of FontFamily objects at index
+func checkFontFamilies(l *lua.State, index int) []*frontend.FontFamily {
+	lua.CheckType(l, index, lua.TypeTable)
+	var families []*frontend.FontFamily
+	n := l.RawLength(index)
+	for i := 1; i <= n; i++ {
+		l.RawGetInt(index, i)
+		ud := lua.TestUserData(l, -1, fontFamilyMetaTable)
+		ff, ok := ud.(*FontFamily)
+		if !ok {
+			lua.Errorf(l, "FontFamily expected at position %d", i)
+			return nil
+		}
+		families = append(families, ff.Value)
+		l.Pop(1)
+	}
+	return families
+}
+
 // fontFamilyIndex handles attribute access (__index metamethod)
 func fontFamilyIndex(l *lua.State) int {
 	ff := checkFontFamily(l, 1)
@@ -171,8 +290,60 @@ func fontFamilyIndex(l *lua.State) int {
 	case "add_member":
 		l.PushGoFunction(fontFamilyAddMember)
 		return 1
+	case "set_fallbacks":
+		l.PushGoFunction(fontFamilySetFallbacks)
+		return 1
+	case "synthetic_bold":
+		syn := ff.doc.synthesisFor(ff.Value)
+		if syn.emboldening == 0 {
+			l.PushBoolean(false)
+		} else {
+			l.PushNumber(syn.emboldening)
+		}
+		return 1
+	case "synthetic_italic":
+		syn := ff.doc.synthesisFor(ff.Value)
+		if syn.slant == 0 {
+			l.PushBoolean(false)
+		} else {
+			l.PushNumber(syn.slant)
+		}
+		return 1
+	}
+
+	return 0
+}
+
+// fontFamilyNewIndex handles attribute setting (__newindex metamethod)
+// synthetic_bold and synthetic_italic accept a boolean or a number (the stroke
+// width as a fraction of the font size or the slant).
+func fontFamilyNewIndex(l *lua.State) int {
+	ff := checkFontFamily(l, 1)
+	key := lua.CheckString(l, 2)
+
+	syn := ff.doc.synthesisFor(ff.Value)
+	switch key {
+	case "synthetic_bold":
+		syn.emboldening = optSynthesisValue(l, 3, defaultEmboldening)
+	case "synthetic_italic":
+		syn.slant = optSynthesisValue(l, 3, defaultSlant)
+	default:
+		lua.Errorf(l, "cannot set attribute %s on FontFamily", key)
+		return 0
 	}
+	ff.doc.synthesis[ff.Value] = syn
+	return 0
+}
 
+// optSynthesisValue returns the number at index, def for true and 0 for false.
+func optSynthesisValue(l *lua.State, index int, def float64) float64 {
+	if l.IsNumber(index) {
+		n, _ := l.ToNumber(index)
+		return n
+	}
+	if l.ToBoolean(index) {
+		return def
+	}
 	return 0
 }
 
@@ -183,7 +354,11 @@ func fontSourceIndex(l *lua.State) int {
 
 	switch key {
 	case "location":
-		l.PushString(fs.Value.Location)
+		if fs.location != "" {
+			l.PushString(fs.location)
+		} else {
+			l.PushString(fs.Value.Location)
+		}
 		return 1
 	case "name":
 		l.PushString(fs.Value.Name)
@@ -191,6 +366,9 @@ func fontSourceIndex(l *lua.State) int {
 	case "index":
 		l.PushInteger(fs.Value.Index)
 		return 1
+	case "variations":
+		pushVariations(l, fs.variations)
+		return 1
 	}
 
 	return 0
@@ -208,11 +386,140 @@ func faceIndex(l *lua.State) int {
 	case "postscript_name":
 		l.PushString(f.Value.PostscriptName)
 		return 1
+	case "upem":
+		l.PushInteger(int(f.Value.UnitsPerEM))
+		return 1
+	case "ascender":
+		l.PushInteger(int(f.Value.OTFace().Ascender()))
+		return 1
+	case "descender":
+		l.PushInteger(int(f.Value.OTFace().Descender()))
+		return 1
+	case "cap_height":
+		l.PushInteger(int(f.Value.OTFace().CapHeight()))
+		return 1
+	case "x_height":
+		l.PushInteger(int(f.Value.OTFace().XHeight()))
+		return 1
+	case "italic_angle":
+		// the post table stores the angle as a 16.16 fixed point number
+		l.PushNumber(float64(f.Value.OTFace().ItalicAngle()) / 65536)
+		return 1
+	case "underline_position", "underline_thickness":
+		var post *ot.Post
+		if data, err := f.font().TableData(ot.TagPost); err == nil {
+			post, _ = ot.ParsePost(data)
+		}
+		if post == nil {
+			l.PushInteger(0)
+		} else if key == "underline_position" {
+			l.PushInteger(int(post.UnderlinePosition))
+		} else {
+			l.PushInteger(int(post.UnderlineThickness))
+		}
+		return 1
+	case "glyph_count":
+		l.PushInteger(f.font().NumGlyphs())
+		return 1
+	case "features":
+		pushStrings(l, f.layoutTags(layoutFeatures))
+		return 1
+	case "scripts":
+		pushStrings(l, f.layoutTags(layoutScripts))
+		return 1
+	case "has_glyph":
+		l.PushGoFunction(faceHasGlyph)
+		return 1
+	case "covers":
+		l.PushGoFunction(faceCovers)
+		return 1
 	}
 
 	return 0
 }
 
+func (f *Face) font() *ot.Font {
+	return f.Value.Shaper.Font()
+}
+
+const (
+	layoutScripts  = 4 // offset of the ScriptList offset in GSUB and GPOS
+	layoutFeatures = 6 // offset of the FeatureList offset in GSUB and GPOS
+)
+
+// layoutTags returns the sorted tags of the script list or the feature list
+// of the GSUB and GPOS tables.
+func (f *Face) layoutTags(list int) []string {
+	seen := map[string]bool{}
+	for _, tag := range []ot.Tag{ot.TagGSUB, ot.TagGPOS} {
+		data, err := f.font().TableData(tag)
+		if err != nil || len(data) < 10 {
+			continue
+		}
+		off := int(binary.BigEndian.Uint16(data[list:]))
+		if off == 0 || off+2 > len(data) {
+			continue
+		}
+		count := int(binary.BigEndian.Uint16(data[off:]))
+		// each record is a four byte tag and a two byte offset
+		for i := 0; i < count; i++ {
+			rec := off + 2 + i*6
+			if rec+4 > len(data) {
+				break
+			}
+			seen[string(data[rec:rec+4])] = true
+		}
+	}
+	tags := make([]string, 0, len(seen))
+	for t := range seen {
+		tags = append(tags, t)
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// faceHasGlyph returns true if the face has a glyph for the codepoint: face:has_glyph(cp)
+// The codepoint can be a number or a one character string.
+func faceHasGlyph(l *lua.State) int {
+	f := checkFace(l, 1)
+	var cp rune
+	if l.IsNumber(2) {
+		n, _ := l.ToInteger(2)
+		cp = rune(n)
+	} else {
+		for _, r := range lua.CheckString(l, 2) {
+			cp = r
+			break
+		}
+	}
+	l.PushBoolean(f.Value.Codepoint(cp) != 0)
+	return 1
+}
+
+// faceCovers checks whether the face has glyphs for all characters of a
+// string: face:covers(str). It returns true, or false and a string with the
+// missing characters.
+func faceCovers(l *lua.State) int {
+	f := checkFace(l, 1)
+	str := lua.CheckString(l, 2)
+	var missing []rune
+	for _, r := range str {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			continue
+		}
+		if f.Value.Codepoint(r) == 0 {
+			missing = append(missing, r)
+		}
+	}
+	if len(missing) == 0 {
+		l.PushBoolean(true)
+		return 1
+	}
+	l.PushBoolean(false)
+	l.PushString(string(missing))
+	return 2
+}
+
 func checkFace(l *lua.State, index int) *Face {
 	ud := lua.CheckUserData(l, index, faceMetaTable)
 	if f, ok := ud.(*Face); ok {
@@ -227,6 +534,7 @@ func registerFontFamilyMetaTable(l *lua.State) {
 	lua.NewMetaTable(l, fontFamilyMetaTable)
 	lua.SetFunctions(l, []lua.RegistryFunction{
 		{Name: "__index", Function: fontFamilyIndex},
+		{Name: "__newindex", Function: fontFamilyNewIndex},
 	}, 0)
 	l.Pop(1)
 }
@@ -0,0 +1,354 @@
+package frontend
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/boxesandglue/boxesandglue/frontend"
+	"github.com/boxesandglue/textshape/ot"
+	"github.com/speedata/glu/lua/common"
+	"github.com/speedata/go-lua"
+)
+
+// systemFontDirs are the standard font directories on Linux systems.
+var systemFontDirs = []string{
+	"/usr/share/fonts",
+	"/usr/local/share/fonts",
+	"~/.local/share/fonts",
+	"~/.fonts",
+}
+
+// fontIndexEntry describes one font (a file or an entry in a collection).
+type fontIndexEntry struct {
+	Location       string
+	Index          int
+	Family         string
+	Subfamily      string
+	FullName       string
+	PostscriptName string
+	Weight         frontend.FontWeight
+	Italic         bool
+}
+
+// fontIndex finds fonts (TrueType, OpenType and WOFF/WOFF2) in the system
+// font directories and in user supplied directories. The directories are
+// scanned on the first lookup.
+type fontIndex struct {
+	dirs    []string
+	entries []fontIndexEntry
+	scanned bool
+}
+
+var systemFonts = &fontIndex{}
+
+// AddFontDirs adds directories to the font index. Fonts in these directories
+// take precedence over the standard font directories.
+func AddFontDirs(dirs ...string) {
+	systemFonts.dirs = append(systemFonts.dirs, dirs...)
+	systemFonts.scanned = false
+}
+
+func (fi *fontIndex) scan() {
+	fi.entries = fi.entries[:0]
+	home, _ := os.UserHomeDir()
+	for _, dir := range append(append([]string{}, fi.dirs...), systemFontDirs...) {
+		if strings.HasPrefix(dir, "~/") {
+			if home == "" {
+				continue
+			}
+			dir = filepath.Join(home, dir[2:])
+		}
+		filepath.WalkDir(dir, func(path string, de fs.DirEntry, err error) error {
+			if err != nil {
+				// unreadable or missing directories are not an error
+				return nil
+			}
+			if de.IsDir() {
+				return nil
+			}
+			switch strings.ToLower(filepath.Ext(path)) {
+			case ".ttf", ".otf", ".ttc", ".otc", ".woff", ".woff2":
+				fi.addFile(path)
+			}
+			return nil
+		})
+	}
+	fi.scanned = true
+	slog.Debug("Font index built", "fonts", len(fi.entries))
+}
+
+// addFile reads the name and OS/2 tables of all fonts in the file. For
+// TrueType and OpenType files and collections only these tables are read,
+// WOFF and WOFF2 files are compressed and decoded as a whole.
+func (fi *fontIndex) addFile(path string) {
+	f, err := os.Open(path)
+	if err != nil {
+		slog.Debug("Cannot read font file", "filename", path, "error", err)
+		return
+	}
+	defer f.Close()
+	fileInfo, err := f.Stat()
+	if err != nil {
+		slog.Debug("Cannot read font file", "filename", path, "error", err)
+		return
+	}
+	size := fileInfo.Size()
+	var header [12]byte
+	if _, err := f.ReadAt(header[:], 0); err != nil {
+		slog.Debug("Cannot read font file", "filename", path, "error", err)
+		return
+	}
+	if common.HasWebFontSignature(header[:]) {
+		fi.addWebFont(path)
+		return
+	}
+	offsets := []int64{0}
+	if string(header[0:4]) == "ttcf" {
+		numFonts := int64(binary.BigEndian.Uint32(header[8:12]))
+		if 12+4*numFonts > size {
+			slog.Debug("Cannot read font collection", "filename", path, "error", "font count exceeds the file size")
+			return
+		}
+		dir := make([]byte, 4*numFonts)
+		if _, err := f.ReadAt(dir, 12); err != nil {
+			slog.Debug("Cannot read font collection", "filename", path, "error", err)
+			return
+		}
+		offsets = offsets[:0]
+		for i := range numFonts {
+			offsets = append(offsets, int64(binary.BigEndian.Uint32(dir[4*i:])))
+		}
+	}
+	for i, offset := range offsets {
+		tables, err := readSfntTables(f, size, offset, ot.TagName, ot.TagOS2)
+		if err != nil {
+			slog.Debug("Cannot parse font file", "filename", path, "index", i, "error", err)
+			continue
+		}
+		fi.addEntry(path, i, tables[ot.TagName], tables[ot.TagOS2])
+	}
+}
+
+// addWebFont adds a WOFF or WOFF2 file to the index. The file is decoded
+// completely, the tables of web fonts cannot be read one by one.
+func (fi *fontIndex) addWebFont(path string) {
+	data, err := common.ReadFontFile(path)
+	if err != nil {
+		slog.Debug("Cannot read font file", "filename", path, "error", err)
+		return
+	}
+	fnt, err := ot.ParseFont(data, 0)
+	if err != nil {
+		slog.Debug("Cannot parse font file", "filename", path, "error", err)
+		return
+	}
+	nameData, _ := fnt.TableData(ot.TagName)
+	os2Data, _ := fnt.TableData(ot.TagOS2)
+	fi.addEntry(path, 0, nameData, os2Data)
+}
+
+// readSfntTables reads the tables with the given tags of the font whose
+// table directory starts at offset. Missing tables are nil. Tables that do not
+// fit into the file of the given size are an error.
+func readSfntTables(f *os.File, size, offset int64, tags ...ot.Tag) (map[ot.Tag][]byte, error) {
+	var header [12]byte
+	if _, err := f.ReadAt(header[:], offset); err != nil {
+		return nil, err
+	}
+	numTables := int(binary.BigEndian.Uint16(header[4:6]))
+	if offset+12+16*int64(numTables) > size {
+		return nil, fmt.Errorf("table directory exceeds the file size")
+	}
+	records := make([]byte, 16*numTables)
+	if _, err := f.ReadAt(records, offset+12); err != nil {
+		return nil, err
+	}
+	tables := make(map[ot.Tag][]byte, len(tags))
+	for i := range numTables {
+		rec := records[16*i:]
+		tag := ot.Tag(binary.BigEndian.Uint32(rec[0:4]))
+		if !slices.Contains(tags, tag) {
+			continue
+		}
+		tableOffset, length := int64(binary.BigEndian.Uint32(rec[8:12])), int64(binary.BigEndian.Uint32(rec[12:16]))
+		if tableOffset+length > size {
+			return nil, fmt.Errorf("table %s exceeds the file size", tag)
+		}
+		data := make([]byte, length)
+		if _, err := f.ReadAt(data, tableOffset); err != nil {
+			return nil, err
+		}
+		tables[tag] = data
+	}
+	return tables, nil
+}
+
+// addEntry adds the font at index of the file with the data of its name and
+// OS/2 tables to the index.
+func (fi *fontIndex) addEntry(path string, index int, nameData, os2Data []byte) {
+	entry := fontIndexEntry{
+		Location: path,
+		Index:    index,
+		Weight:   frontend.FontWeight400,
+	}
+	if nameData != nil {
+		if name, err := ot.ParseName(nameData); err == nil {
+			// Prefer the typographic family and subfamily names (IDs 16 and 17)
+			entry.Family = name.Get(16)
+			if entry.Family == "" {
+				entry.Family = name.FamilyName()
+			}
+			entry.Subfamily = name.Get(17)
+			if entry.Subfamily == "" {
+				entry.Subfamily = name.Get(2)
+			}
+			entry.FullName = name.FullName()
+			entry.PostscriptName = name.PostScriptName()
+		}
+	}
+	if os2Data != nil {
+		if os2, err := ot.ParseOS2(os2Data); err == nil {
+			if os2.UsWeightClass > 0 {
+				entry.Weight = frontend.FontWeight(os2.UsWeightClass)
+			}
+			// bit 0: italic, bit 9: oblique
+			entry.Italic = os2.FsSelection&0x201 != 0
+		}
+	}
+	if entry.Family == "" {
+		return
+	}
+	fi.entries = append(fi.entries, entry)
+}
+
+// normalizeFontName makes font names comparable: "Crimson Pro",
+// "crimson-pro" and "CrimsonPro" are the same.
+func normalizeFontName(name string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(name) {
+		switch r {
+		case ' ', '-', '_':
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// find returns the font that matches name best. If name is a family name,
+// the font of the family with the requested style and the closest weight is
+// returned. Otherwise the name is compared to the full name and the
+// PostScript name. The regular face has the family name as its full name, so
+// the family must be tried first.
+func (fi *fontIndex) find(name string, weight frontend.FontWeight, style frontend.FontStyle) (*fontIndexEntry, error) {
+	if !fi.scanned {
+		fi.scan()
+	}
+	n := normalizeFontName(name)
+	wantItalic := style == frontend.FontStyleItalic || style == frontend.FontStyleOblique
+	var best *fontIndexEntry
+	bestScore := 0
+	for i, e := range fi.entries {
+		if normalizeFontName(e.Family) != n {
+			continue
+		}
+		score := int(e.Weight) - int(weight)
+		if score < 0 {
+			score = -score
+		}
+		if e.Italic != wantItalic {
+			score += 1000
+		}
+		if best == nil || score < bestScore {
+			best = &fi.entries[i]
+			bestScore = score
+		}
+	}
+	if best != nil {
+		return best, nil
+	}
+	for i, e := range fi.entries {
+		if normalizeFontName(e.FullName) == n || normalizeFontName(e.PostscriptName) == n {
+			return &fi.entries[i], nil
+		}
+	}
+	return nil, fmt.Errorf("font %q not found", name)
+}
+
+// findSystemFont looks up a font by name and sets the location of fs.
+func findSystemFont(fs *frontend.FontSource, weight frontend.FontWeight, style frontend.FontStyle) error {
+	entry, err := systemFonts.find(fs.Name, weight, style)
+	if err != nil {
+		return err
+	}
+	slog.Debug("Found system font", "name", fs.Name, "location", entry.Location, "index", entry.Index)
+	fs.Location = entry.Location
+	fs.Index = entry.Index
+	return nil
+}
+
+// readFontSelection reads the optional weight and style fields from the
+// table at index.
+func readFontSelection(l *lua.State, index int) (frontend.FontWeight, frontend.FontStyle) {
+	weight := frontend.FontWeight400
+	style := frontend.FontStyleNormal
+	l.Field(index, "weight")
+	if l.IsNumber(-1) {
+		n, _ := l.ToInteger(-1)
+		weight = frontend.FontWeight(n)
+	} else if l.IsString(-1) {
+		s, _ := l.ToString(-1)
+		weight = frontend.ResolveFontWeight(s, frontend.FontWeight400)
+	}
+	l.Pop(1)
+	l.Field(index, "style")
+	if l.IsString(-1) {
+		s, _ := l.ToString(-1)
+		style = frontend.ResolveFontStyle(s)
+	}
+	l.Pop(1)
+	return weight, style
+}
+
+// addFontDir adds a directory to the font index: frontend.add_font_dir(dir)
+func addFontDir(l *lua.State) int {
+	AddFontDirs(lua.CheckString(l, 1))
+	return 0
+}
+
+// documentFindSystemFont finds an installed font: doc:find_system_font(name, [weight], [style])
+// or doc:find_system_font({name = "Crimson Pro", weight = 700, style = "italic"})
+func documentFindSystemFont(l *lua.State) int {
+	checkDocument(l, 1)
+	fs := &frontend.FontSource{}
+	var weight frontend.FontWeight
+	var style frontend.FontStyle
+	if l.IsTable(2) {
+		l.Field(2, "name")
+		fs.Name = lua.CheckString(l, -1)
+		l.Pop(1)
+		weight, style = readFontSelection(l, 2)
+	} else {
+		fs.Name = lua.CheckString(l, 2)
+		weight = frontend.ResolveFontWeight(lua.OptString(l, 3, "400"), frontend.FontWeight400)
+		style = frontend.ResolveFontStyle(lua.OptString(l, 4, "normal"))
+	}
+	if err := findSystemFont(fs, weight, style); err != nil {
+		l.PushNil()
+		return 1
+	}
+	wrapper := &FontSource{Value: fs}
+	if err := wrapper.decodeWebFont(); err != nil {
+		lua.Errorf(l, "find_system_font: %s", err.Error())
+		return 0
+	}
+	l.PushUserData(wrapper)
+	lua.SetMetaTableNamed(l, fontSourceMetaTable)
+	return 1
+}
@@ -0,0 +1,862 @@
+package frontend
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/boxesandglue/boxesandglue/backend/bag"
+	"github.com/boxesandglue/boxesandglue/backend/color"
+	"github.com/boxesandglue/boxesandglue/backend/node"
+	"github.com/speedata/glu/lua/common"
+	"github.com/speedata/go-lua"
+)
+
+// A form field is a vlist with an invisible rule that writes a marked point
+// into the page contents. When the document is finished, the markers are
+// replaced: glu tracks the transformation matrix up to each marker and adds
+// a widget annotation at that position, or draws the appearance of the field
+// in place if the field is flattened.
+
+const fieldPrefix = "GluField"
+
+// attrField is the form field of a field vlist. In a text the field is
+// inserted as its rule so that it sits on the baseline.
+const attrField = "glu-field"
+
+// Field flags (Ff) of the field dictionary.
+const (
+	fieldReadOnly      = 1 << 0
+	fieldRequired      = 1 << 1
+	fieldMultiline     = 1 << 12
+	fieldPassword      = 1 << 13
+	fieldNoToggleToOff = 1 << 14
+	fieldRadio         = 1 << 15
+	fieldPushButton    = 1 << 16
+	fieldCombo         = 1 << 17
+	fieldEdit          = 1 << 18
+)
+
+// fieldTypes are the field types (FT) of the kinds of fields.
+var fieldTypes = map[string]string{
+	"text":     "Tx",
+	"checkbox": "Btn",
+	"radio":    "Btn",
+	"button":   "Btn",
+	"combo":    "Ch",
+}
+
+// fieldFont is a standard font for the variable text of form fields.
+type fieldFont struct {
+	resource string
+	// widths are the widths of the characters 32 to 126, other characters
+	// have the width def
+	widths []int
+	def    int
+}
+
+var (
+	helveticaWidths = []int{
+		278, 278, 355, 556, 556, 889, 667, 191, 333, 333, 389, 584, 278, 333, 278, 278,
+		556, 556, 556, 556, 556, 556, 556, 556, 556, 556,
+		278, 278, 584, 584, 584, 556, 1015,
+		667, 667, 722, 722, 667, 611, 778, 722, 278, 500, 667, 556, 833,
+		722, 778, 667, 778, 722, 667, 611, 722, 667, 944, 667, 667, 611,
+		278, 278, 278, 469, 556, 333,
+		556, 556, 500, 556, 556, 278, 556, 556, 222, 222, 500, 222, 833,
+		556, 556, 556, 556, 333, 500, 278, 556, 500, 722, 500, 500, 500,
+		334, 260, 334, 584,
+	}
+	helveticaBoldWidths = []int{
+		278, 333, 474, 556, 556, 889, 722, 238, 333, 333, 389, 584, 278, 333, 278, 278,
+		556, 556, 556, 556, 556, 556, 556, 556, 556, 556,
+		333, 333, 584, 584, 584, 611, 975,
+		722, 722, 722, 722, 667, 611, 778, 722, 278, 556, 722, 611, 833,
+		722, 778, 667, 778, 722, 667, 611, 722, 667, 944, 667, 667, 611,
+		333, 278, 333, 584, 556, 333,
+		556, 611, 556, 611, 556, 333, 611, 611, 278, 278, 556, 278, 889,
+		611, 611, 611, 611, 389, 556, 333, 611, 556, 778, 556, 556, 500,
+		389, 280, 389, 584,
+	}
+)
+
+// fieldFonts are the fonts of form fields by PDF name. PDF viewers need the
+// font to edit a field, so these fonts are not embedded.
+var fieldFonts = map[string]*fieldFont{
+	"Helvetica":      {resource: "Helv", widths: helveticaWidths, def: 556},
+	"Helvetica-Bold": {resource: "HeBo", widths: helveticaBoldWidths, def: 556},
+	"Courier":        {resource: "Cour", def: 600},
+	"Courier-Bold":   {resource: "CoBo", def: 600},
+}
+
+// width returns the width of the WinAnsi encoded text s at size.
+func (ff *fieldFont) width(s []byte, size float64) float64 {
+	sum := 0
+	for _, c := range s {
+		if c >= 32 && c <= 126 && ff.widths != nil {
+			sum += ff.widths[c-32]
+		} else {
+			sum += ff.def
+		}
+	}
+	return float64(sum) * size / 1000
+}
+
+// winAnsi are the characters of the WinAnsi encoding from 0x80 to 0x9f that
+// glu can encode.
+var winAnsi = map[rune]byte{
+	'€': 0x80, '‚': 0x82, '„': 0x84, '…': 0x85, '†': 0x86, '‡': 0x87, '‰': 0x89,
+	'Š': 0x8a, '‹': 0x8b, 'Œ': 0x8c, 'Ž': 0x8e, '‘': 0x91, '’': 0x92, '“': 0x93,
+	'”': 0x94, '•': 0x95, '–': 0x96, '—': 0x97, '™': 0x99, 'š': 0x9a, '›': 0x9b,
+	'œ': 0x9c, 'ž': 0x9e, 'Ÿ': 0x9f,
+}
+
+// winAnsiBytes encodes s for the standard fonts, unknown characters become
+// question marks.
+func winAnsiBytes(s string) []byte {
+	var b []byte
+	for _, r := range s {
+		switch {
+		case r < 0x80 || r >= 0xa0 && r <= 0xff:
+			b = append(b, byte(r))
+		case winAnsi[r] != 0:
+			b = append(b, winAnsi[r])
+		default:
+			b = append(b, '?')
+		}
+	}
+	return b
+}
+
+// contentString returns s as a string operand of a content stream.
+func contentString(s []byte) string {
+	var b strings.Builder
+	b.WriteByte('(')
+	for _, c := range s {
+		switch {
+		case c == '(' || c == ')' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < ' ' || c >= 0x7f:
+			fmt.Fprintf(&b, "\\%03o", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte(')')
+	return b.String()
+}
+
+// formField is a form field created with doc:new_field. Radio buttons with
+// the same name form a group.
+type formField struct {
+	id   int
+	kind string
+	name string
+	// value is the default value of text fields and combo boxes and the
+	// export value of check boxes and radio buttons
+	value         string
+	checked       bool
+	options       []string
+	flags         int
+	maxLength     int
+	font          string
+	size          float64
+	align         int
+	color         *color.Color
+	border        *color.Color
+	background    *color.Color
+	borderWidth   float64
+	caption       string
+	tooltip       string
+	url           string
+	submit        string
+	reset         bool
+	flatten       bool
+	width, height bag.ScaledPoint
+	// baseline is the distance of the text baseline from the bottom of the
+	// field, the field is placed on the baseline in a paragraph
+	baseline bag.ScaledPoint
+}
+
+// fieldPlacement is a marker of a field in the page contents.
+type fieldPlacement struct {
+	field *formField
+	page  pdfRef
+	ctm   matrix
+}
+
+// colorComponents returns the components of a gray, RGB or CMYK color.
+func colorComponents(col *color.Color) pdfArray {
+	switch col.Space {
+	case color.ColorGray:
+		return pdfArray{col.G}
+	case color.ColorRGB:
+		return pdfArray{col.R, col.G, col.B}
+	default:
+		return pdfArray{col.C, col.M, col.Y, col.K}
+	}
+}
+
+// textLines returns the lines of the field value, multiline fields wrap at
+// the width w.
+func (ff *formField) textLines(text string, w float64) [][]byte {
+	font := fieldFonts[ff.font]
+	if ff.flags&fieldMultiline == 0 {
+		return [][]byte{winAnsiBytes(strings.ReplaceAll(text, "\n", " "))}
+	}
+	var lines [][]byte
+	for _, para := range strings.Split(text, "\n") {
+		var line []byte
+		for _, word := range strings.Fields(para) {
+			wb := winAnsiBytes(word)
+			if len(line) > 0 && font.width(append(append(line[:len(line):len(line)], ' '), wb...), ff.size) > w {
+				lines = append(lines, line)
+				line = nil
+			}
+			if len(line) > 0 {
+				line = append(line, ' ')
+			}
+			line = append(line, wb...)
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// circle returns the path of a circle.
+func circle(cx, cy, r float64) string {
+	n := common.PDFNumber
+	k := r * 0.5523
+	return fmt.Sprintf("%s %s m %s %s %s %s %s %s c %s %s %s %s %s %s c %s %s %s %s %s %s c %s %s %s %s %s %s c h",
+		n(cx+r), n(cy),
+		n(cx+r), n(cy+k), n(cx+k), n(cy+r), n(cx), n(cy+r),
+		n(cx-k), n(cy+r), n(cx-r), n(cy+k), n(cx-r), n(cy),
+		n(cx-r), n(cy-k), n(cx-k), n(cy-r), n(cx), n(cy-r),
+		n(cx+k), n(cy-r), n(cx+r), n(cy-k), n(cx+r), n(cy))
+}
+
+// appearance returns the content of the appearance stream, on is the
+// state of check boxes and radio buttons.
+func (ff *formField) appearance(on bool) string {
+	n := common.PDFNumber
+	w, h, bw := ff.width.ToPT(), ff.height.ToPT(), ff.borderWidth
+	var b strings.Builder
+	if ff.kind == "radio" {
+		r := min(w, h) / 2
+		if ff.background != nil {
+			fmt.Fprintf(&b, "q %s %s f Q\n", ff.background.PDFStringNonStroking(), circle(w/2, h/2, r))
+		}
+		if ff.border != nil && bw > 0 {
+			fmt.Fprintf(&b, "q %s w %s %s S Q\n", n(bw), ff.border.PDFStringStroking(), circle(w/2, h/2, r-bw/2))
+		}
+		if on {
+			fmt.Fprintf(&b, "q %s %s f Q\n", ff.color.PDFStringNonStroking(), circle(w/2, h/2, (r-bw)*0.5))
+		}
+		return b.String()
+	}
+	if ff.background != nil {
+		fmt.Fprintf(&b, "q %s 0 0 %s %s re f Q\n", ff.background.PDFStringNonStroking(), n(w), n(h))
+	}
+	if ff.border != nil && bw > 0 {
+		fmt.Fprintf(&b, "q %s w %s %s %s %s %s re S Q\n", n(bw), ff.border.PDFStringStroking(), n(bw/2), n(bw/2), n(w-bw), n(h-bw))
+	}
+	font := fieldFonts[ff.font]
+	pad := bw + 2
+	var text string
+	switch ff.kind {
+	case "checkbox":
+		if on {
+			s := min(w, h) - 2*bw
+			fmt.Fprintf(&b, "q %s %s w 1 J 1 j %s %s m %s %s l %s %s l S Q\n",
+				ff.color.PDFStringStroking(), n(s*0.12),
+				n(w/2-s*0.27), n(h/2), n(w/2-s*0.08), n(h/2-s*0.22), n(w/2+s*0.27), n(h/2+s*0.24))
+		}
+		return b.String()
+	case "button":
+		lines := [][]byte{winAnsiBytes(ff.caption)}
+		fmt.Fprintf(&b, "q BT /%s %s Tf %s", font.resource, n(ff.size), ff.color.PDFStringNonStroking())
+		fmt.Fprintf(&b, " 1 0 0 1 %s %s Tm %s Tj ET Q\n", n((w-font.width(lines[0], ff.size))/2), n(ff.baseline.ToPT()), contentString(lines[0]))
+		return b.String()
+	case "text", "combo":
+		if ff.flags&fieldPassword == 0 {
+			text = ff.value
+		}
+	}
+	b.WriteString("/Tx BMC\n")
+	if text != "" {
+		fmt.Fprintf(&b, "q %s %s %s %s re W n BT /%s %s Tf %s\n", n(pad-1), n(pad-1), n(w-2*pad+2), n(h-2*pad+2), font.resource, n(ff.size), ff.color.PDFStringNonStroking())
+		y := ff.baseline.ToPT()
+		for _, line := range ff.textLines(text, w-2*pad) {
+			x := pad
+			switch ff.align {
+			case 1:
+				x = (w - font.width(line, ff.size)) / 2
+			case 2:
+				x = w - pad - font.width(line, ff.size)
+			}
+			fmt.Fprintf(&b, "1 0 0 1 %s %s Tm %s Tj\n", n(x), n(y), contentString(line))
+			y -= ff.size * 1.15
+		}
+		b.WriteString("ET Q\n")
+	}
+	b.WriteString("EMC\n")
+	return b.String()
+}
+
+// formWriter writes the fields of a document.
+type formWriter struct {
+	d *Document
+	f *pdfFile
+	// fonts are the font dictionaries by resource name
+	fonts pdfDict
+}
+
+// font returns the reference of a standard font and adds it to the form
+// resources.
+func (fw *formWriter) font(name, resource string) pdfRef {
+	if ref, ok := fw.fonts[resource].(pdfRef); ok {
+		return ref
+	}
+	font := pdfDict{
+		"Type":     pdfName("Font"),
+		"Subtype":  pdfName("Type1"),
+		"BaseFont": pdfName(name),
+	}
+	if name != "ZapfDingbats" {
+		font["Encoding"] = pdfName("WinAnsiEncoding")
+	}
+	ref := fw.f.Add(font)
+	fw.fonts[resource] = ref
+	return ref
+}
+
+// appearance adds the appearance stream of a field.
+func (fw *formWriter) appearance(ff *formField, on bool) pdfRef {
+	form := pdfDict{
+		"Type":    pdfName("XObject"),
+		"Subtype": pdfName("Form"),
+		"BBox":    pdfArray{0.0, 0.0, ff.width.ToPT(), ff.height.ToPT()},
+	}
+	if ff.kind == "text" || ff.kind == "combo" || ff.kind == "button" {
+		font := fieldFonts[ff.font]
+		form["Resources"] = pdfDict{"Font": pdfDict{font.resource: fw.font(ff.font, font.resource)}}
+	}
+	return fw.f.AddStream(form, []byte(ff.appearance(on)))
+}
+
+// da returns the default appearance of the variable text of a field.
+func (ff *formField) da() pdfString {
+	resource, size := "ZaDb", "0"
+	if font, ok := fieldFonts[ff.font]; ok && ff.kind != "checkbox" && ff.kind != "radio" {
+		resource, size = font.resource, common.PDFNumber(ff.size)
+	}
+	return pdfString(fmt.Sprintf("/%s %s Tf %s", resource, size, strings.TrimSpace(ff.color.PDFStringNonStroking())))
+}
+
+// widget returns the widget annotation of a field at a placement.
+func (fw *formWriter) widget(ff *formField, pl fieldPlacement) pdfDict {
+	w, h, base := ff.width.ToPT(), ff.height.ToPT(), ff.baseline.ToPT()
+	box := bbox{0, -base, w, h - base}.transform(pl.ctm)
+	widget := pdfDict{
+		"Type":    pdfName("Annot"),
+		"Subtype": pdfName("Widget"),
+		"Rect":    pdfBox([4]float64{box.minX, box.minY, box.maxX, box.maxY}),
+		"P":       pl.page,
+		"F":       4,
+	}
+	mk := pdfDict{}
+	if ff.border != nil && ff.borderWidth > 0 {
+		mk["BC"] = colorComponents(ff.border)
+		widget["BS"] = pdfDict{"W": ff.borderWidth, "S": pdfName("S")}
+	} else {
+		widget["BS"] = pdfDict{"W": 0}
+	}
+	if ff.background != nil {
+		mk["BG"] = colorComponents(ff.background)
+	}
+	switch ff.kind {
+	case "checkbox", "radio":
+		on := pdfName(ff.value)
+		mk["CA"] = pdfString("4")
+		if ff.kind == "radio" {
+			mk["CA"] = pdfString("l")
+		}
+		widget["AP"] = pdfDict{"N": pdfDict{string(on): fw.appearance(ff, true), "Off": fw.appearance(ff, false)}}
+		widget["AS"] = pdfName("Off")
+		if ff.checked {
+			widget["AS"] = on
+		}
+	case "button":
+		mk["CA"] = common.PDFTextString(ff.caption)
+		widget["AP"] = pdfDict{"N": fw.appearance(ff, false)}
+		switch {
+		case ff.url != "":
+			widget["A"] = pdfDict{"S": pdfName("URI"), "URI": pdfString(ff.url)}
+		case ff.submit != "":
+			// flag 3: the field values are sent as HTML form data
+			widget["A"] = pdfDict{"S": pdfName("SubmitForm"), "F": pdfDict{"FS": pdfName("URL"), "F": pdfString(ff.submit)}, "Flags": 4}
+		case ff.reset:
+			widget["A"] = pdfDict{"S": pdfName("ResetForm")}
+		}
+	default:
+		widget["AP"] = pdfDict{"N": fw.appearance(ff, false)}
+	}
+	widget["MK"] = mk
+	return widget
+}
+
+// field returns the field dictionary of the fields with the same name (the
+// buttons of a radio group or a single field).
+func (fw *formWriter) field(group []*formField) pdfDict {
+	ff := group[0]
+	field := pdfDict{
+		"FT": pdfName(fieldTypes[ff.kind]),
+		"T":  common.PDFTextString(ff.name),
+		"DA": ff.da(),
+	}
+	flags := ff.flags
+	switch ff.kind {
+	case "text", "combo":
+		if ff.value != "" {
+			field["V"] = common.PDFTextString(ff.value)
+			field["DV"] = common.PDFTextString(ff.value)
+		}
+		if ff.align != 0 {
+			field["Q"] = ff.align
+		}
+		if ff.maxLength > 0 {
+			field["MaxLen"] = ff.maxLength
+		}
+		if ff.kind == "combo" {
+			opts := pdfArray{}
+			for _, o := range ff.options {
+				opts = append(opts, common.PDFTextString(o))
+			}
+			field["Opt"] = opts
+		}
+	case "checkbox", "radio":
+		v := pdfName("Off")
+		for _, btn := range group {
+			if btn.checked {
+				v = pdfName(btn.value)
+			}
+		}
+		field["V"], field["DV"] = v, v
+		if ff.kind == "radio" {
+			flags |= fieldRadio | fieldNoToggleToOff
+		}
+	case "button":
+		flags |= fieldPushButton
+	}
+	if flags != 0 {
+		field["Ff"] = flags
+	}
+	if ff.tooltip != "" {
+		field["TU"] = common.PDFTextString(ff.tooltip)
+	}
+	return field
+}
+
+// placements returns the markers of the fields in the page contents and
+// replaces them, flattened fields are drawn at the marker.
+func (fw *formWriter) placements() ([]fieldPlacement, error) {
+	f := fw.f
+	marker := []byte("/" + fieldPrefix)
+	var placements []fieldPlacement
+	flattened := map[int]pdfRef{}
+	for _, ref := range f.PageRefs() {
+		page := f.Dict(ref)
+		objs := f.Contents(page)
+		streams := make([][]byte, len(objs))
+		found := false
+		for i, obj := range objs {
+			data, ok := f.StreamData(obj)
+			if !ok {
+				return nil, fmt.Errorf("form fields: cannot decode the page contents")
+			}
+			streams[i] = data
+			found = found || bytes.Contains(data, marker)
+		}
+		if !found {
+			continue
+		}
+		ctm := identity
+		var stack []matrix
+		for i, data := range streams {
+			lx := &pdfLexer{Data: data, NoRefs: true}
+			var operands []any
+			var out bytes.Buffer
+			copied, start := 0, -1
+			for {
+				lx.SkipSpace()
+				if lx.EOF() {
+					break
+				}
+				pos := lx.Pos
+				v, err := lx.Value()
+				if err != nil {
+					return nil, fmt.Errorf("form fields: %w", err)
+				}
+				if start < 0 {
+					start = pos
+				}
+				tok, ok := v.(pdfRaw)
+				if !ok || isPDFOperand(tok) {
+					operands = append(operands, v)
+					continue
+				}
+				switch tok {
+				case "ID":
+					if end := bytes.Index(data[lx.Pos:], []byte("EI")); end >= 0 {
+						lx.Pos += end + 2
+					}
+				case "q":
+					stack = append(stack, ctm)
+				case "Q":
+					if len(stack) > 0 {
+						ctm, stack = stack[len(stack)-1], stack[:len(stack)-1]
+					}
+				case "cm":
+					if len(operands) == 6 {
+						var m matrix
+						for j, o := range operands {
+							m[j], _ = common.PDFFloat(o)
+						}
+						ctm = m.mul(ctm)
+					}
+				case "MP":
+					if len(operands) != 1 {
+						break
+					}
+					name, _ := operands[0].(pdfName)
+					s, ok := strings.CutPrefix(string(name), fieldPrefix)
+					if !ok {
+						break
+					}
+					id, err := strconv.Atoi(s)
+					if err != nil || id < 1 || id > len(fw.d.fields) {
+						break
+					}
+					ff := fw.d.fields[id-1]
+					out.Write(data[copied:start])
+					copied = lx.Pos
+					if ff.flatten || fw.d.flattenForms {
+						xobj, ok := flattened[id]
+						if !ok {
+							xobj = fw.appearance(ff, ff.checked)
+							flattened[id] = xobj
+						}
+						f.SubDict(f.SubDict(page, "Resources"), "XObject")[string(name)] = xobj
+						fmt.Fprintf(&out, "q 1 0 0 1 0 %s cm /%s Do Q", common.PDFNumber(-ff.baseline.ToPT()), name)
+					} else {
+						placements = append(placements, fieldPlacement{field: ff, page: ref, ctm: ctm})
+					}
+				}
+				operands = operands[:0]
+				start = -1
+			}
+			out.Write(data[copied:])
+			f.SetStream(objs[i], out.Bytes())
+		}
+	}
+	return placements, nil
+}
+
+// writeForms adds the form fields to the pages and the AcroForm dictionary
+// to the catalog.
+func (d *Document) writeForms(f *pdfFile) error {
+	fw := &formWriter{d: d, f: f, fonts: pdfDict{}}
+	placements, err := fw.placements()
+	if err != nil {
+		return err
+	}
+	widgets := map[*formField][]fieldPlacement{}
+	for _, pl := range placements {
+		widgets[pl.field] = append(widgets[pl.field], pl)
+	}
+	var names []string
+	groups := map[string][]*formField{}
+	for _, ff := range d.fields {
+		if _, ok := widgets[ff]; !ok {
+			if !ff.flatten && !d.flattenForms {
+				slog.Warn("Form field not placed on a page", "name", ff.name)
+			}
+			continue
+		}
+		if _, ok := groups[ff.name]; !ok {
+			names = append(names, ff.name)
+		}
+		groups[ff.name] = append(groups[ff.name], ff)
+	}
+	if len(names) == 0 {
+		return nil
+	}
+
+	acroForm := f.SubDict(f.Catalog(), "AcroForm")
+	fields, _ := f.Resolve(acroForm["Fields"]).(pdfArray)
+	for _, name := range names {
+		group := groups[name]
+		field := fw.field(group)
+		fieldRef := f.Add(field)
+		kids := pdfArray{}
+		for _, ff := range group {
+			for _, pl := range widgets[ff] {
+				widget := fw.widget(ff, pl)
+				widget["Parent"] = fieldRef
+				widgetRef := f.Add(widget)
+				kids = append(kids, widgetRef)
+				page := f.Dict(pl.page)
+				annots, _ := f.Resolve(page["Annots"]).(pdfArray)
+				page["Annots"] = append(annots, widgetRef)
+			}
+		}
+		field["Kids"] = kids
+		fields = append(fields, fieldRef)
+	}
+	acroForm["Fields"] = fields
+	fw.font("Helvetica", "Helv")
+	for _, name := range names {
+		if kind := groups[name][0].kind; kind == "checkbox" || kind == "radio" {
+			fw.font("ZapfDingbats", "ZaDb")
+		}
+	}
+	acroForm["DR"] = pdfDict{"Font": fw.fonts}
+	acroForm["DA"] = pdfString("/Helv 0 Tf 0 g")
+	return nil
+}
+
+// fieldColor returns the color at key of the options table, a color name,
+// a CSS value or a Color object. Form fields need gray, RGB or CMYK colors.
+func fieldColor(l *lua.State, d *Document, index int, key string, def *color.Color) *color.Color {
+	l.Field(index, key)
+	defer l.Pop(1)
+	var col *color.Color
+	switch {
+	case l.IsNil(-1):
+		return def
+	case l.IsBoolean(-1) && !l.ToBoolean(-1):
+		return nil
+	case l.IsString(-1):
+		s, _ := l.ToString(-1)
+		if col = d.color(s); col == nil {
+			lua.Errorf(l, "new_field: unknown color %s", s)
+		}
+	default:
+		col = d.colorValue(checkColor(l, -1))
+	}
+	switch col.Space {
+	case color.ColorGray, color.ColorRGB, color.ColorCMYK:
+		return col
+	}
+	lua.Errorf(l, "new_field: %s must be an opaque gray, RGB or CMYK color", key)
+	return nil
+}
+
+// documentNewField creates a form field and returns a vlist that places it,
+// on a page with page:output_at or inline in a text:
+// doc:new_field{type = "text", name = "email", width = "6cm", value = "..."}
+// The types are text, checkbox, radio, combo and button.
+func documentNewField(l *lua.State) int {
+	d := checkDocument(l, 1)
+	lua.CheckType(l, 2, lua.TypeTable)
+
+	str := func(key string) string {
+		l.Field(2, key)
+		defer l.Pop(1)
+		if l.IsNil(-1) {
+			return ""
+		}
+		return lua.CheckString(l, -1)
+	}
+	boolean := func(key string) bool {
+		l.Field(2, key)
+		defer l.Pop(1)
+		return l.ToBoolean(-1)
+	}
+	dimension := func(key string, def bag.ScaledPoint) bag.ScaledPoint {
+		l.Field(2, key)
+		defer l.Pop(1)
+		if l.IsNil(-1) {
+			return def
+		}
+		return checkDimension(l, -1)
+	}
+	number := func(key string, def float64) float64 {
+		l.Field(2, key)
+		defer l.Pop(1)
+		if l.IsNil(-1) {
+			return def
+		}
+		return lua.CheckNumber(l, -1)
+	}
+
+	ff := &formField{
+		kind:    str("type"),
+		name:    str("name"),
+		value:   str("value"),
+		checked: boolean("checked"),
+		caption: str("caption"),
+		tooltip: str("tooltip"),
+		url:     str("url"),
+		submit:  str("submit"),
+		reset:   boolean("reset"),
+		font:    str("font"),
+		flatten: boolean("flatten"),
+	}
+	if _, ok := fieldTypes[ff.kind]; !ok {
+		lua.Errorf(l, "new_field: unknown type %s (use text, checkbox, radio, combo or button)", ff.kind)
+		return 0
+	}
+	if ff.name == "" || strings.Contains(ff.name, ".") {
+		lua.Errorf(l, "new_field: a name without periods is required")
+		return 0
+	}
+	for _, other := range d.fields {
+		if other.name != ff.name {
+			continue
+		}
+		switch {
+		case other.kind != "radio" || ff.kind != "radio":
+			lua.Errorf(l, "new_field: duplicate field name %s", ff.name)
+		case other.value == ff.value:
+			lua.Errorf(l, "new_field: radio group %s has two buttons with the value %s", ff.name, ff.value)
+		case other.checked && ff.checked:
+			lua.Errorf(l, "new_field: radio group %s has two checked buttons", ff.name)
+		}
+	}
+	if ff.font == "" {
+		ff.font = "Helvetica"
+	}
+	if _, ok := fieldFonts[ff.font]; !ok {
+		lua.Errorf(l, "new_field: unknown font %s (use Helvetica, Helvetica-Bold, Courier or Courier-Bold)", ff.font)
+		return 0
+	}
+	ff.size = number("size", 10)
+	if ff.size <= 0 {
+		lua.Errorf(l, "new_field: size must be positive")
+		return 0
+	}
+	ff.borderWidth = number("border_width", 1)
+	ff.maxLength = int(number("max_length", 0))
+	black := &color.Color{Space: color.ColorGray, A: 1}
+	ff.color = fieldColor(l, d, 2, "color", black)
+	ff.border = fieldColor(l, d, 2, "border_color", black)
+	var background *color.Color
+	if ff.kind == "button" {
+		background = &color.Color{Space: color.ColorGray, G: 0.85, A: 1}
+	}
+	ff.background = fieldColor(l, d, 2, "background_color", background)
+	switch a := str("align"); a {
+	case "", "left":
+	case "center":
+		ff.align = 1
+	case "right":
+		ff.align = 2
+	default:
+		lua.Errorf(l, "new_field: unknown alignment %s", a)
+		return 0
+	}
+	for key, flag := range map[string]int{"readonly": fieldReadOnly, "required": fieldRequired} {
+		if boolean(key) {
+			ff.flags |= flag
+		}
+	}
+
+	font := fieldFonts[ff.font]
+	pad := ff.borderWidth + 2
+	var width, height float64
+	switch ff.kind {
+	case "text":
+		if boolean("multiline") {
+			ff.flags |= fieldMultiline
+		}
+		if boolean("password") {
+			ff.flags |= fieldPassword
+		}
+		width, height = 144, ff.size*1.15+2*pad
+		if ff.flags&fieldMultiline != 0 {
+			height = 3*ff.size*1.15 + 2*pad
+		}
+	case "combo":
+		ff.flags |= fieldCombo
+		if boolean("editable") {
+			ff.flags |= fieldEdit
+		}
+		l.Field(2, "options")
+		if l.IsTable(-1) {
+			for i := 1; i <= l.RawLength(-1); i++ {
+				l.RawGetInt(-1, i)
+				ff.options = append(ff.options, lua.CheckString(l, -1))
+				l.Pop(1)
+			}
+		}
+		l.Pop(1)
+		if len(ff.options) == 0 {
+			lua.Errorf(l, "new_field: combo box %s needs options", ff.name)
+			return 0
+		}
+		if ff.value != "" && ff.flags&fieldEdit == 0 && !slices.Contains(ff.options, ff.value) {
+			lua.Errorf(l, "new_field: %s is not an option of %s", ff.value, ff.name)
+			return 0
+		}
+		width, height = 144, ff.size*1.15+2*pad
+	case "checkbox", "radio":
+		if ff.kind == "radio" && ff.value == "" {
+			lua.Errorf(l, "new_field: radio button %s needs a value", ff.name)
+			return 0
+		}
+		if ff.value == "" {
+			ff.value = "Yes"
+		}
+		if ff.value == "Off" {
+			lua.Errorf(l, "new_field: Off is not a valid value")
+			return 0
+		}
+		width = ff.size * 1.2
+		height = width
+	case "button":
+		if ff.caption == "" {
+			ff.caption = ff.value
+		}
+		ff.value = ""
+		width, height = font.width(winAnsiBytes(ff.caption), ff.size)+2*pad+8, ff.size+2*pad+4
+	}
+	ff.width = dimension("width", bag.ScaledPointFromFloat(width))
+	ff.height = dimension("height", bag.ScaledPointFromFloat(height))
+	if ff.width <= 0 || ff.height <= 0 {
+		lua.Errorf(l, "new_field: width and height must be positive")
+		return 0
+	}
+
+	// the text baseline of single line fields is centered on the cap height
+	h := ff.height.ToPT()
+	base := (h - 0.7*ff.size) / 2
+	if ff.flags&fieldMultiline != 0 {
+		base = h - pad - 0.8*ff.size
+	}
+	ff.baseline = bag.ScaledPointFromFloat(max(base, 0))
+
+	d.fields = append(d.fields, ff)
+	ff.id = len(d.fields)
+	vl := node.Vpack(node.Hpack(ff.rule()))
+	node.SetAttribute(vl, attrField, ff)
+	l.PushUserData(&VList{Value: vl})
+	lua.SetMetaTableNamed(l, vlistMetaTable)
+	return 1
+}
+
+// rule returns the invisible rule that marks the field, the baseline of
+// the field is the baseline of the rule.
+func (ff *formField) rule() *node.Rule {
+	rule := node.NewRule()
+	rule.Hide = true
+	rule.Width = ff.width
+	rule.Height = ff.height - ff.baseline
+	rule.Depth = ff.baseline
+	rule.Pre = fmt.Sprintf("/%s%d MP", fieldPrefix, ff.id)
+	return rule
+}
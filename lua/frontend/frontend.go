@@ -24,12 +24,14 @@ func openFrontend(l *lua.State) int {
 	registerImagefileMetaTable(l)
 	registerImageNodeMetaTable(l)
 	registerColorProfileMetaTable(l)
+	registerLayerMetaTable(l)
 
 	// Create the frontend module table
 	lua.NewLibrary(l, []lua.RegistryFunction{
 		{Name: "new", Function: documentNew},
 		{Name: "text", Function: textNew},
 		{Name: "fontsource", Function: fontSourceNew},
+		{Name: "add_font_dir", Function: addFontDir},
 		{Name: "color", Function: colorNew},
 		{Name: "table", Function: tableNew},
 		{Name: "sp", Function: spNew},
@@ -60,33 +60,13 @@ func tableToTypesettingOptions(l *lua.State, index int, doc *frontend.Document)
 	}
 	l.Pop(1)
 
-	l.Field(absIndex, "font_size")
-	if sp, err := toDimension(l, -1); err == nil {
+	if sp := optionsFontSize(l, absIndex); sp != 0 {
 		opts = append(opts, frontend.FontSize(sp))
-	} else {
-		l.Pop(1)
-		l.Field(absIndex, "fontsize")
-		if sp, err := toDimension(l, -1); err == nil {
-			opts = append(opts, frontend.FontSize(sp))
-		}
 	}
-	l.Pop(1)
 
-	l.Field(absIndex, "font_family")
-	if ud := lua.TestUserData(l, -1, fontFamilyMetaTable); ud != nil {
-		if ff, ok := ud.(*FontFamily); ok {
-			opts = append(opts, frontend.Family(ff.Value))
-		}
-	} else {
-		l.Pop(1)
-		l.Field(absIndex, "fontfamily")
-		if ud := lua.TestUserData(l, -1, fontFamilyMetaTable); ud != nil {
-			if ff, ok := ud.(*FontFamily); ok {
-				opts = append(opts, frontend.Family(ff.Value))
-			}
-		}
+	if ff := optionsFontFamily(l, absIndex); ff != nil {
+		opts = append(opts, frontend.Family(ff))
 	}
-	l.Pop(1)
 
 	l.Field(absIndex, "language")
 	if ud := lua.TestUserData(l, -1, languageMetaTable); ud != nil {
@@ -118,3 +98,69 @@ func tableToTypesettingOptions(l *lua.State, index int, doc *frontend.Document)
 
 	return opts
 }
+
+// optionsFontFamily returns the font_family (or fontfamily) entry of the
+// options table at index or nil if there is none.
+func optionsFontFamily(l *lua.State, index int) *frontend.FontFamily {
+	absIndex := l.AbsIndex(index)
+	for _, key := range []string{"font_family", "fontfamily"} {
+		l.Field(absIndex, key)
+		if ud := lua.TestUserData(l, -1, fontFamilyMetaTable); ud != nil {
+			if ff, ok := ud.(*FontFamily); ok {
+				l.Pop(1)
+				return ff.Value
+			}
+		}
+		l.Pop(1)
+	}
+	return nil
+}
+
+// tableToVariations converts a Lua table such as {wght = 650, wdth = 90} to
+// variable font axis values.
+func tableToVariations(l *lua.State, index int) map[string]float64 {
+	absIndex := l.AbsIndex(index)
+	variations := make(map[string]float64)
+	l.PushNil()
+	for l.Next(absIndex) {
+		if l.IsString(-2) && l.IsNumber(-1) {
+			axis, _ := l.ToString(-2)
+			variations[axis], _ = l.ToNumber(-1)
+		}
+		l.Pop(1)
+	}
+	return variations
+}
+
+// pushVariations pushes variable font axis values as a Lua table.
+func pushVariations(l *lua.State, variations map[string]float64) {
+	l.NewTable()
+	for axis, value := range variations {
+		l.PushNumber(value)
+		l.SetField(-2, axis)
+	}
+}
+
+// pushStrings pushes a list of strings as a Lua array.
+func pushStrings(l *lua.State, strs []string) {
+	l.NewTable()
+	for i, s := range strs {
+		l.PushString(s)
+		l.RawSetInt(-2, i+1)
+	}
+}
+
+// optionsFontSize returns the font_size (or fontsize) entry of the options
+// table at index or 0 if there is none.
+func optionsFontSize(l *lua.State, index int) bag.ScaledPoint {
+	absIndex := l.AbsIndex(index)
+	for _, key := range []string{"font_size", "fontsize"} {
+		l.Field(absIndex, key)
+		sp, err := toDimension(l, -1)
+		l.Pop(1)
+		if err == nil {
+			return sp
+		}
+	}
+	return 0
+}
@@ -0,0 +1,705 @@
+package frontend
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// iccProfile converts colors between the color space of an ICC profile and
+// CIELAB (D50). Profiles with lookup tables (lut8, lut16, lutAtoB and
+// lutBtoA) and matrix/TRC profiles are supported. The perceptual tables are
+// used if a profile has tables for several rendering intents.
+type iccProfile struct {
+	// space is the color space of the profile: "RGB", "CMYK" or "GRAY"
+	space string
+	// channels is the number of color components of space
+	channels int
+	toLab    func([]float64) [3]float64
+	fromLab  func([3]float64) []float64
+}
+
+// d50 is the PCS white point.
+var d50 = [3]float64{0.9642, 1.0, 0.8249}
+
+// srgbProfile is used for the RGB colors of the document.
+var srgbProfile = newMatrixProfile(
+	[3][3]float64{
+		{0.4360747, 0.3850649, 0.1430804},
+		{0.2225045, 0.7168786, 0.0606169},
+		{0.0139322, 0.0971045, 0.7141733},
+	},
+	// the sRGB curve as ICC parametric curve (function type 3)
+	parametricCurve{typ: 3, p: []float64{2.4, 1 / 1.055, 0.055 / 1.055, 1 / 12.92, 0.04045}},
+)
+
+// iccConvert converts the color v from the color space of from into the
+// color space of to.
+func iccConvert(from, to *iccProfile, v []float64) []float64 {
+	return to.fromLab(from.toLab(v))
+}
+
+// iccCurve is a one-dimensional transfer function on [0, 1].
+type iccCurve interface {
+	eval(x float64) float64
+}
+
+type identityCurve struct{}
+
+func (identityCurve) eval(x float64) float64 { return x }
+
+type gammaCurve float64
+
+func (g gammaCurve) eval(x float64) float64 { return math.Pow(clamp01(x), float64(g)) }
+
+// tableCurve is a sampled curve with equally spaced entries.
+type tableCurve []float64
+
+func (t tableCurve) eval(x float64) float64 {
+	return interpolate(t, clamp01(x))
+}
+
+// parametricCurve is an ICC parametric curve ("para").
+type parametricCurve struct {
+	typ int
+	p   []float64
+}
+
+func (c parametricCurve) eval(x float64) float64 {
+	p := c.p
+	pow := func(v float64) float64 {
+		if v <= 0 {
+			return 0
+		}
+		return math.Pow(v, p[0])
+	}
+	switch c.typ {
+	case 1:
+		if x >= -p[2]/p[1] {
+			return pow(p[1]*x + p[2])
+		}
+		return 0
+	case 2:
+		if x >= -p[2]/p[1] {
+			return pow(p[1]*x+p[2]) + p[3]
+		}
+		return p[3]
+	case 3:
+		if x >= p[4] {
+			return pow(p[1]*x + p[2])
+		}
+		return p[3] * x
+	case 4:
+		if x >= p[4] {
+			return pow(p[1]*x+p[2]) + p[5]
+		}
+		return p[3]*x + p[6]
+	}
+	return pow(x)
+}
+
+// invertCurve returns x in [0, 1] with c(x) = y for a monotonic curve.
+func invertCurve(c iccCurve, y float64) float64 {
+	lo, hi := 0.0, 1.0
+	rising := c.eval(1) >= c.eval(0)
+	for i := 0; i < 32; i++ {
+		mid := (lo + hi) / 2
+		if (c.eval(mid) < y) == rising {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return (lo + hi) / 2
+}
+
+// interpolate returns the value at x in [0, 1] of the equally spaced samples.
+func interpolate(samples []float64, x float64) float64 {
+	if len(samples) == 1 {
+		return samples[0]
+	}
+	pos := x * float64(len(samples)-1)
+	i := int(pos)
+	if i >= len(samples)-1 {
+		return samples[len(samples)-1]
+	}
+	f := pos - float64(i)
+	return samples[i]*(1-f) + samples[i+1]*f
+}
+
+func clamp01(x float64) float64 {
+	return math.Max(0, math.Min(1, x))
+}
+
+// clut is a multi-dimensional color lookup table.
+type clut struct {
+	grid []int
+	out  int
+	// data is in the order of the ICC specification, the first input
+	// channel varies slowest
+	data []float64
+}
+
+// eval interpolates the table multilinearly.
+func (t *clut) eval(in []float64) []float64 {
+	n := len(t.grid)
+	base := make([]int, n)
+	frac := make([]float64, n)
+	stride := make([]int, n)
+	s := t.out
+	for i := n - 1; i >= 0; i-- {
+		stride[i] = s
+		s *= t.grid[i]
+	}
+	for i := 0; i < n; i++ {
+		pos := clamp01(in[i]) * float64(t.grid[i]-1)
+		base[i] = int(pos)
+		if base[i] >= t.grid[i]-1 {
+			base[i] = t.grid[i] - 1
+			if base[i] > 0 {
+				base[i]--
+			}
+		}
+		frac[i] = pos - float64(base[i])
+	}
+	ret := make([]float64, t.out)
+	for corner := 0; corner < 1<<n; corner++ {
+		w := 1.0
+		offset := 0
+		for i := 0; i < n; i++ {
+			idx := base[i]
+			if corner&(1<<i) != 0 {
+				w *= frac[i]
+				if t.grid[i] > 1 {
+					idx++
+				}
+			} else {
+				w *= 1 - frac[i]
+			}
+			offset += idx * stride[i]
+		}
+		if w == 0 {
+			continue
+		}
+		for o := 0; o < t.out; o++ {
+			ret[o] += w * t.data[offset+o]
+		}
+	}
+	return ret
+}
+
+// iccStage is one step of a lookup table transform.
+type iccStage func([]float64) []float64
+
+func curveStage(curves []iccCurve) iccStage {
+	return func(in []float64) []float64 {
+		out := make([]float64, len(in))
+		for i, v := range in {
+			out[i] = v
+			if i < len(curves) {
+				out[i] = curves[i].eval(v)
+			}
+		}
+		return out
+	}
+}
+
+// matrixStage applies a 3x3 matrix and an offset.
+func matrixStage(m [12]float64) iccStage {
+	return func(in []float64) []float64 {
+		return []float64{
+			m[0]*in[0] + m[1]*in[1] + m[2]*in[2] + m[9],
+			m[3]*in[0] + m[4]*in[1] + m[5]*in[2] + m[10],
+			m[6]*in[0] + m[7]*in[1] + m[8]*in[2] + m[11],
+		}
+	}
+}
+
+func pipeline(stages []iccStage) func([]float64) []float64 {
+	return func(v []float64) []float64 {
+		for _, st := range stages {
+			v = st(v)
+		}
+		return v
+	}
+}
+
+// pcsEncoding is the encoding of the PCS values in a lookup table.
+type pcsEncoding int
+
+const (
+	pcsLab pcsEncoding = iota
+	// pcsLabLegacy is the 16 bit Lab encoding of ICC version 2
+	pcsLabLegacy
+	pcsXYZ
+)
+
+// decode converts the table values of the PCS into Lab.
+func (e pcsEncoding) decode(v []float64) [3]float64 {
+	switch e {
+	case pcsXYZ:
+		f := 65535.0 / 32768.0
+		return xyzToLab([3]float64{v[0] * f, v[1] * f, v[2] * f})
+	case pcsLabLegacy:
+		return [3]float64{v[0] * 65535 / 65280 * 100, v[1]*65535/256 - 128, v[2]*65535/256 - 128}
+	}
+	return [3]float64{v[0] * 100, v[1]*255 - 128, v[2]*255 - 128}
+}
+
+// encode converts Lab into the table values of the PCS.
+func (e pcsEncoding) encode(lab [3]float64) []float64 {
+	switch e {
+	case pcsXYZ:
+		xyz := labToXYZ(lab)
+		f := 32768.0 / 65535.0
+		return []float64{clamp01(xyz[0] * f), clamp01(xyz[1] * f), clamp01(xyz[2] * f)}
+	case pcsLabLegacy:
+		return []float64{clamp01(lab[0] / 100 * 65280 / 65535), clamp01((lab[1] + 128) * 256 / 65535), clamp01((lab[2] + 128) * 256 / 65535)}
+	}
+	return []float64{clamp01(lab[0] / 100), clamp01((lab[1] + 128) / 255), clamp01((lab[2] + 128) / 255)}
+}
+
+func labF(t float64) float64 {
+	if t > 216.0/24389.0 {
+		return math.Cbrt(t)
+	}
+	return (24389.0/27.0*t + 16) / 116
+}
+
+func labFInv(t float64) float64 {
+	if t3 := t * t * t; t3 > 216.0/24389.0 {
+		return t3
+	}
+	return (116*t - 16) * 27.0 / 24389.0
+}
+
+func xyzToLab(xyz [3]float64) [3]float64 {
+	fx, fy, fz := labF(xyz[0]/d50[0]), labF(xyz[1]/d50[1]), labF(xyz[2]/d50[2])
+	return [3]float64{116*fy - 16, 500 * (fx - fy), 200 * (fy - fz)}
+}
+
+func labToXYZ(lab [3]float64) [3]float64 {
+	fy := (lab[0] + 16) / 116
+	fx := fy + lab[1]/500
+	fz := fy - lab[2]/200
+	return [3]float64{labFInv(fx) * d50[0], labFInv(fy) * d50[1], labFInv(fz) * d50[2]}
+}
+
+// newMatrixProfile returns an RGB profile with the colorants m (the columns
+// are the XYZ values of red, green and blue) and the same curve for all
+// channels.
+func newMatrixProfile(m [3][3]float64, trc iccCurve) *iccProfile {
+	return newMatrixTRCProfile(m, [3]iccCurve{trc, trc, trc})
+}
+
+func newMatrixTRCProfile(m [3][3]float64, trc [3]iccCurve) *iccProfile {
+	inv := invert3(m)
+	return &iccProfile{
+		space:    "RGB",
+		channels: 3,
+		toLab: func(v []float64) [3]float64 {
+			var lin, xyz [3]float64
+			for i := range lin {
+				lin[i] = trc[i].eval(clamp01(v[i]))
+			}
+			for i := range xyz {
+				xyz[i] = m[i][0]*lin[0] + m[i][1]*lin[1] + m[i][2]*lin[2]
+			}
+			return xyzToLab(xyz)
+		},
+		fromLab: func(lab [3]float64) []float64 {
+			xyz := labToXYZ(lab)
+			ret := make([]float64, 3)
+			for i := range ret {
+				lin := clamp01(inv[i][0]*xyz[0] + inv[i][1]*xyz[1] + inv[i][2]*xyz[2])
+				ret[i] = invertCurve(trc[i], lin)
+			}
+			return ret
+		},
+	}
+}
+
+func invert3(m [3][3]float64) [3][3]float64 {
+	det := m[0][0]*(m[1][1]*m[2][2]-m[1][2]*m[2][1]) -
+		m[0][1]*(m[1][0]*m[2][2]-m[1][2]*m[2][0]) +
+		m[0][2]*(m[1][0]*m[2][1]-m[1][1]*m[2][0])
+	return [3][3]float64{
+		{(m[1][1]*m[2][2] - m[1][2]*m[2][1]) / det, (m[0][2]*m[2][1] - m[0][1]*m[2][2]) / det, (m[0][1]*m[1][2] - m[0][2]*m[1][1]) / det},
+		{(m[1][2]*m[2][0] - m[1][0]*m[2][2]) / det, (m[0][0]*m[2][2] - m[0][2]*m[2][0]) / det, (m[0][2]*m[1][0] - m[0][0]*m[1][2]) / det},
+		{(m[1][0]*m[2][1] - m[1][1]*m[2][0]) / det, (m[0][1]*m[2][0] - m[0][0]*m[2][1]) / det, (m[0][0]*m[1][1] - m[0][1]*m[1][0]) / det},
+	}
+}
+
+// iccReader reads the tags of an ICC profile.
+type iccReader struct {
+	data []byte
+	tags map[string][]byte
+}
+
+func (r *iccReader) u16(b []byte, pos int) float64 {
+	return float64(binary.BigEndian.Uint16(b[pos:]))
+}
+
+func (r *iccReader) s15Fixed16(b []byte, pos int) float64 {
+	return float64(int32(binary.BigEndian.Uint32(b[pos:]))) / 65536
+}
+
+// parseICC parses the ICC profile data. The counts and lengths in the profile
+// are checked against the data before they are used.
+func parseICC(data []byte) (*iccProfile, error) {
+	if len(data) < 132 || string(data[36:40]) != "acsp" {
+		return nil, fmt.Errorf("not an ICC profile")
+	}
+	r := &iccReader{data: data, tags: make(map[string][]byte)}
+	count := int(binary.BigEndian.Uint32(data[128:]))
+	if 132+12*count > len(data) {
+		return nil, fmt.Errorf("corrupt ICC profile: the tag table exceeds the profile")
+	}
+	for i := 0; i < count; i++ {
+		entry := data[132+12*i:]
+		offset, size := int(binary.BigEndian.Uint32(entry[4:])), int(binary.BigEndian.Uint32(entry[8:]))
+		if offset+size > len(data) {
+			return nil, fmt.Errorf("corrupt ICC profile: tag %q exceeds the profile", string(entry[:4]))
+		}
+		r.tags[string(entry[:4])] = data[offset : offset+size]
+	}
+	p := &iccProfile{}
+	switch string(data[16:20]) {
+	case "RGB ":
+		p.space, p.channels = "RGB", 3
+	case "CMYK":
+		p.space, p.channels = "CMYK", 4
+	case "GRAY":
+		p.space, p.channels = "GRAY", 1
+	default:
+		return nil, fmt.Errorf("unsupported ICC color space %q", string(data[16:20]))
+	}
+	xyzPCS := string(data[20:24]) == "XYZ "
+
+	if toPCS, enc, err := r.lut(xyzPCS, p.channels, 3, "A2B0", "A2B1", "A2B2"); err != nil {
+		return nil, err
+	} else if toPCS != nil {
+		p.toLab = func(v []float64) [3]float64 { return enc.decode(toPCS(v)) }
+	}
+	if fromPCS, enc, err := r.lut(xyzPCS, 3, p.channels, "B2A0", "B2A1", "B2A2"); err != nil {
+		return nil, err
+	} else if fromPCS != nil {
+		p.fromLab = func(lab [3]float64) []float64 { return fromPCS(enc.encode(lab)) }
+	}
+	if p.toLab != nil && p.fromLab != nil {
+		return p, nil
+	}
+	switch p.space {
+	case "RGB":
+		var m [3][3]float64
+		var trc [3]iccCurve
+		var err error
+		for i, c := range []string{"r", "g", "b"} {
+			xyz, ok := r.tags[c+"XYZ"]
+			if !ok {
+				return nil, fmt.Errorf("ICC profile has neither lookup tables nor colorants")
+			}
+			if len(xyz) < 20 {
+				return nil, fmt.Errorf("corrupt ICC profile: short colorant tag %q", c+"XYZ")
+			}
+			for j := 0; j < 3; j++ {
+				m[j][i] = r.s15Fixed16(xyz, 8+4*j)
+			}
+			if trc[i], _, err = r.curve(r.tags[c+"TRC"]); err != nil {
+				return nil, err
+			}
+		}
+		mp := newMatrixTRCProfile(m, trc)
+		if p.toLab == nil {
+			p.toLab = mp.toLab
+		}
+		if p.fromLab == nil {
+			p.fromLab = mp.fromLab
+		}
+	case "GRAY":
+		trc, _, err := r.curve(r.tags["kTRC"])
+		if err != nil {
+			return nil, err
+		}
+		if p.toLab == nil {
+			p.toLab = func(v []float64) [3]float64 {
+				return [3]float64{116*labF(trc.eval(v[0])) - 16, 0, 0}
+			}
+		}
+		if p.fromLab == nil {
+			p.fromLab = func(lab [3]float64) []float64 {
+				return []float64{invertCurve(trc, labFInv((lab[0]+16)/116))}
+			}
+		}
+	default:
+		return nil, fmt.Errorf("ICC profile has no lookup tables")
+	}
+	return p, nil
+}
+
+// curve reads a "curv" or "para" element and returns its padded length.
+func (r *iccReader) curve(b []byte) (iccCurve, int, error) {
+	if len(b) < 12 {
+		return nil, 0, fmt.Errorf("missing ICC curve")
+	}
+	switch string(b[:4]) {
+	case "curv":
+		n := int(binary.BigEndian.Uint32(b[8:]))
+		if 12+2*n > len(b) {
+			return nil, 0, fmt.Errorf("corrupt ICC profile: the curve exceeds its tag")
+		}
+		size := (12 + 2*n + 3) &^ 3
+		switch n {
+		case 0:
+			return identityCurve{}, size, nil
+		case 1:
+			return gammaCurve(r.u16(b, 12) / 256), size, nil
+		}
+		t := make(tableCurve, n)
+		for i := range t {
+			t[i] = r.u16(b, 12+2*i) / 65535
+		}
+		return t, size, nil
+	case "para":
+		typ := int(binary.BigEndian.Uint16(b[8:]))
+		counts := []int{1, 3, 4, 5, 7}
+		if typ >= len(counts) {
+			return nil, 0, fmt.Errorf("unknown ICC parametric curve type %d", typ)
+		}
+		if 12+4*counts[typ] > len(b) {
+			return nil, 0, fmt.Errorf("corrupt ICC profile: the curve exceeds its tag")
+		}
+		c := parametricCurve{typ: typ, p: make([]float64, counts[typ])}
+		for i := range c.p {
+			c.p[i] = r.s15Fixed16(b, 12+4*i)
+		}
+		return c, (12 + 4*len(c.p) + 3) &^ 3, nil
+	}
+	return nil, 0, fmt.Errorf("unknown ICC curve type %q", string(b[:4]))
+}
+
+func (r *iccReader) curves(b []byte, n int) ([]iccCurve, error) {
+	ret := make([]iccCurve, n)
+	pos := 0
+	for i := range ret {
+		if pos > len(b) {
+			return nil, fmt.Errorf("corrupt ICC profile: the curves exceed their tag")
+		}
+		c, size, err := r.curve(b[pos:])
+		if err != nil {
+			return nil, err
+		}
+		ret[i] = c
+		pos += size
+	}
+	return ret, nil
+}
+
+// lut returns the transform of the first of the tags that the profile has.
+// The transform has in input and out output channels, the PCS side uses the
+// returned encoding.
+func (r *iccReader) lut(xyzPCS bool, in, out int, tags ...string) (func([]float64) []float64, pcsEncoding, error) {
+	for _, tag := range tags {
+		b, ok := r.tags[tag]
+		if !ok {
+			continue
+		}
+		if len(b) < 32 {
+			return nil, 0, fmt.Errorf("corrupt ICC profile: short lookup table %q", tag)
+		}
+		if int(b[8]) != in || int(b[9]) != out {
+			return nil, 0, fmt.Errorf("ICC lookup table %q has %d inputs and %d outputs instead of %d and %d", tag, b[8], b[9], in, out)
+		}
+		enc := pcsLab
+		if xyzPCS {
+			enc = pcsXYZ
+		}
+		var stages []iccStage
+		var err error
+		switch string(b[:4]) {
+		case "mft1", "mft2":
+			if string(b[:4]) == "mft2" && !xyzPCS {
+				enc = pcsLabLegacy
+			}
+			stages, err = r.lut816(b, xyzPCS && tag[0] == 'B')
+		case "mAB ", "mBA ":
+			stages, err = r.lutAB(b, string(b[:4]) == "mAB ")
+		default:
+			err = fmt.Errorf("unsupported ICC lookup table type %q", string(b[:4]))
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		return pipeline(stages), enc, nil
+	}
+	return nil, 0, nil
+}
+
+// clutSize returns the number of values of a color lookup table with the
+// grid points per input channel and out output channels. It returns -1 if a
+// channel has no grid points or if the table has more than limit values.
+func clutSize(grid []int, out, limit int) int {
+	size := out
+	for _, g := range grid {
+		if g < 1 {
+			return -1
+		}
+		if size *= g; size > limit {
+			return -1
+		}
+	}
+	return size
+}
+
+// lut816 reads a lut8 or lut16 element. The matrix is only used for XYZ
+// input.
+func (r *iccReader) lut816(b []byte, useMatrix bool) ([]iccStage, error) {
+	in, out, grid := int(b[8]), int(b[9]), int(b[10])
+	sixteen := string(b[:4]) == "mft2"
+	if len(b) < 48 || sixteen && len(b) < 52 {
+		return nil, fmt.Errorf("corrupt ICC profile: short lookup table")
+	}
+	var stages []iccStage
+	if useMatrix {
+		var m [12]float64
+		for i := 0; i < 9; i++ {
+			m[i] = r.s15Fixed16(b, 12+4*i)
+		}
+		stages = append(stages, matrixStage(m))
+	}
+	inEntries, outEntries, pos, width, maxval := 256, 256, 48, 1, 255.0
+	if sixteen {
+		inEntries, outEntries = int(r.u16(b, 48)), int(r.u16(b, 50))
+		pos, width, maxval = 52, 2, 65535
+	}
+	grids := make([]int, in)
+	for i := range grids {
+		grids[i] = grid
+	}
+	size := clutSize(grids, out, len(b))
+	if inEntries < 2 || outEntries < 2 || size < 0 ||
+		pos+width*(in*inEntries+size+out*outEntries) > len(b) {
+		return nil, fmt.Errorf("corrupt ICC profile: the lookup table exceeds its tag")
+	}
+	value := func(i int) float64 {
+		if sixteen {
+			return r.u16(b, i) / maxval
+		}
+		return float64(b[i]) / maxval
+	}
+	table := func(n int) tableCurve {
+		t := make(tableCurve, n)
+		for i := range t {
+			t[i] = value(pos)
+			pos += width
+		}
+		return t
+	}
+	inCurves := make([]iccCurve, in)
+	for i := range inCurves {
+		inCurves[i] = table(inEntries)
+	}
+	t := &clut{grid: grids, out: out}
+	t.data = table(size)
+	outCurves := make([]iccCurve, out)
+	for i := range outCurves {
+		outCurves[i] = table(outEntries)
+	}
+	return append(stages, curveStage(inCurves), t.eval, curveStage(outCurves)), nil
+}
+
+// lutAB reads a lutAtoB or lutBtoA element.
+func (r *iccReader) lutAB(b []byte, aToB bool) ([]iccStage, error) {
+	in, out := int(b[8]), int(b[9])
+	offset := func(pos int) int { return int(binary.BigEndian.Uint32(b[pos:])) }
+	offB, offMatrix, offM, offCLUT, offA := offset(12), offset(16), offset(20), offset(24), offset(28)
+	for _, off := range []int{offB, offMatrix, offM, offCLUT, offA} {
+		if off > len(b) {
+			return nil, fmt.Errorf("corrupt ICC profile: an element exceeds the lookup table")
+		}
+	}
+	// the channels at the B, M and matrix side are the PCS channels
+	pcs, device := out, in
+	if !aToB {
+		pcs, device = in, out
+	}
+	var bCurves, mCurves, aCurves []iccCurve
+	var err error
+	if bCurves, err = r.curves(b[offB:], pcs); err != nil {
+		return nil, err
+	}
+	if offM != 0 {
+		if mCurves, err = r.curves(b[offM:], pcs); err != nil {
+			return nil, err
+		}
+	}
+	if offA != 0 {
+		if aCurves, err = r.curves(b[offA:], device); err != nil {
+			return nil, err
+		}
+	}
+	var matrix iccStage
+	if offMatrix != 0 {
+		if offMatrix+48 > len(b) {
+			return nil, fmt.Errorf("corrupt ICC profile: the matrix exceeds the lookup table")
+		}
+		var m [12]float64
+		for i := range m {
+			m[i] = r.s15Fixed16(b, offMatrix+4*i)
+		}
+		matrix = matrixStage(m)
+	}
+	var table iccStage
+	if offCLUT != 0 {
+		c := b[offCLUT:]
+		if len(c) < 20 {
+			return nil, fmt.Errorf("corrupt ICC profile: the color table exceeds the lookup table")
+		}
+		t := &clut{grid: make([]int, in), out: out}
+		for i := range t.grid {
+			t.grid[i] = int(c[i])
+		}
+		precision := int(c[16])
+		size := clutSize(t.grid, out, len(c))
+		if precision != 1 && precision != 2 || size < 0 || 20+precision*size > len(c) {
+			return nil, fmt.Errorf("corrupt ICC profile: the color table exceeds the lookup table")
+		}
+		t.data = make([]float64, size)
+		for i := range t.data {
+			if precision == 1 {
+				t.data[i] = float64(c[20+i]) / 255
+			} else {
+				t.data[i] = r.u16(c, 20+2*i) / 65535
+			}
+		}
+		table = t.eval
+	}
+	var stages []iccStage
+	add := func(st ...iccStage) {
+		for _, s := range st {
+			if s != nil {
+				stages = append(stages, s)
+			}
+		}
+	}
+	if aToB {
+		if aCurves != nil {
+			add(curveStage(aCurves))
+		}
+		add(table)
+		if mCurves != nil {
+			add(curveStage(mCurves))
+		}
+		add(matrix, curveStage(bCurves))
+	} else {
+		add(curveStage(bCurves), matrix)
+		if mCurves != nil {
+			add(curveStage(mCurves))
+		}
+		add(table)
+		if aCurves != nil {
+			add(curveStage(aCurves))
+		}
+	}
+	return stages, nil
+}
@@ -86,6 +86,16 @@ func imageNodeIndex(l *lua.State) int {
 	case "height":
 		pushScaledPoint(l, img.Value.Height)
 		return 1
+	case "role":
+		if role, ok := img.Value.Attributes[attrRole].(string); ok && role != "" {
+			l.PushString(role)
+			return 1
+		}
+	case "alt":
+		if alt, ok := img.Value.Attributes[attrAlt].(string); ok && alt != "" {
+			l.PushString(alt)
+			return 1
+		}
 	}
 	return 0
 }
@@ -100,6 +110,14 @@ func imageNodeNewIndex(l *lua.State) int {
 		img.Value.Width = bag.ScaledPoint(checkDimension(l, 3))
 	case "height":
 		img.Value.Height = bag.ScaledPoint(checkDimension(l, 3))
+	case "role":
+		role := lua.CheckString(l, 3)
+		if err := checkRole(role); err != nil {
+			lua.Errorf(l, "%s", err.Error())
+		}
+		node.SetAttribute(img.Value, attrRole, role)
+	case "alt":
+		node.SetAttribute(img.Value, attrAlt, lua.CheckString(l, 3))
 	default:
 		lua.Errorf(l, "cannot set attribute %s on ImageNode", key)
 	}
@@ -0,0 +1,149 @@
+package frontend
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/boxesandglue/boxesandglue/backend/document"
+	"github.com/speedata/go-lua"
+)
+
+// facturXNamespace is the XMP namespace of Factur-X and ZUGFeRD 2.1 and
+// later.
+const facturXNamespace = "urn:factur-x:pdfa:CrossIndustryDocument:invoice:1p0#"
+
+// invoiceProfiles are the conformance levels of the invoice standards with
+// the relationship of the XML file to the PDF. The MINIMUM and BASIC WL
+// profiles are no complete invoices, the PDF is the legal invoice.
+var invoiceProfiles = map[string]string{
+	"MINIMUM":   "Data",
+	"BASIC WL":  "Data",
+	"BASIC":     "Alternative",
+	"EN 16931":  "Alternative",
+	"EXTENDED":  "Alternative",
+	"XRECHNUNG": "Alternative",
+}
+
+// invoice is an electronic invoice embedded in a PDF/A-3 document.
+type invoice struct {
+	// name is the file name of the XML file in the PDF
+	name    string
+	profile string
+}
+
+// checkInvoiceXML returns an error if data is not a Cross Industry Invoice.
+func checkInvoiceXML(data []byte) error {
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return fmt.Errorf("not an XML file: %w", err)
+		}
+		if se, ok := tok.(xml.StartElement); ok {
+			if se.Name.Local != "CrossIndustryInvoice" {
+				return fmt.Errorf("the root element is %s, expected CrossIndustryInvoice", se.Name.Local)
+			}
+			return nil
+		}
+	}
+}
+
+// checkInvoiceFormat returns an error if the document is not PDF/A-3b.
+func (d *Document) checkInvoiceFormat() error {
+	if d.Value.Doc.Format != document.FormatPDFA3b {
+		return fmt.Errorf(`an electronic invoice requires doc.format = "PDF/A-3b"`)
+	}
+	return nil
+}
+
+// documentAttachInvoiceXML embeds a Factur-X or ZUGFeRD invoice:
+// doc:attach_invoice_xml{filename="invoice.xml", profile="EN 16931", standard="factur-x"}
+func documentAttachInvoiceXML(l *lua.State) int {
+	d := checkDocument(l, 1)
+	lua.CheckType(l, 2, lua.TypeTable)
+	if d.invoice != nil {
+		lua.Errorf(l, "attach_invoice_xml: the document already has an invoice")
+		return 0
+	}
+	if err := d.checkInvoiceFormat(); err != nil {
+		lua.Errorf(l, "attach_invoice_xml: %s", err.Error())
+		return 0
+	}
+
+	l.Field(2, "filename")
+	if l.IsNil(-1) {
+		lua.Errorf(l, "attach_invoice_xml: filename is required")
+		return 0
+	}
+	filename := lua.CheckString(l, -1)
+	l.Pop(1)
+
+	inv := &invoice{name: "factur-x.xml", profile: "EN 16931"}
+	l.Field(2, "profile")
+	if !l.IsNil(-1) {
+		inv.profile = strings.ToUpper(lua.CheckString(l, -1))
+	}
+	l.Pop(1)
+	if _, ok := invoiceProfiles[inv.profile]; !ok {
+		lua.Errorf(l, "attach_invoice_xml: unknown profile %s (use MINIMUM, BASIC WL, BASIC, EN 16931, EXTENDED or XRECHNUNG)", inv.profile)
+		return 0
+	}
+
+	standard := "factur-x"
+	l.Field(2, "standard")
+	if !l.IsNil(-1) {
+		standard = strings.ToLower(lua.CheckString(l, -1))
+	}
+	l.Pop(1)
+	switch standard {
+	case "factur-x":
+		if inv.profile == "XRECHNUNG" {
+			lua.Errorf(l, "attach_invoice_xml: the XRECHNUNG profile requires standard = \"zugferd\"")
+			return 0
+		}
+	case "zugferd":
+		// ZUGFeRD 2.1 and later use the Factur-X metadata
+		if inv.profile == "XRECHNUNG" {
+			inv.name = "xrechnung.xml"
+		}
+	default:
+		lua.Errorf(l, "attach_invoice_xml: unknown standard %s (use factur-x or zugferd)", standard)
+		return 0
+	}
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		lua.Errorf(l, "attach_invoice_xml: failed to read file: %s", err.Error())
+		return 0
+	}
+	if err = checkInvoiceXML(data); err != nil {
+		lua.Errorf(l, "attach_invoice_xml: %s: %s", filename, err.Error())
+		return 0
+	}
+
+	fx, err := d.xmpSchema(facturXNamespace, "fx", "Factur-X PDFA Extension Schema")
+	if err != nil {
+		lua.Errorf(l, "attach_invoice_xml: %s", err.Error())
+		return 0
+	}
+	fx.set(&xmpProperty{name: "DocumentType", value: "INVOICE", description: "The type of the hybrid document in capital letters, e.g. INVOICE or ORDER"})
+	fx.set(&xmpProperty{name: "DocumentFileName", value: inv.name, description: "The name of the embedded XML document"})
+	fx.set(&xmpProperty{name: "Version", value: "1.0", description: "The actual version of the standard applying to the embedded XML document"})
+	fx.set(&xmpProperty{name: "ConformanceLevel", value: inv.profile, description: "The conformance level of the embedded XML document"})
+
+	err = d.attachFile(document.Attachment{
+		Name:        inv.name,
+		Description: "Factur-X/ZUGFeRD invoice",
+		MimeType:    "text/xml",
+		Data:        data,
+	}, &attachment{relationship: invoiceProfiles[inv.profile]})
+	if err != nil {
+		lua.Errorf(l, "attach_invoice_xml: %s", err.Error())
+		return 0
+	}
+	d.invoice = inv
+	return 0
+}
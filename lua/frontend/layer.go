@@ -0,0 +1,178 @@
+package frontend
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/boxesandglue/boxesandglue/backend/document"
+	"github.com/speedata/glu/lua/common"
+	"github.com/speedata/go-lua"
+)
+
+const layerMetaTable = "Layer"
+
+// Layer is an optional content group. Content is assigned to a layer with
+// the layer option of page:output_at(), page:underlay() and page:overlay().
+type Layer struct {
+	name    string
+	visible bool
+	print   bool
+	// resource is the name of the layer in the page resources
+	resource string
+}
+
+// checkLayer retrieves a Layer userdata from the stack
+func checkLayer(l *lua.State, index int) *Layer {
+	ud := lua.CheckUserData(l, index, layerMetaTable)
+	if ly, ok := ud.(*Layer); ok {
+		return ly
+	}
+	lua.Errorf(l, "Layer expected")
+	return nil
+}
+
+// documentNewLayer creates an optional content group:
+// doc:new_layer{name="Cutting die", visible=true, print=false}
+func documentNewLayer(l *lua.State) int {
+	d := checkDocument(l, 1)
+	lua.CheckType(l, 2, lua.TypeTable)
+	ly := &Layer{visible: true, print: true, resource: fmt.Sprintf("GluLayer%d", len(d.layers)+1)}
+	l.Field(2, "name")
+	ly.name = lua.CheckString(l, -1)
+	l.Pop(1)
+	l.Field(2, "visible")
+	if !l.IsNil(-1) {
+		ly.visible = l.ToBoolean(-1)
+	}
+	l.Pop(1)
+	l.Field(2, "print")
+	if !l.IsNil(-1) {
+		ly.print = l.ToBoolean(-1)
+	}
+	l.Pop(1)
+	d.layers = append(d.layers, ly)
+
+	l.PushUserData(ly)
+	lua.SetMetaTableNamed(l, layerMetaTable)
+	return 1
+}
+
+// writeLayers adds the optional content groups to the catalog and to the
+// resources of the pages and XObjects that use them.
+func (d *Document) writeLayers(f *pdfFile) {
+	if len(d.layers) == 0 {
+		return
+	}
+	ocgs, order, off := pdfArray{}, pdfArray{}, pdfArray{}
+	var noPrint pdfArray
+	refs := make(map[string]pdfRef, len(d.layers))
+	for _, ly := range d.layers {
+		viewState, printState := pdfName("ON"), pdfName("ON")
+		if !ly.visible {
+			viewState = "OFF"
+		}
+		if !ly.print {
+			printState = "OFF"
+		}
+		ref := f.Add(pdfDict{
+			"Type": pdfName("OCG"),
+			"Name": common.PDFTextString(ly.name),
+			"Usage": pdfDict{
+				"View":  pdfDict{"ViewState": viewState},
+				"Print": pdfDict{"PrintState": printState},
+			},
+		})
+		refs[ly.resource] = ref
+		ocgs = append(ocgs, ref)
+		order = append(order, ref)
+		if !ly.visible {
+			off = append(off, ref)
+		}
+		if !ly.print {
+			noPrint = append(noPrint, ref)
+		}
+	}
+	config := pdfDict{"Name": common.PDFTextString("Layers"), "Order": order, "OFF": off}
+	// PDF/A and PDF/X do not allow the automatic states, layers that are
+	// not printed are only marked in the usage dictionary there
+	switch d.Value.Doc.Format {
+	case document.FormatPDFA3b, document.FormatPDFX3, document.FormatPDFX4:
+	default:
+		if len(noPrint) > 0 {
+			config["AS"] = pdfArray{
+				pdfDict{"Event": pdfName("Print"), "OCGs": ocgs, "Category": pdfArray{pdfName("Print")}},
+				pdfDict{"Event": pdfName("View"), "OCGs": ocgs, "Category": pdfArray{pdfName("View")}},
+			}
+		}
+	}
+	f.Catalog()["OCProperties"] = pdfDict{"OCGs": ocgs, "D": config}
+
+	addUses := func(data []byte, res pdfDict) {
+		for name, ref := range refs {
+			if bytes.Contains(data, []byte("/"+name+" BDC")) {
+				f.SubDict(res, "Properties")[name] = ref
+			}
+		}
+	}
+	for _, page := range f.Pages() {
+		for _, obj := range f.Contents(page) {
+			if data, ok := f.StreamData(obj); ok && bytes.Contains(data, []byte("/GluLayer")) {
+				addUses(data, f.SubDict(page, "Resources"))
+			}
+		}
+	}
+	for _, obj := range f.Objects {
+		if dict, ok := obj.Value.(pdfDict); ok && obj.Stream != nil && dict["Subtype"] == pdfName("Form") {
+			if data, ok := f.StreamData(obj); ok && bytes.Contains(data, []byte("/GluLayer")) {
+				addUses(data, f.SubDict(dict, "Resources"))
+			}
+		}
+	}
+}
+
+// layerIndex handles attribute access (__index metamethod)
+func layerIndex(l *lua.State) int {
+	ly := checkLayer(l, 1)
+	key := lua.CheckString(l, 2)
+
+	switch key {
+	case "name":
+		l.PushString(ly.name)
+		return 1
+	case "visible":
+		l.PushBoolean(ly.visible)
+		return 1
+	case "print":
+		l.PushBoolean(ly.print)
+		return 1
+	}
+	return 0
+}
+
+// layerNewIndex handles attribute setting (__newindex metamethod)
+func layerNewIndex(l *lua.State) int {
+	ly := checkLayer(l, 1)
+	key := lua.CheckString(l, 2)
+
+	switch key {
+	case "name":
+		ly.name = lua.CheckString(l, 3)
+	case "visible":
+		ly.visible = l.ToBoolean(3)
+	case "print":
+		ly.print = l.ToBoolean(3)
+	default:
+		lua.Errorf(l, "cannot set attribute %s on Layer", key)
+	}
+	return 0
+}
+
+// registerLayerMetaTable creates the Layer metatable
+func registerLayerMetaTable(l *lua.State) {
+	lua.NewMetaTable(l, layerMetaTable)
+	lua.SetFunctions(l, []lua.RegistryFunction{
+		{Name: "__index", Function: layerIndex},
+		{Name: "__newindex", Function: layerNewIndex},
+	}, 0)
+	l.Pop(1)
+}
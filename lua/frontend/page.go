@@ -2,9 +2,7 @@ package frontend
 
 import (
 	"github.com/boxesandglue/boxesandglue/backend/document"
-	"github.com/boxesandglue/boxesandglue/backend/node"
 	"github.com/speedata/go-lua"
-	"github.com/speedata/glu/lua/backend"
 )
 
 const pageMetaTable = "Page"
@@ -12,6 +10,20 @@ const pageMetaTable = "Page"
 // Page wraps the boxesandglue document.Page type
 type Page struct {
 	Value *document.Page
+	doc   *Document
+	// layout are the page boxes and printer's marks of the page
+	layout pageLayout
+	// number is the page number, pages are numbered in the order of
+	// doc:new_page()
+	number int
+	// rotate is the /Rotate value of the page
+	rotate int
+	// overlays are drawn after the page contents
+	overlays []document.Object
+	// annotations are the file attachment annotations
+	annotations []fileAnnotation
+	// signature is the visible signature field or nil
+	signature *signatureField
 }
 
 // checkPage retrieves a Page userdata from the stack
@@ -24,42 +36,74 @@ func checkPage(l *lua.State, index int) *Page {
 	return nil
 }
 
-// pageOutputAt places a VList at position: page:output_at(x, y, vlist)
+// pageOutputAt places a VList at position: page:output_at(x, y, vlist, [options])
 // x, y can be numbers (points) or strings with units ("72pt", "1in", "2cm")
 // vlist can be either a frontend VList or a backend node.VList
+// options is a table with rotate, scale, origin, layer and role
 func pageOutputAt(l *lua.State) int {
 	p := checkPage(l, 1)
 	x := checkDimension(l, 2)
 	y := checkDimension(l, 3)
 
-	// Try to get the VList - accept both frontend VList and backend node.VList
-	var vl *node.VList
-	if ud := lua.TestUserData(l, 4, vlistMetaTable); ud != nil {
-		if v, ok := ud.(*VList); ok {
-			vl = v.Value
-		}
-	} else if ud := lua.TestUserData(l, 4, "node.VList"); ud != nil {
-		// Backend NodeVList wrapper
-		if v, ok := ud.(*backend.NodeVList); ok {
-			vl = v.Value
-		}
-	}
-
+	// Accept both frontend VList and backend node.VList
+	vl := toVList(l, 4)
 	if vl == nil {
 		lua.Errorf(l, "VList expected")
 		return 0
 	}
 
-	p.Value.OutputAt(x, y, vl)
+	// output_at(x, y, doc:format_paragraph(...)) passes the paragraph info
+	// table as options, it has no transformation
+	p.Value.Objects = append(p.Value.Objects, checkPlacement(l, 5).objects(p.doc, x, y, vl)...)
 
 	// Return self for chaining
 	l.PushValue(1)
 	return 1
 }
 
+// pageLayer places a VList behind or above the page contents:
+// page:underlay(vlist, x, y, [options]) and page:overlay(vlist, x, y, [options])
+func pageLayer(over bool) lua.Function {
+	return func(l *lua.State) int {
+		p := checkPage(l, 1)
+		vl := toVList(l, 2)
+		if vl == nil {
+			lua.Errorf(l, "VList expected")
+			return 0
+		}
+		x := checkDimension(l, 3)
+		y := checkDimension(l, 4)
+		objs := checkPlacement(l, 5).objects(p.doc, x, y, vl)
+		if over {
+			p.overlays = append(p.overlays, objs...)
+		} else {
+			// the library draws the background objects first
+			p.Value.Background = append(p.Value.Background, objs...)
+		}
+		l.PushValue(1)
+		return 1
+	}
+}
+
 // pageShipout finalizes the page: page:shipout()
 func pageShipout(l *lua.State) int {
 	p := checkPage(l, 1)
+	if !p.Value.Finished {
+		if wm := p.doc.watermark; wm != nil {
+			objs, err := wm.objects(p.doc, p.Value)
+			if err != nil {
+				lua.Errorf(l, "failed to draw the watermark: %s", err.Error())
+				return 0
+			}
+			p.overlays = append(p.overlays, objs...)
+		}
+		p.Value.Objects = append(p.Value.Objects, p.overlays...)
+		p.overlays = nil
+		// the library places the page contents at ExtraOffset
+		margin := p.layout.margin()
+		p.Value.ExtraOffset = margin
+		p.doc.shipped = append(p.doc.shipped, shippedPage{layout: p.layout, margin: margin, width: p.Value.Width, height: p.Value.Height, rotate: p.rotate, annotations: p.annotations, signature: p.signature})
+	}
 	p.Value.Shipout()
 	return 0
 }
@@ -76,12 +120,36 @@ func pageIndex(l *lua.State) int {
 	case "shipout":
 		l.PushGoFunction(pageShipout)
 		return 1
+	case "underlay":
+		l.PushGoFunction(pageLayer(false))
+		return 1
+	case "overlay":
+		l.PushGoFunction(pageLayer(true))
+		return 1
+	case "attach_file":
+		l.PushGoFunction(pageAttachFile)
+		return 1
+	case "signature_field":
+		l.PushGoFunction(pageSignatureField)
+		return 1
 	case "width":
 		pushScaledPoint(l, p.Value.Width)
 		return 1
 	case "height":
 		pushScaledPoint(l, p.Value.Height)
 		return 1
+	case "number":
+		l.PushInteger(p.number)
+		return 1
+	case "rotate":
+		l.PushInteger(p.rotate)
+		return 1
+	case "label":
+		l.PushString(p.doc.pageLabel(p.number))
+		return 1
+	}
+	if p.layout.index(l, key) {
+		return 1
 	}
 
 	return 0
@@ -97,6 +165,15 @@ func pageNewIndex(l *lua.State) int {
 		p.Value.Width = checkDimension(l, 3)
 	case "height":
 		p.Value.Height = checkDimension(l, 3)
+	case "rotate":
+		rotate, err := pageRotation(lua.CheckInteger(l, 3))
+		if err != nil {
+			lua.Errorf(l, "%s", err.Error())
+			return 0
+		}
+		p.rotate = rotate
+	default:
+		p.layout.newIndex(l, key)
 	}
 
 	return 0
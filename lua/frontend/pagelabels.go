@@ -0,0 +1,184 @@
+package frontend
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/speedata/glu/lua/common"
+	"github.com/speedata/go-lua"
+)
+
+// pageLabelStyles are the numbering styles of page labels and their PDF
+// names.
+var pageLabelStyles = map[string]string{
+	"decimal":     "D",
+	"roman":       "r",
+	"lower-roman": "r",
+	"Roman":       "R",
+	"upper-roman": "R",
+	"alphabetic":  "a",
+	"lower-alpha": "a",
+	"Alphabetic":  "A",
+	"upper-alpha": "A",
+	"none":        "",
+}
+
+// pageLabelRange is the numbering of the pages from start on.
+type pageLabelRange struct {
+	// start is the first page (1 based) of the range
+	start int
+	// style is the PDF numbering style, empty for labels without a number
+	style  string
+	prefix string
+	// first is the number of the first page of the range
+	first int
+}
+
+// pageLabel returns the label of the page number (1 based).
+func (d *Document) pageLabel(page int) string {
+	if len(d.pageLabels) == 0 {
+		return strconv.Itoa(page)
+	}
+	r := d.pageLabels[0]
+	for _, pl := range d.pageLabels {
+		if pl.start > page {
+			break
+		}
+		r = pl
+	}
+	n := r.first + page - r.start
+	var num string
+	switch r.style {
+	case "D":
+		num = strconv.Itoa(n)
+	case "r":
+		num = strings.ToLower(romanNumber(n))
+	case "R":
+		num = romanNumber(n)
+	case "a":
+		num = strings.ToLower(alphabeticNumber(n))
+	case "A":
+		num = alphabeticNumber(n)
+	}
+	return r.prefix + num
+}
+
+// romanNumber returns n as an upper case roman number.
+func romanNumber(n int) string {
+	var b strings.Builder
+	for _, r := range []struct {
+		value  int
+		digits string
+	}{
+		{1000, "M"}, {900, "CM"}, {500, "D"}, {400, "CD"}, {100, "C"}, {90, "XC"},
+		{50, "L"}, {40, "XL"}, {10, "X"}, {9, "IX"}, {5, "V"}, {4, "IV"}, {1, "I"},
+	} {
+		for n >= r.value {
+			b.WriteString(r.digits)
+			n -= r.value
+		}
+	}
+	return b.String()
+}
+
+// alphabeticNumber returns the PDF letter numbering: A to Z, then AA to ZZ,
+// AAA to ZZZ and so on.
+func alphabeticNumber(n int) string {
+	if n < 1 {
+		return ""
+	}
+	letter := string(rune('A' + (n-1)%26))
+	return strings.Repeat(letter, (n-1)/26+1)
+}
+
+// writePageLabels adds the page label number tree to the catalog.
+func (d *Document) writePageLabels(f *pdfFile) {
+	if len(d.pageLabels) == 0 {
+		return
+	}
+	nums := pdfArray{}
+	for _, r := range d.pageLabels {
+		label := pdfDict{"Type": pdfName("PageLabel")}
+		if r.style != "" {
+			label["S"] = pdfName(r.style)
+		}
+		if r.prefix != "" {
+			label["P"] = common.PDFTextString(r.prefix)
+		}
+		if r.first != 1 {
+			label["St"] = r.first
+		}
+		nums = append(nums, r.start-1, label)
+	}
+	f.Catalog()["PageLabels"] = pdfDict{"Nums": nums}
+}
+
+// documentSetPageLabels sets the page numbering:
+// doc:set_page_labels{ {start=1, style="roman"}, {start=5, prefix="A-"} }
+func documentSetPageLabels(l *lua.State) int {
+	d := checkDocument(l, 1)
+	lua.CheckType(l, 2, lua.TypeTable)
+
+	var ranges []pageLabelRange
+	n := l.RawLength(2)
+	for i := 1; i <= n; i++ {
+		l.RawGetInt(2, i)
+		if !l.IsTable(-1) {
+			lua.Errorf(l, "page label %d: table expected", i)
+			return 0
+		}
+		r := pageLabelRange{start: 1, style: "D", first: 1}
+		l.Field(-1, "start")
+		if !l.IsNil(-1) {
+			r.start = lua.CheckInteger(l, -1)
+		}
+		l.Pop(1)
+		l.Field(-1, "style")
+		if !l.IsNil(-1) {
+			style, ok := pageLabelStyles[lua.CheckString(l, -1)]
+			if !ok {
+				lua.Errorf(l, "unknown page label style: %s (use decimal, roman, Roman, alphabetic, Alphabetic or none)", lua.CheckString(l, -1))
+				return 0
+			}
+			r.style = style
+		}
+		l.Pop(1)
+		l.Field(-1, "prefix")
+		if !l.IsNil(-1) {
+			r.prefix = lua.CheckString(l, -1)
+		}
+		l.Pop(1)
+		l.Field(-1, "first")
+		if !l.IsNil(-1) {
+			r.first = lua.CheckInteger(l, -1)
+		}
+		l.Pop(2)
+		if r.first < 1 {
+			lua.Errorf(l, "page label %d: first must be at least 1", i)
+			return 0
+		}
+		if r.start < 1 || len(ranges) > 0 && r.start <= ranges[len(ranges)-1].start {
+			lua.Errorf(l, "page label %d: start pages must be ascending and at least 1", i)
+			return 0
+		}
+		ranges = append(ranges, r)
+	}
+	// the number tree must start at the first page
+	if len(ranges) > 0 && ranges[0].start > 1 {
+		ranges = append([]pageLabelRange{{start: 1, style: "D", first: 1}}, ranges...)
+	}
+	d.pageLabels = ranges
+	return 0
+}
+
+// documentPageLabel returns the label of a page: doc:page_label(number)
+func documentPageLabel(l *lua.State) int {
+	d := checkDocument(l, 1)
+	n := lua.CheckInteger(l, 2)
+	if n < 1 {
+		lua.Errorf(l, "invalid page number %d", n)
+		return 0
+	}
+	l.PushString(d.pageLabel(n))
+	return 1
+}
@@ -0,0 +1,273 @@
+package frontend
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/boxesandglue/boxesandglue/backend/bag"
+	"github.com/boxesandglue/boxesandglue/backend/document"
+	"github.com/speedata/glu/lua/common"
+	"github.com/speedata/go-lua"
+)
+
+// The page width and height are the size of the page without the slug area.
+// The trim box is inset by trim from the page edges (for pages that already
+// contain the bleed), the bleed box extends the trim box by bleed. glu
+// enlarges the media box when the bleed or the printer's marks do not fit on
+// the page. The boxes and marks are written when the document is finished.
+
+const (
+	// cropMarkLength is the length of the crop marks
+	cropMarkLength = 18 * bag.Factor
+	// cropMarkDistance is the minimal distance of the crop marks from the
+	// trim box, the marks are always outside of the bleed
+	cropMarkDistance = 6 * bag.Factor
+	// colorBarPatch is the size of a patch of the color bar
+	colorBarPatch = 10 * bag.Factor
+)
+
+// pageLayout are the page boxes and printer's marks of a page.
+type pageLayout struct {
+	bleed, trim bag.ScaledPoint
+	// art is the distance of the art box from the trim box, no art box is
+	// written when art is negative
+	art                                     bag.ScaledPoint
+	cropMarks, registrationMarks, colorBars bool
+}
+
+// defaultPageLayout has no bleed, no art box and no marks.
+var defaultPageLayout = pageLayout{art: -1}
+
+// marks reports whether any printer's marks are drawn.
+func (pl pageLayout) marks() bool {
+	return pl.cropMarks || pl.registrationMarks || pl.colorBars
+}
+
+// markDistance is the distance of the printer's marks from the trim box.
+func (pl pageLayout) markDistance() bag.ScaledPoint {
+	return max(pl.bleed, cropMarkDistance)
+}
+
+// margin returns the space that is added around the page for the bleed and
+// the printer's marks.
+func (pl pageLayout) margin() bag.ScaledPoint {
+	need := pl.bleed
+	if pl.marks() {
+		need = pl.markDistance() + cropMarkLength + 2*bag.Factor
+	}
+	return max(need-pl.trim, 0)
+}
+
+// shippedPage is the layout of a page in the PDF file.
+type shippedPage struct {
+	layout        pageLayout
+	margin        bag.ScaledPoint
+	width, height bag.ScaledPoint
+	rotate        int
+	// annotations are the file attachment annotations of the page
+	annotations []fileAnnotation
+	// signature is the visible signature field of the page or nil
+	signature *signatureField
+}
+
+// index pushes the value of a page layout attribute and returns false for
+// other keys.
+func (pl *pageLayout) index(l *lua.State, key string) bool {
+	switch key {
+	case "bleed":
+		pushScaledPoint(l, pl.bleed)
+	case "trim":
+		pushScaledPoint(l, pl.trim)
+	case "art":
+		if pl.art < 0 {
+			l.PushNil()
+		} else {
+			pushScaledPoint(l, pl.art)
+		}
+	case "crop_marks":
+		l.PushBoolean(pl.cropMarks)
+	case "registration_marks":
+		l.PushBoolean(pl.registrationMarks)
+	case "color_bars":
+		l.PushBoolean(pl.colorBars)
+	default:
+		return false
+	}
+	return true
+}
+
+// newIndex sets a page layout attribute and returns false for other keys.
+func (pl *pageLayout) newIndex(l *lua.State, key string) bool {
+	switch key {
+	case "bleed":
+		pl.bleed = checkDimension(l, 3)
+	case "trim":
+		pl.trim = checkDimension(l, 3)
+	case "art":
+		if l.IsNil(3) {
+			pl.art = -1
+		} else {
+			pl.art = checkDimension(l, 3)
+		}
+	case "crop_marks":
+		pl.cropMarks = l.ToBoolean(3)
+	case "registration_marks":
+		pl.registrationMarks = l.ToBoolean(3)
+	case "color_bars":
+		pl.colorBars = l.ToBoolean(3)
+	default:
+		return false
+	}
+	return true
+}
+
+// needsPageBoxes reports whether any page has a layout or a rotation that
+// the library cannot write.
+func (d *Document) needsPageBoxes() bool {
+	for _, sp := range d.shipped {
+		if sp.layout != defaultPageLayout || sp.rotate != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// writePageBoxes sets the page boxes and the rotation and draws the
+// printer's marks of the shipped pages.
+func (d *Document) writePageBoxes(f *pdfFile) error {
+	pdfx := d.Value.Doc.Format == document.FormatPDFX3 || d.Value.Doc.Format == document.FormatPDFX4
+	pages := f.Pages()
+	if len(pages) != len(d.shipped) {
+		return fmt.Errorf("page boxes: %d pages in the PDF, %d pages shipped out", len(pages), len(d.shipped))
+	}
+	var registration pdfRef
+	for i, page := range pages {
+		sp := d.shipped[i]
+		pl := sp.layout
+		if sp.rotate != 0 {
+			page["Rotate"] = sp.rotate
+		}
+		if pl == defaultPageLayout {
+			// the library has written the trim box
+			continue
+		}
+		if pdfx && pl.art >= 0 {
+			return fmt.Errorf("page %d: PDF/X does not allow an art box together with the trim box", i+1)
+		}
+		m := sp.margin.ToPT()
+		mediaWidth, mediaHeight := sp.width.ToPT()+2*m, sp.height.ToPT()+2*m
+		trim := [4]float64{m + pl.trim.ToPT(), m + pl.trim.ToPT(), m + sp.width.ToPT() - pl.trim.ToPT(), m + sp.height.ToPT() - pl.trim.ToPT()}
+		b := pl.bleed.ToPT()
+		bleed := [4]float64{
+			math.Max(trim[0]-b, 0), math.Max(trim[1]-b, 0),
+			math.Min(trim[2]+b, mediaWidth), math.Min(trim[3]+b, mediaHeight),
+		}
+		page["TrimBox"] = pdfBox(trim)
+		page["BleedBox"] = pdfBox(bleed)
+		delete(page, "ArtBox")
+		if pl.art >= 0 {
+			a := pl.art.ToPT()
+			page["ArtBox"] = pdfBox([4]float64{trim[0] + a, trim[1] + a, trim[2] - a, trim[3] - a})
+		}
+		if !pl.marks() {
+			continue
+		}
+		res := f.SubDict(page, "Resources")
+		if pl.cropMarks || pl.registrationMarks {
+			if registration == 0 {
+				registration = f.Add(pdfArray{
+					pdfName("Separation"),
+					pdfName("All"),
+					pdfName("DeviceCMYK"),
+					pdfDict{
+						"FunctionType": 2,
+						"Domain":       pdfArray{0, 1},
+						"C0":           pdfArray{0, 0, 0, 0},
+						"C1":           pdfArray{1, 1, 1, 1},
+						"N":            1,
+					},
+				})
+			}
+			f.SubDict(res, "ColorSpace")["Registration"] = registration
+		}
+		// the page contents are enclosed in q/Q so the marks are drawn with
+		// the default graphics state
+		contents := pdfArray{f.AddStream(pdfDict{}, []byte("q\n"))}
+		switch t := page["Contents"].(type) {
+		case pdfRef:
+			contents = append(contents, t)
+		case pdfArray:
+			contents = append(contents, t...)
+		}
+		contents = append(contents, f.AddStream(pdfDict{}, printersMarks(pl, trim)))
+		page["Contents"] = contents
+	}
+	return nil
+}
+
+func pdfBox(box [4]float64) pdfArray {
+	return pdfArray{box[0], box[1], box[2], box[3]}
+}
+
+// printersMarks returns the content stream with the marks around the trim
+// box.
+func printersMarks(pl pageLayout, trim [4]float64) []byte {
+	var b strings.Builder
+	n := common.PDFNumber
+	x0, y0, x1, y1 := trim[0], trim[1], trim[2], trim[3]
+	dist, length := pl.markDistance().ToPT(), cropMarkLength.ToPT()
+	// the center of the slug area
+	slug := dist + length/2
+	// the marks are not part of the document structure
+	b.WriteString("Q\n/Artifact BMC q /Registration CS 1 SCN 0.25 w 0 J [] 0 d\n")
+	if pl.cropMarks {
+		for _, c := range [][2]float64{{x0, y0}, {x1, y0}, {x0, y1}, {x1, y1}} {
+			dx, dy := 1.0, 1.0
+			if c[0] == x0 {
+				dx = -1
+			}
+			if c[1] == y0 {
+				dy = -1
+			}
+			fmt.Fprintf(&b, "%s %s m %s %s l S\n", n(c[0]+dx*dist), n(c[1]), n(c[0]+dx*(dist+length)), n(c[1]))
+			fmt.Fprintf(&b, "%s %s m %s %s l S\n", n(c[0]), n(c[1]+dy*dist), n(c[0]), n(c[1]+dy*(dist+length)))
+		}
+	}
+	if pl.registrationMarks {
+		cx, cy := (x0+x1)/2, (y0+y1)/2
+		for _, c := range [][2]float64{{cx, y1 + slug}, {cx, y0 - slug}, {x0 - slug, cy}, {x1 + slug, cy}} {
+			b.WriteString(registrationMark(c[0], c[1], length/2))
+		}
+	}
+	if pl.colorBars {
+		patch := colorBarPatch.ToPT()
+		y := y0 - slug - patch/2
+		x := x0 + length
+		for _, cmyk := range [][4]float64{
+			{1, 0, 0, 0}, {0, 1, 0, 0}, {0, 0, 1, 0}, {0, 0, 0, 1},
+			{1, 1, 0, 0}, {1, 0, 1, 0}, {0, 1, 1, 0},
+			{0.5, 0, 0, 0}, {0, 0.5, 0, 0}, {0, 0, 0.5, 0}, {0, 0, 0, 0.5},
+		} {
+			fmt.Fprintf(&b, "%s %s %s %s k %s %s %s %s re f\n", n(cmyk[0]), n(cmyk[1]), n(cmyk[2]), n(cmyk[3]), n(x), n(y), n(patch), n(patch))
+			x += patch
+		}
+	}
+	b.WriteString("Q EMC\n")
+	return []byte(b.String())
+}
+
+// registrationMark returns a circle with a cross hair of size r around x, y.
+func registrationMark(x, y, r float64) string {
+	n := common.PDFNumber
+	// control point distance of a Bézier quarter circle
+	k := 0.5523 * r * 0.6
+	c := r * 0.6
+	return fmt.Sprintf("%s %s m %s %s l S %s %s m %s %s l S\n", n(x-r), n(y), n(x+r), n(y), n(x), n(y-r), n(x), n(y+r)) +
+		fmt.Sprintf("%s %s m %s %s %s %s %s %s c %s %s %s %s %s %s c %s %s %s %s %s %s c %s %s %s %s %s %s c S\n",
+			n(x+c), n(y),
+			n(x+c), n(y+k), n(x+k), n(y+c), n(x), n(y+c),
+			n(x-k), n(y+c), n(x-c), n(y+k), n(x-c), n(y),
+			n(x-c), n(y-k), n(x-k), n(y-c), n(x), n(y-c),
+			n(x+k), n(y-c), n(x+c), n(y-k), n(x+c), n(y))
+}
@@ -0,0 +1,146 @@
+package frontend
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/boxesandglue/boxesandglue/backend/color"
+	"github.com/speedata/go-lua"
+)
+
+// A palette file defines named colors. JSON palettes are objects with the
+// color names as keys, the values are CSS colors, names of other colors or
+// objects like the tables of frontend.color():
+//
+//	{
+//	  "brand-blue": "#0055a4",
+//	  "brand-spot": { "model": "spot", "name": "PANTONE 286 C", "cmyk": [1, 0.66, 0, 0.02] }
+//	}
+//
+// Other files are read as CSS custom properties, the leading dashes are not
+// part of the color name:
+//
+//	:root { --brand-blue: #0055a4; --link: var(--brand-blue); }
+
+var (
+	cssCommentRE  = regexp.MustCompile(`(?s)/\*.*?\*/`)
+	cssPropertyRE = regexp.MustCompile(`--([A-Za-z0-9_-]+)\s*:\s*([^;}]+)`)
+	cssVarRE      = regexp.MustCompile(`^var\(\s*--([A-Za-z0-9_-]+)\s*(?:,\s*(.+))?\)$`)
+)
+
+// readPalette returns the color definitions of a palette file, the values are
+// strings or colorOptions.
+func readPalette(filename string, data []byte) (map[string]any, error) {
+	entries := make(map[string]any)
+	if strings.HasSuffix(strings.ToLower(filename), ".json") || bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		var obj map[string]any
+		if err := json.Unmarshal(data, &obj); err != nil {
+			return nil, err
+		}
+		for name, v := range obj {
+			switch t := v.(type) {
+			case string:
+				entries[name] = t
+			case map[string]any:
+				entries[name] = colorOptions(t)
+			default:
+				return nil, fmt.Errorf("color %q must be a string or an object", name)
+			}
+		}
+		return entries, nil
+	}
+	data = cssCommentRE.ReplaceAll(data, nil)
+	for _, m := range cssPropertyRE.FindAllSubmatch(data, -1) {
+		entries[string(m[1])] = strings.TrimSpace(string(m[2]))
+	}
+	return entries, nil
+}
+
+// loadPalette defines the colors of the palette file. Colors can refer to
+// other colors of the palette in any order.
+func (d *Document) loadPalette(filename string) (map[string]*color.Color, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := readPalette(filename, data)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	colors := make(map[string]*color.Color, len(entries))
+	for len(colors) < len(entries) {
+		progress := false
+		var missing string
+		for _, name := range names {
+			if colors[name] != nil {
+				continue
+			}
+			var col *color.Color
+			switch t := entries[name].(type) {
+			case string:
+				col = d.paletteColor(t)
+				if col == nil {
+					missing = fmt.Sprintf("unknown color %q for %q", t, name)
+					continue
+				}
+			case colorOptions:
+				c, err := t.color()
+				if err != nil {
+					return nil, fmt.Errorf("color %q: %w", name, err)
+				}
+				col = d.colorValue(c)
+			}
+			d.defineColor(name, col)
+			colors[name] = col
+			progress = true
+		}
+		if !progress {
+			return nil, fmt.Errorf("%s", missing)
+		}
+	}
+	return colors, nil
+}
+
+// paletteColor resolves a color value of a palette, var(--name, fallback) is
+// the color name or the fallback.
+func (d *Document) paletteColor(value string) *color.Color {
+	if m := cssVarRE.FindStringSubmatch(value); m != nil {
+		if col := d.color(m[1]); col != nil {
+			return col
+		}
+		if m[2] == "" {
+			return nil
+		}
+		return d.paletteColor(strings.TrimSpace(m[2]))
+	}
+	return d.color(value)
+}
+
+// documentLoadPalette loads named colors from a file: doc:load_palette(filename)
+func documentLoadPalette(l *lua.State) int {
+	d := checkDocument(l, 1)
+	filename := lua.CheckString(l, 2)
+
+	colors, err := d.loadPalette(filename)
+	if err != nil {
+		lua.Errorf(l, "failed to load palette: %s", err.Error())
+		return 0
+	}
+	l.NewTable()
+	for name, col := range colors {
+		l.PushUserData(&Color{Value: col, spec: d.colorSpecOf(col)})
+		lua.SetMetaTableNamed(l, colorMetaTable)
+		l.SetField(-2, name)
+	}
+	return 1
+}
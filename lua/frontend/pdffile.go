@@ -0,0 +1,16 @@
+package frontend
+
+import "github.com/speedata/glu/lua/common"
+
+// The PDF types of the post processing are shared with the pdf module.
+type (
+	pdfName   = common.PDFName
+	pdfString = common.PDFString
+	pdfRef    = common.PDFRef
+	pdfRaw    = common.PDFRaw
+	pdfArray  = common.PDFArray
+	pdfDict   = common.PDFDict
+	pdfObject = common.PDFObject
+	pdfFile   = common.PDFFile
+	pdfLexer  = common.PDFLexer
+)
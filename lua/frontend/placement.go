@@ -0,0 +1,170 @@
+package frontend
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/boxesandglue/boxesandglue/backend/bag"
+	"github.com/boxesandglue/boxesandglue/backend/document"
+	"github.com/boxesandglue/boxesandglue/backend/node"
+	"github.com/speedata/go-lua"
+)
+
+// placement is a transformation of a vlist placed with page:output_at().
+type placement struct {
+	// rotate is the counterclockwise rotation in degrees
+	rotate         float64
+	scaleX, scaleY float64
+	// origin is the fixed point of the transformation
+	origin string
+	// layer is the optional content group of the vlist or nil
+	layer *Layer
+	// role is the structure role of the vlist in a tagged PDF
+	role string
+	// alt is the alternative text of the vlist
+	alt string
+}
+
+// placementOrigins are the fixed points of a transformation as fractions of
+// the width and the height of the vlist, measured from the top left corner.
+var placementOrigins = map[string][2]float64{
+	"top-left":     {0, 0},
+	"top":          {0.5, 0},
+	"top-right":    {1, 0},
+	"left":         {0, 0.5},
+	"center":       {0.5, 0.5},
+	"right":        {1, 0.5},
+	"bottom-left":  {0, 1},
+	"bottom":       {0.5, 1},
+	"bottom-right": {1, 1},
+}
+
+// checkPlacement reads the table with rotate, scale, origin, layer, role and
+// alt at index, which can be none or nil.
+func checkPlacement(l *lua.State, index int) placement {
+	pl := placement{scaleX: 1, scaleY: 1, origin: "top-left"}
+	if l.IsNoneOrNil(index) {
+		return pl
+	}
+	lua.CheckType(l, index, lua.TypeTable)
+	l.Field(index, "rotate")
+	if !l.IsNil(-1) {
+		pl.rotate = lua.CheckNumber(l, -1)
+	}
+	l.Pop(1)
+	l.Field(index, "scale")
+	switch l.TypeOf(-1) {
+	case lua.TypeNumber:
+		pl.scaleX = lua.CheckNumber(l, -1)
+		pl.scaleY = pl.scaleX
+	case lua.TypeTable:
+		l.RawGetInt(-1, 1)
+		pl.scaleX = lua.CheckNumber(l, -1)
+		l.RawGetInt(-2, 2)
+		pl.scaleY = lua.CheckNumber(l, -1)
+		l.Pop(2)
+	case lua.TypeNil:
+	default:
+		lua.Errorf(l, "scale must be a number or a table {x, y}")
+	}
+	l.Pop(1)
+	l.Field(index, "origin")
+	if !l.IsNil(-1) {
+		pl.origin = lua.CheckString(l, -1)
+		if _, ok := placementOrigins[pl.origin]; !ok {
+			lua.Errorf(l, "unknown origin: %s (use top-left, top, top-right, left, center, right, bottom-left, bottom or bottom-right)", pl.origin)
+		}
+	}
+	l.Pop(1)
+	l.Field(index, "layer")
+	if !l.IsNil(-1) {
+		pl.layer = checkLayer(l, -1)
+	}
+	l.Pop(1)
+	l.Field(index, "role")
+	if !l.IsNil(-1) {
+		pl.role = lua.CheckString(l, -1)
+		if err := checkRole(pl.role); err != nil {
+			lua.Errorf(l, "%s", err.Error())
+		}
+	}
+	l.Pop(1)
+	l.Field(index, "alt")
+	if !l.IsNil(-1) {
+		pl.alt = lua.CheckString(l, -1)
+	}
+	l.Pop(1)
+	return pl
+}
+
+// isIdentity reports whether the placement does not transform the vlist.
+func (pl placement) isIdentity() bool {
+	return math.Mod(pl.rotate, 360) == 0 && pl.scaleX == 1 && pl.scaleY == 1
+}
+
+// matrix returns the transformation of a vlist of the given size at x, y
+// (the top left corner) in page coordinates.
+func (pl placement) matrix(x, y bag.ScaledPoint, vl *node.VList) matrix {
+	o := placementOrigins[pl.origin]
+	ox := x.ToPT() + o[0]*vl.Width.ToPT()
+	oy := y.ToPT() - o[1]*(vl.Height+vl.Depth).ToPT()
+	sin, cos := math.Sincos(pl.rotate * math.Pi / 180)
+	m := matrix{pl.scaleX * cos, pl.scaleX * sin, -pl.scaleY * sin, pl.scaleY * cos, 0, 0}
+	return around(m, ox, oy)
+}
+
+// objects returns the page objects that place vl at x, y with the
+// transformation. The library writes each object on its own outside of a
+// text object, so the objects before and after vl can save the graphics
+// state, change the CTM and restore it. The objects also start and end the
+// structure element of the vlist.
+func (pl placement) objects(d *Document, x, y bag.ScaledPoint, vl *node.VList) []document.Object {
+	objs := []document.Object{{X: x, Y: y, Vlist: vl}}
+	if !pl.isIdentity() {
+		objs = []document.Object{
+			{Vlist: pdfCode("q " + pl.matrix(x, y, vl).String())},
+			objs[0],
+			{Vlist: pdfCode("Q")},
+		}
+	}
+	d.tagNodes(vl)
+	se := nodeStructElem(vl)
+	if pl.role != "" {
+		se.role = pl.role
+	}
+	if pl.alt != "" {
+		se.alt = pl.alt
+		if se.role == "" {
+			se.role = "Figure"
+		}
+	}
+	if d.needsMarkers(se) {
+		start, stop := d.newStructElem(se)
+		objs = append([]document.Object{{Vlist: pdfCode(start)}}, objs...)
+		objs = append(objs, document.Object{Vlist: pdfCode(stop)})
+	}
+	if pl.layer != nil {
+		objs = append([]document.Object{{Vlist: pdfCode("/OC /" + pl.layer.resource + " BDC")}}, objs...)
+		objs = append(objs, document.Object{Vlist: pdfCode("EMC")})
+	}
+	return objs
+}
+
+// pdfCode returns a vlist that writes the PDF code s. The library moves to
+// the position of the vlist before s and back afterwards, the vlists are
+// placed at 0, 0 so the position is the page offset for both operations.
+func pdfCode(s string) *node.VList {
+	rule := node.NewRule()
+	rule.Pre = s
+	rule.Hide = true
+	return node.Vpack(rule)
+}
+
+// pageRotation returns the rotation of the page in degrees, it must be a
+// multiple of 90.
+func pageRotation(deg int) (int, error) {
+	if deg%90 != 0 {
+		return 0, fmt.Errorf("page rotation must be a multiple of 90, got %d", deg)
+	}
+	return (deg%360 + 360) % 360, nil
+}
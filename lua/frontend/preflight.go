@@ -0,0 +1,399 @@
+package frontend
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"sort"
+
+	"github.com/boxesandglue/boxesandglue/backend/document"
+	"github.com/speedata/glu/lua/common"
+)
+
+// The preflight checks the requirements of PDF/A-3b, PDF/X-3, PDF/X-4 and
+// PDF/UA that glu can verify in the finished file. The violations are
+// logged, with strict_conformance they abort the output.
+
+var formatNames = map[document.Format]string{
+	document.FormatPDFA3b: "PDF/A-3b",
+	document.FormatPDFX3:  "PDF/X-3",
+	document.FormatPDFX4:  "PDF/X-4",
+	document.FormatPDFUA:  "PDF/UA",
+}
+
+// preflight collects the violations of a PDF file.
+type preflight struct {
+	f      *pdfFile
+	format document.Format
+	// intent is the color space of the output intent (RGB, CMYK, Gray) or
+	// empty
+	intent string
+	// page is the current page number, 0 outside of pages
+	page       int
+	violations []string
+	seen       map[string]bool
+	done       map[pdfRef]bool
+}
+
+func (pf *preflight) pdfA() bool {
+	return pf.format == document.FormatPDFA3b
+}
+
+func (pf *preflight) pdfX() bool {
+	return pf.format == document.FormatPDFX3 || pf.format == document.FormatPDFX4
+}
+
+// report adds a violation, each violation is reported once per page.
+func (pf *preflight) report(format string, a ...any) {
+	msg := fmt.Sprintf(format, a...)
+	if pf.page > 0 {
+		msg = fmt.Sprintf("page %d: %s", pf.page, msg)
+	}
+	if !pf.seen[msg] {
+		pf.seen[msg] = true
+		pf.violations = append(pf.violations, msg)
+	}
+}
+
+// sortedKeys returns the keys of d in sorted order.
+func sortedKeys(d pdfDict) []string {
+	keys := make([]string, 0, len(d))
+	for k := range d {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// colorSpace checks a color space against the output intent. what
+// describes the object that uses the color space.
+func (pf *preflight) colorSpace(cs any, what string) {
+	if !pf.pdfA() && !pf.pdfX() {
+		return
+	}
+	switch t := pf.f.Resolve(cs).(type) {
+	case pdfName:
+		var space string
+		switch t {
+		case "DeviceRGB":
+			space = "RGB"
+		case "DeviceCMYK":
+			space = "CMYK"
+		case "DeviceGray":
+			if pf.intent == "" {
+				pf.report("%s uses DeviceGray without an output intent", what)
+			}
+			return
+		default:
+			return
+		}
+		if pf.intent != space {
+			if pf.intent == "" {
+				pf.report("%s uses %s without an output intent", what, t)
+			} else {
+				pf.report("%s uses %s, the output intent is %s", what, t, pf.intent)
+			}
+		}
+	case pdfArray:
+		if len(t) == 0 {
+			return
+		}
+		switch t[0] {
+		case pdfName("Separation"), pdfName("DeviceN"):
+			if len(t) > 2 {
+				pf.colorSpace(t[2], what+" (alternate color space)")
+			}
+		case pdfName("Indexed"):
+			if len(t) > 1 {
+				pf.colorSpace(t[1], what)
+			}
+		}
+	}
+}
+
+// stream checks the color operators of a content stream.
+func (pf *preflight) stream(obj *pdfObject, res pdfDict) {
+	data, ok := pf.f.StreamData(obj)
+	if !ok {
+		return
+	}
+	lx := &pdfLexer{Data: data, NoRefs: true}
+	var operands []any
+	for {
+		lx.SkipSpace()
+		if lx.EOF() {
+			break
+		}
+		v, err := lx.Value()
+		if err != nil {
+			return
+		}
+		tok, ok := v.(pdfRaw)
+		if !ok || isPDFOperand(tok) {
+			operands = append(operands, v)
+			continue
+		}
+		switch tok {
+		case "ID":
+			if end := bytes.Index(data[lx.Pos:], []byte("EI")); end >= 0 {
+				lx.Pos += end + 2
+			}
+		case "rg", "RG":
+			pf.colorSpace(pdfName("DeviceRGB"), "the content")
+		case "k", "K":
+			pf.colorSpace(pdfName("DeviceCMYK"), "the content")
+		case "g", "G":
+			pf.colorSpace(pdfName("DeviceGray"), "the content")
+		case "cs", "CS":
+			if len(operands) == 1 {
+				if name, ok := operands[0].(pdfName); ok {
+					if cs, ok := pf.f.Dict(res["ColorSpace"])[string(name)]; ok {
+						pf.colorSpace(cs, "the content")
+					} else {
+						pf.colorSpace(name, "the content")
+					}
+				}
+			}
+		}
+		operands = operands[:0]
+	}
+}
+
+// group checks the transparency group of a page or form.
+func (pf *preflight) group(d pdfDict, what string) {
+	if g := pf.f.Dict(d["Group"]); g != nil && g["S"] == pdfName("Transparency") {
+		if pf.format == document.FormatPDFX3 {
+			pf.report("%s has a transparency group, PDF/X-3 does not allow transparency", what)
+		}
+		if cs, ok := g["CS"]; ok {
+			pf.colorSpace(cs, what+" (transparency group)")
+		}
+	}
+}
+
+// resources checks the fonts, the graphics states, the images and the forms
+// of a resource dictionary.
+func (pf *preflight) resources(res pdfDict) {
+	fonts := pf.f.Dict(res["Font"])
+	for _, name := range sortedKeys(fonts) {
+		pf.font(fonts[name])
+	}
+	for _, name := range sortedKeys(pf.f.Dict(res["ColorSpace"])) {
+		pf.colorSpace(pf.f.Dict(res["ColorSpace"])[name], "color space "+name)
+	}
+	if pf.format == document.FormatPDFX3 {
+		gstates := pf.f.Dict(res["ExtGState"])
+		for _, name := range sortedKeys(gstates) {
+			gs := pf.f.Dict(gstates[name])
+			transparent := false
+			for _, key := range []string{"CA", "ca"} {
+				if a, ok := common.PDFFloat(gs[key]); ok && a < 1 {
+					transparent = true
+				}
+			}
+			if sm, ok := gs["SMask"]; ok && sm != pdfName("None") {
+				transparent = true
+			}
+			if bm, ok := gs["BM"].(pdfName); ok && bm != "Normal" && bm != "Compatible" {
+				transparent = true
+			}
+			if transparent {
+				pf.report("graphics state %s is transparent, PDF/X-3 does not allow transparency", name)
+			}
+		}
+	}
+	xobjects := pf.f.Dict(res["XObject"])
+	for _, name := range sortedKeys(xobjects) {
+		ref, ok := xobjects[name].(pdfRef)
+		if !ok || pf.done[ref] || pf.f.Objects[int(ref)] == nil {
+			continue
+		}
+		pf.done[ref] = true
+		obj := pf.f.Objects[int(ref)]
+		d, _ := obj.Value.(pdfDict)
+		switch d["Subtype"] {
+		case pdfName("Form"):
+			pf.group(d, "form "+name)
+			pf.stream(obj, pf.f.Dict(d["Resources"]))
+			pf.resources(pf.f.Dict(d["Resources"]))
+		case pdfName("Image"):
+			pf.image(d, "image "+name)
+		}
+	}
+}
+
+// font checks that a font is embedded.
+func (pf *preflight) font(v any) {
+	font := pf.f.Dict(v)
+	if font == nil || font["Subtype"] == pdfName("Type3") {
+		return
+	}
+	name, _ := font["BaseFont"].(pdfName)
+	fd := pf.f.Dict(font["FontDescriptor"])
+	if font["Subtype"] == pdfName("Type0") {
+		if df, ok := pf.f.Resolve(font["DescendantFonts"]).(pdfArray); ok && len(df) > 0 {
+			fd = pf.f.Dict(pf.f.Dict(df[0])["FontDescriptor"])
+		}
+	}
+	for _, key := range []string{"FontFile", "FontFile2", "FontFile3"} {
+		if _, ok := fd[key]; ok {
+			return
+		}
+	}
+	pf.report("font %s is not embedded", name)
+}
+
+// image checks the color space, the compression and the soft mask of an
+// image.
+func (pf *preflight) image(d pdfDict, what string) {
+	if d["ImageMask"] == true {
+		return
+	}
+	pf.colorSpace(d["ColorSpace"], what)
+	if pf.format != document.FormatPDFX3 {
+		return
+	}
+	if d["Filter"] == pdfName("JPXDecode") {
+		pf.report("%s is JPEG 2000 compressed, PDF/X-3 does not allow JPEG 2000", what)
+	}
+	if bpc, _ := common.PDFInt(d["BitsPerComponent"]); bpc > 8 {
+		pf.report("%s has %d bits per component, PDF/X-3 allows 8 bits", what, bpc)
+	}
+	if _, ok := d["SMask"]; ok {
+		pf.report("%s has a soft mask, PDF/X-3 does not allow transparency", what)
+	}
+}
+
+// attachments checks the embedded files.
+func (pf *preflight) attachments() {
+	catalog := pf.f.Catalog()
+	af, _ := pf.f.Resolve(catalog["AF"]).(pdfArray)
+	_, embedded := pf.f.Dict(catalog["Names"])["EmbeddedFiles"]
+	if pf.pdfX() && (len(af) > 0 || embedded) {
+		pf.report("%s does not allow embedded files", formatNames[pf.format])
+		return
+	}
+	if !pf.pdfA() {
+		return
+	}
+	for _, ref := range af {
+		fs := pf.f.Dict(ref)
+		name, _ := pf.f.Resolve(fs["UF"]).(pdfString)
+		if _, ok := fs["AFRelationship"]; !ok {
+			pf.report("attachment %s has no relationship", name)
+		}
+		ef := pf.f.Dict(pf.f.Dict(fs["EF"])["F"])
+		if _, ok := ef["Subtype"].(pdfName); !ok {
+			pf.report("attachment %s has no MIME type", name)
+		}
+	}
+}
+
+// forms checks the form fields: PDF/X does not allow them, PDF/A requires
+// embedded fonts and PDF/UA a description of each field.
+func (pf *preflight) forms() {
+	acroForm := pf.f.Dict(pf.f.Catalog()["AcroForm"])
+	fields, _ := pf.f.Resolve(acroForm["Fields"]).(pdfArray)
+	if len(fields) == 0 {
+		return
+	}
+	if pf.pdfX() {
+		pf.report("%s does not allow form fields, flatten them (doc.flatten_forms)", formatNames[pf.format])
+		return
+	}
+	if pf.pdfA() {
+		pf.resources(pf.f.Dict(acroForm["DR"]))
+	}
+	if pf.format == document.FormatPDFUA {
+		for _, ref := range fields {
+			field := pf.f.Dict(ref)
+			if _, ok := field["TU"]; !ok && field["FT"] != pdfName("Sig") {
+				name, _ := pf.f.Resolve(field["T"]).(pdfString)
+				pf.report("form field %s has no tooltip", name)
+			}
+		}
+	}
+}
+
+// annotations checks the annotations of a page: PDF/X does not allow file
+// attachment annotations and PDF/A requires printed annotations that are
+// not invisible (1), hidden (2) or excluded from the view (32).
+func (pf *preflight) annotations(annots pdfArray) {
+	for _, a := range annots {
+		annot := pf.f.Dict(a)
+		subtype, _ := annot["Subtype"].(pdfName)
+		if pf.pdfX() && subtype == "FileAttachment" {
+			pf.report("%s does not allow file attachment annotations", formatNames[pf.format])
+		}
+		if !pf.pdfA() || subtype == "Popup" {
+			continue
+		}
+		flags, _ := common.PDFInt(pf.f.Resolve(annot["F"]))
+		if flags&4 == 0 || flags&(1|2|32) != 0 {
+			pf.report("%s requires printed and visible annotations, the %s annotation has the flags %d", formatNames[pf.format], subtype, flags)
+		}
+	}
+}
+
+// preflight checks the finished PDF file against the format of the
+// document.
+func (d *Document) preflight(f *pdfFile) error {
+	pf := &preflight{
+		f:      f,
+		format: d.Value.Doc.Format,
+		seen:   make(map[string]bool),
+		done:   make(map[pdfRef]bool),
+	}
+	if ref, ok := f.OutputProfile(); ok {
+		switch n, _ := common.PDFInt(f.Dict(ref)["N"]); n {
+		case 1:
+			pf.intent = "Gray"
+		case 3:
+			pf.intent = "RGB"
+		case 4:
+			pf.intent = "CMYK"
+		}
+	} else if pf.pdfA() || pf.pdfX() {
+		pf.report("the document has no output intent")
+	}
+
+	catalog := f.Catalog()
+	if _, ok := catalog["Metadata"]; !ok {
+		pf.report("the document has no XMP metadata")
+	}
+	if (pf.pdfX() || pf.format == document.FormatPDFUA) && d.Value.Doc.Title == "" {
+		pf.report("%s requires a document title (doc.title)", formatNames[pf.format])
+	}
+	pf.attachments()
+	pf.forms()
+
+	for i, page := range f.Pages() {
+		pf.page = i + 1
+		if _, ok := page["TrimBox"]; pf.pdfX() && !ok {
+			if _, ok := page["ArtBox"]; !ok {
+				pf.report("PDF/X requires a trim box")
+			}
+		}
+		annots, _ := f.Resolve(page["Annots"]).(pdfArray)
+		pf.annotations(annots)
+		res := f.Dict(page["Resources"])
+		pf.group(page, "the page")
+		for _, obj := range f.Contents(page) {
+			pf.stream(obj, res)
+		}
+		pf.resources(res)
+	}
+
+	name := formatNames[pf.format]
+	for _, v := range pf.violations {
+		if d.strictConformance {
+			slog.Error("Conformance violation", "format", name, "violation", v)
+		} else {
+			slog.Warn("Conformance violation", "format", name, "violation", v)
+		}
+	}
+	if d.strictConformance && len(pf.violations) > 0 {
+		return fmt.Errorf("the document does not conform to %s (%d violations)", name, len(pf.violations))
+	}
+	return nil
+}
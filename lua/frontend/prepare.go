@@ -0,0 +1,495 @@
+package frontend
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"unicode"
+
+	pdf "github.com/boxesandglue/baseline-pdf"
+	"github.com/boxesandglue/boxesandglue/backend/bag"
+	"github.com/boxesandglue/boxesandglue/backend/color"
+	"github.com/boxesandglue/boxesandglue/frontend"
+)
+
+// textContext holds the font selection that is in effect for a Text item.
+type textContext struct {
+	family *frontend.FontFamily
+	weight frontend.FontWeight
+	style  frontend.FontStyle
+	// variations are the axis values requested with the variations setting
+	variations map[string]float64
+	// effective are the axis values that the Text inherits from its parent
+	// in the prepared tree
+	effective map[string]float64
+	size      bag.ScaledPoint
+	// color is a color name or a *color.Color
+	color any
+	// palette is the CPAL palette for color fonts
+	palette int
+}
+
+// weightRange is the weight range of a variable font family member.
+type weightRange struct {
+	min frontend.FontWeight
+	max frontend.FontWeight
+}
+
+// newTextContext returns the default font selection for a root Text.
+func newTextContext() textContext {
+	return textContext{weight: frontend.FontWeight400, style: frontend.FontStyleNormal, size: 12 * bag.Factor}
+}
+
+// apply returns a copy of ctx with the font settings from settings applied.
+func (ctx textContext) apply(settings frontend.TypesettingSettings) textContext {
+	if ff, ok := settings[frontend.SettingFontFamily].(*frontend.FontFamily); ok && ff != nil {
+		ctx.family = ff
+	}
+	switch w := settings[frontend.SettingFontWeight].(type) {
+	case frontend.FontWeight:
+		ctx.weight = w
+	case int:
+		ctx.weight = frontend.FontWeight(w)
+	}
+	if s, ok := settings[frontend.SettingStyle].(frontend.FontStyle); ok {
+		ctx.style = s
+	}
+	if v, ok := settings[frontend.SettingFontVariationSettings].(map[string]float64); ok {
+		ctx.variations = v
+	}
+	if sz, ok := settings[frontend.SettingSize].(bag.ScaledPoint); ok {
+		ctx.size = sz
+	}
+	if col, ok := settings[frontend.SettingColor]; ok {
+		ctx.color = col
+	}
+	if pal, ok := settings[settingPalette].(int); ok {
+		ctx.palette = pal
+	}
+	return ctx
+}
+
+type faceKey struct {
+	family *frontend.FontFamily
+	weight frontend.FontWeight
+	style  frontend.FontStyle
+}
+
+// synthesizedKey identifies a synthesized style ("bold" or "italic") of a face.
+type synthesizedKey struct {
+	faceKey
+	synthesized string
+}
+
+// textPreparer walks a Text tree before it is handed to boxesandglue and
+// rewrites it where glu adds functionality on top of the library (for example
+// font fallbacks). The input tree is never modified, the preparer works on a
+// copy.
+type textPreparer struct {
+	doc          *Document
+	sources      map[faceKey]*frontend.FontSource
+	faces        map[faceKey]*pdf.Face
+	missing      map[*frontend.FontFamily][]rune
+	missingSeen  map[*frontend.FontFamily]map[rune]bool
+	missingOrder []*frontend.FontFamily
+}
+
+func (d *Document) newTextPreparer() *textPreparer {
+	return &textPreparer{
+		doc:         d,
+		sources:     make(map[faceKey]*frontend.FontSource),
+		faces:       make(map[faceKey]*pdf.Face),
+		missing:     make(map[*frontend.FontFamily][]rune),
+		missingSeen: make(map[*frontend.FontFamily]map[rune]bool),
+	}
+}
+
+// prepareText returns a prepared copy of te. If family is not nil or size is
+// not 0, they override the font family and size of the root Text (as the
+// options of format_paragraph do).
+func (d *Document) prepareText(te *frontend.Text, family *frontend.FontFamily, size bag.ScaledPoint) *frontend.Text {
+	p := d.newTextPreparer()
+	ctx := newTextContext().apply(te.Settings)
+	if family != nil {
+		ctx.family = family
+	}
+	if size != 0 {
+		ctx.size = size
+	}
+	ret := p.text(te, ctx)
+	p.logMissing()
+	return ret
+}
+
+// prepareTable returns a prepared copy of tbl.
+func (d *Document) prepareTable(tbl *frontend.Table) *frontend.Table {
+	p := d.newTextPreparer()
+	ret := p.table(tbl)
+	p.logMissing()
+	return ret
+}
+
+func (p *textPreparer) text(te *frontend.Text, ctx textContext) *frontend.Text {
+	ret := frontend.NewText()
+	for k, v := range te.Settings {
+		if !isGluSetting(k) {
+			ret.Settings[k] = v
+		}
+	}
+	// colors are resolved here so that spot colors become glu colors and the
+	// CSS syntax of glu is used
+	if name, ok := te.Settings[frontend.SettingColor].(string); ok {
+		if col := p.doc.color(name); col != nil {
+			ret.Settings[frontend.SettingColor] = col
+		}
+	}
+	// Lua colors get the color of the document
+	for _, st := range []frontend.SettingType{frontend.SettingColor, frontend.SettingBackgroundColor} {
+		if c, ok := te.Settings[st].(*Color); ok {
+			ret.Settings[st] = p.doc.colorValue(c)
+		}
+	}
+	_, hasVariations := te.Settings[frontend.SettingFontVariationSettings]
+	if vs := p.variations(ctx); hasVariations || !sameVariations(vs, ctx.effective) {
+		ret.Settings[frontend.SettingFontVariationSettings] = vs
+		ctx.effective = vs
+	}
+	for _, itm := range te.Items {
+		switch t := itm.(type) {
+		case string:
+			ret.Items = append(ret.Items, p.splitByCoverage(t, ctx)...)
+		case *frontend.Text:
+			ret.Items = append(ret.Items, p.text(t, ctx.apply(t.Settings)))
+		case *frontend.Table:
+			ret.Items = append(ret.Items, p.table(t))
+		default:
+			ret.Items = append(ret.Items, itm)
+		}
+	}
+	se := &structElem{}
+	se.role, _ = te.Settings[settingRole].(string)
+	if se.actualText, _ = te.Settings[settingActualText].(string); se.actualText != "" && se.role == "" {
+		se.role = "Span"
+	}
+	if p.doc.needsMarkers(se) {
+		start, stop := p.doc.structMarkers(se, false)
+		ret.Items = append(append([]any{start}, ret.Items...), stop)
+	}
+	return ret
+}
+
+// table copies the exported parts of the table so that the library can build
+// the copy from scratch.
+func (p *textPreparer) table(tbl *frontend.Table) *frontend.Table {
+	ret := &frontend.Table{
+		MaxWidth:   tbl.MaxWidth,
+		Stretch:    tbl.Stretch,
+		FontFamily: tbl.FontFamily,
+		FontSize:   tbl.FontSize,
+		Leading:    tbl.Leading,
+		ColSpec:    tbl.ColSpec,
+	}
+	for _, row := range tbl.Rows {
+		newRow := &frontend.TableRow{VAlign: row.VAlign}
+		for _, cell := range row.Cells {
+			newCell := &frontend.TableCell{
+				BackgroundColor:   cell.BackgroundColor,
+				BorderTopWidth:    cell.BorderTopWidth,
+				BorderBottomWidth: cell.BorderBottomWidth,
+				BorderLeftWidth:   cell.BorderLeftWidth,
+				BorderRightWidth:  cell.BorderRightWidth,
+				BorderTopColor:    cell.BorderTopColor,
+				BorderBottomColor: cell.BorderBottomColor,
+				BorderLeftColor:   cell.BorderLeftColor,
+				BorderRightColor:  cell.BorderRightColor,
+				HAlign:            cell.HAlign,
+				VAlign:            cell.VAlign,
+				ExtraColspan:      cell.ExtraColspan,
+				ExtraRowspan:      cell.ExtraRowspan,
+				PaddingTop:        cell.PaddingTop,
+				PaddingBottom:     cell.PaddingBottom,
+				PaddingLeft:       cell.PaddingLeft,
+				PaddingRight:      cell.PaddingRight,
+			}
+			for _, cc := range cell.Contents {
+				if te, ok := cc.(*frontend.Text); ok {
+					// The table font family and size override the settings of
+					// the cell contents.
+					ctx := newTextContext().apply(te.Settings)
+					if tbl.FontFamily != nil {
+						ctx.family = tbl.FontFamily
+					}
+					if tbl.FontSize != 0 {
+						ctx.size = tbl.FontSize
+					}
+					cc = p.text(te, ctx)
+				}
+				newCell.Contents = append(newCell.Contents, cc)
+			}
+			newRow.Cells = append(newRow.Cells, newCell)
+		}
+		ret.Rows = append(ret.Rows, newRow)
+	}
+	return ret
+}
+
+// source returns the font source that the family uses for the weight and
+// style in ctx or nil if the family has no such member.
+func (p *textPreparer) source(ff *frontend.FontFamily, ctx textContext) *frontend.FontSource {
+	key := faceKey{family: ff, weight: ctx.weight, style: ctx.style}
+	if fs, ok := p.sources[key]; ok {
+		return fs
+	}
+	fs, err := ff.GetFontSource(ctx.weight, ctx.style)
+	if err != nil {
+		fs = nil
+	}
+	p.sources[key] = fs
+	return fs
+}
+
+// face returns the face that the family uses for the weight and style in ctx
+// or nil if the face cannot be loaded.
+func (p *textPreparer) face(ff *frontend.FontFamily, ctx textContext) *pdf.Face {
+	key := faceKey{family: ff, weight: ctx.weight, style: ctx.style}
+	if face, ok := p.faces[key]; ok {
+		return face
+	}
+	var face *pdf.Face
+	if fs := p.source(ff, ctx); fs != nil {
+		var err error
+		if face, err = p.doc.Value.LoadFace(fs); err != nil {
+			face = nil
+		}
+	}
+	p.faces[key] = face
+	return face
+}
+
+// variations returns the variable font axis values for the font selected by
+// ctx: the values of the font source, the weight for a member with a weight
+// range and the values from the variations setting.
+func (p *textPreparer) variations(ctx textContext) map[string]float64 {
+	vs := make(map[string]float64)
+	if ctx.family != nil {
+		if fs := p.source(ctx.family, ctx); fs != nil {
+			for k, v := range p.doc.sourceVariations[fs] {
+				vs[k] = v
+			}
+			if r, ok := p.doc.weightRanges[fs]; ok {
+				vs["wght"] = float64(min(max(ctx.weight, r.min), r.max))
+			}
+		}
+	}
+	for k, v := range ctx.variations {
+		vs[k] = v
+	}
+	return vs
+}
+
+func sameVariations(a, b map[string]float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if bv, ok := b[k]; !ok || bv != v {
+			return false
+		}
+	}
+	return true
+}
+
+// splitByCoverage splits str into runs by glyph coverage. Runs that the font
+// family from ctx can render are returned as strings, other runs are wrapped
+// in a Text with the first fallback family that has the glyphs. Whitespace
+// stays in the current run.
+func (p *textPreparer) splitByCoverage(str string, ctx textContext) []any {
+	if ctx.family == nil {
+		return []any{str}
+	}
+	primary := p.face(ctx.family, ctx)
+	if primary == nil {
+		// let boxesandglue report the error
+		return []any{str}
+	}
+	chain := p.doc.fallbackChain(ctx.family)
+
+	var items []any
+	cur := ctx.family
+	start := 0
+	for i, r := range str {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			continue
+		}
+		ff := ctx.family
+		if primary.Codepoint(r) == 0 {
+			ff = nil
+			for _, fb := range chain {
+				if face := p.face(fb, ctx); face != nil && face.Codepoint(r) != 0 {
+					ff = fb
+					break
+				}
+			}
+			if ff == nil {
+				p.addMissing(ctx.family, r)
+				ff = ctx.family
+			}
+		}
+		if ff != cur {
+			if i > start {
+				items = append(items, p.run(str[start:i], cur, ctx)...)
+			}
+			start = i
+			cur = ff
+		}
+	}
+	if start < len(str) {
+		items = append(items, p.run(str[start:], cur, ctx)...)
+	}
+	return items
+}
+
+// run returns the items for s: a plain string if it uses the current font
+// family or a Text with the fallback family otherwise. Synthesized styles and
+// the color glyph settings are added around the string.
+func (p *textPreparer) run(s string, ff *frontend.FontFamily, ctx textContext) []any {
+	runctx := ctx
+	runctx.family = ff
+	items := p.colorGlyphs(p.synthesize(s, runctx), runctx)
+	if ff == ctx.family {
+		return items
+	}
+	te := frontend.NewText()
+	te.Settings[frontend.SettingFontFamily] = ff
+	if vs := p.variations(runctx); !sameVariations(vs, ctx.effective) {
+		te.Settings[frontend.SettingFontVariationSettings] = vs
+	}
+	te.Items = append(te.Items, items...)
+	return []any{te}
+}
+
+// synthesize wraps s in nodes for synthetic bold and italic if the font of
+// the family has not the requested weight or style.
+func (p *textPreparer) synthesize(s string, ctx textContext) []any {
+	face := p.face(ctx.family, ctx)
+	if face == nil {
+		return []any{s}
+	}
+	syn := p.doc.synthesisFor(ctx.family)
+	otf := face.OTFace()
+	var starts, stops []any
+	if syn.emboldening > 0 && ctx.weight >= 600 && otf.WeightClass() < 600 {
+		_, isRange := p.doc.weightRanges[p.source(ctx.family, ctx)]
+		if !isRange && p.variations(ctx)["wght"] < 600 {
+			p.warnSynthetic(ctx, "bold")
+			start, stop := syntheticBoldNodes(bag.MultiplyFloat(ctx.size, syn.emboldening), p.color(ctx))
+			starts = append(starts, start)
+			stops = append([]any{stop}, stops...)
+		}
+	}
+	italic := ctx.style == frontend.FontStyleItalic || ctx.style == frontend.FontStyleOblique
+	if syn.slant != 0 && italic && !otf.IsItalic() && otf.ItalicAngle() == 0 {
+		p.warnSynthetic(ctx, "italic")
+		start, stop := syntheticSlantNodes(syn.slant)
+		starts = append(starts, start)
+		stops = append([]any{stop}, stops...)
+	}
+	if len(starts) == 0 {
+		return []any{s}
+	}
+	return append(append(starts, s), stops...)
+}
+
+// colorGlyphs wraps items in markers for the palette and the text color if
+// the font of the family has color glyphs.
+func (p *textPreparer) colorGlyphs(items []any, ctx textContext) []any {
+	col := p.color(ctx)
+	if ctx.palette == 0 && col == nil {
+		return items
+	}
+	face := p.face(ctx.family, ctx)
+	if face == nil || p.doc.colorFont(face) == nil {
+		return items
+	}
+	start, stop := colorGlyphNodes(ctx.palette, colorToRGBA(p.doc.processColor(col)))
+	return append(append([]any{start}, items...), stop)
+}
+
+// warnSynthetic logs once per document, family, weight, style and synthesized
+// style that a style is synthesized.
+func (p *textPreparer) warnSynthetic(ctx textContext, style string) {
+	key := synthesizedKey{faceKey{family: ctx.family, weight: ctx.weight, style: ctx.style}, style}
+	if p.doc.synthesized[key] {
+		return
+	}
+	p.doc.synthesized[key] = true
+	slog.Warn("Font family has no matching member, synthesizing style",
+		"family", ctx.family.Name,
+		"weight", int(ctx.weight),
+		"style", ctx.style.String(),
+		"synthesized", style)
+}
+
+// color returns the text color of ctx or nil for the default color.
+func (p *textPreparer) color(ctx textContext) *color.Color {
+	switch t := ctx.color.(type) {
+	case string:
+		return p.doc.color(t)
+	case *color.Color:
+		return t
+	case *Color:
+		return p.doc.colorValue(t)
+	}
+	return nil
+}
+
+func (p *textPreparer) addMissing(ff *frontend.FontFamily, r rune) {
+	if p.missingSeen[ff] == nil {
+		p.missingSeen[ff] = make(map[rune]bool)
+		p.missingOrder = append(p.missingOrder, ff)
+	}
+	if p.missingSeen[ff][r] {
+		return
+	}
+	p.missingSeen[ff][r] = true
+	p.missing[ff] = append(p.missing[ff], r)
+}
+
+// logMissing logs the characters that no font family could render.
+func (p *textPreparer) logMissing() {
+	for _, ff := range p.missingOrder {
+		runes := p.missing[ff]
+		codepoints := make([]string, 0, len(runes))
+		for _, r := range runes {
+			codepoints = append(codepoints, fmt.Sprintf("U+%04X", r))
+		}
+		slog.Warn("Glyphs not found in font family or fallbacks",
+			"family", ff.Name,
+			"characters", string(runes),
+			"codepoints", strings.Join(codepoints, " "))
+	}
+}
+
+// fallbackChain returns the fallback families for ff: first the fallbacks
+// of the family itself, then the document wide fallbacks.
+func (d *Document) fallbackChain(ff *frontend.FontFamily) []*frontend.FontFamily {
+	var chain []*frontend.FontFamily
+	seen := map[*frontend.FontFamily]bool{ff: true}
+	for _, list := range [][]*frontend.FontFamily{d.familyFallbacks[ff], d.fallbacks} {
+		for _, fb := range list {
+			if !seen[fb] {
+				seen[fb] = true
+				chain = append(chain, fb)
+			}
+		}
+	}
+	return chain
+}
+
+// synthesisFor returns the synthesis settings for the font family.
+func (d *Document) synthesisFor(ff *frontend.FontFamily) synthesis {
+	if syn, ok := d.synthesis[ff]; ok {
+		return syn
+	}
+	return defaultSynthesis
+}
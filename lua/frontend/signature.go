@@ -0,0 +1,400 @@
+package frontend
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/boxesandglue/boxesandglue/backend/bag"
+	"github.com/speedata/glu/lua/common"
+	"github.com/speedata/go-lua"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// A signed PDF has a signature dictionary with a ByteRange and a Contents
+// placeholder. After the file is written, the placeholder is replaced by a
+// detached CMS signature of the bytes outside of Contents.
+
+var (
+	oidData          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidSignedData    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidContentType   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidMessageDigest = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidSigningTime   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 5}
+	oidSHA256        = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidRSA           = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidECDSASHA256   = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+)
+
+// byteRangePlaceholder is replaced by the byte range, the numbers are
+// padded with spaces.
+const byteRangePlaceholder = "[0 0000000000 0000000000 0000000000]"
+
+// signer signs the document with a certificate.
+type signer struct {
+	key   crypto.Signer
+	chain []*x509.Certificate
+	// name, reason, location and contact are the optional entries of the
+	// signature dictionary
+	name, reason, location, contact string
+}
+
+// signatureField is the field of the signature on a page. An invisible
+// field has no size.
+type signatureField struct {
+	name          string
+	x, y          bag.ScaledPoint
+	width, height bag.ScaledPoint
+}
+
+// loadSigner reads the certificate and the key. certificate is a PKCS#12
+// file if key is empty, otherwise a PEM file with the certificate chain.
+func loadSigner(certificate, key, password string) (*signer, error) {
+	data, err := os.ReadFile(certificate)
+	if err != nil {
+		return nil, err
+	}
+	var privateKey any
+	var chain []*x509.Certificate
+	if block, _ := pem.Decode(data); block == nil {
+		if key != "" {
+			return nil, fmt.Errorf("%s is not a PEM file", certificate)
+		}
+		var cert *x509.Certificate
+		var ca []*x509.Certificate
+		if privateKey, cert, ca, err = pkcs12.DecodeChain(data, password); err != nil {
+			return nil, fmt.Errorf("%s: %w", certificate, err)
+		}
+		chain = append([]*x509.Certificate{cert}, ca...)
+	} else {
+		keyData := data
+		if key != "" {
+			if keyData, err = os.ReadFile(key); err != nil {
+				return nil, err
+			}
+		}
+		for rest := data; ; {
+			var block *pem.Block
+			if block, rest = pem.Decode(rest); block == nil {
+				break
+			}
+			if block.Type == "CERTIFICATE" {
+				cert, err := x509.ParseCertificate(block.Bytes)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %w", certificate, err)
+				}
+				chain = append(chain, cert)
+			}
+		}
+		if len(chain) == 0 {
+			return nil, fmt.Errorf("%s has no certificate", certificate)
+		}
+		if privateKey, err = parsePEMKey(keyData); err != nil {
+			return nil, err
+		}
+	}
+	s := &signer{chain: chain}
+	var ok bool
+	if s.key, ok = privateKey.(crypto.Signer); !ok {
+		return nil, fmt.Errorf("unsupported private key")
+	}
+	switch s.key.(type) {
+	case *rsa.PrivateKey, *ecdsa.PrivateKey:
+	default:
+		return nil, fmt.Errorf("unsupported private key %T, use RSA or ECDSA", s.key)
+	}
+	return s, nil
+}
+
+// parsePEMKey returns the first private key of the PEM data.
+func parsePEMKey(data []byte) (any, error) {
+	for rest := data; ; {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			return nil, fmt.Errorf("no private key found")
+		}
+		switch block.Type {
+		case "PRIVATE KEY":
+			return x509.ParsePKCS8PrivateKey(block.Bytes)
+		case "RSA PRIVATE KEY":
+			return x509.ParsePKCS1PrivateKey(block.Bytes)
+		case "EC PRIVATE KEY":
+			return x509.ParseECPrivateKey(block.Bytes)
+		case "ENCRYPTED PRIVATE KEY":
+			return nil, fmt.Errorf("encrypted PEM keys are not supported, use a PKCS#12 file")
+		}
+	}
+}
+
+// placeholderSize is the number of bytes reserved for the CMS signature.
+func (s *signer) placeholderSize() int {
+	size := 4096
+	for _, cert := range s.chain {
+		size += len(cert.Raw)
+	}
+	return size
+}
+
+// cms returns the detached CMS signature (SignedData) of data.
+func (s *signer) cms(data []byte, signingTime time.Time) ([]byte, error) {
+	digest := sha256.Sum256(data)
+	attr := func(oid asn1.ObjectIdentifier, value any) ([]byte, error) {
+		v, err := asn1.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		return asn1.Marshal(struct {
+			Type  asn1.ObjectIdentifier
+			Value []asn1.RawValue `asn1:"set"`
+		}{oid, []asn1.RawValue{{FullBytes: v}}})
+	}
+	var attrs [][]byte
+	for _, a := range []struct {
+		oid   asn1.ObjectIdentifier
+		value any
+	}{{oidContentType, oidData}, {oidSigningTime, signingTime.UTC()}, {oidMessageDigest, digest[:]}} {
+		b, err := attr(a.oid, a.value)
+		if err != nil {
+			return nil, err
+		}
+		attrs = append(attrs, b)
+	}
+	// DER sorts the elements of a set
+	sort.Slice(attrs, func(i, j int) bool { return bytes.Compare(attrs[i], attrs[j]) < 0 })
+	signedAttrs := bytes.Join(attrs, nil)
+
+	// the signature is computed over the attributes with the SET tag
+	set, err := asn1.Marshal(asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: signedAttrs})
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.Sum256(set)
+	signature, err := s.key.Sign(rand.Reader, h[:], crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+	sigAlg := pkix.AlgorithmIdentifier{Algorithm: oidRSA, Parameters: asn1.NullRawValue}
+	if _, ok := s.key.(*ecdsa.PrivateKey); ok {
+		sigAlg = pkix.AlgorithmIdentifier{Algorithm: oidECDSASHA256}
+	}
+
+	var certs []byte
+	for _, cert := range s.chain {
+		certs = append(certs, cert.Raw...)
+	}
+	type issuerAndSerialNumber struct {
+		Issuer       asn1.RawValue
+		SerialNumber *big.Int
+	}
+	type signerInfo struct {
+		Version            int
+		SID                issuerAndSerialNumber
+		DigestAlgorithm    pkix.AlgorithmIdentifier
+		SignedAttrs        asn1.RawValue
+		SignatureAlgorithm pkix.AlgorithmIdentifier
+		Signature          []byte
+	}
+	sd, err := asn1.Marshal(struct {
+		Version          int
+		DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+		EncapContentInfo struct{ ContentType asn1.ObjectIdentifier }
+		Certificates     asn1.RawValue
+		SignerInfos      []signerInfo `asn1:"set"`
+	}{
+		Version:          1,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{{Algorithm: oidSHA256}},
+		EncapContentInfo: struct{ ContentType asn1.ObjectIdentifier }{oidData},
+		Certificates:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: certs},
+		SignerInfos: []signerInfo{{
+			Version:            1,
+			SID:                issuerAndSerialNumber{asn1.RawValue{FullBytes: s.chain[0].RawIssuer}, s.chain[0].SerialNumber},
+			DigestAlgorithm:    pkix.AlgorithmIdentifier{Algorithm: oidSHA256},
+			SignedAttrs:        asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: signedAttrs},
+			SignatureAlgorithm: sigAlg,
+			Signature:          signature,
+		}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(struct {
+		ContentType asn1.ObjectIdentifier
+		Content     asn1.RawValue
+	}{oidSignedData, asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: sd}})
+}
+
+// writeSignature adds the signature field, the signature dictionary with
+// the placeholders and the AcroForm dictionary.
+func (d *Document) writeSignature(f *pdfFile) error {
+	refs := f.PageRefs()
+	if len(refs) != len(d.shipped) {
+		return fmt.Errorf("signature: %d pages in the PDF, %d pages shipped out", len(refs), len(d.shipped))
+	}
+	if len(refs) == 0 {
+		return fmt.Errorf("signature: the document has no pages")
+	}
+	// an invisible signature is on the first page with an empty rectangle,
+	// the widget is printed (4) since PDF/A forbids hidden annotations
+	page, field, rect := 0, &signatureField{name: "Signature1"}, [4]float64{}
+	for i, sp := range d.shipped {
+		if sp.signature != nil {
+			page, field = i, sp.signature
+			m := sp.margin.ToPT()
+			x, y := m+field.x.ToPT(), m+field.y.ToPT()
+			rect = [4]float64{x, y - field.height.ToPT(), x + field.width.ToPT(), y}
+		}
+	}
+	widget := pdfDict{
+		"Type":    pdfName("Annot"),
+		"Subtype": pdfName("Widget"),
+		"FT":      pdfName("Sig"),
+		"T":       common.PDFTextString(field.name),
+		"F":       4,
+		"Rect":    pdfBox(rect),
+		"P":       refs[page],
+		"AP": pdfDict{"N": f.AddStream(pdfDict{
+			"Type":    pdfName("XObject"),
+			"Subtype": pdfName("Form"),
+			"BBox":    pdfArray{0.0, 0.0, rect[2] - rect[0], rect[3] - rect[1]},
+		}, nil)},
+	}
+	if s := d.signer; s != nil {
+		sig := pdfDict{
+			"Type":      pdfName("Sig"),
+			"Filter":    pdfName("Adobe.PPKLite"),
+			"SubFilter": pdfName("adbe.pkcs7.detached"),
+			"M":         pdfDate(time.Now()),
+			"ByteRange": pdfRaw(byteRangePlaceholder),
+			"Contents":  pdfRaw("<" + strings.Repeat("0", 2*s.placeholderSize()) + ">"),
+		}
+		name := s.name
+		if name == "" {
+			name = s.chain[0].Subject.CommonName
+		}
+		for k, v := range map[string]string{"Name": name, "Reason": s.reason, "Location": s.location, "ContactInfo": s.contact} {
+			if v != "" {
+				sig[k] = common.PDFTextString(v)
+			}
+		}
+		widget["V"] = f.Add(sig)
+	}
+	widgetRef := f.Add(widget)
+	pageDict := f.Dict(refs[page])
+	annots, _ := f.Resolve(pageDict["Annots"]).(pdfArray)
+	pageDict["Annots"] = append(annots, widgetRef)
+
+	acroForm := f.SubDict(f.Catalog(), "AcroForm")
+	fields, _ := f.Resolve(acroForm["Fields"]).(pdfArray)
+	acroForm["Fields"] = append(fields, widgetRef)
+	if d.signer != nil {
+		// signatures exist, append only
+		acroForm["SigFlags"] = 3
+	}
+	return nil
+}
+
+// sign replaces the placeholders of the signature dictionary in the PDF
+// data by the byte range and the signature.
+func (s *signer) sign(data []byte) ([]byte, error) {
+	br := bytes.Index(data, []byte(byteRangePlaceholder))
+	if br < 0 {
+		return nil, fmt.Errorf("signature: byte range not found")
+	}
+	placeholder := []byte("<" + strings.Repeat("0", 2*s.placeholderSize()) + ">")
+	start := bytes.Index(data, placeholder)
+	if start < 0 {
+		return nil, fmt.Errorf("signature: contents not found")
+	}
+	end := start + len(placeholder)
+	byteRange := fmt.Sprintf("[0 %d %d %d]", start, end, len(data)-end)
+	byteRange += strings.Repeat(" ", len(byteRangePlaceholder)-len(byteRange))
+	copy(data[br:], byteRange)
+
+	signed := append(append([]byte{}, data[:start]...), data[end:]...)
+	cms, err := s.cms(signed, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if 2*len(cms) > len(placeholder)-2 {
+		return nil, fmt.Errorf("signature: the signature is too large")
+	}
+	hex.Encode(data[start+1:], cms)
+	return data, nil
+}
+
+// documentSign signs the document when it is finished:
+// doc:sign{certificate = "signer.p12", password = "...", reason = "..."}
+// or certificate = "cert.pem" and key = "key.pem". Without a signature
+// field on a page the signature is invisible.
+func documentSign(l *lua.State) int {
+	d := checkDocument(l, 1)
+	lua.CheckType(l, 2, lua.TypeTable)
+	opts := map[string]string{}
+	for _, key := range []string{"certificate", "key", "password", "name", "reason", "location", "contact_info"} {
+		l.Field(2, key)
+		if !l.IsNil(-1) {
+			opts[key] = lua.CheckString(l, -1)
+		}
+		l.Pop(1)
+	}
+	if opts["certificate"] == "" {
+		lua.Errorf(l, "sign: certificate is required")
+		return 0
+	}
+	s, err := loadSigner(opts["certificate"], opts["key"], opts["password"])
+	if err != nil {
+		lua.Errorf(l, "sign: %s", err.Error())
+		return 0
+	}
+	s.name, s.reason, s.location, s.contact = opts["name"], opts["reason"], opts["location"], opts["contact_info"]
+	d.signer = s
+	return 0
+}
+
+// pageSignatureField reserves the area of a visible signature:
+// page:signature_field{x = "2cm", y = "5cm", width = "6cm", height = "2cm", name = "Signature1"}
+// x and y are the top left corner.
+func pageSignatureField(l *lua.State) int {
+	p := checkPage(l, 1)
+	lua.CheckType(l, 2, lua.TypeTable)
+	if p.doc.hasSignatureField {
+		lua.Errorf(l, "signature_field: the document already has a signature field")
+		return 0
+	}
+	field := &signatureField{name: "Signature1"}
+	for _, dim := range []struct {
+		key string
+		val *bag.ScaledPoint
+	}{{"x", &field.x}, {"y", &field.y}, {"width", &field.width}, {"height", &field.height}} {
+		l.Field(2, dim.key)
+		if l.IsNil(-1) {
+			lua.Errorf(l, "signature_field: %s is required", dim.key)
+			return 0
+		}
+		*dim.val = checkDimension(l, -1)
+		l.Pop(1)
+	}
+	l.Field(2, "name")
+	if !l.IsNil(-1) {
+		field.name = lua.CheckString(l, -1)
+	}
+	l.Pop(1)
+	p.signature = field
+	p.doc.hasSignatureField = true
+	l.PushValue(1)
+	return 1
+}
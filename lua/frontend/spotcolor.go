@@ -0,0 +1,385 @@
+package frontend
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/boxesandglue/boxesandglue/backend/color"
+	"github.com/boxesandglue/boxesandglue/frontend"
+	"github.com/speedata/glu/lua/common"
+)
+
+// Spot colors, tints, overprint and transparent colors are written by glu.
+// The library writes these colors with the color space "/CSn" (n is the
+// SpotcolorID) and glu replaces the color operators in the finished PDF and
+// adds the color spaces and graphics states to the page resources.
+
+// firstColorSpecID is the SpotcolorID of the first glu color, the library
+// numbers its predefined spot colors from 1.
+const firstColorSpecID = 1000
+
+// colorSpec describes a spot color, a tint of a spot color or a process
+// color with overprint or transparency.
+type colorSpec struct {
+	// name is the colorant name of a spot color, empty for process colors
+	name string
+	// cmyk is the alternate color of the spot color at full strength
+	cmyk [4]float64
+	tint float64
+	// process is the color for process colors
+	process   *color.Color
+	overprint bool
+	// alpha is the opacity, 1 is opaque
+	alpha float64
+}
+
+// newSpecColor returns the Lua color that stands for spec. Its value is used
+// where glu approximates the color, a document uses a color of its own (see
+// Document.specColor).
+func newSpecColor(spec *colorSpec) *Color {
+	col := &color.Color{Space: color.ColorSpotcolor, Basecolor: spec.name, A: spec.alpha}
+	if p := spec.process; p != nil {
+		col.C, col.M, col.Y, col.K = p.C, p.M, p.Y, p.K
+		col.R, col.G, col.B = p.R, p.G, p.B
+	} else {
+		// the tinted values are used where glu approximates the color
+		col.C, col.M, col.Y, col.K = spec.cmyk[0]*spec.tint, spec.cmyk[1]*spec.tint, spec.cmyk[2]*spec.tint, spec.cmyk[3]*spec.tint
+	}
+	return &Color{Value: col, spec: spec}
+}
+
+// specColor returns the library color that stands for spec in the document.
+// The SpotcolorIDs are numbered per document.
+func (d *Document) specColor(spec *colorSpec) *color.Color {
+	if col, ok := d.specColors[spec]; ok {
+		return col
+	}
+	c := *newSpecColor(spec).Value
+	c.SpotcolorID = firstColorSpecID + len(d.colorSpecs)
+	d.colorSpecs[c.SpotcolorID] = spec
+	d.specColors[spec] = &c
+	return &c
+}
+
+// colorValue returns the library color of a Lua color in the document.
+func (d *Document) colorValue(c *Color) *color.Color {
+	if c.spec != nil {
+		return d.specColor(c.spec)
+	}
+	return c.Value
+}
+
+// colorSpecOf returns the description of a glu color of the document or nil
+// for other colors.
+func (d *Document) colorSpecOf(col *color.Color) *colorSpec {
+	if col == nil || col.Space != color.ColorSpotcolor {
+		return nil
+	}
+	return d.colorSpecs[col.SpotcolorID]
+}
+
+// processColor returns the process color of a glu color with overprint or
+// transparency and col for other colors.
+func (d *Document) processColor(col *color.Color) *color.Color {
+	if spec := d.colorSpecOf(col); spec != nil && spec.process != nil {
+		return spec.process
+	}
+	return col
+}
+
+// color returns the color for a name or a CSS value. The library cannot write
+// its predefined spot colors, these are replaced by glu spot colors. They are
+// looked up without the document, so that the library does not write them.
+func (d *Document) color(s string) *color.Color {
+	if col, ok := d.namedColors[s]; ok {
+		return col
+	}
+	if col, ok := parseCSSColor(s); ok {
+		if col.A < 1 {
+			col = d.specColor(&colorSpec{process: col, alpha: col.A})
+		}
+		d.namedColors[s] = col
+		return col
+	}
+	if col := predefinedColor(s); col != nil && col.Space == color.ColorSpotcolor {
+		col = d.specColor(&colorSpec{name: col.Basecolor, cmyk: [4]float64{col.C, col.M, col.Y, col.K}, tint: 1, alpha: 1})
+		d.defineColor(s, col)
+		return col
+	}
+	return d.Value.GetColor(s)
+}
+
+// defineColor defines a named color in the document.
+func (d *Document) defineColor(name string, col *color.Color) {
+	d.namedColors[name] = col
+	d.Value.DefineColor(name, col)
+}
+
+// colorNames resolves the predefined color names of the library. The library
+// registers a predefined spot color in the document that looks it up, and
+// writes its separation when the document is finished.
+var colorNames *frontend.Document
+
+// predefinedColor returns the predefined color of the library with the name
+// s or nil.
+func predefinedColor(s string) *color.Color {
+	if colorNames == nil {
+		doc, err := frontend.NewForWriter(io.Discard)
+		if err != nil {
+			return nil
+		}
+		colorNames = doc
+	}
+	return colorNames.GetColor(s)
+}
+
+// graphicsState is the overprint and opacity setting for stroking and
+// filling.
+type graphicsState struct {
+	overprintStroke, overprintFill bool
+	alphaStroke, alphaFill         float64
+}
+
+// defaultGraphicsState is the state without overprint and transparency.
+var defaultGraphicsState = graphicsState{alphaStroke: 1, alphaFill: 1}
+
+// colorRewriter replaces the color operators of glu colors in content
+// streams.
+type colorRewriter struct {
+	f *pdfFile
+	// specs are the glu colors of the document by SpotcolorID
+	specs map[int]*colorSpec
+	// alternate is the alternate color space of the separations
+	alternate any
+	// separations are the resource names of the separation color spaces by
+	// colorant name
+	separations map[string]string
+	// states are the resource names of the graphics states
+	states  map[graphicsState]string
+	objects map[string]pdfRef
+}
+
+func newColorRewriter(f *pdfFile, specs map[int]*colorSpec) *colorRewriter {
+	cr := &colorRewriter{
+		f:           f,
+		specs:       specs,
+		alternate:   pdfName("DeviceCMYK"),
+		separations: make(map[string]string),
+		states:      make(map[graphicsState]string),
+		objects:     make(map[string]pdfRef),
+	}
+	// use the output intent if it is a CMYK profile
+	if ref, ok := f.OutputProfile(); ok {
+		if n, _ := common.PDFInt(f.Dict(ref)["N"]); n == 4 {
+			cr.alternate = pdfArray{pdfName("ICCBased"), ref}
+		}
+	}
+	return cr
+}
+
+// writeColorSpecs replaces the operators of the glu colors in the page
+// contents.
+func (d *Document) writeColorSpecs(f *pdfFile) error {
+	cr := newColorRewriter(f, d.colorSpecs)
+	for _, page := range f.Pages() {
+		res := f.SubDict(page, "Resources")
+		for _, obj := range f.Contents(page) {
+			data, ok := f.StreamData(obj)
+			if !ok || !bytes.Contains(data, []byte("/CS")) {
+				continue
+			}
+			if data, ok = cr.rewrite(data, res); ok {
+				f.SetStream(obj, data)
+			}
+		}
+	}
+	return nil
+}
+
+// isPDFOperand reports whether a regular token is a number, a boolean or null.
+func isPDFOperand(tok pdfRaw) bool {
+	if tok == "true" || tok == "false" || tok == "null" {
+		return true
+	}
+	return strings.IndexByte("+-.0123456789", tok[0]) >= 0
+}
+
+// rewrite replaces the color operators of glu colors in the content stream
+// data and adds the resources to res. It returns false if nothing has
+// changed.
+func (cr *colorRewriter) rewrite(data []byte, res pdfDict) ([]byte, bool) {
+	lx := &pdfLexer{Data: data, NoRefs: true}
+	var out bytes.Buffer
+	// data up to copied is written to out
+	copied := 0
+	// start of the operands of the current operator
+	start := -1
+	var operands []any
+	cur := defaultGraphicsState
+	var stack []graphicsState
+	changed := false
+	// the library writes "/CSn cs 1 scn", the scn is dropped
+	dropSCN := false
+
+	// setState switches overprint and opacity before the operator, spec is
+	// nil for other colors
+	setState := func(stroke bool, spec *colorSpec) {
+		overprint, alpha := false, 1.0
+		if spec != nil {
+			overprint, alpha = spec.overprint, spec.alpha
+		}
+		want := cur
+		if stroke {
+			want.overprintStroke, want.alphaStroke = overprint, alpha
+		} else {
+			want.overprintFill, want.alphaFill = overprint, alpha
+		}
+		if want == cur {
+			return
+		}
+		out.Write(data[copied:start])
+		out.WriteString(cr.graphicsState(want, res))
+		out.WriteByte(' ')
+		copied = start
+		cur = want
+		changed = true
+	}
+
+	for {
+		lx.SkipSpace()
+		if lx.EOF() {
+			break
+		}
+		pos := lx.Pos
+		v, err := lx.Value()
+		if err != nil {
+			return data, false
+		}
+		if start < 0 {
+			start = pos
+		}
+		tok, ok := v.(pdfRaw)
+		if !ok || isPDFOperand(tok) {
+			operands = append(operands, v)
+			continue
+		}
+		drop := dropSCN
+		dropSCN = false
+		switch tok {
+		case "q":
+			stack = append(stack, cur)
+		case "Q":
+			if len(stack) > 0 {
+				cur = stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+			}
+		case "ID":
+			// skip the inline image data
+			if end := bytes.Index(data[lx.Pos:], []byte("EI")); end >= 0 {
+				lx.Pos += end + 2
+			}
+		case "rg", "g", "k":
+			setState(false, nil)
+		case "RG", "G", "K":
+			setState(true, nil)
+		case "scn", "SCN":
+			if drop {
+				out.Write(data[copied:start])
+				copied = lx.Pos
+			}
+		case "cs", "CS":
+			stroke := tok == "CS"
+			var spec *colorSpec
+			if len(operands) == 1 {
+				if name, ok := operands[0].(pdfName); ok && strings.HasPrefix(string(name), "CS") {
+					if id, err := strconv.Atoi(string(name[2:])); err == nil {
+						spec = cr.specs[id]
+					}
+				}
+			}
+			if spec == nil {
+				setState(stroke, nil)
+				break
+			}
+			setState(stroke, spec)
+			out.Write(data[copied:start])
+			out.WriteString(cr.colorOperators(spec, stroke, res))
+			copied = lx.Pos
+			dropSCN = true
+			changed = true
+		}
+		operands = operands[:0]
+		start = -1
+	}
+	if !changed {
+		return data, false
+	}
+	out.Write(data[copied:])
+	return out.Bytes(), true
+}
+
+// colorOperators returns the operators that set the color of spec.
+func (cr *colorRewriter) colorOperators(spec *colorSpec, stroke bool, res pdfDict) string {
+	if spec.process != nil {
+		if stroke {
+			return spec.process.PDFStringStroking()
+		}
+		return spec.process.PDFStringNonStroking()
+	}
+	name := cr.separation(spec, res)
+	if stroke {
+		return fmt.Sprintf("/%s CS %s SCN", name, common.PDFNumber(spec.tint))
+	}
+	return fmt.Sprintf("/%s cs %s scn", name, common.PDFNumber(spec.tint))
+}
+
+// separation returns the resource name of the separation color space for
+// the colorant of spec and adds it to res.
+func (cr *colorRewriter) separation(spec *colorSpec, res pdfDict) string {
+	name, ok := cr.separations[spec.name]
+	if !ok {
+		name = fmt.Sprintf("Sep%d", len(cr.separations)+1)
+		cr.separations[spec.name] = name
+		c1 := pdfArray{}
+		for _, v := range spec.cmyk {
+			c1 = append(c1, v)
+		}
+		cr.objects[name] = cr.f.Add(pdfArray{
+			pdfName("Separation"),
+			pdfName(spec.name),
+			cr.alternate,
+			pdfDict{
+				"FunctionType": 2,
+				"Domain":       pdfArray{0, 1},
+				"C0":           pdfArray{0, 0, 0, 0},
+				"C1":           c1,
+				"N":            1,
+			},
+		})
+	}
+	cr.f.SubDict(res, "ColorSpace")[name] = cr.objects[name]
+	return name
+}
+
+// graphicsState returns the operator that sets the overprint and opacity
+// state and adds the graphics state to res.
+func (cr *colorRewriter) graphicsState(st graphicsState, res pdfDict) string {
+	name, ok := cr.states[st]
+	if !ok {
+		name = fmt.Sprintf("GSglu%d", len(cr.states)+1)
+		cr.states[st] = name
+		cr.objects[name] = cr.f.Add(pdfDict{
+			"Type": pdfName("ExtGState"),
+			"OP":   st.overprintStroke,
+			"op":   st.overprintFill,
+			"OPM":  1,
+			"CA":   st.alphaStroke,
+			"ca":   st.alphaFill,
+		})
+	}
+	cr.f.SubDict(res, "ExtGState")[name] = cr.objects[name]
+	return "/" + name + " gs"
+}
@@ -0,0 +1,595 @@
+package frontend
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/boxesandglue/boxesandglue/backend/document"
+	"github.com/boxesandglue/boxesandglue/backend/node"
+	"github.com/speedata/glu/lua/common"
+)
+
+// Tagged PDF: glu marks the content of each structure element with
+// "/GluTagN BMC" and "EMC" where N is the number of the element. These
+// markers are output in page mode (outside of text objects) by invisible
+// rules. When the document is finished, the markers are replaced by marked
+// content with MCIDs and the structure tree is built from the nesting of
+// the markers in the page contents. Untagged documents only have markers
+// for alternative and actual text, they become marked content without
+// MCID.
+
+const (
+	// attrRole is the structure role of a node, it is tagged when its
+	// vlist is placed on a page.
+	attrRole = "glu-role"
+	// attrAlt is the alternative text of a node.
+	attrAlt = "glu-alt"
+	// roleArtifact marks content that is not part of the structure tree.
+	roleArtifact = "Artifact"
+	tagPrefix    = "GluTag"
+)
+
+// structureRoles are the standard structure types of PDF 1.7.
+var structureRoles = map[string]bool{
+	"Document": true, "Part": true, "Art": true, "Sect": true, "Div": true,
+	"BlockQuote": true, "Caption": true, "TOC": true, "TOCI": true, "Index": true,
+	"P": true, "H": true, "H1": true, "H2": true, "H3": true, "H4": true, "H5": true, "H6": true,
+	"L": true, "LI": true, "Lbl": true, "LBody": true,
+	"Table": true, "TR": true, "TH": true, "TD": true, "THead": true, "TBody": true, "TFoot": true,
+	"Span": true, "Quote": true, "Note": true, "Reference": true, "Code": true, "Link": true,
+	"Figure": true, "Formula": true, roleArtifact: true,
+}
+
+// checkRole returns an error if role is not a standard structure type.
+func checkRole(role string) error {
+	if !structureRoles[role] {
+		return fmt.Errorf("unknown role %q (use for example P, H1 to H6, L, LI, Table, TR, TH, TD, Figure or Artifact)", role)
+	}
+	return nil
+}
+
+// structElem is an element of the structure tree.
+type structElem struct {
+	role string
+	// alt is the alternative text, for example the description of a figure
+	alt string
+	// actualText replaces the text of the glyphs when the content is
+	// extracted (ligatures, decorative initials)
+	actualText string
+	parent     *structElem
+	// kids are the child elements and the marked content in reading order
+	kids []any
+	ref  pdfRef
+}
+
+// markedContent is a marked-content sequence of a structure element.
+type markedContent struct {
+	page pdfRef
+	mcid int
+}
+
+// hasContent reports whether the element or one of its descendants has
+// marked content.
+func (se *structElem) hasContent() bool {
+	for _, kid := range se.kids {
+		switch t := kid.(type) {
+		case markedContent:
+			return true
+		case *structElem:
+			if t.hasContent() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isTagged reports whether the document gets a structure tree.
+func (d *Document) isTagged() bool {
+	return d.tagged || d.Value.Doc.Format == document.FormatPDFUA
+}
+
+// properties returns the property list of the marked content of the
+// element, mcid is -1 for marked content without MCID. ok is false if the
+// property list is empty.
+func (se *structElem) properties(mcid int) (string, bool) {
+	var b bytes.Buffer
+	if mcid >= 0 {
+		fmt.Fprintf(&b, " /MCID %d", mcid)
+	}
+	if se.alt != "" {
+		b.WriteString(" /Alt ")
+		common.WritePDFValue(&b, common.PDFTextString(se.alt), 0)
+	}
+	if se.actualText != "" {
+		b.WriteString(" /ActualText ")
+		common.WritePDFValue(&b, common.PDFTextString(se.actualText), 0)
+	}
+	if b.Len() == 0 {
+		return "", false
+	}
+	return "<<" + b.String()[1:] + ">>", true
+}
+
+// needsMarkers reports whether the content of the element is marked in the
+// document.
+func (d *Document) needsMarkers(se *structElem) bool {
+	return se.role != "" && d.isTagged() || se.alt != "" || se.actualText != ""
+}
+
+// newStructElem adds a structure element and returns the PDF code that
+// starts and ends its content.
+func (d *Document) newStructElem(se *structElem) (string, string) {
+	d.structElems = append(d.structElems, se)
+	return fmt.Sprintf("/%s%d BMC", tagPrefix, len(d.structElems)), "EMC"
+}
+
+// structMarkers returns the invisible rules that start and end a structure
+// element. Rules in a vertical list are written inside a text object, so
+// the markers are packed in an hlist there.
+func (d *Document) structMarkers(se *structElem, vertical bool) (node.Node, node.Node) {
+	pre, post := d.newStructElem(se)
+	start, stop := node.NewRule(), node.NewRule()
+	start.Hide, stop.Hide = true, true
+	start.Pre, stop.Pre = pre, post
+	if vertical {
+		return node.Hpack(start), node.Hpack(stop)
+	}
+	return start, stop
+}
+
+// tagNodes encloses the nodes below vl that have a role or an alternative
+// text in structure markers. The attributes are removed afterwards so each
+// node is tagged once.
+func (d *Document) tagNodes(vl *node.VList) {
+	vl.List = d.tagList(vl.List, true)
+}
+
+func (d *Document) tagList(head node.Node, vertical bool) node.Node {
+	for n := head; n != nil; n = n.Next() {
+		switch t := n.(type) {
+		case *node.HList:
+			t.List = d.tagList(t.List, false)
+		case *node.VList:
+			t.List = d.tagList(t.List, true)
+		}
+		if se := nodeStructElem(n); d.needsMarkers(se) {
+			node.SetAttribute(n, attrRole, "")
+			node.SetAttribute(n, attrAlt, "")
+			start, stop := d.structMarkers(se, vertical)
+			head = node.InsertBefore(head, n, start)
+			node.InsertAfter(head, n, stop)
+			n = stop
+		}
+	}
+	return head
+}
+
+// nodeStructElem returns the structure element for the role and the
+// alternative text of n. Images with an alternative text are figures.
+func nodeStructElem(n node.Node) *structElem {
+	se := &structElem{}
+	if role, ok := node.GetAttribute(n, attrRole); ok {
+		se.role, _ = role.(string)
+	}
+	if alt, ok := node.GetAttribute(n, attrAlt); ok {
+		se.alt, _ = alt.(string)
+	}
+	if _, isImage := n.(*node.Image); isImage && se.role == "" && se.alt != "" {
+		se.role = "Figure"
+	}
+	return se
+}
+
+// tagTable sets the roles of the table, its rows and cells in the vlists
+// built from tbl.
+func tagTable(tbl *Table, vlists []*node.VList) {
+	rows := tbl.rows
+	for _, vl := range vlists {
+		node.SetAttribute(vl, attrRole, "Table")
+		for n := vl.List; n != nil; n = n.Next() {
+			hl, ok := n.(*node.HList)
+			if origin, _ := node.GetAttribute(n, "origin"); !ok || origin != "table row" {
+				continue
+			}
+			node.SetAttribute(hl, attrRole, "TR")
+			var cells []*TableCell
+			if len(rows) > 0 {
+				cells, rows = rows[0].cells, rows[1:]
+			}
+			for c := hl.List; c != nil; c = c.Next() {
+				if origin, _ := node.GetAttribute(c, "origin"); origin != "td" {
+					continue
+				}
+				role := "TD"
+				if len(cells) > 0 {
+					role, cells = cells[0].cellRole(), cells[1:]
+				}
+				node.SetAttribute(c, attrRole, role)
+			}
+		}
+	}
+}
+
+// contentTagger replaces the structure markers in the content streams of a
+// page by marked content with MCIDs.
+type contentTagger struct {
+	d    *Document
+	page pdfRef
+	// root is the root of the structure tree, nil for untagged content
+	root *structElem
+	// parents are the structure elements of the marked content by MCID
+	parents []*structElem
+	// untagged are the kinds of content outside of structure elements and
+	// artifacts
+	untagged map[string]bool
+}
+
+// markedEntry is an open marked-content sequence in a content stream.
+// elem is nil for marked content that glu does not handle (for example
+// optional content).
+type markedEntry struct {
+	elem     *structElem
+	artifact bool
+}
+
+// openContent is the marked-content sequence with MCID of the innermost
+// structure element. The BDC operator is written when the sequence is
+// closed, empty sequences are dropped.
+type openContent struct {
+	elem    *structElem
+	piece   int
+	painted bool
+}
+
+// paintingOperators are the operators that put marks on the page.
+var paintingOperators = map[pdfRaw]string{
+	"Tj": "text", "TJ": "text", "'": "text", "\"": "text",
+	"f": "graphics", "F": "graphics", "f*": "graphics", "S": "graphics", "s": "graphics",
+	"B": "graphics", "B*": "graphics", "b": "graphics", "b*": "graphics", "sh": "graphics",
+	"Do": "images", "BI": "images",
+}
+
+// tagElem returns the structure element of a marker name or nil.
+func (d *Document) tagElem(name pdfName) *structElem {
+	s, ok := strings.CutPrefix(string(name), tagPrefix)
+	if !ok {
+		return nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 || n > len(d.structElems) {
+		return nil
+	}
+	return d.structElems[n-1]
+}
+
+// stream returns the content stream data with the structure markers
+// replaced. Without a structure tree and in Form XObjects (inXObject) the
+// markers become marked content without MCID, the XObject belongs to the
+// element of the page content that draws it.
+func (t *contentTagger) stream(data []byte, inXObject bool) ([]byte, bool) {
+	plain := inXObject || t.root == nil
+	lx := &pdfLexer{Data: data, NoRefs: true}
+	var pieces []string
+	var stack []markedEntry
+	var open *openContent
+	copied, start := 0, -1
+	var operands []any
+	changed := false
+
+	// inner returns the innermost structure element or artifact
+	inner := func() *markedEntry {
+		for i := len(stack) - 1; i >= 0; i-- {
+			if stack[i].elem != nil || stack[i].artifact {
+				return &stack[i]
+			}
+		}
+		return nil
+	}
+	closeContent := func() {
+		if open == nil {
+			return
+		}
+		if open.painted {
+			mcid := len(t.parents)
+			t.parents = append(t.parents, open.elem)
+			open.elem.kids = append(open.elem.kids, markedContent{page: t.page, mcid: mcid})
+			props, _ := open.elem.properties(mcid)
+			pieces[open.piece] = fmt.Sprintf("/%s %s BDC ", open.elem.role, props)
+			pieces = append(pieces, " EMC ")
+		}
+		open = nil
+	}
+	openInner := func() {
+		if e := inner(); e != nil && e.elem != nil && !plain {
+			pieces = append(pieces, "")
+			open = &openContent{elem: e.elem, piece: len(pieces) - 1}
+		}
+	}
+	for {
+		lx.SkipSpace()
+		if lx.EOF() {
+			break
+		}
+		pos := lx.Pos
+		v, err := lx.Value()
+		if err != nil {
+			return nil, false
+		}
+		if start < 0 {
+			start = pos
+		}
+		tok, ok := v.(pdfRaw)
+		if !ok || isPDFOperand(tok) {
+			operands = append(operands, v)
+			continue
+		}
+		switch tok {
+		case "ID":
+			// skip the inline image data
+			if end := bytes.Index(data[lx.Pos:], []byte("EI")); end >= 0 {
+				lx.Pos += end + 2
+			}
+		case "BMC", "BDC":
+			var elem *structElem
+			if len(operands) == 1 && tok == "BMC" {
+				name, _ := operands[0].(pdfName)
+				elem = t.d.tagElem(name)
+			}
+			pieces = append(pieces, string(data[copied:start]))
+			copied = lx.Pos
+			closeContent()
+			switch {
+			case elem == nil:
+				pieces = append(pieces, string(data[start:lx.Pos]))
+				stack = append(stack, markedEntry{})
+			case elem.role == roleArtifact || inner() != nil && inner().artifact:
+				pieces = append(pieces, "/Artifact BMC")
+				stack = append(stack, markedEntry{artifact: true})
+			case plain:
+				role := elem.role
+				if role == "" || !t.d.isTagged() {
+					role = "Span"
+				}
+				if props, ok := elem.properties(-1); ok {
+					pieces = append(pieces, "/"+role+" "+props+" BDC")
+				} else {
+					pieces = append(pieces, "/"+role+" BMC")
+				}
+				stack = append(stack, markedEntry{})
+			default:
+				if elem.parent == nil {
+					elem.parent = t.root
+					if e := inner(); e != nil {
+						elem.parent = e.elem
+					}
+					elem.parent.kids = append(elem.parent.kids, elem)
+				}
+				stack = append(stack, markedEntry{elem: elem})
+			}
+			changed = changed || elem != nil
+			openInner()
+		case "EMC":
+			pieces = append(pieces, string(data[copied:start]))
+			copied = lx.Pos
+			closeContent()
+			if len(stack) > 0 {
+				if e := stack[len(stack)-1]; e.elem == nil {
+					pieces = append(pieces, "EMC")
+				}
+				stack = stack[:len(stack)-1]
+			}
+			openInner()
+		default:
+			if kind, ok := paintingOperators[tok]; ok {
+				switch e := inner(); {
+				case e == nil:
+					t.untagged[kind] = true
+				case open != nil:
+					open.painted = true
+				}
+			}
+		}
+		operands = operands[:0]
+		start = -1
+	}
+	pieces = append(pieces, string(data[copied:]))
+	closeContent()
+	if !changed {
+		return data, false
+	}
+	return []byte(strings.Join(pieces, "")), true
+}
+
+// writeStructure replaces the structure markers in the content streams and
+// writes the structure tree. For PDF/UA all content must be tagged or an
+// artifact.
+func (d *Document) writeStructure(f *pdfFile) error {
+	if !d.isTagged() {
+		if len(d.structElems) > 0 {
+			d.writeMarkedContent(f)
+		}
+		return nil
+	}
+	root := &structElem{role: "Document"}
+	var untagged []string
+	var parents [][]*structElem
+	refs := f.PageRefs()
+	for i, page := range f.Pages() {
+		t := &contentTagger{d: d, page: refs[i], root: root, untagged: make(map[string]bool)}
+		for _, obj := range f.Contents(page) {
+			data, ok := f.StreamData(obj)
+			if !ok {
+				continue
+			}
+			if data, ok = t.stream(data, false); ok {
+				f.SetStream(obj, data)
+			}
+		}
+		parents = append(parents, t.parents)
+		if len(t.parents) > 0 {
+			page["StructParents"] = i
+		}
+		page["Tabs"] = pdfName("S")
+		if len(t.untagged) > 0 {
+			kinds := make([]string, 0, len(t.untagged))
+			for k := range t.untagged {
+				kinds = append(kinds, k)
+			}
+			sort.Strings(kinds)
+			untagged = append(untagged, fmt.Sprintf("page %d: untagged %s", i+1, strings.Join(kinds, " and ")))
+		}
+	}
+	for _, obj := range f.Objects {
+		if dict, ok := obj.Value.(pdfDict); ok && obj.Stream != nil && dict["Subtype"] == pdfName("Form") {
+			if data, ok := f.StreamData(obj); ok && bytes.Contains(data, []byte("/"+tagPrefix)) {
+				t := &contentTagger{d: d, root: root, untagged: make(map[string]bool)}
+				if data, ok = t.stream(data, true); ok {
+					f.SetStream(obj, data)
+				}
+			}
+		}
+	}
+	if d.Value.Doc.Format == document.FormatPDFUA && len(untagged) > 0 {
+		return fmt.Errorf("PDF/UA requires tagged content, %s (set a role on the Text, the table cells or the ImageNode, or place decorations with {role=\"Artifact\"})", strings.Join(untagged, ", "))
+	}
+	if d.Value.Doc.Format == document.FormatPDFUA {
+		for _, se := range d.structElems {
+			if se.role == "Figure" && se.alt == "" && se.hasContent() {
+				return fmt.Errorf("PDF/UA requires an alternative text for each figure (set alt on the ImageNode or in the options of output_at)")
+			}
+		}
+	}
+
+	treeRoot := pdfDict{"Type": pdfName("StructTreeRoot")}
+	treeRootRef := f.Add(treeRoot)
+	var write func(se *structElem, parent pdfRef) pdfRef
+	write = func(se *structElem, parent pdfRef) pdfRef {
+		dict := pdfDict{"Type": pdfName("StructElem"), "S": pdfName(se.role), "P": parent}
+		if se.alt != "" {
+			dict["Alt"] = common.PDFTextString(se.alt)
+		}
+		se.ref = f.Add(dict)
+		k := pdfArray{}
+		for _, kid := range se.kids {
+			switch t := kid.(type) {
+			case *structElem:
+				if t.hasContent() {
+					k = append(k, write(t, se.ref))
+				}
+			case markedContent:
+				k = append(k, pdfDict{"Type": pdfName("MCR"), "Pg": t.page, "MCID": t.mcid})
+			}
+		}
+		dict["K"] = k
+		return se.ref
+	}
+	treeRoot["K"] = write(root, treeRootRef)
+	nums := pdfArray{}
+	for i, elems := range parents {
+		if len(elems) == 0 {
+			continue
+		}
+		arr := make(pdfArray, len(elems))
+		for j, se := range elems {
+			arr[j] = se.ref
+		}
+		nums = append(nums, i, arr)
+	}
+	treeRoot["ParentTree"] = pdfDict{"Nums": nums}
+	treeRoot["ParentTreeNextKey"] = len(parents)
+
+	catalog := f.Catalog()
+	catalog["StructTreeRoot"] = treeRootRef
+	catalog["MarkInfo"] = pdfDict{"Marked": true}
+	if lang := d.Value.Doc.DefaultLanguage; lang != nil && lang.Name != "" {
+		catalog["Lang"] = common.PDFTextString(lang.Name)
+	}
+	if d.Value.Doc.Format == document.FormatPDFUA {
+		f.SubDict(catalog, "ViewerPreferences")["DisplayDocTitle"] = true
+	}
+	return nil
+}
+
+// annotationRoles are the structure roles of the annotations, other
+// annotations than widgets and links are tagged as Annot.
+var annotationRoles = map[pdfName]string{
+	"Widget": "Form",
+	"Link":   "Link",
+}
+
+// writeAnnotationStructure adds the annotations of the pages to the
+// structure tree written by writeStructure. The form fields, the file
+// attachment annotations and the signature are written after the structure
+// tree, each annotation gets a structure element with an object reference at
+// the end of the document element.
+func (d *Document) writeAnnotationStructure(f *pdfFile) {
+	treeRoot := f.Dict(f.Catalog()["StructTreeRoot"])
+	root, ok := treeRoot["K"].(pdfRef)
+	if !ok {
+		return
+	}
+	rootDict := f.Dict(root)
+	kids, _ := rootDict["K"].(pdfArray)
+	parentTree, _ := treeRoot["ParentTree"].(pdfDict)
+	nums, _ := parentTree["Nums"].(pdfArray)
+	next, _ := common.PDFInt(treeRoot["ParentTreeNextKey"])
+	refs := f.PageRefs()
+	for i, page := range f.Pages() {
+		annots, _ := f.Resolve(page["Annots"]).(pdfArray)
+		for _, a := range annots {
+			ref, ok := a.(pdfRef)
+			if !ok {
+				continue
+			}
+			annot := f.Dict(ref)
+			subtype, _ := annot["Subtype"].(pdfName)
+			if _, tagged := annot["StructParent"]; tagged || subtype == "Popup" {
+				continue
+			}
+			role, ok := annotationRoles[subtype]
+			if !ok {
+				role = "Annot"
+			}
+			elem := f.Add(pdfDict{
+				"Type": pdfName("StructElem"),
+				"S":    pdfName(role),
+				"P":    root,
+				"Pg":   refs[i],
+				"K":    pdfDict{"Type": pdfName("OBJR"), "Obj": ref, "Pg": refs[i]},
+			})
+			annot["StructParent"] = next
+			kids = append(kids, elem)
+			nums = append(nums, next, elem)
+			next++
+		}
+	}
+	rootDict["K"] = kids
+	treeRoot["ParentTree"] = pdfDict{"Nums": nums}
+	treeRoot["ParentTreeNextKey"] = next
+}
+
+// writeMarkedContent replaces the structure markers of an untagged document
+// by marked content with the alternative and actual texts.
+func (d *Document) writeMarkedContent(f *pdfFile) {
+	t := &contentTagger{d: d, untagged: make(map[string]bool)}
+	var streams []*pdfObject
+	for _, page := range f.Pages() {
+		streams = append(streams, f.Contents(page)...)
+	}
+	for _, obj := range f.Objects {
+		if dict, ok := obj.Value.(pdfDict); ok && obj.Stream != nil && dict["Subtype"] == pdfName("Form") {
+			streams = append(streams, obj)
+		}
+	}
+	for _, obj := range streams {
+		if data, ok := f.StreamData(obj); ok && bytes.Contains(data, []byte("/"+tagPrefix)) {
+			if data, ok = t.stream(data, false); ok {
+				f.SetStream(obj, data)
+			}
+		}
+	}
+}
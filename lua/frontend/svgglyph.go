@@ -0,0 +1,945 @@
+package frontend
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/boxesandglue/boxesandglue/backend/color"
+)
+
+// maxSVGDocumentSize limits the size of a decompressed SVG document.
+const maxSVGDocumentSize = 1 << 26
+
+// svgGlyphs holds the documents of the OpenType SVG table. Only a subset of
+// SVG is supported: the basic shapes and paths, groups, use elements, solid
+// colors and linear and radial gradients. CSS style sheets, masks, clip paths
+// and filters are ignored.
+type svgGlyphs struct {
+	data     fontData
+	records  []svgRecord
+	docs     map[int]*svgDocument
+	getColor func(string) *color.Color
+}
+
+// svgRecord is an entry in the SVG document list. offset is relative to the
+// start of the table.
+type svgRecord struct {
+	first, last    int
+	offset, length int
+}
+
+type svgElement struct {
+	name     string
+	attrs    map[string]string
+	parent   *svgElement
+	children []*svgElement
+}
+
+type svgDocument struct {
+	ids map[string]*svgElement
+}
+
+// parseSVGTable reads the document list of the SVG table. It returns nil if
+// the table is missing or empty.
+func parseSVGTable(d fontData, getColor func(string) *color.Color) *svgGlyphs {
+	list := d.u32(2)
+	if list == 0 {
+		return nil
+	}
+	s := &svgGlyphs{data: d, docs: make(map[int]*svgDocument), getColor: getColor}
+	for i := range d.u16(list) {
+		o := list + 2 + 12*i
+		s.records = append(s.records, svgRecord{
+			first:  d.u16(o),
+			last:   d.u16(o + 2),
+			offset: list + d.u32(o+4),
+			length: d.u32(o + 8),
+		})
+	}
+	if len(s.records) == 0 {
+		return nil
+	}
+	return s
+}
+
+func (s *svgGlyphs) record(gid int) (svgRecord, bool) {
+	for _, rec := range s.records {
+		if gid >= rec.first && gid <= rec.last {
+			return rec, true
+		}
+	}
+	return svgRecord{}, false
+}
+
+func (s *svgGlyphs) has(gid int) bool {
+	_, ok := s.record(gid)
+	return ok
+}
+
+// document returns the parsed SVG document or nil if it cannot be read.
+func (s *svgGlyphs) document(rec svgRecord) *svgDocument {
+	if doc, ok := s.docs[rec.offset]; ok {
+		return doc
+	}
+	var doc *svgDocument
+	if rec.offset+rec.length <= len(s.data) {
+		var err error
+		if doc, err = parseSVGDocument(s.data[rec.offset : rec.offset+rec.length]); err != nil {
+			doc = nil
+		}
+	}
+	s.docs[rec.offset] = doc
+	return doc
+}
+
+func parseSVGDocument(data []byte) (*svgDocument, error) {
+	var r io.Reader = bytes.NewReader(data)
+	if bytes.HasPrefix(data, []byte{0x1f, 0x8b}) {
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		r = io.LimitReader(zr, maxSVGDocumentSize)
+	}
+	dec := xml.NewDecoder(r)
+	dec.Strict = false
+	doc := &svgDocument{ids: make(map[string]*svgElement)}
+	var cur *svgElement
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			el := &svgElement{name: t.Name.Local, attrs: make(map[string]string), parent: cur}
+			for _, a := range t.Attr {
+				el.attrs[a.Name.Local] = a.Value
+			}
+			// declarations in the style attribute override the presentation
+			// attributes
+			for _, decl := range strings.Split(el.attrs["style"], ";") {
+				if k, v, ok := strings.Cut(decl, ":"); ok {
+					el.attrs[strings.TrimSpace(k)] = strings.TrimSpace(v)
+				}
+			}
+			if id, ok := el.attrs["id"]; ok {
+				doc.ids[id] = el
+			}
+			if cur != nil {
+				cur.children = append(cur.children, el)
+			}
+			cur = el
+		case xml.EndElement:
+			if cur != nil {
+				cur = cur.parent
+			}
+		}
+	}
+	return doc, nil
+}
+
+// draw draws the glyph with the id glyph<gid>. The SVG coordinate system has
+// the y axis pointing down.
+func (s *svgGlyphs) draw(p *colorPainter, gid int) {
+	rec, ok := s.record(gid)
+	if !ok {
+		return
+	}
+	doc := s.document(rec)
+	if doc == nil {
+		return
+	}
+	el := doc.ids[fmt.Sprintf("glyph%d", gid)]
+	if el == nil {
+		return
+	}
+	var ancestors []*svgElement
+	for e := el.parent; e != nil; e = e.parent {
+		ancestors = append([]*svgElement{e}, ancestors...)
+	}
+	r := &svgRenderer{svg: s, doc: doc, p: p}
+	st := svgState{fill: svgPaint{color: rgba{a: 1}}, stroke: svgPaint{none: true}, strokeWidth: 1}
+	p.transformed(matrix{1, 0, 0, -1, 0, 0}, func() { r.chain(ancestors, el, st) })
+}
+
+// svgPaint is the value of a fill or stroke property.
+type svgPaint struct {
+	none bool
+	// current is true for currentColor, the text color.
+	current  bool
+	color    rgba
+	gradient *svgElement
+}
+
+// svgState holds the inherited properties.
+type svgState struct {
+	fill, stroke svgPaint
+	strokeWidth  float64
+	evenOdd      bool
+	lineCap      int
+	lineJoin     int
+}
+
+type svgRenderer struct {
+	svg *svgGlyphs
+	doc *svgDocument
+	p   *colorPainter
+}
+
+// chain applies the properties and transformations of the ancestors and draws
+// the element.
+func (r *svgRenderer) chain(ancestors []*svgElement, el *svgElement, st svgState) {
+	if len(ancestors) == 0 {
+		r.element(el, st)
+		return
+	}
+	a := ancestors[0]
+	st = r.style(a, st)
+	if a.name == "svg" {
+		r.p.transformed(r.viewBox(a), func() { r.chain(ancestors[1:], el, st) })
+	} else {
+		r.withTransform(a, func() { r.chain(ancestors[1:], el, st) })
+	}
+}
+
+// viewBox returns the transformation for the viewBox of an svg element. The
+// view box is mapped to the em square unless the element has a width and a
+// height.
+func (r *svgRenderer) viewBox(el *svgElement) matrix {
+	sc := &pathScanner{s: el.attrs["viewBox"]}
+	vb, ok := sc.numbers(4)
+	if !ok || vb[2] <= 0 || vb[3] <= 0 {
+		return identity
+	}
+	upem := float64(r.p.cf.face.UnitsPerEM)
+	w, h := upem, upem
+	if v, ok := el.attrs["width"]; ok && !strings.HasSuffix(v, "%") {
+		w = svgLength(v)
+	}
+	if v, ok := el.attrs["height"]; ok && !strings.HasSuffix(v, "%") {
+		h = svgLength(v)
+	}
+	return translation(-vb[0], -vb[1]).mul(matrix{w / vb[2], 0, 0, h / vb[3], 0, 0})
+}
+
+func (r *svgRenderer) withTransform(el *svgElement, fn func()) {
+	if _, ok := el.attrs["transform"]; ok {
+		r.p.transformed(elementTransform(el), fn)
+	} else {
+		fn()
+	}
+}
+
+// style returns the properties of el, inherited from st.
+func (r *svgRenderer) style(el *svgElement, st svgState) svgState {
+	if v, ok := el.attrs["fill"]; ok {
+		st.fill = r.paint(v, st.fill)
+	}
+	if v, ok := el.attrs["stroke"]; ok {
+		st.stroke = r.paint(v, st.stroke)
+	}
+	if v, ok := el.attrs["stroke-width"]; ok {
+		st.strokeWidth = svgLength(v)
+	}
+	if v, ok := el.attrs["fill-rule"]; ok {
+		st.evenOdd = v == "evenodd"
+	}
+	if v, ok := el.attrs["stroke-linecap"]; ok {
+		st.lineCap = map[string]int{"round": 1, "square": 2}[v]
+	}
+	if v, ok := el.attrs["stroke-linejoin"]; ok {
+		st.lineJoin = map[string]int{"round": 1, "bevel": 2}[v]
+	}
+	if v, ok := el.attrs["fill-opacity"]; ok && svgLength(v) < minAlpha {
+		st.fill = svgPaint{none: true}
+	}
+	if v, ok := el.attrs["stroke-opacity"]; ok && svgLength(v) < minAlpha {
+		st.stroke = svgPaint{none: true}
+	}
+	return st
+}
+
+// paint parses a fill or stroke value. Invalid values keep the inherited
+// value.
+func (r *svgRenderer) paint(v string, inherited svgPaint) svgPaint {
+	v = strings.TrimSpace(v)
+	switch v {
+	case "none", "transparent":
+		return svgPaint{none: true}
+	case "currentColor", "currentcolor":
+		return svgPaint{current: true, color: r.p.fg}
+	case "inherit":
+		return inherited
+	}
+	if strings.HasPrefix(v, "url(") {
+		if el := r.doc.ids[svgRef(v)]; el != nil {
+			return svgPaint{gradient: el}
+		}
+		return svgPaint{none: true}
+	}
+	if c, ok := r.color(v); ok {
+		return svgPaint{color: c}
+	}
+	return inherited
+}
+
+func (r *svgRenderer) color(v string) (rgba, bool) {
+	v = strings.ToLower(strings.TrimSpace(v))
+	if hex, ok := strings.CutPrefix(v, "#"); ok {
+		// #rgb is expanded to #rrggbb
+		if len(hex) == 3 {
+			hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+		}
+		n, err := strconv.ParseUint(hex, 16, 32)
+		if err != nil || len(hex) != 6 {
+			return rgba{}, false
+		}
+		return rgba{r: float64(n>>16) / 255, g: float64(n>>8&0xff) / 255, b: float64(n&0xff) / 255, a: 1}, true
+	}
+	if r.svg.getColor == nil {
+		return rgba{}, false
+	}
+	col := r.svg.getColor(v)
+	if col == nil {
+		return rgba{}, false
+	}
+	return colorToRGBA(col), true
+}
+
+func (r *svgRenderer) element(el *svgElement, st svgState) {
+	if r.p.depth >= maxPaintDepth {
+		return
+	}
+	r.p.depth++
+	defer func() { r.p.depth-- }()
+	if el.attrs["display"] == "none" || el.attrs["visibility"] == "hidden" {
+		return
+	}
+	if v, ok := el.attrs["opacity"]; ok && svgLength(v) < minAlpha {
+		return
+	}
+	st = r.style(el, st)
+	draw := func() { r.clipped(el, func() { r.content(el, st) }) }
+	if el.name == "svg" {
+		r.p.transformed(r.viewBox(el), draw)
+	} else {
+		r.withTransform(el, draw)
+	}
+}
+
+// content draws the element in its own coordinate system.
+func (r *svgRenderer) content(el *svgElement, st svgState) {
+	switch el.name {
+	case "g", "a", "switch", "svg":
+		for _, c := range el.children {
+			r.element(c, st)
+		}
+	case "use":
+		ref := r.doc.ids[svgRef(el.attrs["href"])]
+		if ref == nil {
+			return
+		}
+		r.p.transformed(translation(svgLength(el.attrs["x"]), svgLength(el.attrs["y"])), func() {
+			if ref.name == "symbol" {
+				st := r.style(ref, st)
+				for _, c := range ref.children {
+					r.element(c, st)
+				}
+			} else {
+				r.element(ref, st)
+			}
+		})
+	case "path", "rect", "circle", "ellipse", "line", "polyline", "polygon":
+		r.shape(st, elementPath(el))
+	}
+}
+
+// svgRef returns the id from a reference such as #id or url(#id).
+func svgRef(v string) string {
+	v = strings.TrimSpace(v)
+	if strings.HasPrefix(v, "url(") {
+		v, _, _ = strings.Cut(strings.TrimPrefix(v, "url("), ")")
+	}
+	return strings.TrimPrefix(strings.Trim(strings.TrimSpace(v), "'\""), "#")
+}
+
+// elementPath returns the path of a path element or a basic shape.
+func elementPath(el *svgElement) *glyphPath {
+	if el.name == "path" {
+		return parsePathData(el.attrs["d"])
+	}
+	return shapePath(el)
+}
+
+// elementTransform returns the value of the transform attribute.
+func elementTransform(el *svgElement) matrix {
+	if t, ok := el.attrs["transform"]; ok {
+		return parseSVGTransform(t)
+	}
+	return identity
+}
+
+// clipped calls fn with the clip path of el applied. Clip paths whose
+// children have different transformations are ignored, as are clip paths in
+// the object bounding box units.
+func (r *svgRenderer) clipped(el *svgElement, fn func()) {
+	cp := r.doc.ids[svgRef(el.attrs["clip-path"])]
+	if cp == nil || cp.name != "clipPath" || cp.attrs["clipPathUnits"] == "objectBoundingBox" {
+		fn()
+		return
+	}
+	var ops strings.Builder
+	box := emptyBBox
+	m, first := identity, true
+	for _, c := range cp.children {
+		shape, cm := c, elementTransform(c)
+		if c.name == "use" {
+			if shape = r.doc.ids[svgRef(c.attrs["href"])]; shape == nil {
+				continue
+			}
+			cm = elementTransform(shape).mul(translation(svgLength(c.attrs["x"]), svgLength(c.attrs["y"]))).mul(cm)
+		}
+		path := elementPath(shape)
+		if path == nil || path.ops == "" {
+			continue
+		}
+		cm = cm.mul(elementTransform(cp))
+		if !first && cm != m {
+			fn()
+			return
+		}
+		m, first = cm, false
+		ops.WriteString(path.ops)
+		box = bbox{min(box.minX, path.box.minX), min(box.minY, path.box.minY), max(box.maxX, path.box.maxX), max(box.maxY, path.box.maxY)}
+	}
+	inv, ok := m.invert()
+	if first || !ok {
+		// an empty clip path hides the element
+		return
+	}
+	p := r.p
+	saved := p.clip
+	p.clip = p.clip.intersect(box.transform(m.mul(p.ctm)))
+	op := "W"
+	if el.attrs["clip-rule"] == "evenodd" || cp.attrs["clip-rule"] == "evenodd" {
+		op = "W*"
+	}
+	// the clip path is set in the coordinate system of the clip path, the
+	// inverse transformation restores the coordinate system of the element
+	fmt.Fprintf(&p.out, "q %s\n%s%s n\n%s\n", m, ops.String(), op, inv)
+	fn()
+	p.out.WriteString("Q\n")
+	p.clip = saved
+}
+
+// shape fills and strokes the path.
+func (r *svgRenderer) shape(st svgState, path *glyphPath) {
+	if path == nil || path.ops == "" {
+		return
+	}
+	p := r.p
+	if !st.fill.none {
+		op := "f"
+		if st.evenOdd {
+			op = "f*"
+		}
+		switch {
+		case st.fill.gradient != nil:
+			saved := p.clip
+			p.clip = p.clip.intersect(path.box.transform(p.ctm))
+			fmt.Fprintf(&p.out, "q\n%sW%s n\n", path.ops, strings.TrimPrefix(op, "f"))
+			r.gradient(st.fill.gradient, path.box)
+			p.out.WriteString("Q\n")
+			p.clip = saved
+		case st.fill.current:
+			// keep the text color from the graphics state
+			fmt.Fprintf(&p.out, "q\n%s%s Q\n", path.ops, op)
+		default:
+			fmt.Fprintf(&p.out, "q %s\n%s%s Q\n", st.fill.color.pdfFill(), path.ops, op)
+		}
+	}
+	if !st.stroke.none && st.strokeWidth > 0 {
+		c := st.stroke.color
+		if st.stroke.gradient != nil {
+			// gradient strokes are drawn with the first color
+			if stops := r.stops(st.stroke.gradient, 0); len(stops) > 0 {
+				c = stops[0].color
+			}
+		}
+		fmt.Fprintf(&p.out, "q %s %s w %d J %d j\n%sS Q\n", c.pdfStroke(), strconv.FormatFloat(st.strokeWidth, 'f', -1, 64), st.lineCap, st.lineJoin, path.ops)
+	}
+}
+
+// stops returns the color stops of the gradient or of the gradient it refers
+// to.
+func (r *svgRenderer) stops(el *svgElement, depth int) []colorStop {
+	var stops []colorStop
+	for _, c := range el.children {
+		if c.name != "stop" {
+			continue
+		}
+		offset := svgLength(c.attrs["offset"])
+		if strings.HasSuffix(strings.TrimSpace(c.attrs["offset"]), "%") {
+			offset /= 100
+		}
+		offset = min(max(offset, 0), 1)
+		if len(stops) > 0 {
+			offset = max(offset, stops[len(stops)-1].offset)
+		}
+		col := rgba{a: 1}
+		if v, ok := c.attrs["stop-color"]; ok {
+			if v == "currentColor" || v == "currentcolor" {
+				col = r.p.fg
+			} else if sc, ok := r.color(v); ok {
+				col = sc
+			}
+		}
+		if v, ok := c.attrs["stop-opacity"]; ok {
+			col.a = svgLength(v)
+		}
+		stops = append(stops, colorStop{offset: offset, color: col})
+	}
+	if len(stops) == 0 && depth < 8 {
+		if ref := r.doc.ids[svgRef(el.attrs["href"])]; ref != nil {
+			return r.stops(ref, depth+1)
+		}
+	}
+	return stops
+}
+
+// gradient fills the clip region with the gradient. box is the bounding box
+// of the shape.
+func (r *svgRenderer) gradient(el *svgElement, box bbox) {
+	stops := r.stops(el, 0)
+	if len(stops) == 0 {
+		return
+	}
+	cl := colorLine{stops: stops}
+	switch el.attrs["spreadMethod"] {
+	case "repeat":
+		cl.extend = extendRepeat
+	case "reflect":
+		cl.extend = extendReflect
+	}
+	num := func(name string, def float64) float64 {
+		v, ok := el.attrs[name]
+		if !ok {
+			return def
+		}
+		f := svgLength(v)
+		if strings.HasSuffix(strings.TrimSpace(v), "%") {
+			f /= 100
+		}
+		return f
+	}
+	m := identity
+	if el.attrs["gradientUnits"] != "userSpaceOnUse" {
+		m = matrix{box.maxX - box.minX, 0, 0, box.maxY - box.minY, box.minX, box.minY}
+	}
+	if t, ok := el.attrs["gradientTransform"]; ok {
+		m = parseSVGTransform(t).mul(m)
+	}
+	r.p.transformed(m, func() {
+		switch el.name {
+		case "linearGradient":
+			x1, y1, x2, y2 := num("x1", 0), num("y1", 0), num("x2", 1), num("y2", 0)
+			r.p.linearGradient(cl, x1, y1, x2, y2, x1-(y2-y1), y1+(x2-x1))
+		case "radialGradient":
+			cx, cy, radius := num("cx", 0.5), num("cy", 0.5), num("r", 0.5)
+			r.p.radialGradient(cl, num("fx", cx), num("fy", cy), num("fr", 0), cx, cy, radius)
+		}
+	})
+}
+
+// svgLength returns the number of a length or a number attribute. Units and
+// percent signs are ignored.
+func svgLength(v string) float64 {
+	v = strings.TrimSpace(v)
+	v = strings.TrimRight(v, "%abcdefghijklmnopqrstuvwxyz")
+	f, _ := strconv.ParseFloat(v, 64)
+	return f
+}
+
+// shapePath returns the path of a basic shape.
+func shapePath(el *svgElement) *glyphPath {
+	a := func(name string) float64 { return svgLength(el.attrs[name]) }
+	gp := &glyphPath{box: emptyBBox}
+	switch el.name {
+	case "rect":
+		x, y, w, h := a("x"), a("y"), a("width"), a("height")
+		if w <= 0 || h <= 0 {
+			return nil
+		}
+		rx, hasRX := el.attrs["rx"]
+		ry, hasRY := el.attrs["ry"]
+		if !hasRY {
+			ry = rx
+		}
+		if !hasRX {
+			rx = ry
+		}
+		r := [2]float64{min(svgLength(rx), w/2), min(svgLength(ry), h/2)}
+		if r[0] > 0 && r[1] > 0 {
+			gp.ops = roundedRectPath(x, y, w, h, r[0], r[1])
+		} else {
+			gp.ops = polygon([2]float64{x, y}, [2]float64{x + w, y}, [2]float64{x + w, y + h}, [2]float64{x, y + h})
+		}
+		gp.box = bbox{x, y, x + w, y + h}
+	case "circle", "ellipse":
+		cx, cy := a("cx"), a("cy")
+		rx, ry := a("r"), a("r")
+		if el.name == "ellipse" {
+			rx, ry = a("rx"), a("ry")
+		}
+		if rx <= 0 || ry <= 0 {
+			return nil
+		}
+		gp.ops = ellipsePath(cx, cy, rx, ry)
+		gp.box = bbox{cx - rx, cy - ry, cx + rx, cy + ry}
+	case "line":
+		var b strings.Builder
+		writePoints(&b, "m", a("x1"), a("y1"))
+		writePoints(&b, "l", a("x2"), a("y2"))
+		gp.ops = b.String()
+		gp.box.add(a("x1"), a("y1"))
+		gp.box.add(a("x2"), a("y2"))
+	case "polyline", "polygon":
+		sc := &pathScanner{s: el.attrs["points"]}
+		var points [][2]float64
+		for {
+			x, ok1 := sc.number()
+			y, ok2 := sc.number()
+			if !ok1 || !ok2 {
+				break
+			}
+			points = append(points, [2]float64{x, y})
+			gp.box.add(x, y)
+		}
+		if len(points) < 2 {
+			return nil
+		}
+		gp.ops = polygon(points...)
+		if el.name == "polyline" {
+			gp.ops = strings.TrimSuffix(gp.ops, "h\n")
+		}
+	}
+	return gp
+}
+
+// roundedRectPath returns the path of a rectangle with elliptical corners.
+func roundedRectPath(x, y, w, h, rx, ry float64) string {
+	const k = 1 - 0.5522847498
+	var b strings.Builder
+	writePoints(&b, "m", x+rx, y)
+	writePoints(&b, "l", x+w-rx, y)
+	writePoints(&b, "c", x+w-k*rx, y, x+w, y+k*ry, x+w, y+ry)
+	writePoints(&b, "l", x+w, y+h-ry)
+	writePoints(&b, "c", x+w, y+h-k*ry, x+w-k*rx, y+h, x+w-rx, y+h)
+	writePoints(&b, "l", x+rx, y+h)
+	writePoints(&b, "c", x+k*rx, y+h, x, y+h-k*ry, x, y+h-ry)
+	writePoints(&b, "l", x, y+ry)
+	writePoints(&b, "c", x, y+k*ry, x+k*rx, y, x+rx, y)
+	b.WriteString("h\n")
+	return b.String()
+}
+
+// pathScanner reads numbers and flags from path data and point lists.
+type pathScanner struct {
+	s string
+	i int
+}
+
+func (sc *pathScanner) skipSeparators() {
+	for sc.i < len(sc.s) && strings.IndexByte(" \t\r\n,", sc.s[sc.i]) >= 0 {
+		sc.i++
+	}
+}
+
+func (sc *pathScanner) digits() {
+	for sc.i < len(sc.s) && sc.s[sc.i] >= '0' && sc.s[sc.i] <= '9' {
+		sc.i++
+	}
+}
+
+func (sc *pathScanner) number() (float64, bool) {
+	sc.skipSeparators()
+	start := sc.i
+	if sc.i < len(sc.s) && (sc.s[sc.i] == '+' || sc.s[sc.i] == '-') {
+		sc.i++
+	}
+	sc.digits()
+	if sc.i < len(sc.s) && sc.s[sc.i] == '.' {
+		sc.i++
+		sc.digits()
+	}
+	if sc.i < len(sc.s) && (sc.s[sc.i] == 'e' || sc.s[sc.i] == 'E') {
+		sc.i++
+		if sc.i < len(sc.s) && (sc.s[sc.i] == '+' || sc.s[sc.i] == '-') {
+			sc.i++
+		}
+		sc.digits()
+	}
+	f, err := strconv.ParseFloat(sc.s[start:sc.i], 64)
+	if err != nil {
+		sc.i = start
+		return 0, false
+	}
+	return f, true
+}
+
+// flag reads an arc flag, which need not be separated from the next number.
+func (sc *pathScanner) flag() (bool, bool) {
+	sc.skipSeparators()
+	if sc.i < len(sc.s) && (sc.s[sc.i] == '0' || sc.s[sc.i] == '1') {
+		sc.i++
+		return sc.s[sc.i-1] == '1', true
+	}
+	return false, false
+}
+
+func (sc *pathScanner) numbers(n int) ([]float64, bool) {
+	ret := make([]float64, n)
+	for i := range ret {
+		f, ok := sc.number()
+		if !ok {
+			return nil, false
+		}
+		ret[i] = f
+	}
+	return ret, true
+}
+
+// parsePathData converts SVG path data to a PDF path. Parsing stops at the
+// first error, as SVG renderers do.
+func parsePathData(d string) *glyphPath {
+	gp := &glyphPath{box: emptyBBox}
+	var b strings.Builder
+	add := func(op string, coords ...float64) {
+		for i := 0; i+1 < len(coords); i += 2 {
+			gp.box.add(coords[i], coords[i+1])
+		}
+		writePoints(&b, op, coords...)
+	}
+	sc := &pathScanner{s: d}
+	var curX, curY, startX, startY, ctrlX, ctrlY float64
+	var cmd, prev byte
+	for {
+		sc.skipSeparators()
+		if sc.i >= len(sc.s) {
+			break
+		}
+		if c := sc.s[sc.i]; (c|0x20) >= 'a' && (c|0x20) <= 'z' {
+			cmd = c
+			sc.i++
+		} else if cmd == 0 || cmd|0x20 == 'z' {
+			break
+		}
+		var ox, oy float64
+		if cmd >= 'a' {
+			ox, oy = curX, curY
+		}
+		lower := cmd | 0x20
+		var n []float64
+		var ok bool
+		switch lower {
+		case 'z':
+			b.WriteString("h\n")
+			curX, curY = startX, startY
+			ok = true
+		case 'm', 'l', 't':
+			if n, ok = sc.numbers(2); ok {
+				x, y := ox+n[0], oy+n[1]
+				switch lower {
+				case 'm':
+					add("m", x, y)
+					startX, startY = x, y
+					// further coordinate pairs are line segments
+					cmd -= 'm' - 'l'
+				case 'l':
+					add("l", x, y)
+				case 't':
+					qx, qy := curX, curY
+					if prev == 'q' || prev == 't' {
+						qx, qy = 2*curX-ctrlX, 2*curY-ctrlY
+					}
+					add("c", curX+2*(qx-curX)/3, curY+2*(qy-curY)/3, x+2*(qx-x)/3, y+2*(qy-y)/3, x, y)
+					ctrlX, ctrlY = qx, qy
+				}
+				curX, curY = x, y
+			}
+		case 'h':
+			if n, ok = sc.numbers(1); ok {
+				curX = ox + n[0]
+				add("l", curX, curY)
+			}
+		case 'v':
+			if n, ok = sc.numbers(1); ok {
+				curY = oy + n[0]
+				add("l", curX, curY)
+			}
+		case 'c':
+			if n, ok = sc.numbers(6); ok {
+				add("c", ox+n[0], oy+n[1], ox+n[2], oy+n[3], ox+n[4], oy+n[5])
+				ctrlX, ctrlY = ox+n[2], oy+n[3]
+				curX, curY = ox+n[4], oy+n[5]
+			}
+		case 's':
+			if n, ok = sc.numbers(4); ok {
+				x1, y1 := curX, curY
+				if prev == 'c' || prev == 's' {
+					x1, y1 = 2*curX-ctrlX, 2*curY-ctrlY
+				}
+				add("c", x1, y1, ox+n[0], oy+n[1], ox+n[2], oy+n[3])
+				ctrlX, ctrlY = ox+n[0], oy+n[1]
+				curX, curY = ox+n[2], oy+n[3]
+			}
+		case 'q':
+			if n, ok = sc.numbers(4); ok {
+				qx, qy, x, y := ox+n[0], oy+n[1], ox+n[2], oy+n[3]
+				add("c", curX+2*(qx-curX)/3, curY+2*(qy-curY)/3, x+2*(qx-x)/3, y+2*(qy-y)/3, x, y)
+				ctrlX, ctrlY = qx, qy
+				curX, curY = x, y
+			}
+		case 'a':
+			var rx, ry, rot float64
+			var large, sweep bool
+			var ok1, ok2, ok3 bool
+			if n, ok = sc.numbers(3); ok {
+				rx, ry, rot = n[0], n[1], n[2]
+				large, ok1 = sc.flag()
+				sweep, ok2 = sc.flag()
+				n, ok3 = sc.numbers(2)
+				ok = ok1 && ok2 && ok3
+			}
+			if ok {
+				x, y := ox+n[0], oy+n[1]
+				for _, c := range arcToCubics(curX, curY, rx, ry, rot, large, sweep, x, y) {
+					add("c", c[:]...)
+				}
+				curX, curY = x, y
+			}
+		}
+		if !ok {
+			break
+		}
+		prev = lower
+	}
+	gp.ops = b.String()
+	return gp
+}
+
+// arcToCubics converts an elliptical arc to cubic Bézier curves (see the
+// implementation notes of the SVG specification). Each curve is given as two
+// control points and the end point.
+func arcToCubics(x1, y1, rx, ry, rotation float64, large, sweep bool, x2, y2 float64) [][6]float64 {
+	if x1 == x2 && y1 == y2 {
+		return nil
+	}
+	rx, ry = math.Abs(rx), math.Abs(ry)
+	if rx == 0 || ry == 0 {
+		return [][6]float64{{x1, y1, x2, y2, x2, y2}}
+	}
+	sinPhi, cosPhi := math.Sincos(rotation * math.Pi / 180)
+	dx, dy := (x1-x2)/2, (y1-y2)/2
+	x1p := cosPhi*dx + sinPhi*dy
+	y1p := -sinPhi*dx + cosPhi*dy
+	if lambda := x1p*x1p/(rx*rx) + y1p*y1p/(ry*ry); lambda > 1 {
+		rx *= math.Sqrt(lambda)
+		ry *= math.Sqrt(lambda)
+	}
+	num := rx*rx*ry*ry - rx*rx*y1p*y1p - ry*ry*x1p*x1p
+	den := rx*rx*y1p*y1p + ry*ry*x1p*x1p
+	coef := math.Sqrt(max(0, num/den))
+	if large == sweep {
+		coef = -coef
+	}
+	cxp, cyp := coef*rx*y1p/ry, -coef*ry*x1p/rx
+	cx := cosPhi*cxp - sinPhi*cyp + (x1+x2)/2
+	cy := sinPhi*cxp + cosPhi*cyp + (y1+y2)/2
+	angle := func(ux, uy, vx, vy float64) float64 {
+		return math.Atan2(ux*vy-uy*vx, ux*vx+uy*vy)
+	}
+	theta := angle(1, 0, (x1p-cxp)/rx, (y1p-cyp)/ry)
+	delta := angle((x1p-cxp)/rx, (y1p-cyp)/ry, (-x1p-cxp)/rx, (-y1p-cyp)/ry)
+	if !sweep && delta > 0 {
+		delta -= 2 * math.Pi
+	} else if sweep && delta < 0 {
+		delta += 2 * math.Pi
+	}
+	n := int(math.Ceil(math.Abs(delta) / (math.Pi / 2)))
+	step := delta / float64(n)
+	t := 4.0 / 3 * math.Tan(step/4)
+	point := func(a float64) (float64, float64, float64, float64) {
+		sin, cos := math.Sincos(a)
+		return cx + rx*cos*cosPhi - ry*sin*sinPhi, cy + rx*cos*sinPhi + ry*sin*cosPhi,
+			-rx*sin*cosPhi - ry*cos*sinPhi, -rx*sin*sinPhi + ry*cos*cosPhi
+	}
+	ret := make([][6]float64, 0, n)
+	for i := range n {
+		ax, ay, adx, ady := point(theta + float64(i)*step)
+		bx, by, bdx, bdy := point(theta + float64(i+1)*step)
+		ret = append(ret, [6]float64{ax + t*adx, ay + t*ady, bx - t*bdx, by - t*bdy, bx, by})
+	}
+	return ret
+}
+
+// parseSVGTransform parses the value of a transform attribute.
+func parseSVGTransform(v string) matrix {
+	m := identity
+	for {
+		name, rest, ok := strings.Cut(v, "(")
+		if !ok {
+			break
+		}
+		args, after, _ := strings.Cut(rest, ")")
+		v = after
+		sc := &pathScanner{s: args}
+		var n []float64
+		for {
+			f, ok := sc.number()
+			if !ok {
+				break
+			}
+			n = append(n, f)
+		}
+		arg := func(i int, def float64) float64 {
+			if i < len(n) {
+				return n[i]
+			}
+			return def
+		}
+		var t matrix
+		switch strings.Trim(strings.TrimSpace(name), ",") {
+		case "matrix":
+			if len(n) != 6 {
+				continue
+			}
+			t = matrix{n[0], n[1], n[2], n[3], n[4], n[5]}
+		case "translate":
+			t = translation(arg(0, 0), arg(1, 0))
+		case "scale":
+			t = matrix{arg(0, 1), 0, 0, arg(1, arg(0, 1)), 0, 0}
+		case "rotate":
+			t = around(rotation(arg(0, 0)/180), arg(1, 0), arg(2, 0))
+		case "skewX":
+			t = matrix{1, 0, math.Tan(arg(0, 0) * math.Pi / 180), 1, 0, 0}
+		case "skewY":
+			t = matrix{1, math.Tan(arg(0, 0) * math.Pi / 180), 0, 1, 0, 0}
+		default:
+			continue
+		}
+		// the rightmost transformation is applied first
+		m = t.mul(m)
+	}
+	return m
+}
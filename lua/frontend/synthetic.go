@@ -0,0 +1,131 @@
+package frontend
+
+import (
+	"fmt"
+
+	pdf "github.com/boxesandglue/baseline-pdf"
+	"github.com/boxesandglue/boxesandglue/backend/bag"
+	"github.com/boxesandglue/boxesandglue/backend/color"
+	"github.com/boxesandglue/boxesandglue/backend/node"
+)
+
+const (
+	// defaultEmboldening is the stroke width for synthetic bold as a fraction
+	// of the font size.
+	defaultEmboldening = 0.03
+	// defaultSlant is the horizontal shear for synthetic italic (about 11°).
+	defaultSlant = 0.2
+	// attrSynthetic marks the rules that start and end a synthesized style.
+	attrSynthetic = "glu-synthetic"
+)
+
+// synthesis holds the settings for synthesized styles of a font family. A
+// value of 0 disables the synthesis.
+type synthesis struct {
+	emboldening float64
+	slant       float64
+}
+
+var defaultSynthesis = synthesis{emboldening: defaultEmboldening, slant: defaultSlant}
+
+// syntheticMarker is stored in the start and end node of a synthesized
+// style, as the value of the bold start/stop nodes and as an attribute of the
+// slant rules. The slant nodes are invisible rules, because rules are output
+// outside of the text object with the origin on the base line. The post line
+// break callback uses it to end the style at the end of each line and to
+// restart it on the next line.
+type syntheticMarker struct {
+	start bool
+	// bold is true for synthetic bold, which changes the text rendering mode.
+	bold   bool
+	create func() (node.Node, node.Node)
+}
+
+// syntheticBoldNodes returns the nodes that switch to fill and stroke text
+// rendering and back. The outline is stroked in the text color. The end node
+// resets the text rendering mode, the line width and the stroke color to
+// their defaults. The run cannot be wrapped in q/Q: the library does not
+// repeat the font after Q, so the text after the run would have no font.
+func syntheticBoldNodes(width bag.ScaledPoint, col *color.Color) (node.Node, node.Node) {
+	strokeColor := "0 G"
+	if col != nil {
+		strokeColor = col.PDFStringStroking()
+	}
+	start := node.NewStartStop()
+	start.Position = node.PDFOutputPage
+	start.ShipoutCallback = func(node.Node) string {
+		return fmt.Sprintf(" 2 Tr %s w %s ", pdf.FloatToPoint(width.ToPT()), strokeColor)
+	}
+	stop := node.NewStartStop()
+	stop.Position = node.PDFOutputPage
+	stop.ShipoutCallback = func(node.Node) string { return " 0 Tr 1 w 0 G " }
+	create := func() (node.Node, node.Node) { return syntheticBoldNodes(width, col) }
+	start.Value = &syntheticMarker{start: true, bold: true, create: create}
+	stop.Value = &syntheticMarker{bold: true, create: create}
+	return start, stop
+}
+
+// syntheticSlantNodes returns two invisible rules that shear the coordinate
+// system at the base line and undo the shear. A rule is output with the origin
+// at its position on the base line, so the shear does not move the glyphs
+// horizontally.
+func syntheticSlantNodes(slant float64) (node.Node, node.Node) {
+	start := node.NewRule()
+	start.Hide = true
+	start.Pre = fmt.Sprintf("1 0 %s 1 0 0 cm", pdf.FloatToPoint(slant))
+	stop := node.NewRule()
+	stop.Hide = true
+	stop.Pre = fmt.Sprintf("1 0 %s 1 0 0 cm", pdf.FloatToPoint(-slant))
+	create := func() (node.Node, node.Node) { return syntheticSlantNodes(slant) }
+	start.Attributes = node.H{attrSynthetic: &syntheticMarker{start: true, create: create}}
+	stop.Attributes = node.H{attrSynthetic: &syntheticMarker{create: create}}
+	return start, stop
+}
+
+// postLinebreakSynthetic ends all synthesized styles at the end of a line and
+// restarts them at the beginning of the next line, so that each line can be
+// output on its own (the shear depends on the base line).
+func postLinebreakSynthetic(vl *node.VList) *node.VList {
+	var open []*syntheticMarker
+	for e := vl.List; e != nil; e = e.Next() {
+		hl, ok := e.(*node.HList)
+		if !ok {
+			continue
+		}
+		// restart the styles that are still active from the previous line
+		for i := len(open) - 1; i >= 0; i-- {
+			start, _ := open[i].create()
+			hl.List = node.InsertBefore(hl.List, hl.List, start)
+		}
+		open = open[:0:0]
+		var tail node.Node
+		for n := hl.List; n != nil; n = n.Next() {
+			tail = n
+			if m, ok := syntheticMarkerOf(n); ok {
+				if m.start {
+					open = append(open, m)
+				} else if len(open) > 0 {
+					open = open[:len(open)-1]
+				}
+			}
+		}
+		for i := len(open) - 1; i >= 0; i-- {
+			_, stop := open[i].create()
+			node.InsertAfter(hl.List, tail, stop)
+			tail = stop
+		}
+	}
+	return vl
+}
+
+func syntheticMarkerOf(n node.Node) (*syntheticMarker, bool) {
+	if ss, ok := n.(*node.StartStop); ok {
+		m, ok := ss.Value.(*syntheticMarker)
+		return m, ok
+	}
+	if val, ok := node.GetAttribute(n, attrSynthetic); ok {
+		m, ok := val.(*syntheticMarker)
+		return m, ok
+	}
+	return nil, false
+}
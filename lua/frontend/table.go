@@ -13,16 +13,22 @@ const tableCellMetaTable = "TableCell"
 // Table wraps the boxesandglue frontend.Table type
 type Table struct {
 	Value *frontend.Table
+	// rows are the wrappers of Value.Rows
+	rows []*TableRow
 }
 
 // TableRow wraps the boxesandglue frontend.TableRow type
 type TableRow struct {
 	Value *frontend.TableRow
+	// cells are the wrappers of Value.Cells
+	cells []*TableCell
 }
 
 // TableCell wraps the boxesandglue frontend.TableCell type
 type TableCell struct {
 	Value *frontend.TableCell
+	// role is the structure role set with cell.role, TD if empty
+	role string
 }
 
 // checkTable retrieves a Table userdata from the stack
@@ -83,10 +89,11 @@ func tableNew(l *lua.State) int {
 func tableAddRow(l *lua.State) int {
 	tbl := checkTable(l, 1)
 
-	row := &frontend.TableRow{}
-	tbl.Value.Rows = append(tbl.Value.Rows, row)
+	row := &TableRow{Value: &frontend.TableRow{}}
+	tbl.Value.Rows = append(tbl.Value.Rows, row.Value)
+	tbl.rows = append(tbl.rows, row)
 
-	l.PushUserData(&TableRow{Value: row})
+	l.PushUserData(row)
 	lua.SetMetaTableNamed(l, tableRowMetaTable)
 	return 1
 }
@@ -178,10 +185,11 @@ func rowAddCell(l *lua.State) int {
 		return 0
 	}
 
-	cell := &frontend.TableCell{}
-	row.Value.Cells = append(row.Value.Cells, cell)
+	cell := &TableCell{Value: &frontend.TableCell{}}
+	row.Value.Cells = append(row.Value.Cells, cell.Value)
+	row.cells = append(row.cells, cell)
 
-	l.PushUserData(&TableCell{Value: cell})
+	l.PushUserData(cell)
 	lua.SetMetaTableNamed(l, tableCellMetaTable)
 	return 1
 }
@@ -247,11 +255,22 @@ func cellIndex(l *lua.State) int {
 	case "rowspan":
 		l.PushInteger(cell.Value.ExtraRowspan + 1)
 		return 1
+	case "role":
+		l.PushString(cell.cellRole())
+		return 1
 	}
 
 	return 0
 }
 
+// cellRole returns the structure role of the cell.
+func (cell *TableCell) cellRole() string {
+	if cell.role == "" {
+		return "TD"
+	}
+	return cell.role
+}
+
 // cellNewIndex handles attribute setting (__newindex metamethod)
 // Dimensions can be numbers (points) or strings ("2pt", "5mm")
 func cellNewIndex(l *lua.State) int {
@@ -276,6 +295,12 @@ func cellNewIndex(l *lua.State) int {
 	case "rowspan":
 		n, _ := l.ToInteger(3)
 		cell.Value.ExtraRowspan = n - 1
+	case "role":
+		role := lua.CheckString(l, 3)
+		if role != "TD" && role != "TH" {
+			lua.Errorf(l, "cell role must be TD or TH, got %s", role)
+		}
+		cell.role = role
 	case "padding_left":
 		cell.Value.PaddingLeft = checkDimension(l, 3)
 	case "padding_right":
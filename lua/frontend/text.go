@@ -1,6 +1,7 @@
 package frontend
 
 import (
+	"github.com/boxesandglue/boxesandglue/backend/node"
 	"github.com/boxesandglue/boxesandglue/frontend"
 	"github.com/speedata/go-lua"
 )
@@ -215,6 +216,22 @@ func textSettingsNewIndex(l *lua.State) int {
 	return 0
 }
 
+// Settings that glu handles itself. The prepare pass removes them before the
+// Text is passed to boxesandglue.
+const (
+	// settingPalette selects the CPAL palette of a color font.
+	settingPalette frontend.SettingType = iota + 1000
+	// settingRole is the structure role of the Text in a tagged PDF.
+	settingRole
+	// settingActualText replaces the text of the glyphs for extraction.
+	settingActualText
+)
+
+// isGluSetting returns true if glu handles the setting itself.
+func isGluSetting(st frontend.SettingType) bool {
+	return st >= settingPalette
+}
+
 func settingKeyToType(key string) frontend.SettingType {
 	switch key {
 	case "fontfamily", "font_family":
@@ -233,6 +250,14 @@ func settingKeyToType(key string) frontend.SettingType {
 		return frontend.SettingHAlign
 	case "valign":
 		return frontend.SettingVAlign
+	case "variations", "font_variations":
+		return frontend.SettingFontVariationSettings
+	case "palette":
+		return settingPalette
+	case "role":
+		return settingRole
+	case "actual_text", "actualtext":
+		return settingActualText
 	}
 	return 0
 }
@@ -251,6 +276,18 @@ func pushSettingValue(l *lua.State, settingType frontend.SettingType, val any) {
 		if w, ok := val.(frontend.FontWeight); ok {
 			l.PushInteger(int(w))
 		}
+	case frontend.SettingFontVariationSettings:
+		if v, ok := val.(map[string]float64); ok {
+			pushVariations(l, v)
+		}
+	case settingPalette:
+		if n, ok := val.(int); ok {
+			l.PushInteger(n)
+		}
+	case settingRole, settingActualText:
+		if s, ok := val.(string); ok {
+			l.PushString(s)
+		}
 	default:
 		l.PushNil()
 	}
@@ -298,6 +335,9 @@ func luaValueToItem(l *lua.State, index int) any {
 		// Check for VList
 		if ud := lua.TestUserData(l, index, vlistMetaTable); ud != nil {
 			if v, ok := ud.(*VList); ok {
+				if ff, ok := node.GetAttribute(v.Value, attrField); ok {
+					return ff.(*formField).rule()
+				}
 				return v.Value
 			}
 		}
@@ -339,7 +379,7 @@ func parseSettingKeyValue(l *lua.State, key string, valueIndex int) (frontend.Se
 		}
 		if ud := lua.TestUserData(l, valueIndex, colorMetaTable); ud != nil {
 			if c, ok := ud.(*Color); ok {
-				return frontend.SettingColor, c.Value
+				return frontend.SettingColor, c
 			}
 		}
 	case "leading":
@@ -351,11 +391,31 @@ func parseSettingKeyValue(l *lua.State, key string, valueIndex int) (frontend.Se
 			s, _ := l.ToString(valueIndex)
 			return frontend.SettingHAlign, parseHAlign(s)
 		}
+	case "variations", "font_variations":
+		if l.IsTable(valueIndex) {
+			return frontend.SettingFontVariationSettings, tableToVariations(l, valueIndex)
+		}
 	case "valign":
 		if l.IsString(valueIndex) {
 			s, _ := l.ToString(valueIndex)
 			return frontend.SettingVAlign, parseVAlign(s)
 		}
+	case "palette":
+		if l.IsNumber(valueIndex) {
+			n, _ := l.ToInteger(valueIndex)
+			return settingPalette, n
+		}
+	case "role":
+		role := lua.CheckString(l, valueIndex)
+		if err := checkRole(role); err != nil {
+			lua.Errorf(l, "%s", err.Error())
+		}
+		return settingRole, role
+	case "actual_text", "actualtext":
+		if l.IsString(valueIndex) {
+			s, _ := l.ToString(valueIndex)
+			return settingActualText, s
+		}
 	case "marginleft", "margin_left":
 		if sp, err := toDimension(l, valueIndex); err == nil {
 			return frontend.SettingMarginLeft, sp
@@ -395,7 +455,7 @@ func parseSettingKeyValue(l *lua.State, key string, valueIndex int) (frontend.Se
 		}
 		if ud := lua.TestUserData(l, valueIndex, colorMetaTable); ud != nil {
 			if c, ok := ud.(*Color); ok {
-				return frontend.SettingBackgroundColor, c.Value
+				return frontend.SettingBackgroundColor, c
 			}
 		}
 	case "indentleft", "indent_left":
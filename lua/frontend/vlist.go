@@ -2,6 +2,7 @@ package frontend
 
 import (
 	"github.com/boxesandglue/boxesandglue/backend/node"
+	"github.com/speedata/glu/lua/backend"
 	"github.com/speedata/go-lua"
 )
 
@@ -22,6 +23,22 @@ func checkVList(l *lua.State, index int) *VList {
 	return nil
 }
 
+// toVList returns the node.VList of a frontend VList or a backend
+// node.VList at index or nil.
+func toVList(l *lua.State, index int) *node.VList {
+	if ud := lua.TestUserData(l, index, vlistMetaTable); ud != nil {
+		if v, ok := ud.(*VList); ok {
+			return v.Value
+		}
+	} else if ud := lua.TestUserData(l, index, "node.VList"); ud != nil {
+		// Backend NodeVList wrapper
+		if v, ok := ud.(*backend.NodeVList); ok {
+			return v.Value
+		}
+	}
+	return nil
+}
+
 // vlistIndex handles attribute access (__index metamethod)
 func vlistIndex(l *lua.State) int {
 	vl := checkVList(l, 1)
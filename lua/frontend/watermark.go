@@ -0,0 +1,122 @@
+package frontend
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/boxesandglue/boxesandglue/backend/bag"
+	"github.com/boxesandglue/boxesandglue/backend/color"
+	"github.com/boxesandglue/boxesandglue/backend/document"
+	"github.com/boxesandglue/boxesandglue/backend/node"
+	"github.com/boxesandglue/boxesandglue/frontend"
+	"github.com/speedata/go-lua"
+)
+
+// watermark is a text that is drawn above the contents of each page.
+type watermark struct {
+	text    string
+	family  *frontend.FontFamily
+	size    bag.ScaledPoint
+	color   string
+	opacity float64
+	// rotate is the counterclockwise rotation in degrees, the watermark
+	// follows the page diagonal if rotate is nil
+	rotate *float64
+	// form is the Form XObject of the text, created on the first page
+	form *node.VList
+}
+
+// checkWatermark reads the watermark table at index.
+func checkWatermark(l *lua.State, index int) *watermark {
+	lua.CheckType(l, index, lua.TypeTable)
+	wm := &watermark{size: 72 * bag.Factor, color: "#7f7f7f", opacity: 0.3}
+	l.Field(index, "text")
+	wm.text = lua.CheckString(l, -1)
+	l.Pop(1)
+	l.Field(index, "font_family")
+	if ud := lua.TestUserData(l, -1, fontFamilyMetaTable); ud != nil {
+		if ff, ok := ud.(*FontFamily); ok {
+			wm.family = ff.Value
+		}
+	}
+	l.Pop(1)
+	if wm.family == nil {
+		lua.Errorf(l, "watermark: font_family is required")
+		return nil
+	}
+	l.Field(index, "font_size")
+	if !l.IsNil(-1) {
+		wm.size = checkDimension(l, -1)
+	}
+	l.Pop(1)
+	l.Field(index, "color")
+	if !l.IsNil(-1) {
+		wm.color = lua.CheckString(l, -1)
+	}
+	l.Pop(1)
+	l.Field(index, "opacity")
+	if !l.IsNil(-1) {
+		wm.opacity = lua.CheckNumber(l, -1)
+	}
+	l.Pop(1)
+	l.Field(index, "rotate")
+	if !l.IsNil(-1) {
+		r := lua.CheckNumber(l, -1)
+		wm.rotate = &r
+	}
+	l.Pop(1)
+	return wm
+}
+
+// withOpacity returns col with the opacity alpha.
+func (d *Document) withOpacity(col *color.Color, alpha float64) *color.Color {
+	if spec := d.colorSpecOf(col); spec != nil {
+		s := *spec
+		s.alpha = spec.alpha * alpha
+		return d.specColor(&s)
+	}
+	return d.specColor(&colorSpec{process: col, alpha: alpha})
+}
+
+// vlist returns the watermark text as a Form XObject.
+func (wm *watermark) vlist(d *Document) (*node.VList, error) {
+	if wm.form != nil {
+		return wm.form, nil
+	}
+	col := d.color(wm.color)
+	if col == nil {
+		return nil, fmt.Errorf("unknown color %q", wm.color)
+	}
+	te := frontend.NewText()
+	te.Settings[frontend.SettingFontFamily] = wm.family
+	te.Settings[frontend.SettingSize] = wm.size
+	te.Settings[frontend.SettingColor] = d.withOpacity(col, wm.opacity)
+	te.Items = append(te.Items, wm.text)
+	vl, info, err := d.Value.FormatParagraph(d.prepareText(te, nil, 0), 10000*bag.Factor)
+	if err != nil {
+		return nil, err
+	}
+	if len(info.Widths) > 0 {
+		vl.Width = info.Widths[0]
+	}
+	wm.form = d.newFormXObject(vl)
+	return wm.form, nil
+}
+
+// objects returns the page objects that draw the watermark in the center of
+// the page.
+func (wm *watermark) objects(d *Document, p *document.Page) ([]document.Object, error) {
+	vl, err := wm.vlist(d)
+	if err != nil {
+		return nil, err
+	}
+	pl := placement{scaleX: 1, scaleY: 1, origin: "center", role: roleArtifact}
+	if wm.rotate != nil {
+		pl.rotate = *wm.rotate
+	} else {
+		pl.rotate = math.Atan2(p.Height.ToPT(), p.Width.ToPT()) * 180 / math.Pi
+	}
+	x := (p.Width - vl.Width) / 2
+	y := (p.Height + vl.Height + vl.Depth) / 2
+	return pl.objects(d, x, y, vl), nil
+}
@@ -0,0 +1,347 @@
+package frontend
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/boxesandglue/boxesandglue/backend/document"
+	"github.com/speedata/glu/lua/common"
+	"github.com/speedata/go-lua"
+)
+
+// xmpNamespaces are the namespaces of the XMP specification by prefix. PDF/A
+// requires an extension schema for all other namespaces.
+var xmpNamespaces = map[string]string{
+	"dc":        "http://purl.org/dc/elements/1.1/",
+	"xmp":       "http://ns.adobe.com/xap/1.0/",
+	"xmpRights": "http://ns.adobe.com/xap/1.0/rights/",
+	"xmpMM":     "http://ns.adobe.com/xap/1.0/mm/",
+	"xmpBJ":     "http://ns.adobe.com/xap/1.0/bj/",
+	"xmpTPg":    "http://ns.adobe.com/xap/1.0/t/pg/",
+	"xmpDM":     "http://ns.adobe.com/xmp/1.0/DynamicMedia/",
+	"pdf":       "http://ns.adobe.com/pdf/1.3/",
+	"photoshop": "http://ns.adobe.com/photoshop/1.0/",
+	"tiff":      "http://ns.adobe.com/tiff/1.0/",
+	"exif":      "http://ns.adobe.com/exif/1.0/",
+	"pdfaid":    "http://www.aiim.org/pdfa/ns/id/",
+	"pdfuaid":   "http://www.aiim.org/pdfua/ns/id/",
+}
+
+// xmpReserved are the properties that glu writes from the document
+// attributes.
+var xmpReserved = map[string]string{
+	"dc:title":             "title",
+	"dc:creator":           "author",
+	"dc:description":       "subject",
+	"dc:language":          "language",
+	"pdf:Keywords":         "keywords",
+	"pdf:Producer":         "producer",
+	"xmp:CreatorTool":      "creator",
+	"xmp:CreateDate":       "creation_date",
+	"xmp:ModifyDate":       "mod_date",
+	"xmp:MetadataDate":     "mod_date",
+	"xmpMM:DocumentID":     "",
+	"xmpMM:InstanceID":     "",
+	"xmpMM:VersionID":      "",
+	"xmpMM:RenditionClass": "",
+	"pdf:Trapped":          "",
+}
+
+// infoReserved are the entries of the document information dictionary that
+// glu writes from the document attributes.
+var infoReserved = map[string]string{
+	"Title":           "title",
+	"Author":          "author",
+	"Subject":         "subject",
+	"Keywords":        "keywords",
+	"Creator":         "creator",
+	"Producer":        "producer",
+	"CreationDate":    "creation_date",
+	"ModDate":         "mod_date",
+	"Trapped":         "",
+	"GTS_PDFXVersion": "",
+}
+
+// xmpProperty is a property of an XMP schema. The value is a text or an
+// unordered array (bag) of texts.
+type xmpProperty struct {
+	name        string
+	value       string
+	bag         []string
+	description string
+}
+
+// xmpSchema has the properties of a namespace.
+type xmpSchema struct {
+	namespace string
+	prefix    string
+	// name is the name in the PDF/A extension schema
+	name       string
+	properties []*xmpProperty
+}
+
+// set adds the property or replaces its value.
+func (s *xmpSchema) set(p *xmpProperty) {
+	for i, old := range s.properties {
+		if old.name == p.name {
+			s.properties[i] = p
+			return
+		}
+	}
+	s.properties = append(s.properties, p)
+}
+
+// isXMLName reports whether s is a valid XML name without a colon.
+func isXMLName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, r := range s {
+		switch {
+		case r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= 0x80:
+		case i > 0 && (r == '-' || r == '.' || r >= '0' && r <= '9'):
+		default:
+			return false
+		}
+	}
+	return !strings.HasPrefix(strings.ToLower(s), "xml")
+}
+
+func xmlEscape(s string) string {
+	var b bytes.Buffer
+	_ = xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// xmpSchema returns the schema of the namespace and creates it if necessary.
+func (d *Document) xmpSchema(namespace, prefix, name string) (*xmpSchema, error) {
+	if !isXMLName(prefix) || prefix == "rdf" || prefix == "x" {
+		return nil, fmt.Errorf("invalid prefix %q", prefix)
+	}
+	if ns, ok := xmpNamespaces[prefix]; ok && ns != namespace {
+		return nil, fmt.Errorf("the prefix %s is reserved for %s", prefix, ns)
+	}
+	for _, s := range d.xmpSchemas {
+		switch {
+		case s.namespace == namespace && s.prefix != prefix:
+			return nil, fmt.Errorf("the namespace %s has the prefix %s", namespace, s.prefix)
+		case s.namespace != namespace && s.prefix == prefix:
+			return nil, fmt.Errorf("the prefix %s is used for the namespace %s", prefix, s.namespace)
+		case s.namespace == namespace:
+			return s, nil
+		}
+	}
+	s := &xmpSchema{namespace: namespace, prefix: prefix, name: name}
+	d.xmpSchemas = append(d.xmpSchemas, s)
+	return s, nil
+}
+
+// xmpSet sets the property name of the namespace.
+func (d *Document) xmpSet(namespace, prefix string, p *xmpProperty) error {
+	if namespace == "" {
+		return fmt.Errorf("the namespace must not be empty")
+	}
+	if !isXMLName(p.name) {
+		return fmt.Errorf("invalid property name %q", p.name)
+	}
+	qname := prefix + ":" + p.name
+	if attr, ok := xmpReserved[qname]; ok {
+		if attr == "" {
+			return fmt.Errorf("%s is written by glu", qname)
+		}
+		return fmt.Errorf("%s is written by glu, use doc.%s", qname, attr)
+	}
+	s, err := d.xmpSchema(namespace, prefix, prefix+" schema")
+	if err != nil {
+		return err
+	}
+	s.set(p)
+	return nil
+}
+
+// xmpMetadata returns the XMP descriptions of the document attributes that
+// the library does not write, the properties of xmp_set and the PDF/A
+// extension schemas.
+func (d *Document) xmpMetadata() string {
+	var b strings.Builder
+	pdfDoc := d.Value.Doc
+	if pdfDoc.Subject != "" || pdfDoc.Keywords != "" || d.lang != "" {
+		fmt.Fprintf(&b, `<rdf:Description xmlns:dc=%q xmlns:pdf=%q rdf:about="">`, xmpNamespaces["dc"], xmpNamespaces["pdf"])
+		if pdfDoc.Subject != "" {
+			fmt.Fprintf(&b, `<dc:description><rdf:Alt><rdf:li xml:lang="x-default">%s</rdf:li></rdf:Alt></dc:description>`, xmlEscape(pdfDoc.Subject))
+		}
+		if d.lang != "" {
+			fmt.Fprintf(&b, "<dc:language><rdf:Bag><rdf:li>%s</rdf:li></rdf:Bag></dc:language>", xmlEscape(d.lang))
+		}
+		if pdfDoc.Keywords != "" {
+			fmt.Fprintf(&b, "<pdf:Keywords>%s</pdf:Keywords>", xmlEscape(pdfDoc.Keywords))
+		}
+		b.WriteString("</rdf:Description>")
+	}
+
+	var extensions []*xmpSchema
+	for _, s := range d.xmpSchemas {
+		if len(s.properties) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, `<rdf:Description xmlns:%s=%q rdf:about="">`, s.prefix, s.namespace)
+		for _, p := range s.properties {
+			if p.bag != nil {
+				fmt.Fprintf(&b, "<%s:%s><rdf:Bag>", s.prefix, p.name)
+				for _, v := range p.bag {
+					fmt.Fprintf(&b, "<rdf:li>%s</rdf:li>", xmlEscape(v))
+				}
+				fmt.Fprintf(&b, "</rdf:Bag></%s:%s>", s.prefix, p.name)
+			} else {
+				fmt.Fprintf(&b, "<%s:%s>%s</%s:%s>", s.prefix, p.name, xmlEscape(p.value), s.prefix, p.name)
+			}
+		}
+		b.WriteString("</rdf:Description>")
+		if _, ok := xmpNamespaces[s.prefix]; !ok {
+			extensions = append(extensions, s)
+		}
+	}
+
+	if len(extensions) == 0 || pdfDoc.Format != document.FormatPDFA3b {
+		return b.String()
+	}
+	b.WriteString(`<rdf:Description xmlns:pdfaExtension="http://www.aiim.org/pdfa/ns/extension/" xmlns:pdfaSchema="http://www.aiim.org/pdfa/ns/schema#" xmlns:pdfaProperty="http://www.aiim.org/pdfa/ns/property#" rdf:about="">`)
+	b.WriteString("<pdfaExtension:schemas><rdf:Bag>")
+	for _, s := range extensions {
+		b.WriteString(`<rdf:li rdf:parseType="Resource">`)
+		fmt.Fprintf(&b, "<pdfaSchema:schema>%s</pdfaSchema:schema>", xmlEscape(s.name))
+		fmt.Fprintf(&b, "<pdfaSchema:namespaceURI>%s</pdfaSchema:namespaceURI>", xmlEscape(s.namespace))
+		fmt.Fprintf(&b, "<pdfaSchema:prefix>%s</pdfaSchema:prefix>", s.prefix)
+		b.WriteString("<pdfaSchema:property><rdf:Seq>")
+		for _, p := range s.properties {
+			valueType := "Text"
+			if p.bag != nil {
+				valueType = "bag Text"
+			}
+			description := p.description
+			if description == "" {
+				description = p.name
+			}
+			b.WriteString(`<rdf:li rdf:parseType="Resource">`)
+			fmt.Fprintf(&b, "<pdfaProperty:name>%s</pdfaProperty:name>", p.name)
+			fmt.Fprintf(&b, "<pdfaProperty:valueType>%s</pdfaProperty:valueType>", valueType)
+			b.WriteString("<pdfaProperty:category>external</pdfaProperty:category>")
+			fmt.Fprintf(&b, "<pdfaProperty:description>%s</pdfaProperty:description>", xmlEscape(description))
+			b.WriteString("</rdf:li>")
+		}
+		b.WriteString("</rdf:Seq></pdfaSchema:property></rdf:li>")
+	}
+	b.WriteString("</rdf:Bag></pdfaExtension:schemas></rdf:Description>")
+	return b.String()
+}
+
+var (
+	xmpProducer   = regexp.MustCompile(`<pdf:Producer>[^<]*</pdf:Producer>`)
+	xmpModifyDate = regexp.MustCompile(`<xmp:(ModifyDate|MetadataDate)>[^<]*</xmp:(ModifyDate|MetadataDate)>`)
+)
+
+// needsMetadata reports whether the document has metadata that the library
+// cannot write.
+func (d *Document) needsMetadata() bool {
+	return d.producer != "" || !d.modDate.IsZero() || d.lang != "" || len(d.info) > 0
+}
+
+// writeMetadata writes the producer, the modification date, the language
+// and the custom entries to the document information dictionary, the
+// catalog and the XMP metadata.
+func (d *Document) writeMetadata(f *pdfFile) error {
+	info := f.Dict(f.Trailer["Info"])
+	if info == nil {
+		info = pdfDict{}
+		f.Trailer["Info"] = f.Add(info)
+	}
+	for k, v := range d.info {
+		info[k] = common.PDFTextString(v)
+	}
+	if d.producer != "" {
+		info["Producer"] = common.PDFTextString(d.producer)
+	}
+	if !d.modDate.IsZero() {
+		info["ModDate"] = pdfDate(d.modDate)
+	}
+	if d.lang != "" {
+		f.Catalog()["Lang"] = common.PDFTextString(d.lang)
+	}
+
+	if d.producer == "" && d.modDate.IsZero() {
+		return nil
+	}
+	ref, ok := f.Catalog()["Metadata"].(pdfRef)
+	if !ok {
+		return nil
+	}
+	obj := f.Objects[int(ref)]
+	data, ok := f.StreamData(obj)
+	if !ok {
+		return fmt.Errorf("metadata: cannot decode the XMP stream")
+	}
+	if d.producer != "" {
+		data = xmpProducer.ReplaceAll(data, []byte("<pdf:Producer>"+xmlEscape(d.producer)+"</pdf:Producer>"))
+	}
+	if !d.modDate.IsZero() {
+		date := d.modDate.Format(time.RFC3339)
+		data = xmpModifyDate.ReplaceAll(data, []byte("<xmp:$1>"+date+"</xmp:$1>"))
+	}
+	// PDF/A does not allow filters for the metadata stream
+	if dict, ok := obj.Value.(pdfDict); ok {
+		delete(dict, "Filter")
+		delete(dict, "DecodeParms")
+	}
+	obj.Stream = data
+	return nil
+}
+
+// documentXMPSet sets an XMP property: doc:xmp_set(namespace, prefix, name, value)
+// value is a string or an array of strings
+func documentXMPSet(l *lua.State) int {
+	d := checkDocument(l, 1)
+	namespace := lua.CheckString(l, 2)
+	prefix := lua.CheckString(l, 3)
+	p := &xmpProperty{name: lua.CheckString(l, 4)}
+	if l.IsTable(5) {
+		p.bag = []string{}
+		for i := 1; i <= l.RawLength(5); i++ {
+			l.RawGetInt(5, i)
+			p.bag = append(p.bag, lua.CheckString(l, -1))
+			l.Pop(1)
+		}
+	} else {
+		p.value = lua.CheckString(l, 5)
+	}
+	if err := d.xmpSet(namespace, prefix, p); err != nil {
+		lua.Errorf(l, "xmp_set: %s", err.Error())
+		return 0
+	}
+	return 0
+}
+
+// documentInfoSet sets an entry of the document information dictionary:
+// doc:info_set(key, value)
+func documentInfoSet(l *lua.State) int {
+	d := checkDocument(l, 1)
+	key := lua.CheckString(l, 2)
+	value := lua.CheckString(l, 3)
+	if attr, ok := infoReserved[key]; ok {
+		if attr == "" {
+			lua.Errorf(l, "info_set: %s is written by glu", key)
+		} else {
+			lua.Errorf(l, "info_set: %s is written by glu, use doc.%s", key, attr)
+		}
+		return 0
+	}
+	if key == "" || strings.ContainsAny(key, " \t\r\n/()<>[]{}%") {
+		lua.Errorf(l, "info_set: invalid key %q", key)
+		return 0
+	}
+	d.info[key] = value
+	return 0
+}
@@ -0,0 +1,122 @@
+package frontend
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/boxesandglue/boxesandglue/backend/node"
+	"github.com/speedata/glu/lua/common"
+	"github.com/speedata/go-lua"
+)
+
+// Form XObjects are rendered by the library on extra pages at the end of the
+// document. When the document is finished, glu turns these pages into Form
+// XObjects and removes them from the page tree. The vlists returned by
+// doc:create_xobject() only contain a rule that draws the XObject.
+
+// formXObject is a vlist that is written once as a Form XObject.
+type formXObject struct {
+	vlist *node.VList
+	// name is the resource name of the XObject
+	name string
+}
+
+// newFormXObject registers vl as a Form XObject and returns the vlist that
+// places it.
+func (d *Document) newFormXObject(vl *node.VList) *node.VList {
+	x := &formXObject{vlist: vl, name: fmt.Sprintf("GluForm%d", len(d.xobjects)+1)}
+	d.xobjects = append(d.xobjects, x)
+	rule := node.NewRule()
+	rule.Width = vl.Width
+	rule.Height = vl.Height
+	rule.Depth = vl.Depth
+	rule.Hide = true
+	// the rule starts at the baseline, the XObject at the bottom
+	rule.Pre = fmt.Sprintf("q 1 0 0 1 0 %s cm /%s Do Q", common.PDFNumber(-vl.Depth.ToPT()), x.name)
+	return node.Vpack(node.Hpack(rule))
+}
+
+// renderFormXObjects places each XObject on a page of its size.
+func (d *Document) renderFormXObjects() {
+	for _, x := range d.xobjects {
+		page := d.Value.Doc.NewPage()
+		page.ExtraOffset = 0
+		page.Width = x.vlist.Width
+		page.Height = x.vlist.Height + x.vlist.Depth
+		page.OutputAt(0, page.Height, x.vlist)
+		page.Shipout()
+	}
+}
+
+// writeFormXObjects replaces the last pages by the Form XObjects and adds the
+// XObjects to the resources of the pages and XObjects that use them.
+func (d *Document) writeFormXObjects(f *pdfFile) error {
+	if len(d.xobjects) == 0 {
+		return nil
+	}
+	pages := f.Pages()
+	first := len(pages) - len(d.xobjects)
+	if first < 0 {
+		return fmt.Errorf("XObjects: %d pages in the PDF, %d XObjects", len(pages), len(d.xobjects))
+	}
+	refs := make(map[string]pdfRef, len(d.xobjects))
+	var forms []*pdfObject
+	for i, x := range d.xobjects {
+		page := pages[first+i]
+		var data []byte
+		for _, obj := range f.Contents(page) {
+			sd, ok := f.StreamData(obj)
+			if !ok {
+				return fmt.Errorf("XObject %s: cannot decode the page contents", x.name)
+			}
+			data = append(data, sd...)
+			data = append(data, '\n')
+		}
+		form := &pdfObject{Value: pdfDict{
+			"Type":      pdfName("XObject"),
+			"Subtype":   pdfName("Form"),
+			"BBox":      pdfBox([4]float64{0, 0, x.vlist.Width.ToPT(), (x.vlist.Height + x.vlist.Depth).ToPT()}),
+			"Resources": page["Resources"],
+		}}
+		f.SetStream(form, data)
+		refs[x.name] = f.AddObject(form)
+		forms = append(forms, form)
+	}
+	f.TruncatePages(first)
+
+	// addUses adds the XObjects drawn in data to res
+	addUses := func(data []byte, res func() pdfDict) {
+		for name, ref := range refs {
+			if bytes.Contains(data, []byte("/"+name+" Do")) {
+				f.SubDict(res(), "XObject")[name] = ref
+			}
+		}
+	}
+	for _, page := range f.Pages() {
+		for _, obj := range f.Contents(page) {
+			if data, ok := f.StreamData(obj); ok && bytes.Contains(data, []byte("/GluForm")) {
+				addUses(data, func() pdfDict { return f.SubDict(page, "Resources") })
+			}
+		}
+	}
+	for _, form := range forms {
+		if data, ok := f.StreamData(form); ok && bytes.Contains(data, []byte("/GluForm")) {
+			addUses(data, func() pdfDict { return f.SubDict(form.Value.(pdfDict), "Resources") })
+		}
+	}
+	return nil
+}
+
+// documentCreateXObject renders a VList once as a Form XObject and returns a
+// VList that places it: doc:create_xobject(vlist)
+func documentCreateXObject(l *lua.State) int {
+	d := checkDocument(l, 1)
+	vl := toVList(l, 2)
+	if vl == nil {
+		lua.Errorf(l, "VList expected")
+		return 0
+	}
+	l.PushUserData(&VList{Value: d.newFormXObject(vl)})
+	lua.SetMetaTableNamed(l, vlistMetaTable)
+	return 1
+}
@@ -1,9 +1,11 @@
 package pdf
 
 import (
+	"bytes"
 	"os"
 
 	pdf "github.com/boxesandglue/baseline-pdf"
+	"github.com/speedata/glu/lua/common"
 	"github.com/speedata/go-lua"
 )
 
@@ -12,7 +14,27 @@ const pdfMetaTable = "PDF"
 // PDF wraps the baseline-pdf PDF type
 type PDF struct {
 	Value *pdf.PDF
-	file  *os.File
+	out   *pdfOutput
+	// encryption are the options of pdf:encrypt or nil
+	encryption *common.Encryption
+}
+
+// pdfOutput is the destination of the PDF writer. The PDF is written to the
+// file, an encrypted PDF is held in buf until it is finished.
+type pdfOutput struct {
+	file *os.File
+	buf  *bytes.Buffer
+	// written is the number of bytes written to file
+	written int64
+}
+
+func (o *pdfOutput) Write(p []byte) (int, error) {
+	if o.buf != nil {
+		return o.buf.Write(p)
+	}
+	n, err := o.file.Write(p)
+	o.written += int64(n)
+	return n, err
 }
 
 // checkPDF retrieves a PDF userdata from the stack
@@ -35,9 +57,10 @@ func pdfNew(l *lua.State) int {
 		return 0
 	}
 
+	out := &pdfOutput{file: f}
 	p := &PDF{
-		Value: pdf.NewPDFWriter(f),
-		file:  f,
+		Value: pdf.NewPDFWriter(out),
+		out:   out,
 	}
 
 	l.PushUserData(p)
@@ -52,8 +75,41 @@ func pdfFinish(l *lua.State) int {
 		lua.Errorf(l, "failed to finish PDF: %s", err.Error())
 		return 0
 	}
-	if p.file != nil {
-		p.file.Close()
+	if p.out.file == nil {
+		return 0
+	}
+	var err error
+	if p.encryption != nil {
+		var data []byte
+		if data, err = common.EncryptPDF(p.out.buf.Bytes(), p.encryption); err != nil {
+			p.out.file.Close()
+			p.out.file = nil
+			lua.Errorf(l, "failed to encrypt PDF: %s", err.Error())
+			return 0
+		}
+		_, err = p.out.file.Write(data)
+	}
+	if cerr := p.out.file.Close(); err == nil {
+		err = cerr
+	}
+	p.out.file = nil
+	if err != nil {
+		lua.Errorf(l, "failed to write PDF: %s", err.Error())
+	}
+	return 0
+}
+
+// pdfEncrypt encrypts the PDF when it is finished:
+// pdf:encrypt{user_password = "", owner_password = "secret", permissions = {copy = false}}
+func pdfEncrypt(l *lua.State) int {
+	p := checkPDF(l, 1)
+	if p.out.written > 0 {
+		lua.Errorf(l, "encrypt must be called before the PDF is written")
+		return 0
+	}
+	p.encryption = common.CheckEncryption(l, 2)
+	if p.out.buf == nil {
+		p.out.buf = &bytes.Buffer{}
 	}
 	return 0
 }
@@ -86,7 +142,18 @@ func pdfLoadFace(l *lua.State) int {
 	filename := lua.CheckString(l, 2)
 	idx := lua.OptInteger(l, 3, 0)
 
-	face, err := p.Value.LoadFace(filename, idx)
+	var face *pdf.Face
+	var err error
+	if common.IsWebFont(filename) {
+		var data []byte
+		if data, err = common.ReadFontFile(filename); err == nil {
+			if face, err = p.Value.NewFaceFromData(data, idx); err == nil {
+				face.Filename = filename
+			}
+		}
+	} else {
+		face, err = p.Value.LoadFace(filename, idx)
+	}
 	if err != nil {
 		lua.Errorf(l, "failed to load face: %s", err.Error())
 		return 0
@@ -135,6 +202,9 @@ func pdfIndex(l *lua.State) int {
 	case "add_page":
 		l.PushGoFunction(pdfAddPage)
 		return 1
+	case "encrypt":
+		l.PushGoFunction(pdfEncrypt)
+		return 1
 	case "finish":
 		l.PushGoFunction(pdfFinish)
 		return 1
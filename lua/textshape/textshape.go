@@ -3,9 +3,8 @@
 package textshape
 
 import (
-	"os"
-
 	"github.com/boxesandglue/textshape/ot"
+	"github.com/speedata/glu/lua/common"
 	"github.com/speedata/go-lua"
 )
 
@@ -628,12 +627,12 @@ func registerShaperMetaTable(l *lua.State) {
 
 // --- Module functions ---
 
-// parseFont loads a font file: parse_font(filename, [index])
+// parseFont loads a font file (TrueType, OpenType, WOFF or WOFF2): parse_font(filename, [index])
 func parseFont(l *lua.State) int {
 	filename := lua.CheckString(l, 1)
 	idx := lua.OptInteger(l, 2, 0)
 
-	data, err := os.ReadFile(filename)
+	data, err := common.ReadFontFile(filename)
 	if err != nil {
 		lua.Errorf(l, "failed to read font file: %s", err.Error())
 		return 0